@@ -0,0 +1,11 @@
+set -e
+
+# Builds self-contained binaries for servers and home machines into dist/
+PKG=github.com/seveneightn9ne/pottery-log-server/v2/potterylog
+LDFLAGS="-X $PKG.version=$(git describe --tags --always --dirty) -X $PKG.commit=$(git rev-parse HEAD) -X $PKG.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+mkdir -p dist
+for target in linux/amd64 linux/arm64 linux/arm darwin/arm64 darwin/amd64; do
+	os=${target%/*}
+	arch=${target#*/}
+	CGO_ENABLED=0 GOOS=$os GOARCH=$arch go build -ldflags "$LDFLAGS" -o "dist/pottery-log-server-$os-$arch"
+done
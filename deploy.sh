@@ -1,6 +1,8 @@
 set -e
 
-GOOS=linux GOARCH=amd64 go build
+PKG=github.com/seveneightn9ne/pottery-log-server/v2/potterylog
+LDFLAGS="-X $PKG.version=$(git describe --tags --always --dirty) -X $PKG.commit=$(git rev-parse HEAD) -X $PKG.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+GOOS=linux GOARCH=amd64 go build -ldflags "$LDFLAGS"
 ssh stipple "mv pottery-log-server/pottery-log-server pottery-log-server/pottery-log-server.bak"
 scp pottery-log-server stipple:pottery-log-server/pottery-log-server
 ssh stipple "sudo systemctl restart pottery-log-server"
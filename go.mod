@@ -1,5 +1,25 @@
 module github.com/seveneightn9ne/pottery-log-server/v2
 
-go 1.16
+go 1.23
 
-require github.com/aws/aws-sdk-go v1.38.43
+require (
+	github.com/aws/aws-sdk-go v1.38.43
+	github.com/gen2brain/webp v0.6.4
+	github.com/lib/pq v1.10.9
+	modernc.org/sqlite v1.34.5
+)
+
+require (
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/ebitengine/purego v0.10.1 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/ncruces/go-strftime v0.1.9 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	golang.org/x/net v0.22.0 // indirect
+	golang.org/x/sys v0.22.0 // indirect
+	modernc.org/libc v1.55.3 // indirect
+	modernc.org/mathutil v1.6.0 // indirect
+	modernc.org/memory v1.8.0 // indirect
+)
@@ -0,0 +1,9 @@
+// Command pottery-log-server runs the Pottery Log server. To mount the
+// server inside another Go program, use the potterylog package instead.
+package main
+
+import "github.com/seveneightn9ne/pottery-log-server/v2/potterylog"
+
+func main() {
+	potterylog.Main()
+}
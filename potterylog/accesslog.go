@@ -0,0 +1,84 @@
+package potterylog
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// statusRecorder captures the status and size of a response for the access log
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	bytesOut int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytesOut += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("The response writer can't be hijacked")
+	}
+	r.status = 499 // client closed request, in nginx's terms
+	return hijacker.Hijack()
+}
+
+// countingBody counts the request bytes the handler actually read
+type countingBody struct {
+	io.ReadCloser
+	bytesIn int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytesIn += int64(n)
+	return n, err
+}
+
+// requestIDHeader carries the id that ties a response to its log lines
+const requestIDHeader = "X-Request-Id"
+
+// logRequests writes one access log line per request in logfmt
+func logRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		requestID := newID()
+		w.Header().Set(requestIDHeader, requestID)
+		rec := &statusRecorder{ResponseWriter: w}
+		body := &countingBody{ReadCloser: req.Body}
+		req.Body = body
+
+		handler.ServeHTTP(rec, req)
+
+		// Only look at the form if the handler parsed it; parsing here would
+		// read bodies that the handler chose not to.
+		deviceID := req.URL.Query().Get("deviceId")
+		if req.Form != nil {
+			deviceID = req.Form.Get("deviceId")
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		log.Printf("request_id=%s method=%s path=%s device=%q status=%d bytes_in=%d bytes_out=%d duration_ms=%d\n",
+			requestID, req.Method, req.URL.Path, deviceID, rec.status, body.bytesIn, rec.bytesOut,
+			time.Since(start).Milliseconds())
+	})
+}
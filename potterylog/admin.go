@@ -0,0 +1,69 @@
+package potterylog
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+)
+
+// AdminHandler is the diagnostics and operator API. The admin server
+// listens on its own port, bound to localhost, so that it's never
+// reachable through the public listener. Once admin credentials are
+// configured, they're required too (see auth.go).
+func (s *Server) AdminHandler() http.Handler {
+	adminMux := http.NewServeMux()
+	adminMux.HandleFunc("/debug/pprof/", pprof.Index)
+	adminMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	adminMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	adminMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	adminMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	// The first admin handler's server is the one /debug/vars shows, since
+	// expvar's variables are the process's
+	if expvar.Get("active_exports") == nil {
+		s.publishVars()
+	}
+	adminMux.Handle("/debug/vars", expvar.Handler())
+	adminMux.HandleFunc("/stats", s.Stats)
+	adminMux.HandleFunc("/admin/server-export", s.ServerExport)
+	adminMux.HandleFunc("/admin/reload-config", s.ReloadConfig)
+	adminMux.HandleFunc("/admin/verify-report", s.VerifyReport)
+	adminMux.HandleFunc("/admin/maintenance", s.Maintenance)
+	adminMux.HandleFunc("/admin/blocklist", s.Blocklist)
+	adminMux.HandleFunc("/admin/api-keys", s.AdminAPIKeys)
+	adminMux.HandleFunc("/admin/device-tokens", s.DeviceTokens)
+	adminMux.HandleFunc("/admin/audit-log", s.AuditLog)
+	adminMux.HandleFunc("/admin/jobs", s.Jobs)
+	adminMux.HandleFunc("/admin/jobs/", s.Jobs)
+	adminMux.Handle(adminUIPath, serveStatic(adminUIPath, "admin.html"))
+	return s.requireAdmin(adminMux)
+}
+
+func (s *Server) publishVars() {
+	vars := map[string]func() interface{}{
+		"active_exports":  func() interface{} { return s.Exports.Count() },
+		"counters":        func() interface{} { return s.counters.Snapshot() },
+		"active_uploads":  func() interface{} { return s.activeUploads() },
+		"large_uploads":   func() interface{} { return s.largeUploads.InProgress() },
+		"memory_reserved": func() interface{} { return s.memory.Reserved() },
+		"endpoint_limits": func() interface{} { return s.endpointUsage() },
+		"analytics":       func() interface{} { return s.amplitude.Gauges() },
+	}
+	for name, f := range vars {
+		expvar.Publish(name, expvar.Func(f))
+	}
+}
+
+func (s *Server) serveAdmin(port int, handler http.Handler) {
+	if port == 0 {
+		log.Print("Admin server disabled.\n")
+		return
+	}
+	addr := fmt.Sprintf("127.0.0.1:%v", port)
+	log.Printf("Serving admin at %v", addr)
+	if !s.adminCredentialsConfigured() {
+		log.Print("No admin credentials are configured; the admin port is open to local users.\n")
+	}
+	log.Printf("Admin server stopped: %v\n", http.ListenAndServe(addr, handler))
+}
@@ -0,0 +1,349 @@
+package potterylog
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API keys let third-party integrations use the v2 API on a device's
+// behalf without its device token. A device issues keys at /v2/api-keys,
+// each either read-only or read-write, and a key is sent as a bearer token
+// like the device token. Every key is rate limited per minute (in each
+// replica's memory) and per day (in the operational database); operators
+// can see every key's use and change its limits at /admin/api-keys.
+type apiKeyConfig struct {
+	// Keys per device (default 5)
+	MaxPerDevice int `json:"max_per_device"`
+	// Default limits for keys without their own (60 a minute and 10,000
+	// a day); -1 means no limit
+	RequestsPerMinute int `json:"requests_per_minute"`
+	RequestsPerDay    int `json:"requests_per_day"`
+}
+
+func (c apiKeyConfig) maxPerDevice() int {
+	if c.MaxPerDevice > 0 {
+		return c.MaxPerDevice
+	}
+	return 5
+}
+
+const (
+	apiKeyScopeRead      = "read"
+	apiKeyScopeReadWrite = "read-write"
+	// apiKeyPrefix tells keys apart from device tokens
+	apiKeyPrefix = "plk_"
+)
+
+var (
+	errInvalidAPIKey     = newAPIError("invalid_api_key", "This API key is not valid")
+	errAPIKeyReadOnly    = newAPIError("api_key_read_only", "This API key can only read")
+	errAPIKeyNotAllowed  = newAPIError("api_key_not_allowed", "API keys can't manage API keys")
+	errAPIKeyRateLimited = newAPIError("api_key_rate_limited", "This API key has made too many requests. Please slow down.")
+	errAPIKeyQuota       = newAPIError("api_key_quota", "This API key has used its requests for today")
+	errNoSuchAPIKey      = newAPIError("no_such_api_key", "There is no API key with that id")
+	errTooManyAPIKeys    = newAPIError("too_many_api_keys", "This device has as many API keys as it can have")
+)
+
+var (
+	apiKeyScopePattern = regexp.MustCompile(`^(read|read-write)$`)
+	apiKeyLimitPattern = regexp.MustCompile(`^-?[0-9]+$`)
+)
+
+var (
+	apiKeyNameField  = field{Name: "name", Required: true, MaxLen: 100}
+	apiKeyScopeField = field{Name: "scope", Pattern: apiKeyScopePattern}
+	apiKeyIDField    = field{Name: "keyId", Required: true, MaxLen: 128, Pattern: validIDPattern}
+	apiKeyLimitField = field{Name: "requestsPerMinute", MaxLen: 10, Pattern: apiKeyLimitPattern}
+	apiKeyQuotaField = field{Name: "requestsPerDay", MaxLen: 10, Pattern: apiKeyLimitPattern}
+)
+
+type apiKey struct {
+	ID       string `json:"id"`
+	DeviceID string `json:"device_id"`
+	Name     string `json:"name"`
+	Scope    string `json:"scope"`
+	// Token is only in the response that issues the key
+	Token string `json:"token,omitempty"`
+	// The key's own limits; 0 uses the configured ones
+	RequestsPerMinute int        `json:"requests_per_minute"`
+	RequestsPerDay    int        `json:"requests_per_day"`
+	RequestsToday     int        `json:"requests_today"`
+	RequestsTotal     int64      `json:"requests_total"`
+	CreatedAt         time.Time  `json:"created_at"`
+	LastUsedAt        *time.Time `json:"last_used_at"`
+}
+
+// limits are the key's requests allowed per minute and per day, falling
+// back to c's, with 0 meaning no limit
+func (k *apiKey) limits(c apiKeyConfig) (int, int) {
+	perMinute, perDay := k.RequestsPerMinute, k.RequestsPerDay
+	if perMinute == 0 {
+		perMinute = c.RequestsPerMinute
+		if perMinute == 0 {
+			perMinute = 60
+		}
+	}
+	if perDay == 0 {
+		perDay = c.RequestsPerDay
+		if perDay == 0 {
+			perDay = 10000
+		}
+	}
+	return max(perMinute, 0), max(perDay, 0)
+}
+
+// apiKeyBuckets is the API key limiter: a token bucket per key, refilled at the key's rate
+type apiKeyBuckets struct {
+	mu      sync.Mutex
+	buckets map[string]*apiKeyBucket
+}
+
+type apiKeyBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allowAPIKeyRequest takes a token from the key's bucket, or returns how
+// long until there is one
+func (s *Server) allowAPIKeyRequest(keyID string, perMinute int) (bool, time.Duration) {
+	if perMinute <= 0 {
+		return true, 0
+	}
+	s.apiKeyLimiter.mu.Lock()
+	defer s.apiKeyLimiter.mu.Unlock()
+
+	now := s.Clock.Now()
+	rate := float64(perMinute) / float64(time.Minute)
+	b, ok := s.apiKeyLimiter.buckets[keyID]
+	if !ok {
+		b = &apiKeyBucket{tokens: float64(perMinute), last: now}
+		s.apiKeyLimiter.buckets[keyID] = b
+	}
+	b.tokens = math.Min(float64(perMinute), b.tokens+float64(now.Sub(b.last))*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate)
+	}
+	b.tokens--
+	return true, 0
+}
+
+// A bucket refills completely within a minute, so one that's been idle
+// longer is the same as a new one and can be dropped
+const apiKeyBucketIdle = time.Minute
+
+// pruneAPIKeyLimiter drops the buckets of keys that haven't been used
+// lately, so the limiter doesn't grow with every key ever seen
+func (s *Server) pruneAPIKeyLimiter(r *jobRun) error {
+	s.apiKeyLimiter.mu.Lock()
+	defer s.apiKeyLimiter.mu.Unlock()
+	now := s.Clock.Now()
+	pruned := 0
+	for keyID, b := range s.apiKeyLimiter.buckets {
+		if now.Sub(b.last) > apiKeyBucketIdle {
+			delete(s.apiKeyLimiter.buckets, keyID)
+			pruned++
+		}
+	}
+	if pruned > 0 {
+		r.Logf("Dropped %d idle API key rate limits", pruned)
+	}
+	return nil
+}
+
+type apiKeyContextKey struct{}
+
+// requestAPIKey is the API key the request was made with, if any
+func requestAPIKey(req *http.Request) *apiKey {
+	k, _ := req.Context().Value(apiKeyContextKey{}).(*apiKey)
+	return k
+}
+
+// withAPIKeys lets requests to the v2 API authenticate with an API key
+// instead of a device token. A key is checked against its scope and
+// limits here, and then stands in for its device's token (see
+// deviceAuthorized).
+func (s *Server) withAPIKeys(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token := bearerToken(req)
+		if !strings.HasPrefix(token, apiKeyPrefix) {
+			handler(w, req)
+			return
+		}
+		deviceID := req.FormValue("deviceId")
+		k, err := s.ops.APIKeyByToken(hashToken(token))
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		if k == nil {
+			s.handleErrCode(errInvalidAPIKey, http.StatusUnauthorized, deviceID, w)
+			return
+		}
+		readOnly := req.Method == http.MethodGet || req.Method == http.MethodHead
+		if k.Scope != apiKeyScopeReadWrite && !readOnly {
+			s.handleErrCode(errAPIKeyReadOnly, http.StatusForbidden, deviceID, w)
+			return
+		}
+		perMinute, perDay := k.limits(s.config().APIKeys)
+		if ok, retryAfter := s.allowAPIKeyRequest(k.ID, perMinute); !ok {
+			s.tooBusy(w, errAPIKeyRateLimited, deviceID, retryAfter+time.Second)
+			return
+		}
+		if perDay == 0 {
+			perDay = math.MaxInt32
+		}
+		ok, err := s.ops.UseAPIKey(k.ID, perDay)
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		if !ok {
+			now := s.Clock.Now().UTC()
+			midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+			s.tooBusy(w, errAPIKeyQuota, deviceID, midnight.Sub(now))
+			return
+		}
+		if perMinute > 0 {
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(perMinute))
+		}
+		handler(w, req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, k)))
+	}
+}
+
+// APIKeys serves /v2/api-keys for a device: GET lists its keys, POST with
+// name (and scope, read by default) issues one, and DELETE with keyId
+// revokes one. Keys can't be managed with a key.
+func (s *Server) APIKeys(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	if requestAPIKey(req) != nil {
+		s.handleErrCode(errAPIKeyNotAllowed, http.StatusForbidden, deviceID, w)
+		return
+	}
+	if !s.requireDevice(w, req, deviceID) {
+		return
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		keys, err := s.ops.APIKeys(deviceID)
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		writeAPIKeys(w, keys)
+	case http.MethodPost:
+		if !s.validateForm(w, req, apiKeyNameField, apiKeyScopeField) {
+			return
+		}
+		keys, err := s.ops.APIKeys(deviceID)
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		if len(keys) >= s.config().APIKeys.maxPerDevice() {
+			s.handleErrCode(errTooManyAPIKeys, http.StatusConflict, deviceID, w)
+			return
+		}
+		k := &apiKey{
+			ID:        newID(),
+			DeviceID:  deviceID,
+			Name:      req.FormValue("name"),
+			Scope:     req.FormValue("scope"),
+			CreatedAt: s.Clock.Now().Truncate(time.Second),
+		}
+		if k.Scope == "" {
+			k.Scope = apiKeyScopeRead
+		}
+		token := apiKeyPrefix + newID() + newID()
+		if s.handleErr(s.ops.AddAPIKey(k, hashToken(token)), deviceID, w) {
+			return
+		}
+		k.Token = token
+		s.logEvent(deviceID, IssueAPIKeyEvent)
+		writeJSON(w, struct {
+			Status string  `json:"status"`
+			Key    *apiKey `json:"key"`
+		}{
+			Status: "ok",
+			Key:    k,
+		})
+	case http.MethodDelete:
+		if !s.validateForm(w, req, apiKeyIDField) {
+			return
+		}
+		deleted, err := s.ops.DeleteAPIKey(deviceID, req.FormValue("keyId"))
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		if !deleted {
+			s.handleErrCode(errNoSuchAPIKey, http.StatusNotFound, deviceID, w)
+			return
+		}
+		s.logEvent(deviceID, RevokeAPIKeyEvent)
+		w.Write(okResponse())
+	default:
+		s.handleErrCode(errMethodNotAllowed, http.StatusMethodNotAllowed, deviceID, w)
+	}
+}
+
+// AdminAPIKeys lists every key (or a deviceId's) with its use on GET, sets
+// a key's requestsPerMinute and requestsPerDay on POST (0 for the
+// configured limit, -1 for none), and revokes a key on DELETE
+func (s *Server) AdminAPIKeys(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		if !s.validateForm(w, req, field{Name: "deviceId", MaxLen: 128, Pattern: validIDPattern}) {
+			return
+		}
+		keys, err := s.ops.APIKeys(req.FormValue("deviceId"))
+		if s.handleErr(err, "", w) {
+			return
+		}
+		writeAPIKeys(w, keys)
+	case http.MethodPost:
+		if !s.validateForm(w, req, apiKeyIDField, apiKeyLimitField, apiKeyQuotaField) {
+			return
+		}
+		perMinute, _ := strconv.Atoi(req.FormValue("requestsPerMinute"))
+		perDay, _ := strconv.Atoi(req.FormValue("requestsPerDay"))
+		found, err := s.ops.SetAPIKeyLimits(req.FormValue("keyId"), perMinute, perDay)
+		if s.handleErr(err, "", w) {
+			return
+		}
+		if !found {
+			s.handleErrCode(errNoSuchAPIKey, http.StatusNotFound, "", w)
+			return
+		}
+		w.Write(okResponse())
+	case http.MethodDelete:
+		if !s.validateForm(w, req, apiKeyIDField) {
+			return
+		}
+		deleted, err := s.ops.DeleteAPIKey("", req.FormValue("keyId"))
+		if s.handleErr(err, "", w) {
+			return
+		}
+		if !deleted {
+			s.handleErrCode(errNoSuchAPIKey, http.StatusNotFound, "", w)
+			return
+		}
+		w.Write(okResponse())
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeAPIKeys(w http.ResponseWriter, keys []*apiKey) {
+	writeJSON(w, struct {
+		Status string    `json:"status"`
+		Keys   []*apiKey `json:"keys"`
+	}{
+		Status: "ok",
+		Keys:   keys,
+	})
+}
@@ -0,0 +1,356 @@
+package potterylog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The app's metadata.json is a dump of its key-value storage. Each pot is
+// stored under "@Pot:<id>", usually as a JSON-encoded string.
+const appPotKeyPrefix = "@Pot:"
+
+// appMetadataPots returns each pot in the metadata by id, as compact JSON
+func appMetadataPots(metadata []byte) (map[string]json.RawMessage, error) {
+	var storage map[string]json.RawMessage
+	if err := json.Unmarshal(metadata, &storage); err != nil {
+		return nil, errors.New("The metadata is not valid JSON")
+	}
+
+	potsByID := make(map[string]json.RawMessage)
+	for key, value := range storage {
+		if !strings.HasPrefix(key, appPotKeyPrefix) {
+			continue
+		}
+		// Unwrap JSON-in-a-string values
+		var encoded string
+		if json.Unmarshal(value, &encoded) == nil {
+			value = json.RawMessage(encoded)
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, value); err != nil {
+			return nil, errors.New("The metadata has an invalid pot " + key)
+		}
+		potsByID[strings.TrimPrefix(key, appPotKeyPrefix)] = compact.Bytes()
+	}
+	return potsByID, nil
+}
+
+// appPotTitle reads the title of a pot from the app's metadata
+func appPotTitle(potJSON json.RawMessage) string {
+	var p struct {
+		Title string `json:"title"`
+	}
+	json.Unmarshal(potJSON, &p)
+	return p.Title
+}
+
+type potChange struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+}
+
+type metadataDiff struct {
+	Added     []potChange `json:"added"`
+	Removed   []potChange `json:"removed"`
+	Changed   []potChange `json:"changed"`
+	Unchanged int         `json:"unchanged"`
+}
+
+// diffAppMetadata describes what replacing from with to would do to the pots
+func diffAppMetadata(from, to []byte) (*metadataDiff, error) {
+	fromPots, err := appMetadataPots(from)
+	if err != nil {
+		return nil, err
+	}
+	toPots, err := appMetadataPots(to)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &metadataDiff{
+		Added:   []potChange{},
+		Removed: []potChange{},
+		Changed: []potChange{},
+	}
+	for id, toPot := range toPots {
+		fromPot, ok := fromPots[id]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, potChange{ID: id, Title: appPotTitle(toPot)})
+		case !jsonEqual(fromPot, toPot):
+			diff.Changed = append(diff.Changed, potChange{ID: id, Title: appPotTitle(toPot)})
+		default:
+			diff.Unchanged++
+		}
+	}
+	for id, fromPot := range fromPots {
+		if _, ok := toPots[id]; !ok {
+			diff.Removed = append(diff.Removed, potChange{ID: id, Title: appPotTitle(fromPot)})
+		}
+	}
+	for _, changes := range [][]potChange{diff.Added, diff.Removed, diff.Changed} {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].ID < changes[j].ID })
+	}
+	return diff, nil
+}
+
+// jsonEqual compares two JSON documents ignoring key order
+func jsonEqual(a, b json.RawMessage) bool {
+	var av, bv interface{}
+	if json.Unmarshal(a, &av) != nil || json.Unmarshal(b, &bv) != nil {
+		return bytes.Equal(a, b)
+	}
+	ab, _ := json.Marshal(av)
+	bb, _ := json.Marshal(bv)
+	return bytes.Equal(ab, bb)
+}
+
+// The app's pot statuses, in the order a pot goes through them
+var appStatusOrder = []string{"notstarted", "thrown", "trimmed", "bisqued", "glazed", "pickedup"}
+
+// appPot is what the server reads from a pot in the app's metadata. The
+// app has changed its format over the years, so fields are read leniently.
+type appPot struct {
+	ID    string
+	Title string
+	// Dates has when the pot reached each status
+	Dates map[string]time.Time
+	// Notes are keyed by the status they were written at, or "general"
+	Notes map[string]string
+	// Images are the app's image names, in display order
+	Images []string
+}
+
+// Status is the pot's latest status, or "" if it has none
+func (p appPot) Status() (string, time.Time) {
+	var status string
+	var date time.Time
+	for _, s := range p.statuses() {
+		if d := p.Dates[s]; !d.Before(date) {
+			status, date = s, d
+		}
+	}
+	return status, date
+}
+
+// statuses lists the pot's statuses in app order, then any others by name
+func (p appPot) statuses() []string {
+	return orderStatuses(p.Dates)
+}
+
+func orderStatuses(dates map[string]time.Time) []string {
+	known := make(map[string]bool)
+	statuses := []string{}
+	for _, s := range appStatusOrder {
+		known[s] = true
+		if _, ok := dates[s]; ok {
+			statuses = append(statuses, s)
+		}
+	}
+	others := []string{}
+	for s := range dates {
+		if !known[s] {
+			others = append(others, s)
+		}
+	}
+	sort.Strings(others)
+	return append(statuses, others...)
+}
+
+// appPots reads every pot in the metadata, sorted by title and then id
+func appPots(metadata []byte) ([]appPot, error) {
+	potsByID, err := appMetadataPots(metadata)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]appPot, 0, len(potsByID))
+	for id, potJSON := range potsByID {
+		list = append(list, parseAppPot(id, potJSON))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Title != list[j].Title {
+			return list[i].Title < list[j].Title
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
+
+func parseAppPot(id string, potJSON json.RawMessage) appPot {
+	var raw struct {
+		Title   string                     `json:"title"`
+		Status  map[string]json.RawMessage `json:"status"`
+		Notes   json.RawMessage            `json:"notes"`
+		Notes2  json.RawMessage            `json:"notes2"`
+		Images  []json.RawMessage          `json:"images"`
+		Images2 []json.RawMessage          `json:"images2"`
+		Images3 []json.RawMessage          `json:"images3"`
+	}
+	json.Unmarshal(potJSON, &raw)
+	p := appPot{
+		ID:     id,
+		Title:  raw.Title,
+		Dates:  make(map[string]time.Time),
+		Notes:  make(map[string]string),
+		Images: []string{},
+	}
+	for status, value := range raw.Status {
+		if date, ok := appDate(value); ok {
+			p.Dates[status] = date
+		}
+	}
+	for _, notes := range []json.RawMessage{raw.Notes, raw.Notes2} {
+		readAppNotes(notes, p.Notes)
+	}
+	for _, images := range [][]json.RawMessage{raw.Images3, raw.Images2, raw.Images} {
+		if len(images) == 0 {
+			continue
+		}
+		for _, image := range images {
+			if name := appImageName(image); name != "" {
+				p.Images = append(p.Images, name)
+			}
+		}
+		break
+	}
+	return p
+}
+
+// appDate reads a date the app wrote as an ISO string or milliseconds
+func appDate(value json.RawMessage) (time.Time, bool) {
+	var s string
+	if json.Unmarshal(value, &s) == nil {
+		t, err := time.Parse(time.RFC3339, s)
+		return t.UTC(), err == nil
+	}
+	var ms float64
+	if json.Unmarshal(value, &ms) == nil && ms > 0 {
+		return time.UnixMilli(int64(ms)).UTC(), true
+	}
+	return time.Time{}, false
+}
+
+// readAppNotes reads notes that are a plain string, an object of notes by
+// status, or such an object under "notes"
+func readAppNotes(value json.RawMessage, notes map[string]string) {
+	if len(value) == 0 {
+		return
+	}
+	var s string
+	if json.Unmarshal(value, &s) == nil {
+		if s != "" {
+			notes["general"] = s
+		}
+		return
+	}
+	var byStatus map[string]json.RawMessage
+	if json.Unmarshal(value, &byStatus) != nil {
+		return
+	}
+	if nested, ok := byStatus["notes"]; ok && len(byStatus) == 1 {
+		readAppNotes(nested, notes)
+		return
+	}
+	for status, note := range byStatus {
+		if json.Unmarshal(note, &s) == nil && s != "" {
+			notes[status] = s
+		}
+	}
+}
+
+// appImageName reads an image entry, which is a name or an object with
+// one
+func appImageName(value json.RawMessage) string {
+	var name string
+	if json.Unmarshal(value, &name) == nil {
+		return name
+	}
+	var image struct {
+		Name      string `json:"name"`
+		FileName  string `json:"fileName"`
+		RemoteURI string `json:"remoteUri"`
+	}
+	json.Unmarshal(value, &image)
+	switch {
+	case image.Name != "":
+		return image.Name
+	case image.FileName != "":
+		return image.FileName
+	case image.RemoteURI != "":
+		return path.Base(image.RemoteURI)
+	}
+	return ""
+}
+
+// appPotEdited is when a pot was last edited: its editTime, if the app
+// recorded one, or else the date of its latest status
+func appPotEdited(potJSON json.RawMessage) time.Time {
+	var raw struct {
+		EditTime json.RawMessage `json:"editTime"`
+	}
+	json.Unmarshal(potJSON, &raw)
+	if edited, ok := appDate(raw.EditTime); ok {
+		return edited
+	}
+	_, date := parseAppPot("", potJSON).Status()
+	return date
+}
+
+type mergeSummary struct {
+	// Added pots were only in the archive
+	Added int `json:"added"`
+	// Updated pots were in both, and the archive's edit was newer
+	Updated int `json:"updated"`
+	// Kept pots were only in the current metadata, or its edit was as
+	// new as the archive's
+	Kept int `json:"kept"`
+}
+
+// mergeAppMetadata merges an archive's metadata into the current metadata.
+// Pots are matched by id, and the one edited last wins; any other key keeps
+// its current value. Values are copied as they were written, so pots
+// stored as JSON strings stay that way.
+func mergeAppMetadata(current, archive []byte) ([]byte, *mergeSummary, error) {
+	var currentKeys, archiveKeys map[string]json.RawMessage
+	currentPots, err := appMetadataPots(current)
+	if err != nil || json.Unmarshal(current, &currentKeys) != nil {
+		return nil, nil, errInvalidCurrentMetadata
+	}
+	archivePots, err := appMetadataPots(archive)
+	if err != nil || json.Unmarshal(archive, &archiveKeys) != nil {
+		return nil, nil, errInvalidMetadata
+	}
+
+	merged := make(map[string]json.RawMessage, len(currentKeys)+len(archiveKeys))
+	for key, value := range currentKeys {
+		merged[key] = value
+	}
+	summary := &mergeSummary{Kept: len(currentPots)}
+	for key, value := range archiveKeys {
+		if !strings.HasPrefix(key, appPotKeyPrefix) {
+			if _, ok := merged[key]; !ok {
+				merged[key] = value
+			}
+			continue
+		}
+		id := strings.TrimPrefix(key, appPotKeyPrefix)
+		currentPot, ok := currentPots[id]
+		switch {
+		case !ok:
+			summary.Added++
+		case appPotEdited(archivePots[id]).After(appPotEdited(currentPot)):
+			summary.Kept--
+			summary.Updated++
+		default:
+			continue
+		}
+		merged[key] = value
+	}
+	data, err := json.Marshal(merged)
+	return data, summary, err
+}
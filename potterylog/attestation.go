@@ -0,0 +1,341 @@
+package potterylog
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Attestation checks that Upload and Import requests come from the real app
+// on a real device, using Play Integrity on Android and DeviceCheck on iOS.
+// The app sends X-Attestation-Platform ("android" or "ios") and
+// X-Attestation-Token. It's off unless configured, since hobby deployments
+// don't have Google or Apple credentials.
+type attestationConfig struct {
+	// "off" (default), "log" to only log failures, or "enforce"
+	Mode string `json:"mode"`
+
+	// Play Integrity: the app's package name and a Google service account
+	// key file with access to the Play Integrity API
+	AndroidPackageName   string `json:"android_package_name"`
+	GoogleServiceAccount string `json:"google_service_account"`
+	// DeviceCheck: the team and key ids and .p8 key file from Apple
+	AppleTeamID      string `json:"apple_team_id"`
+	AppleKeyID       string `json:"apple_key_id"`
+	ApplePrivateKey  string `json:"apple_private_key"`
+	AppleDevelopment bool   `json:"apple_development"`
+}
+
+// Devices that passed are trusted for a while to avoid a round trip to
+// Google or Apple on every upload
+const attestationTTL = time.Hour
+
+type attestationCache struct {
+	mu      sync.Mutex
+	devices map[string]time.Time
+}
+
+type cachedToken struct {
+	token   string
+	expires time.Time
+}
+
+// googleTokens caches access tokens by service account file and scope,
+// since notifications use one too (see notify.go)
+var googleTokens = struct {
+	mu     sync.Mutex
+	tokens map[string]cachedToken
+}{
+	tokens: make(map[string]cachedToken),
+}
+
+// requireAttestation wraps a handler that should only be used by the app
+func (s *Server) requireAttestation(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ac := s.config().Attestation
+		if ac.Mode == "" || ac.Mode == "off" {
+			handler(w, req)
+			return
+		}
+		deviceID := req.FormValue("deviceId")
+		err := s.checkAttestation(ac, deviceID, req.Header.Get("X-Attestation-Platform"), req.Header.Get("X-Attestation-Token"))
+		if err != nil {
+			log.Printf("Attestation failed for device %s: %v\n", deviceID, err)
+			s.logEvent(deviceID, AttestationFailedEvent{Mode: ac.Mode})
+			if ac.Mode == "enforce" {
+				s.handleErrCode(errAttestationFailed, http.StatusForbidden, deviceID, w)
+				return
+			}
+		}
+		handler(w, req)
+	}
+}
+
+func (s *Server) checkAttestation(ac attestationConfig, deviceID, platform, token string) error {
+	s.attested.mu.Lock()
+	passed, ok := s.attested.devices[deviceID]
+	s.attested.mu.Unlock()
+	if ok && s.Clock.Now().Sub(passed) < attestationTTL {
+		return nil
+	}
+	if err := verifyAttestation(ac, platform, token); err != nil {
+		return err
+	}
+
+	s.attested.mu.Lock()
+	s.attested.devices[deviceID] = s.Clock.Now()
+	s.attested.mu.Unlock()
+	return nil
+}
+
+// verifyAttestation checks a token with Google or Apple, without trusting
+// an earlier pass
+func verifyAttestation(ac attestationConfig, platform, token string) error {
+	if token == "" {
+		return errors.New("no attestation token")
+	}
+	switch platform {
+	case "android":
+		return checkPlayIntegrity(ac, token)
+	case "ios":
+		return checkDeviceCheck(ac, token)
+	default:
+		return fmt.Errorf("unknown platform %q", platform)
+	}
+}
+
+func checkPlayIntegrity(ac attestationConfig, integrityToken string) error {
+	accessToken, err := googleAccessToken(ac.GoogleServiceAccount, "https://www.googleapis.com/auth/playintegrity")
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(map[string]string{"integrity_token": integrityToken})
+	apiURL := fmt.Sprintf("https://playintegrity.googleapis.com/v1/%s:decodeIntegrityToken", url.PathEscape(ac.AndroidPackageName))
+	req, err := http.NewRequest(http.MethodPost, apiURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	var verdict struct {
+		TokenPayloadExternal struct {
+			RequestDetails struct {
+				RequestPackageName string `json:"requestPackageName"`
+			} `json:"requestDetails"`
+			AppIntegrity struct {
+				AppRecognitionVerdict string `json:"appRecognitionVerdict"`
+			} `json:"appIntegrity"`
+			DeviceIntegrity struct {
+				DeviceRecognitionVerdict []string `json:"deviceRecognitionVerdict"`
+			} `json:"deviceIntegrity"`
+		} `json:"tokenPayloadExternal"`
+	}
+	if err := doJSON(req, &verdict); err != nil {
+		return err
+	}
+	payload := verdict.TokenPayloadExternal
+	if payload.RequestDetails.RequestPackageName != ac.AndroidPackageName {
+		return errors.New("token is for package " + payload.RequestDetails.RequestPackageName)
+	}
+	if payload.AppIntegrity.AppRecognitionVerdict != "PLAY_RECOGNIZED" {
+		return errors.New("app not recognized: " + payload.AppIntegrity.AppRecognitionVerdict)
+	}
+	for _, v := range payload.DeviceIntegrity.DeviceRecognitionVerdict {
+		if v == "MEETS_DEVICE_INTEGRITY" {
+			return nil
+		}
+	}
+	return errors.New("device does not meet integrity")
+}
+
+func checkDeviceCheck(ac attestationConfig, deviceToken string) error {
+	keyPEM, err := ioutil.ReadFile(ac.ApplePrivateKey)
+	if err != nil {
+		return err
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return errors.New("the Apple private key must be an EC key")
+	}
+	jwt, err := signJWT(map[string]interface{}{"alg": "ES256", "kid": ac.AppleKeyID},
+		map[string]interface{}{"iss": ac.AppleTeamID, "iat": time.Now().Unix()}, ecKey)
+	if err != nil {
+		return err
+	}
+
+	host := "api.devicecheck.apple.com"
+	if ac.AppleDevelopment {
+		host = "api.development.devicecheck.apple.com"
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"device_token":   deviceToken,
+		"transaction_id": newID(),
+		"timestamp":      time.Now().UnixNano() / int64(time.Millisecond),
+	})
+	req, err := http.NewRequest(http.MethodPost, "https://"+host+"/v1/validate_device_token", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Content-Type", "application/json")
+	return doJSON(req, nil)
+}
+
+// googleAccessToken exchanges a signed service account assertion for an
+// OAuth access token, reusing it until shortly before it expires
+func googleAccessToken(serviceAccountFile, scope string) (string, error) {
+	googleTokens.mu.Lock()
+	defer googleTokens.mu.Unlock()
+	cacheKey := serviceAccountFile + " " + scope
+	if cached := googleTokens.tokens[cacheKey]; cached.token != "" && time.Until(cached.expires) > time.Minute {
+		return cached.token, nil
+	}
+
+	data, err := ioutil.ReadFile(serviceAccountFile)
+	if err != nil {
+		return "", err
+	}
+	var account struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &account); err != nil {
+		return "", err
+	}
+	key, err := parsePrivateKey([]byte(account.PrivateKey))
+	if err != nil {
+		return "", err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("the service account key must be an RSA key")
+	}
+	now := time.Now().Unix()
+	assertion, err := signJWT(map[string]interface{}{"alg": "RS256", "typ": "JWT"}, map[string]interface{}{
+		"iss":   account.ClientEmail,
+		"scope": scope,
+		"aud":   account.TokenURI,
+		"iat":   now,
+		"exp":   now + 3600,
+	}, rsaKey)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, account.TokenURI, strings.NewReader(url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := doJSON(req, &tok); err != nil {
+		return "", err
+	}
+	googleTokens.tokens[cacheKey] = cachedToken{
+		token:   tok.AccessToken,
+		expires: time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second),
+	}
+	return tok.AccessToken, nil
+}
+
+// doJSON sends req and decodes a successful JSON response into out
+func doJSON(req *http.Request, out interface{}) error {
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d: %s", req.URL.Host, resp.StatusCode, body)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+func parsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+	return signer, nil
+}
+
+// signJWT makes a compact JWT signed with RS256 or ES256, per the key type
+func signJWT(header, claims map[string]interface{}, key crypto.Signer) (string, error) {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	signingInput := enc.EncodeToString(headerJSON) + "." + enc.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		// JWS wants the raw r || s, each padded to 32 bytes
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		if err == nil {
+			sig = make([]byte, 64)
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+		}
+	default:
+		err = errors.New("unsupported JWT key type")
+	}
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + enc.EncodeToString(sig), nil
+}
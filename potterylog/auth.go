@@ -0,0 +1,393 @@
+package potterylog
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// There are two kinds of credentials. Operators use admin credentials from
+// the config on the admin port; an "admin" can do anything there and a
+// "viewer" can only GET. Devices get a device token from
+// /pottery-log/register-device, which endpoints that return a device's own
+// private data require.
+const (
+	adminRoleAdmin  = "admin"
+	adminRoleViewer = "viewer"
+)
+
+type adminCredential struct {
+	Name string `json:"name"`
+	// TokenSHA256 is the hex SHA-256 of the bearer token, so the config
+	// file doesn't hold usable secrets
+	TokenSHA256 string `json:"token_sha256"`
+	Role        string `json:"role"`
+}
+
+var (
+	errDeviceUnauthorized = newAPIError("device_unauthorized", "This device is not authorized")
+	errDeviceRegistered   = newAPIError("device_registered", "This device is already registered")
+)
+
+func bearerToken(req *http.Request) string {
+	return strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticateAdmin returns the credential the request was made with, or nil
+func (s *Server) authenticateAdmin(req *http.Request) *adminCredential {
+	token := bearerToken(req)
+	if token == "" {
+		return nil
+	}
+	if s.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1 {
+		return &adminCredential{Name: "admin_token", Role: adminRoleAdmin}
+	}
+	hashed := hashToken(token)
+	for _, cred := range s.config().AdminCredentials {
+		if subtle.ConstantTimeCompare([]byte(hashed), []byte(strings.ToLower(cred.TokenSHA256))) == 1 {
+			c := cred
+			return &c
+		}
+	}
+	return nil
+}
+
+func (s *Server) adminCredentialsConfigured() bool {
+	return s.adminToken != "" || len(s.config().AdminCredentials) > 0
+}
+
+// requireAdmin guards the admin port. Until credentials are configured the
+// port is only protected by listening on localhost.
+func (s *Server) requireAdmin(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		readOnly := req.Method == http.MethodGet || req.Method == http.MethodHead
+		// The dashboard page has no data of its own; it asks for the
+		// token and sends it with its requests
+		if readOnly && req.URL.Path == adminUIPath {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		if !s.adminCredentialsConfigured() {
+			if !readOnly {
+				s.audit("local", req)
+			}
+			handler.ServeHTTP(w, req)
+			return
+		}
+		cred := s.authenticateAdmin(req)
+		if cred == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if cred.Role != adminRoleAdmin && !(cred.Role == adminRoleViewer && readOnly) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if !readOnly {
+			log.Printf("Admin %s: %s %s\n", cred.Name, req.Method, req.URL.Path)
+			s.audit(cred.Name, req)
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// audit records an admin request in the audit log
+func (s *Server) audit(actor string, req *http.Request) {
+	req.ParseForm()
+	s.ops.Audit(actor, req.Method+" "+req.URL.Path, auditedForm(req.Form))
+}
+
+// secretFieldPattern matches the names of fields that carry credentials,
+// like deviceToken, apiKey, or token_sha256
+var secretFieldPattern = regexp.MustCompile(`(?i)token|key|secret|password|credential`)
+
+// auditedForm is the form as the audit log keeps it, with the values of
+// fields that carry credentials left out
+func auditedForm(form url.Values) string {
+	audited := make(url.Values, len(form))
+	for name, values := range form {
+		if secretFieldPattern.MatchString(name) {
+			values = []string{"[redacted]"}
+		}
+		audited[name] = values
+	}
+	return audited.Encode()
+}
+
+// deviceTokenStore keeps the hash of each registered device's token
+type deviceTokenStore struct {
+	mu       sync.Mutex
+	location string
+	hashes   map[string]string
+}
+
+// NewDeviceTokenStore loads the device tokens from the given file
+func NewDeviceTokenStore(location string) (*deviceTokenStore, error) {
+	s := &deviceTokenStore{
+		mu:       sync.Mutex{},
+		location: location,
+		hashes:   make(map[string]string),
+	}
+	data, err := ioutil.ReadFile(location)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, json.Unmarshal(data, &s.hashes)
+}
+
+// Register issues a token for a device that doesn't have one yet
+func (s *deviceTokenStore) Register(deviceID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.hashes[deviceID]; ok {
+		return "", errDeviceRegistered
+	}
+	token := newID() + newID()
+	s.hashes[deviceID] = hashToken(token)
+	return token, s.save()
+}
+
+// Reset forgets the device's token, so it can register again
+func (s *deviceTokenStore) Reset(deviceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.hashes[deviceID]; !ok {
+		return nil
+	}
+	delete(s.hashes, deviceID)
+	return s.save()
+}
+
+// save writes the tokens to disk. The caller holds s.mu.
+func (s *deviceTokenStore) save() error {
+	data, err := json.Marshal(s.hashes)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.location+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(s.location+".tmp", s.location)
+}
+
+func (s *deviceTokenStore) Check(deviceID, token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hashed, ok := s.hashes[deviceID]
+	return ok && token != "" && subtle.ConstantTimeCompare([]byte(hashed), []byte(hashToken(token))) == 1
+}
+
+func (s *deviceTokenStore) Registered(deviceID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.hashes[deviceID]
+	return ok
+}
+
+// deviceAuthorized checks the device token sent as a bearer token or as the
+// deviceToken field, or the API key the request was made with (see
+// apikeys.go). Devices that never registered (older app versions)
+// don't have a token to send, so they're let through.
+func (s *Server) deviceAuthorized(req *http.Request, deviceID string) bool {
+	if k := requestAPIKey(req); k != nil {
+		return k.DeviceID == deviceID
+	}
+	key := requestTenant(req).dataKey(deviceID)
+	if !s.deviceTokens.Registered(key) {
+		return true
+	}
+	token := bearerToken(req)
+	if token == "" {
+		token = req.FormValue("deviceToken")
+	}
+	return s.deviceTokens.Check(key, token)
+}
+
+// deviceAuthorizedBeforeForm is deviceAuthorized for middleware that runs
+// before withForm, so the deviceToken field of a multipart form isn't seen
+// and the token has to come in the header or the query
+func (s *Server) deviceAuthorizedBeforeForm(req *http.Request, deviceID string) bool {
+	if k := requestAPIKey(req); k != nil {
+		return k.DeviceID == deviceID
+	}
+	if !s.deviceTokens.Registered(requestTenant(req).dataKey(deviceID)) {
+		return true
+	}
+	return s.hasDeviceToken(req, deviceID)
+}
+
+// hasDeviceToken reports whether the request has the token of a registered
+// device. Unlike deviceAuthorized, it's false for devices that never
+// registered, and it's for middleware that runs before withForm.
+func (s *Server) hasDeviceToken(req *http.Request, deviceID string) bool {
+	token := bearerToken(req)
+	if token == "" {
+		token = preFormValue(req, "deviceToken")
+	}
+	return s.deviceTokens != nil && s.deviceTokens.Check(requestTenant(req).dataKey(deviceID), token)
+}
+
+// requireDevice handles the error and returns false if the request doesn't
+// have the device's token
+func (s *Server) requireDevice(w http.ResponseWriter, req *http.Request, deviceID string) bool {
+	if s.deviceAuthorized(req, deviceID) {
+		return true
+	}
+	s.handleErrCode(errDeviceUnauthorized, http.StatusUnauthorized, deviceID, w)
+	return false
+}
+
+// registrationAllowedSetting is the device setting that lets the device
+// register once without proving it's the app (see DeviceTokens)
+const registrationAllowedSetting = "registration_allowed"
+
+var errRegistrationUnverified = newAPIError("registration_unverified", "This device already has data on the server, so registering it needs app attestation or an operator's approval")
+
+// deviceHasData reports whether the server holds any of the device's data,
+// with its images in t's bucket
+func (s *Server) deviceHasData(t *tenant, deviceID string) bool {
+	if _, _, err := s.metadataHistory.Latest(t.dataKey(deviceID)); err == nil {
+		return true
+	}
+	if _, err := s.ops.LatestExportRecord(deviceID); err == nil {
+		return true
+	}
+	if n, err := s.ops.Usage(t, deviceID, "uploads", time.Time{}); err == nil && n > 0 {
+		return true
+	}
+	// If the images can't be listed, assume there are some
+	images, err := s.deviceImages(t.imageBucket(), deviceID)
+	return err != nil || len(images) > 0
+}
+
+// checkRegistration checks that the device may take a token. A new device
+// has nothing to lose, but whoever registers a device first locks out
+// everyone else, so registering a device the server has data for needs
+// proof that the request comes from the app: a fresh attestation with
+// attestation enforced, or an operator's approval from DeviceTokens.
+func (s *Server) checkRegistration(req *http.Request, deviceID string) error {
+	t := requestTenant(req)
+	if !s.deviceHasData(t, deviceID) || s.ops.DeviceSetting(t.dataKey(deviceID), registrationAllowedSetting) == "true" {
+		return nil
+	}
+	ac := s.config().Attestation
+	if ac.Mode != "enforce" {
+		return errRegistrationUnverified
+	}
+	err := verifyAttestation(ac, req.Header.Get("X-Attestation-Platform"), req.Header.Get("X-Attestation-Token"))
+	if err != nil {
+		log.Printf("Attestation failed registering device %s: %v\n", deviceID, err)
+		s.logEvent(deviceID, AttestationFailedEvent{Mode: ac.Mode})
+		return errRegistrationUnverified
+	}
+	return nil
+}
+
+func (s *Server) RegisterDevice(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	key := requestTenant(req).dataKey(deviceID)
+	if s.deviceTokens.Registered(key) {
+		s.handleErrCode(errDeviceRegistered, http.StatusConflict, deviceID, w)
+		return
+	}
+	if s.handleErrCode(s.checkRegistration(req, deviceID), http.StatusForbidden, deviceID, w) {
+		return
+	}
+	token, err := s.deviceTokens.Register(key)
+	if err == errDeviceRegistered {
+		s.handleErrCode(err, http.StatusConflict, deviceID, w)
+		return
+	}
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+	// An operator's approval is good for one registration
+	if err := s.ops.SetDeviceSetting(key, registrationAllowedSetting, ""); err != nil {
+		log.Printf("Error clearing the registration approval for %s: %v\n", deviceID, err)
+	}
+	s.logEvent(deviceID, RegisterDeviceEvent)
+	writeJSON(w, struct {
+		Status      string `json:"status"`
+		DeviceToken string `json:"device_token"`
+	}{
+		Status:      "ok",
+		DeviceToken: token,
+	})
+}
+
+// DeviceTokens is the admin port's view of a device's registration, in the
+// default tenant or the one named by tenant. POST resets it, for a device
+// someone else registered first: the token is forgotten, and the device's
+// next registration needs no attestation.
+func (s *Server) DeviceTokens(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField, tenantField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	t := s.findTenant(req.FormValue("tenant"))
+	if t == nil {
+		s.handleErrCode(errUnknownTenant(req.FormValue("tenant")), http.StatusBadRequest, deviceID, w)
+		return
+	}
+	key := t.dataKey(deviceID)
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if s.handleErr(s.deviceTokens.Reset(key), deviceID, w) {
+			return
+		}
+		if s.handleErr(s.ops.SetDeviceSetting(key, registrationAllowedSetting, "true"), deviceID, w) {
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, struct {
+		Status              string `json:"status"`
+		Registered          bool   `json:"registered"`
+		RegistrationAllowed bool   `json:"registration_allowed"`
+	}{
+		Status:              "ok",
+		Registered:          s.deviceTokens.Registered(key),
+		RegistrationAllowed: s.ops.DeviceSetting(key, registrationAllowedSetting) == "true",
+	})
+}
+
+// Maintenance turns maintenance mode on or off from the admin port
+func (s *Server) Maintenance(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		s.setMaintenance(req.FormValue("on") == "true")
+	}
+	writeJSON(w, struct {
+		Status      string `json:"status"`
+		Maintenance bool   `json:"maintenance"`
+	}{
+		Status:      "ok",
+		Maintenance: s.inMaintenance(),
+	})
+}
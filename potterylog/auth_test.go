@@ -0,0 +1,84 @@
+package potterylog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func adminRequest(t *testing.T, admin *httptest.Server, method, path, token string, form url.Values) int {
+	t.Helper()
+	req, err := http.NewRequest(method, admin.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func newAdminServer(t *testing.T, h *testHarness) *httptest.Server {
+	t.Helper()
+	c := *h.srv.config()
+	c.AdminCredentials = []adminCredential{
+		{Name: "ops", TokenSHA256: hashToken("admin-token"), Role: adminRoleAdmin},
+		{Name: "dashboard", TokenSHA256: hashToken("viewer-token"), Role: adminRoleViewer},
+	}
+	h.srv.setConfig(&c)
+	admin := httptest.NewServer(h.srv.AdminHandler())
+	t.Cleanup(admin.Close)
+	return admin
+}
+
+func TestAdminActionsNeedPost(t *testing.T) {
+	h, err := newTestHarness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	admin := newAdminServer(t, h)
+
+	for _, path := range []string{"/admin/reload-config", "/admin/server-export?deviceId=device1"} {
+		if code := adminRequest(t, admin, http.MethodGet, path, "viewer-token", nil); code != http.StatusMethodNotAllowed {
+			t.Errorf("viewer GET %s: got %d, want 405", path, code)
+		}
+		if code := adminRequest(t, admin, http.MethodPost, path, "viewer-token", nil); code != http.StatusForbidden {
+			t.Errorf("viewer POST %s: got %d, want 403", path, code)
+		}
+	}
+}
+
+func TestAuditLogRedactsCredentials(t *testing.T) {
+	h, err := newTestHarness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	admin := newAdminServer(t, h)
+
+	form := url.Values{"deviceId": {"device1"}, "deviceToken": {"hunter2"}, "apiKey": {"pk_secret"}}
+	if code := adminRequest(t, admin, http.MethodPost, "/admin/device-tokens", "admin-token", form); code != http.StatusOK {
+		t.Fatalf("device-tokens: got %d", code)
+	}
+	entries, err := h.srv.ops.AuditLog(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d audit entries, want 1", len(entries))
+	}
+	detail := entries[0].Detail
+	if strings.Contains(detail, "hunter2") || strings.Contains(detail, "pk_secret") {
+		t.Errorf("audit log kept a credential: %s", detail)
+	}
+	if !strings.Contains(detail, "deviceId=device1") {
+		t.Errorf("audit log lost the device id: %s", detail)
+	}
+}
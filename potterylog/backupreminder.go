@@ -0,0 +1,129 @@
+package potterylog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Backup reminders nudge devices that have been adding pots but haven't
+// exported in a while, before a lost phone takes months of work with it.
+type backupReminderConfig struct {
+	// AfterDays is how old the last export can get before a reminder; 0
+	// turns reminders off
+	AfterDays int `json:"after_days"`
+	// RepeatDays is how long to wait before reminding the same device
+	// again, default 7
+	RepeatDays int `json:"repeat_days"`
+	// WebhookURL, if set, gets a JSON POST for each reminder. Reminders
+	// also go to the notifiers (see notify.go).
+	WebhookURL string `json:"webhook_url"`
+}
+
+func (c backupReminderConfig) repeatDays() int {
+	if c.RepeatDays <= 0 {
+		return 7
+	}
+	return c.RepeatDays
+}
+
+// backupReminder is the webhook payload
+type backupReminder struct {
+	Event    string `json:"event"`
+	DeviceID string `json:"device_id"`
+	Tenant   string `json:"tenant"`
+	// LastExport is nil if the device never exported
+	LastExport *time.Time `json:"last_export"`
+	LastActive time.Time  `json:"last_active"`
+}
+
+// The device setting that records when a device was last reminded
+const backupRemindedSetting = "backup-reminded"
+
+func (s *Server) sendBackupReminders(r *jobRun) error {
+	cfg := s.config().BackupReminder
+	if cfg.AfterDays <= 0 {
+		r.Logf("Backup reminders are off")
+		return nil
+	}
+	now := s.Clock.Now()
+	cutoff := now.AddDate(0, 0, -cfg.AfterDays)
+	devices, err := s.ops.StaleBackups(cutoff)
+	if err != nil {
+		return err
+	}
+
+	sent := 0
+	for _, d := range devices {
+		if reminded, err := strconv.ParseInt(s.ops.DeviceSetting(d.DeviceID, backupRemindedSetting), 10, 64); err == nil &&
+			now.Sub(time.Unix(reminded, 0)) < time.Duration(cfg.repeatDays())*24*time.Hour {
+			continue
+		}
+		reminder := backupReminder{
+			Event:      "backup-reminder",
+			DeviceID:   d.DeviceID,
+			Tenant:     s.tenantOf(d.DeviceID).Name,
+			LastExport: d.LastExport,
+			LastActive: d.LastActive,
+		}
+		if cfg.WebhookURL != "" {
+			if err := postWebhook(cfg.WebhookURL, reminder); err != nil {
+				r.Logf("Backup reminder webhook for %s failed: %v", d.DeviceID, err)
+				continue
+			}
+		}
+		if err := s.notify(backupReminderNotification(d, now)); err != nil {
+			r.Logf("Backup reminder notification for %s failed: %v", d.DeviceID, err)
+			continue
+		}
+		if d.LastExport == nil {
+			s.logEvent(d.DeviceID, BackupReminderEvent{NeverExported: true})
+		} else {
+			s.logEvent(d.DeviceID, BackupReminderEvent{Days: int(now.Sub(*d.LastExport).Hours() / 24)})
+		}
+		if err := s.ops.SetDeviceSetting(d.DeviceID, backupRemindedSetting, strconv.FormatInt(now.Unix(), 10)); err != nil {
+			return err
+		}
+		sent++
+	}
+	r.Logf("%d devices need a backup, reminded %d", len(devices), sent)
+	return nil
+}
+
+func backupReminderNotification(d staleBackup, now time.Time) notification {
+	n := notification{
+		Kind:     notifyBackupReminder,
+		DeviceID: d.DeviceID,
+		Title:    "Time to back up your pots",
+		Body:     "You've added photos since your last backup. Export now so you don't lose them if something happens to your phone.",
+		Data:     map[string]interface{}{"last_active": d.LastActive.Format("2006-01-02")},
+	}
+	if d.LastExport == nil {
+		n.Body = "You've never backed up your pots. Export now so you don't lose them if something happens to your phone."
+	} else {
+		n.Data["last_export"] = d.LastExport.Format(time.RFC3339)
+		n.Data["days"] = int(now.Sub(*d.LastExport).Hours() / 24)
+	}
+	return n
+}
+
+// postWebhook sends body as JSON and expects any 2xx back
+func postWebhook(url string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
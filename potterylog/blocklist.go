@@ -0,0 +1,304 @@
+package potterylog
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The blocklist keeps scrapers and misbehaving devices off the public
+// endpoints. Operators add IPs (or CIDR ranges) and deviceIds through
+// /admin/blocklist, and devices or IPs that keep getting 429s are banned
+// for a while automatically (see abuseConfig).
+type abuseConfig struct {
+	// Ban after this many 429s within WindowSeconds. 0 disables auto bans.
+	Strikes       int `json:"strikes"`
+	WindowSeconds int `json:"window_seconds"`
+	BanMinutes    int `json:"ban_minutes"`
+}
+
+type blockEntry struct {
+	Reason string    `json:"reason"`
+	Added  time.Time `json:"added"`
+	// Until is nil for permanent entries
+	Until *time.Time `json:"until,omitempty"`
+}
+
+func (e blockEntry) active(now time.Time) bool {
+	return e.Until == nil || now.Before(*e.Until)
+}
+
+var errBlocked = newAPIError("device_blocked", "This device has been blocked. Please contact support.")
+
+type blockStore struct {
+	mu       sync.Mutex
+	location string
+	lists    struct {
+		IPs     map[string]blockEntry `json:"ips"`
+		Devices map[string]blockEntry `json:"devices"`
+	}
+	// recent 429s by "ip:<addr>" or "device:<id>", which aren't persisted
+	strikes map[string][]time.Time
+	clock   Clock
+}
+
+// NewBlockStore loads the blocklist from the given file
+func NewBlockStore(location string, clock Clock) (*blockStore, error) {
+	s := &blockStore{
+		mu:       sync.Mutex{},
+		location: location,
+		strikes:  make(map[string][]time.Time),
+		clock:    clock,
+	}
+	data, err := ioutil.ReadFile(location)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.lists); err != nil {
+			return nil, err
+		}
+	}
+	if s.lists.IPs == nil {
+		s.lists.IPs = make(map[string]blockEntry)
+	}
+	if s.lists.Devices == nil {
+		s.lists.Devices = make(map[string]blockEntry)
+	}
+	return s, nil
+}
+
+// Blocked reports whether the IP or device is on the blocklist
+func (s *blockStore) Blocked(ip, deviceID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.lists.Devices[deviceID]; ok && deviceID != "" && e.active(s.clock.Now()) {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	for entry, e := range s.lists.IPs {
+		if !e.active(s.clock.Now()) {
+			continue
+		}
+		if entry == ip {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil && addr != nil && network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add blocks an IP, CIDR range, or device. A zero duration is permanent.
+func (s *blockStore) Add(ip, deviceID, reason string, duration time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(ip, deviceID, reason, duration)
+	return s.save()
+}
+
+func (s *blockStore) add(ip, deviceID, reason string, duration time.Duration) {
+	e := blockEntry{Reason: reason, Added: s.clock.Now()}
+	if duration > 0 {
+		until := e.Added.Add(duration)
+		e.Until = &until
+	}
+	if ip != "" {
+		s.lists.IPs[ip] = e
+	}
+	if deviceID != "" {
+		s.lists.Devices[deviceID] = e
+	}
+}
+
+func (s *blockStore) Remove(ip, deviceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.lists.IPs, ip)
+	delete(s.lists.Devices, deviceID)
+	delete(s.strikes, "ip:"+ip)
+	delete(s.strikes, "device:"+deviceID)
+	return s.save()
+}
+
+// Strike records a 429 and bans the IP and device if they've had too many
+// under c, reporting whether it banned them
+func (s *blockStore) Strike(c abuseConfig, ip, deviceID string) bool {
+	if c.Strikes <= 0 {
+		return false
+	}
+	window := time.Duration(c.WindowSeconds) * time.Second
+	ban := time.Duration(c.BanMinutes) * time.Minute
+	if ban <= 0 {
+		ban = time.Hour
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	banned := false
+	strike := func(key, ip, deviceID string) {
+		now := s.clock.Now()
+		recent := s.strikes[key][:0]
+		for _, t := range s.strikes[key] {
+			if now.Sub(t) < window {
+				recent = append(recent, t)
+			}
+		}
+		recent = append(recent, now)
+		s.strikes[key] = recent
+		if len(recent) >= c.Strikes {
+			log.Printf("Banning ip=%q device=%q for %v after %d rate limited requests\n", ip, deviceID, ban, len(recent))
+			s.add(ip, deviceID, "rate limited repeatedly", ban)
+			delete(s.strikes, key)
+			banned = true
+		}
+	}
+	if ip != "" {
+		strike("ip:"+ip, ip, "")
+	}
+	if deviceID != "" {
+		strike("device:"+deviceID, "", deviceID)
+	}
+	if banned {
+		if err := s.save(); err != nil {
+			log.Printf("Error saving the blocklist: %v\n", err)
+		}
+	}
+	return banned
+}
+
+// List returns copies of the active IP and device entries
+func (s *blockStore) List() (map[string]blockEntry, map[string]blockEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ips := make(map[string]blockEntry)
+	for ip, e := range s.lists.IPs {
+		if e.active(s.clock.Now()) {
+			ips[ip] = e
+		}
+	}
+	devices := make(map[string]blockEntry)
+	for deviceID, e := range s.lists.Devices {
+		if e.active(s.clock.Now()) {
+			devices[deviceID] = e
+		}
+	}
+	return ips, devices
+}
+
+// save writes the blocklist, dropping expired bans. The caller holds s.mu.
+func (s *blockStore) save() error {
+	for ip, e := range s.lists.IPs {
+		if !e.active(s.clock.Now()) {
+			delete(s.lists.IPs, ip)
+		}
+	}
+	for deviceID, e := range s.lists.Devices {
+		if !e.active(s.clock.Now()) {
+			delete(s.lists.Devices, deviceID)
+		}
+	}
+	data, err := json.Marshal(s.lists)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.location+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(s.location+".tmp", s.location)
+}
+
+// clientIP is the address the request came from. Behind a reverse proxy on
+// the same host, that's the last address the proxy added to X-Forwarded-For.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	// Requests over a unix socket have no remote address, and can only
+	// come from this host
+	ip := net.ParseIP(host)
+	if (ip != nil && ip.IsLoopback()) || host == "" || host == "@" {
+		if forwarded := req.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			last := forwarded[len(forwarded)-1]
+			last = last[strings.LastIndex(last, ",")+1:]
+			if ip := net.ParseIP(strings.TrimSpace(last)); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+	return host
+}
+
+// blockAbusers rejects blocked IPs and devices, and counts 429s toward
+// automatic bans
+func (s *Server) blockAbusers(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ip := clientIP(req)
+		deviceID := preFormValue(req, "deviceId")
+		if s.blocks.Blocked(ip, deviceID) {
+			s.handleErrCode(errBlocked, http.StatusForbidden, deviceID, w)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(rec, req)
+		if rec.status == http.StatusTooManyRequests && s.blocks.Strike(s.config().Abuse, ip, deviceID) {
+			s.logEvent(deviceID, AutoBanEvent)
+		}
+	})
+}
+
+// Blocklist lists, adds, and removes blocklist entries from the admin port
+func (s *Server) Blocklist(w http.ResponseWriter, req *http.Request) {
+	ip := req.FormValue("ip")
+	deviceID := req.FormValue("deviceId")
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodDelete:
+		if ip == "" && deviceID == "" {
+			s.handleErrCode(errMissingField("ip", "deviceId"), http.StatusBadRequest, deviceID, w)
+			return
+		}
+		if ip != "" && net.ParseIP(ip) == nil {
+			if _, _, err := net.ParseCIDR(ip); err != nil {
+				s.handleErrCode(errors.New("ip must be an IP address or CIDR range"), http.StatusBadRequest, deviceID, w)
+				return
+			}
+		}
+		var err error
+		if req.Method == http.MethodPost {
+			minutes, _ := strconv.Atoi(req.FormValue("minutes"))
+			err = s.blocks.Add(ip, deviceID, req.FormValue("reason"), time.Duration(minutes)*time.Minute)
+		} else {
+			err = s.blocks.Remove(ip, deviceID)
+		}
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ips, devices := s.blocks.List()
+	writeJSON(w, struct {
+		Status  string                `json:"status"`
+		IPs     map[string]blockEntry `json:"ips"`
+		Devices map[string]blockEntry `json:"devices"`
+	}{
+		Status:  "ok",
+		IPs:     ips,
+		Devices: devices,
+	})
+}
@@ -0,0 +1,112 @@
+package potterylog
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Objects are put with the public-read canned ACL unless bucket_acls says
+// otherwise for their bucket. Buckets with Object Ownership set to "bucket
+// owner enforced", the default for new buckets, reject every request with
+// an ACL, so those need "none", with a bucket policy granting public reads
+// on the image bucket instead. A bucket policy is the better choice for
+// any bucket the server manages.
+var bucketACLChoices = map[string]bool{"none": true, "private": true, "public-read": true}
+
+const defaultBucketACL = "public-read"
+
+// The SDK version we use predates this Object Ownership setting
+const objectOwnershipBucketOwnerEnforced = "BucketOwnerEnforced"
+
+// objectACL is the canned ACL for objects put in the bucket, or nil for
+// none
+func (s *Server) objectACL(bucketName string) *string {
+	return objectACL(s.config(), bucketName)
+}
+
+// objectACL is the canned ACL c gives objects put in the bucket
+func objectACL(c *config, bucketName string) *string {
+	acl := c.BucketACLs[bucketName]
+	switch acl {
+	case "none":
+		return nil
+	case "":
+		acl = defaultBucketACL
+	}
+	return aws.String(acl)
+}
+
+func validateBucketACLs(c *config) error {
+	for bucketName, acl := range c.BucketACLs {
+		if !bucketACLChoices[acl] {
+			return fmt.Errorf("bucket_acls: %q for %s must be none, private, or public-read", acl, bucketName)
+		}
+	}
+	return nil
+}
+
+// configuredBuckets are the image and import buckets of every tenant,
+// mapped to whether each is an image bucket
+func (s *Server) configuredBuckets() map[string]bool {
+	buckets := map[string]bool{}
+	for _, t := range s.tenants() {
+		buckets[t.importBucket()] = buckets[t.importBucket()]
+		buckets[t.imageBucket()] = true
+	}
+	return buckets
+}
+
+// checkBucketACLs compares each bucket's Object Ownership setting with its
+// ACL in bucket_acls. A bucket that would reject every upload is an error.
+// Anything else the check finds, or can't find out, is only logged.
+func (s *s3Store) checkBucketACLs(buckets map[string]bool) error {
+	names := make([]string, 0, len(buckets))
+	for bucketName := range buckets {
+		names = append(names, bucketName)
+	}
+	sort.Strings(names)
+	for _, bucketName := range names {
+		acl := "none"
+		if a := s.acl(bucketName); a != nil {
+			acl = *a
+		}
+		ownership := s3.ObjectOwnershipObjectWriter
+		out, err := s.svc.GetBucketOwnershipControls(&s3.GetBucketOwnershipControlsInput{Bucket: aws.String(bucketName)})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "OwnershipControlsNotFoundError" {
+			// Buckets without ownership controls accept ACLs
+		} else if err != nil {
+			log.Printf("Couldn't check the ownership settings of bucket %s: %v\n", bucketName, err)
+			continue
+		} else if out.OwnershipControls != nil && len(out.OwnershipControls.Rules) > 0 {
+			ownership = aws.StringValue(out.OwnershipControls.Rules[0].ObjectOwnership)
+		}
+		if ownership == objectOwnershipBucketOwnerEnforced && acl != "none" {
+			return fmt.Errorf("bucket %s has Object Ownership set to BucketOwnerEnforced, which rejects the %s ACL on every upload. "+
+				"Set \"bucket_acls\": {%q: \"none\"} in the config and grant public reads with a bucket policy", bucketName, acl, bucketName)
+		}
+		if buckets[bucketName] && acl != "public-read" {
+			s.checkPublicPolicy(bucketName)
+		}
+	}
+	return nil
+}
+
+// checkPublicPolicy warns when an image bucket's objects aren't public by
+// ACL or by policy, since the app loads images from their bucket URLs
+func (s *s3Store) checkPublicPolicy(bucketName string) {
+	out, err := s.svc.GetBucketPolicyStatus(&s3.GetBucketPolicyStatusInput{Bucket: aws.String(bucketName)})
+	public := err == nil && out.PolicyStatus != nil && aws.BoolValue(out.PolicyStatus.IsPublic)
+	if aerr, ok := err.(awserr.Error); err != nil && !(ok && aerr.Code() == "NoSuchBucketPolicy") {
+		log.Printf("Couldn't check the policy of bucket %s: %v\n", bucketName, err)
+		return
+	}
+	if !public {
+		log.Printf("Warning: image bucket %s has no public-read ACL in bucket_acls and no public bucket policy, "+
+			"so the app can only load its images through %s\n", bucketName, imageProxyPath)
+	}
+}
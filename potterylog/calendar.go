@@ -0,0 +1,162 @@
+package potterylog
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// A device can subscribe to its pots' firing dates and commission deadlines
+// from a calendar app. Calendar apps can't send a device token, so the feed
+// URL has its own secret token in it, which only its hash is stored for.
+// Making a new URL replaces the old one, and deleting the feed turns it off.
+
+const calendarPath = "/pottery-log/calendar/"
+
+var errNoCalendarFeed = newAPIError("no_calendar_feed", "This device doesn't have a calendar feed")
+
+// calendarDates are the pot dates that go on the calendar, and what they
+// are called there. Apps set "due" for a commission's deadline.
+var calendarDates = map[string]string{
+	"bisqued": "Bisque firing",
+	"glazed":  "Glaze firing",
+	"fired":   "Firing",
+	"due":     "Due",
+}
+
+func (s *Server) calendarURL(req *http.Request, token string) string {
+	return s.publicLink(req, calendarPath+token+".ics")
+}
+
+// CalendarFeed serves /pottery-log/calendar: POST makes a new feed URL for
+// the device, replacing any it had, and DELETE turns the feed off
+func (s *Server) CalendarFeed(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	if !s.requireDevice(w, req, deviceID) {
+		return
+	}
+	// The feed is of the device's own pots, in the request's tenant
+	library := requestTenant(req).dataKey(deviceID)
+	switch req.Method {
+	case http.MethodPost:
+		token := newID() + newID()
+		if s.handleErr(s.ops.SetCalendarFeed(library, hashToken(token)), deviceID, w) {
+			return
+		}
+		s.logEvent(deviceID, CalendarFeedEvent)
+		writeJSON(w, struct {
+			Status string `json:"status"`
+			URL    string `json:"url"`
+		}{
+			Status: "ok",
+			URL:    s.calendarURL(req, token),
+		})
+	case http.MethodDelete:
+		deleted, err := s.ops.DeleteCalendarFeed(library)
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		if !deleted {
+			s.handleErrCode(errNoCalendarFeed, http.StatusNotFound, deviceID, w)
+			return
+		}
+		w.Write(okResponse())
+	default:
+		s.handleErrCode(errMethodNotAllowed, http.StatusMethodNotAllowed, deviceID, w)
+	}
+}
+
+// Calendar serves a feed URL as iCalendar, with an all-day event for each
+// of the device's pot dates in calendarDates
+func (s *Server) Calendar(w http.ResponseWriter, req *http.Request) {
+	token := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, calendarPath), ".ics")
+	if token == "" || !validID(token) {
+		http.NotFound(w, req)
+		return
+	}
+	library, err := s.ops.CalendarFeedDevice(hashToken(token))
+	if err != nil {
+		log.Printf("Error looking up a calendar feed: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if library == "" {
+		http.NotFound(w, req)
+		return
+	}
+	list, err := s.pots.List(library)
+	if s.handleErr(err, "", w) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, max-age=900")
+	w.Write(potCalendar(list))
+}
+
+// potCalendar renders the pots' calendar dates as iCalendar (RFC 5545)
+func potCalendar(list []*pot) []byte {
+	var out strings.Builder
+	line := func(text string) {
+		out.WriteString(foldCalendarLine(text))
+	}
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//Pottery Log//pottery-log-server " + version + "//EN")
+	line("CALSCALE:GREGORIAN")
+	line("X-WR-CALNAME:Pottery Log")
+	for _, p := range list {
+		kinds := make([]string, 0, len(p.Dates))
+		for kind := range p.Dates {
+			if _, ok := calendarDates[kind]; ok {
+				kinds = append(kinds, kind)
+			}
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			date := p.Dates[kind]
+			line("BEGIN:VEVENT")
+			line(fmt.Sprintf("UID:%s-%s@pottery-log", p.ID, kind))
+			line("DTSTAMP:" + p.Updated.UTC().Format("20060102T150405Z"))
+			line("DTSTART;VALUE=DATE:" + date.Format("20060102"))
+			line("DTEND;VALUE=DATE:" + date.AddDate(0, 0, 1).Format("20060102"))
+			line("SUMMARY:" + calendarText(calendarDates[kind]+": "+potTitle(p)))
+			if description := potDescription(p); description != "" {
+				line("DESCRIPTION:" + calendarText(description))
+			}
+			line("TRANSP:TRANSPARENT")
+			line("END:VEVENT")
+		}
+	}
+	line("END:VCALENDAR")
+	return []byte(out.String())
+}
+
+// calendarText escapes text for an iCalendar property value
+func calendarText(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`).Replace(text)
+}
+
+// foldCalendarLine ends a content line with CRLF, folding it so no line is
+// longer than 75 bytes without splitting a character
+func foldCalendarLine(text string) string {
+	var out strings.Builder
+	limit := 75
+	for len(text) > limit {
+		n := limit
+		for n > 0 && !utf8.RuneStart(text[n]) {
+			n--
+		}
+		out.WriteString(text[:n] + "\r\n ")
+		text = text[n:]
+		// The leading space of a continuation counts toward its length
+		limit = 74
+	}
+	out.WriteString(text + "\r\n")
+	return out.String()
+}
@@ -0,0 +1,199 @@
+package potterylog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"strings"
+	"sync"
+)
+
+// With content_addressed_images on, uploads are stored once per distinct
+// content at blobs/<sha256> in the image bucket, and the ops database's
+// image_refs table records which device file names point at each blob.
+// Images uploaded before that stay at <deviceId>/<fileName>.
+const blobPrefix = "blobs/"
+
+var errAmbiguousImage = newAPIError("ambiguous_image", "This device has more than one name for the image, so say which with fileName")
+
+// keyLocks holds a lock for each name in use, dropping it once nobody
+// holds or waits for it
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	waiters int
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{locks: make(map[string]*keyLock)}
+}
+
+// Lock locks name and returns the function to unlock it
+func (k *keyLocks) Lock(name string) func() {
+	k.mu.Lock()
+	l := k.locks[name]
+	if l == nil {
+		l = &keyLock{}
+		k.locks[name] = l
+	}
+	l.waiters++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if l.waiters--; l.waiters == 0 {
+			delete(k.locks, name)
+		}
+	}
+}
+
+// blobLocks holds a lock for each blob whose references are changing, so
+// that storing a blob and taking up a reference to it can't interleave
+// with dropping its last reference and deleting it
+var blobLocks = newKeyLocks()
+
+// lockBlob locks the bucket's blob and returns the function to unlock it
+func lockBlob(bucketName, blobKey string) func() {
+	return blobLocks.Lock(bucketName + "/" + blobKey)
+}
+
+// storeBlob stores an upload by content hash, skipping the upload if the
+// same content is already stored
+func storeBlob(s *Server, item *uploadItem) error {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, item.Body); err != nil {
+		return err
+	}
+	if _, err := item.Body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	blobKey := blobPrefix + hex.EncodeToString(hash.Sum(nil))
+	fileName, _, unlockName, err := freeName(item, func(fileName string) (bool, bool, error) {
+		ref, ok := s.ops.ImageRef(item.Bucket, item.DeviceID, fileName)
+		return ref == blobKey, ok, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer unlockName()
+	item.FileName = fileName
+	item.ETag, err = bodyMD5(item)
+	if err != nil {
+		return err
+	}
+
+	replaced, err := addBlobRef(s, item, blobKey)
+	if err != nil {
+		return err
+	}
+	// A replaced image's blob goes once nothing references it
+	if replaced != "" && replaced != blobKey {
+		unlock := lockBlob(item.Bucket, replaced)
+		n, err := s.ops.ImageRefCount(item.Bucket, replaced)
+		if err == nil && n == 0 {
+			err = s.Storage.Delete(item.Bucket, replaced)
+		}
+		unlock()
+		if err != nil {
+			log.Printf("Error deleting replaced blob %s: %v\n", replaced, err)
+		}
+	}
+	item.Key = blobKey
+	item.URI = s.objectUrl(item.Bucket, blobKey)
+	return nil
+}
+
+// addBlobRef stores the item's blob, unless it's already stored, and
+// points the item's name at it, returning the blob the name pointed at
+// before
+func addBlobRef(s *Server, item *uploadItem, blobKey string) (string, error) {
+	unlock := lockBlob(item.Bucket, blobKey)
+	defer unlock()
+	if !s.Storage.Exists(item.Bucket, blobKey) {
+		err := s.Storage.Put(item.Bucket, blobKey, item.Body, item.ContentType)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		debugf("Blob %s already in s3\n", blobKey)
+	}
+	return s.ops.AddImageRef(item.Bucket, item.DeviceID, item.FileName, blobKey)
+}
+
+// deleteImageRef removes the device's reference to an image by fileName
+// (see ReleaseImageRef), deleting the object once nothing references it.
+// It returns the keys of the objects deleted, or with dryRun the ones that
+// would be, and changes nothing.
+func (s *Server) deleteImageRef(bucketName, deviceID, key, fileName string, dryRun bool) ([]string, error) {
+	var sidecars []string
+	if strings.HasPrefix(key, blobPrefix) {
+		unlock := lockBlob(bucketName, key)
+		defer unlock()
+		ref, remaining, err := s.ops.ReleaseImageRef(bucketName, deviceID, fileName, key, dryRun)
+		if err != nil {
+			return []string{}, err
+		}
+		sidecars = s.imageMetaKeys(bucketName, ref.DeviceID, key, ref.FileName)
+		if remaining > 0 {
+			return s.deleteImageMeta(bucketName, sidecars, dryRun), nil
+		}
+	} else {
+		sidecars = s.imageMetaKeys(bucketName, deviceID, key, "")
+	}
+	if dryRun {
+		return append([]string{key}, sidecars...), nil
+	}
+	if err := s.Storage.Delete(bucketName, key); err != nil {
+		return nil, err
+	}
+	return append([]string{key}, s.deleteImageMeta(bucketName, sidecars, dryRun)...), nil
+}
+
+// deviceImages maps each of the device's image file names in the bucket to
+// its key, whether it was stored before or after content addressing
+func (s *Server) deviceImages(bucketName, deviceID string) (map[string]string, error) {
+	keys, err := s.Storage.List(bucketName, deviceID+"/")
+	if err != nil {
+		return nil, err
+	}
+	images, err := s.ops.DeviceImageRefs(bucketName, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		images[strings.TrimPrefix(key, deviceID+"/")] = key
+	}
+	return images, nil
+}
+
+// ownsBlob reports whether the device references a blob in the bucket
+func (s *Server) ownsBlob(bucketName, deviceID, blobKey string) bool {
+	names, err := s.ops.BlobImageNames(bucketName, deviceID, blobKey)
+	if err != nil {
+		log.Printf("Error finding the names of %s for %s: %v\n", blobKey, deviceID, err)
+	}
+	return len(names) > 0
+}
+
+// imageName is the file name a device knows an image key in the bucket by
+func (s *Server) imageName(bucketName, deviceID, key string) string {
+	if strings.HasPrefix(key, blobPrefix) {
+		names, err := s.ops.BlobImageNames(bucketName, deviceID, key)
+		if err != nil {
+			log.Printf("Error finding the names of %s for %s: %v\n", key, deviceID, err)
+		}
+		if len(names) > 0 {
+			return names[0]
+		}
+	}
+	return strings.TrimPrefix(key, deviceID+"/")
+}
@@ -0,0 +1,97 @@
+package potterylog
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// exportedPhoto uploads photo for deviceID, exports it, and returns the
+// archive's URI
+func exportedPhoto(t *testing.T, h *testHarness, deviceID string, photo []byte) string {
+	t.Helper()
+	var uploaded struct {
+		Key string `json:"key"`
+	}
+	postForm(t, h, "/pottery-log-images/upload", map[string]string{"deviceId": deviceID}, "image", "pot.jpg", photo, &uploaded)
+	keys, _ := json.Marshal([]string{uploaded.Key})
+	var started struct {
+		ExportID string `json:"export_id"`
+	}
+	postForm(t, h, "/pottery-log/export", map[string]string{
+		"deviceId":  deviceID,
+		"metadata":  `{"pots":[{"id":"1","images3":["pot.jpg"]}]}`,
+		"imageKeys": string(keys),
+	}, "", "", nil, &started)
+	resp, err := http.PostForm(h.Server.URL+"/pottery-log/finish-export", url.Values{
+		"deviceId": {deviceID},
+		"exportId": {started.ExportID},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var finished struct {
+		URI string `json:"uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&finished); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("finish export: got %s, %v", resp.Status, err)
+	}
+	return finished.URI
+}
+
+func TestImportedImagesAreContentAddressed(t *testing.T) {
+	h, err := newTestHarness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	c := *h.srv.config()
+	c.ContentAddressedImages = true
+	h.srv.setConfig(&c)
+
+	var photo bytes.Buffer
+	if err := jpeg.Encode(&photo, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	archive := exportedPhoto(t, h, "device1", photo.Bytes())
+
+	// Two devices restore the same export, so they share one blob
+	bucket := defaultTenant.importBucket()
+	uris := make(map[string]string)
+	for _, deviceID := range []string{"device2", "device3"} {
+		var imported importResponse
+		postForm(t, h, "/pottery-log/import", map[string]string{"deviceId": deviceID, "importURL": archive}, "", "", nil, &imported)
+		if len(imported.ImageMap) != 1 {
+			t.Fatalf("import for %s: got images %v, want 1", deviceID, imported.ImageMap)
+		}
+		for _, uri := range imported.ImageMap {
+			key, ok := h.Storage.Key(bucket, uri)
+			if !ok || !strings.HasPrefix(key, blobPrefix) {
+				t.Fatalf("import for %s stored %s, not a blob in the import bucket", deviceID, uri)
+			}
+			uris[deviceID] = uri
+		}
+	}
+	if uris["device2"] != uris["device3"] {
+		t.Fatalf("the same image was stored twice: %s and %s", uris["device2"], uris["device3"])
+	}
+	blobKey, _ := h.Storage.Key(bucket, uris["device2"])
+
+	var deleted struct {
+		Status string `json:"status"`
+	}
+	postForm(t, h, "/pottery-log-images/delete", map[string]string{"deviceId": "device2", "uri": uris["device2"]}, "", "", nil, &deleted)
+	if !h.Storage.Exists(bucket, blobKey) {
+		t.Fatal("deleting one device's import removed the blob the other still uses")
+	}
+	postForm(t, h, "/pottery-log-images/delete", map[string]string{"deviceId": "device3", "uri": uris["device3"]}, "", "", nil, &deleted)
+	if h.Storage.Exists(bucket, blobKey) {
+		t.Error("the blob is still stored after the last reference was deleted")
+	}
+}
@@ -0,0 +1,88 @@
+package potterylog
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// The app reports its own errors and crashes to /pottery-log/client-event,
+// and they go to the event sink like the server's, as client-error and
+// client-crash events, so client and server problems end up in one place.
+// An error from a failed request can carry that response's X-Request-Id,
+// which ties it to the server's server-error event and log lines.
+
+// clientEventsPerMinute is how many events a device may report a minute,
+// so an app stuck in a loop can't flood analytics
+const clientEventsPerMinute = 30
+
+var errClientEventsRateLimited = newAPIError("client_events_rate_limited", "Too many client events. Please slow down.")
+
+var clientEventKindPattern = regexp.MustCompile(`^(error|crash)$`)
+
+var (
+	clientEventKindField      = field{Name: "kind", Required: true, Pattern: clientEventKindPattern}
+	clientEventMessageField   = field{Name: "message", Required: true, MaxLen: 1000}
+	clientEventStackField     = field{Name: "stack", MaxLen: 8000}
+	clientEventScreenField    = field{Name: "screen", MaxLen: 100}
+	clientEventRequestIDField = field{Name: "requestId", MaxLen: 128, Pattern: validIDPattern}
+	// context is a JSON object of strings, like {"potId": "..."}
+	clientEventContextField = field{Name: "context", MaxLen: 4000}
+)
+
+// ClientErrorEvent is an error or crash the app reported. Its type is
+// client-error or client-crash, by Kind.
+type ClientErrorEvent struct {
+	Kind      string            `json:"kind"`
+	Message   string            `json:"message"`
+	Stack     string            `json:"stack,omitempty"`
+	Screen    string            `json:"screen,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+	Context   map[string]string `json:"context,omitempty"`
+	Source    string            `json:"source"`
+}
+
+func (e ClientErrorEvent) eventType() string { return "client-" + e.Kind }
+
+// ClientEvent records an error (kind=error) or crash (kind=crash) the app
+// ran into, with its message and optionally its stack, the screen it was
+// on, the requestId of a failed request, and a context object
+func (s *Server) ClientEvent(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		s.handleErrCode(errMethodNotAllowed, http.StatusMethodNotAllowed, req.FormValue("deviceId"), w)
+		return
+	}
+	if !s.validateForm(w, req, deviceIDField, clientEventKindField, clientEventMessageField, clientEventStackField,
+		clientEventScreenField, clientEventRequestIDField, clientEventContextField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	e := ClientErrorEvent{
+		Kind:      req.FormValue("kind"),
+		Message:   req.FormValue("message"),
+		Stack:     req.FormValue("stack"),
+		Screen:    req.FormValue("screen"),
+		RequestID: req.FormValue("requestId"),
+		Source:    "client",
+	}
+	if c := req.FormValue("context"); c != "" {
+		if err := json.Unmarshal([]byte(c), &e.Context); err != nil {
+			s.handleErrCode(errInvalidField("context"), http.StatusBadRequest, deviceID, w)
+			return
+		}
+	}
+	// The API key limiter's buckets work for any key
+	if ok, retryAfter := s.allowAPIKeyRequest("client-events:"+deviceID, clientEventsPerMinute); !ok {
+		s.tooBusy(w, errClientEventsRateLimited, deviceID, retryAfter+time.Second)
+		return
+	}
+	if e.Kind == "crash" {
+		log.Printf("Device %s reported a crash: %s\n", deviceID, e.Message)
+	} else {
+		debugf("Device %s reported an error: %s\n", deviceID, e.Message)
+	}
+	s.logEvent(deviceID, e)
+	w.Write(okResponse())
+}
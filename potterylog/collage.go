@@ -0,0 +1,146 @@
+package potterylog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	_ "image/png"
+	"net/http"
+)
+
+const (
+	collageTileSize  = 600
+	collageGap       = 12
+	collageMaxImages = 6
+)
+
+// Collage serves POST /v2/pots/<id>/collage. It lays the pot's photos out
+// in their display order (throwing, trimming, glazing, fired...) in a
+// single image, uploads it, and returns the URI.
+func (s *Server) Collage(w http.ResponseWriter, req *http.Request, deviceID, library, potID string) {
+	if req.Method != http.MethodPost {
+		s.handleErrCode(errMethodNotAllowed, http.StatusMethodNotAllowed, deviceID, w)
+		return
+	}
+	p, err := s.pots.Get(library, potID)
+	if s.handlePotErr(err, deviceID, w) {
+		return
+	}
+	if len(p.Images) == 0 {
+		s.handleErrCode(errors.New("The pot has no images"), http.StatusBadRequest, deviceID, w)
+		return
+	}
+
+	keys := p.imagesCoverFirst()
+	if len(keys) > collageMaxImages {
+		keys = keys[:collageMaxImages]
+	}
+	var tiles []image.Image
+	for _, key := range keys {
+		img, err := s.downloadImage(requestTenant(req).imageBucket(), key)
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		tiles = append(tiles, fitSquare(img, collageTileSize))
+	}
+
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, composeCollage(tiles), &jpeg.Options{Quality: 85})
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+
+	fileName := fmt.Sprintf("collage-%s-%d.jpg", potID, s.Clock.Now().Unix())
+	uri, err := s.uploadFile(requestTenant(req).imageBucket(), bytes.NewReader(buf.Bytes()), fileName, "image/jpeg", deviceID)
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+
+	writeJSON(w, struct {
+		Status string `json:"status"`
+		URI    string `json:"uri"`
+	}{
+		Status: "ok",
+		URI:    uri,
+	})
+	s.logEvent(deviceID, CollageEvent{Images: len(tiles), Bytes: buf.Len()})
+}
+
+func (s *Server) downloadImage(bucketName, key string) (image.Image, error) {
+	body, _, err := s.Storage.Get(bucketName, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	img, _, err := image.Decode(body)
+	return img, err
+}
+
+// composeCollage puts square tiles in rows of up to three on a white
+// background
+func composeCollage(tiles []image.Image) image.Image {
+	cols := len(tiles)
+	if cols > 3 {
+		cols = 3
+	}
+	rows := (len(tiles) + cols - 1) / cols
+	step := collageTileSize + collageGap
+	out := image.NewRGBA(image.Rect(0, 0, cols*step+collageGap, rows*step+collageGap))
+	draw.Draw(out, out.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	for i, tile := range tiles {
+		x := collageGap + (i%cols)*step
+		y := collageGap + (i/cols)*step
+		draw.Draw(out, image.Rect(x, y, x+collageTileSize, y+collageTileSize), tile, image.Point{}, draw.Src)
+	}
+	return out
+}
+
+// fitSquare center-crops img to a square and scales it to size x size by
+// averaging the source pixels that fall in each destination pixel.
+func fitSquare(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+
+	out := image.NewRGBA(image.Rect(0, 0, size, size))
+	for dy := 0; dy < size; dy++ {
+		sy0 := y0 + dy*side/size
+		sy1 := y0 + (dy+1)*side/size
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for dx := 0; dx < size; dx++ {
+			sx0 := x0 + dx*side/size
+			sx1 := x0 + (dx+1)*side/size
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+			var r, g, bl, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, _ := img.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					bl += uint64(cb)
+					n++
+				}
+			}
+			out.SetRGBA(dx, dy, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(bl / n >> 8),
+				A: 0xff,
+			})
+		}
+	}
+	return out
+}
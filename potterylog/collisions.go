@@ -0,0 +1,124 @@
+package potterylog
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Apps name photos after the camera's file names, so two different photos
+// can arrive under one name, and storing only the first would lose the
+// second. A name that's taken by different content gets a numbered suffix
+// (pot.jpg, then pot-2.jpg, ...), which Upload reports back in fileName.
+// With onConflict=error, the upload is refused with a 409 instead, so the
+// app can rename it itself.
+
+var errFileNameTaken = newAPIError("file_name_taken", "A different image with this name has already been uploaded")
+
+var onConflictPattern = regexp.MustCompile(`^(rename|error)$`)
+
+// maxNameSuffix is how many numbered names are tried before giving up
+const maxNameSuffix = 100
+
+// suffixedName is the nth name to try for fileName, counting from 1
+func suffixedName(fileName string, n int) string {
+	if n == 1 {
+		return fileName
+	}
+	ext := path.Ext(fileName)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(fileName, ext), n, ext)
+}
+
+// nameLocks holds a lock for each device file name being stored, so two
+// uploads can't both find a name free and then both store under it
+var nameLocks = newKeyLocks()
+
+// lockName locks the device's file name in the bucket and returns the
+// function to unlock it
+func lockName(item *uploadItem, fileName string) func() {
+	return nameLocks.Lock(item.Bucket + "/" + item.DeviceID + "/" + fileName)
+}
+
+// freeName finds a name for the item that is either unused or already
+// holds the same content, according to taken. The bool is whether the
+// content is already stored under that name. The name stays locked until
+// the returned function is called, once the item is stored.
+func freeName(item *uploadItem, taken func(fileName string) (same bool, used bool, err error)) (string, bool, func(), error) {
+	if item.Replace {
+		unlock := lockName(item, item.FileName)
+		same, _, err := taken(item.FileName)
+		if err != nil {
+			unlock()
+			return "", false, nil, err
+		}
+		return item.FileName, same, unlock, nil
+	}
+	for n := 1; n <= maxNameSuffix; n++ {
+		fileName := suffixedName(item.FileName, n)
+		unlock := lockName(item, fileName)
+		same, used, err := taken(fileName)
+		if err != nil {
+			unlock()
+			return "", false, nil, err
+		}
+		if !used || same {
+			if n > 1 {
+				debugf("Storing %s as %s, since a different image has its name\n", item.FileName, fileName)
+			}
+			return fileName, used, unlock, nil
+		}
+		// Only one name is locked at a time, so uploads trying each
+		// other's names can't deadlock
+		unlock()
+		if item.FailOnConflict {
+			return "", false, nil, errFileNameTaken
+		}
+	}
+	return "", false, nil, errFileNameTaken
+}
+
+// sameObject reports whether the stored object has the item's content,
+// going by size and, when the ETag is a plain MD5, the checksum. Objects
+// from multipart uploads are read back to compare.
+func sameObject(s *Server, item *uploadItem, info ObjectInfo) (bool, error) {
+	if info.Size != item.Size {
+		return false, nil
+	}
+	sum, err := bodyMD5(item)
+	if err != nil {
+		return false, err
+	}
+	return s.objectHasMD5(item.Bucket, info, sum)
+}
+
+// objectHasMD5 reports whether the stored object's hex MD5 is sum
+func (s *Server) objectHasMD5(bucketName string, info ObjectInfo, sum string) (bool, error) {
+	if !strings.Contains(info.ETag, "-") {
+		return sum == info.ETag, nil
+	}
+	obj, err := s.Storage.Fetch(bucketName, info.Key, FetchConditions{})
+	if err != nil {
+		return false, err
+	}
+	defer obj.Body.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, obj.Body); err != nil {
+		return false, err
+	}
+	return sum == hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func bodyMD5(item *uploadItem) (string, error) {
+	hash := md5.New()
+	if _, err := io.Copy(hash, item.Body); err != nil {
+		return "", err
+	}
+	if _, err := item.Body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
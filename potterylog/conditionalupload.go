@@ -0,0 +1,112 @@
+package potterylog
+
+import (
+	"net/http"
+	"strings"
+)
+
+// When the app re-syncs its library it would otherwise upload every photo
+// again. A conditional upload sends If-None-Match with the etag Upload
+// returned for the stored image, and the file name in the query. If the
+// image stored under that name still has that etag, the server answers 304
+// Not Modified before reading the request body, so a client that sends
+// Expect: 100-continue never sends the image at all. Otherwise the upload
+// replaces the stored image under that name, rather than taking a suffixed
+// name, and returns the new etag. Since it can overwrite the device's
+// photos, a conditional upload needs the device token, sent as a bearer
+// token or in the query, and the query's deviceId and fileName are the
+// ones used: the form can repeat them but can't name others.
+
+// conditional wraps Upload to answer conditional uploads of unchanged
+// images. It only looks at the URL, so it has to come before anything that
+// reads the form.
+func (s *Server) conditional(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		match := req.Header.Get("If-None-Match")
+		if match == "" {
+			handler(w, req)
+			return
+		}
+		query := req.URL.Query()
+		deviceID := query.Get("deviceId")
+		fileName := query.Get("fileName")
+		if !validIDPattern.MatchString(deviceID) {
+			s.handleErrCode(errInvalidDeviceID, http.StatusBadRequest, "", w)
+			return
+		}
+		if fileName == "" {
+			s.handleErrCode(errMissingField("fileName"), http.StatusBadRequest, deviceID, w)
+			return
+		}
+		if len(fileName) > 255 || !fileNamePattern.MatchString(fileName) || strings.HasPrefix(fileName, ".") {
+			s.handleErrCode(errInvalidField("fileName"), http.StatusBadRequest, deviceID, w)
+			return
+		}
+		if !s.deviceAuthorizedBeforeForm(req, deviceID) {
+			s.handleErrCode(errDeviceUnauthorized, http.StatusUnauthorized, deviceID, w)
+			return
+		}
+		etag, err := s.storedImageETag(requestTenant(req).imageBucket(), deviceID, fileName)
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		if etag != "" && etagMatches(match, etag) {
+			s.counters.Incr("upload-unchanged")
+			w.Header().Set("ETag", `"`+etag+`"`)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		handler(w, req)
+	}
+}
+
+// conditionalTarget is the device and file name a conditional upload
+// replaces, from the query. It handles the error and returns false if the
+// form names a different one, or the request doesn't have the device's
+// token.
+func (s *Server) conditionalTarget(w http.ResponseWriter, req *http.Request) (string, string, bool) {
+	query := req.URL.Query()
+	deviceID, fileName := query.Get("deviceId"), query.Get("fileName")
+	for _, name := range []string{"deviceId", "fileName"} {
+		if values, ok := req.PostForm[name]; ok && (len(values) != 1 || values[0] != query.Get(name)) {
+			s.handleErrCode(errInvalidField(name), http.StatusBadRequest, deviceID, w)
+			return "", "", false
+		}
+	}
+	if !s.requireDevice(w, req, deviceID) {
+		return "", "", false
+	}
+	return deviceID, fileName, true
+}
+
+// storedImageETag is the etag of the device's image in the bucket named
+// fileName, or "" if there isn't one. An image that was recompressed when it was stored
+// has a .webp suffix on its name.
+func (s *Server) storedImageETag(bucketName, deviceID, fileName string) (string, error) {
+	for _, name := range []string{fileName, fileName + ".webp"} {
+		key := deviceID + "/" + name
+		if blobKey, ok := s.ops.ImageRef(bucketName, deviceID, name); ok {
+			key = blobKey
+		}
+		info, err := s.Storage.Head(bucketName, key)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return info.ETag, nil
+	}
+	return "", nil
+}
+
+// etagMatches is whether an If-None-Match header lists etag, or is "*"
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || strings.Trim(candidate, `"`) == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package potterylog
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// unreadBody fails the test if the handler reads it
+type unreadBody struct {
+	t *testing.T
+}
+
+func (b unreadBody) Read(p []byte) (int, error) {
+	b.t.Error("the body of a matching conditional upload was read")
+	return 0, errors.New("unreadBody read")
+}
+
+func TestConditionalUploadSkipsBody(t *testing.T) {
+	h, err := newTestHarness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("deviceId", "device1")
+	part, err := form.CreateFormFile("image", "pot.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("\xff\xd8\xff\xe0 a pot"))
+	form.Close()
+	resp, err := http.Post(h.Server.URL+"/pottery-log-images/upload", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("upload: got %s with ETag %q", resp.Status, etag)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/pottery-log-images/upload?deviceId=device1&fileName=pot.jpg", unreadBody{t})
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("If-None-Match", etag)
+	rec := httptest.NewRecorder()
+	h.Server.Config.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("conditional upload: got %d, want 304", rec.Code)
+	}
+	if got := rec.Header().Get("ETag"); got != etag {
+		t.Errorf("conditional upload: got ETag %q, want %q", got, etag)
+	}
+}
+
+// conditionalUpload sends image as a conditional upload replacing fileName,
+// with the form's own deviceId, and the token if it isn't empty
+func conditionalUpload(t *testing.T, h *testHarness, queryDevice, formDevice, fileName, token string, image []byte) *http.Response {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("deviceId", formDevice)
+	part, err := form.CreateFormFile("image", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(image)
+	form.Close()
+	req, err := http.NewRequest(http.MethodPost, h.Server.URL+"/pottery-log-images/upload?deviceId="+queryDevice+"&fileName="+fileName, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("If-None-Match", `"not-the-stored-etag"`)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestConditionalUploadNeedsDeviceToken(t *testing.T) {
+	h, err := newTestHarness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	var registered struct {
+		DeviceToken string `json:"device_token"`
+	}
+	postForm(t, h, "/pottery-log/register-device", map[string]string{"deviceId": "device1"}, "", "", nil, &registered)
+	original := []byte("\xff\xd8\xff\xe0 the original")
+	var uploaded struct {
+		Key string `json:"key"`
+	}
+	postForm(t, h, "/pottery-log-images/upload", map[string]string{"deviceId": "device1", "deviceToken": registered.DeviceToken}, "image", "pot.jpg", original, &uploaded)
+
+	resp := conditionalUpload(t, h, "device1", "device1", "pot.jpg", "", []byte("\xff\xd8\xff\xe0 a replacement"))
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("replace without the token: got %s, want 401", resp.Status)
+	}
+	resp = conditionalUpload(t, h, "device1", "device1", "pot.jpg", "wrong-token", []byte("\xff\xd8\xff\xe0 a replacement"))
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("replace with the wrong token: got %s, want 401", resp.Status)
+	}
+	if stored, err := h.Storage.get(defaultTenant.imageBucket(), uploaded.Key); err != nil || !bytes.Equal(stored.data, original) {
+		t.Fatalf("the stored image changed after unauthorized replaces (err %v)", err)
+	}
+
+	resp = conditionalUpload(t, h, "device1", "device1", "pot.jpg", registered.DeviceToken, []byte("\xff\xd8\xff\xe0 a replacement"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("replace with the token: got %s", resp.Status)
+	}
+	if stored, err := h.Storage.get(defaultTenant.imageBucket(), uploaded.Key); err != nil || bytes.Equal(stored.data, original) {
+		t.Errorf("the authorized replace didn't replace the image (err %v)", err)
+	}
+}
+
+func TestConditionalUploadQueryAndFormMustAgree(t *testing.T) {
+	h, err := newTestHarness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	resp := conditionalUpload(t, h, "device1", "device2", "pot.jpg", "", []byte("\xff\xd8\xff\xe0 a pot"))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("query and form devices differ: got %s, want 400", resp.Status)
+	}
+	if keys, _ := h.Storage.List(defaultTenant.imageBucket(), ""); len(keys) > 0 {
+		t.Errorf("stored %v for a rejected upload", keys)
+	}
+}
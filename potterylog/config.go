@@ -0,0 +1,217 @@
+package potterylog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"log/syslog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// config is the optional JSON file passed with -config. Everything in it has
+// a sensible zero value so the server runs without one.
+type config struct {
+	FeatureFlags map[string]featureFlag `json:"feature_flags"`
+
+	// Caps on exports in progress; 0 means no limit
+	MaxExports          int `json:"max_exports"`
+	MaxExportsPerDevice int `json:"max_exports_per_device"`
+
+	// Cap on simultaneous S3 uploads from Upload and Import; 0 means no
+	// limit. Requests wait up to UploadQueueSeconds for a slot.
+	MaxUploads         int `json:"max_uploads"`
+	UploadQueueSeconds int `json:"upload_queue_seconds"`
+
+	// Caps on simultaneous requests to an endpoint, by path (see
+	// endpointlimits.go)
+	EndpointLimits map[string]endpointLimit `json:"endpoint_limits"`
+
+	// Cap on memory held in request buffers, in MB; 0 means no limit (see
+	// memorybudget.go)
+	MemoryBudgetMB int64 `json:"memory_budget_mb"`
+	// How much of a multipart form is kept in memory before the rest
+	// spills to disk, in MB; default 32 (see formspill.go)
+	FormMemoryMB int64 `json:"form_memory_mb"`
+
+	// How long Import may spend downloading an importURL, and how big it
+	// may be; 0 means no limit
+	ImportDownloadSeconds int   `json:"import_download_seconds"`
+	MaxImportBytes        int64 `json:"max_import_bytes"`
+
+	// Where importURL may point, and how much each client may import from
+	// links (see importabuse.go)
+	ImportURL importURLConfig `json:"import_url"`
+
+	// The canned ACL for each bucket's objects: "none", "private", or
+	// "public-read", the default (see bucketacl.go)
+	BucketACLs map[string]string `json:"bucket_acls"`
+
+	// Finished exports are deleted after this many days; 0 keeps them
+	// until the user deletes them
+	ExportRetentionDays int `json:"export_retention_days"`
+	// "direct" answers finish-export with the archive instead of storing
+	// it in the exports bucket (see exportdownload.go)
+	ExportDelivery string `json:"export_delivery"`
+
+	// Limits on fetching images by URL (see uploadfromurl.go)
+	UploadFromURL uploadFromURLConfig `json:"upload_from_url"`
+
+	// Studio webhooks for pot status changes (see potwebhooks.go)
+	PotWebhooks potWebhookConfig `json:"pot_webhooks"`
+
+	// Device webhooks for stored and deleted images (see imagewebhooks.go)
+	ImageWebhooks imageWebhookConfig `json:"image_webhooks"`
+
+	// Keys for third-party use of the v2 API (see apikeys.go)
+	APIKeys apiKeyConfig `json:"api_keys"`
+
+	// How clients are given stored objects' URLs: public, presigned, cdn,
+	// or proxy (see urlsigner.go)
+	ObjectURLs objectURLConfig `json:"object_urls"`
+	signer     urlSigner
+
+	// Store new uploads once per distinct content (see cas.go)
+	ContentAddressedImages bool `json:"content_addressed_images"`
+
+	// If set, reloading the config turns maintenance mode on or off
+	Maintenance        *bool  `json:"maintenance"`
+	MaintenanceMessage string `json:"maintenance_message"`
+
+	// "debug" adds chatty per-file logs; anything else is the default
+	LogLevel string `json:"log_level"`
+	// "syslog" or "journald" logs there instead of stderr or -log-file,
+	// and syslog_address sends them to a remote syslog (see logoutput.go)
+	LogOutput     string `json:"log_output"`
+	SyslogAddress string `json:"syslog_address"`
+
+	// Store large uploads as WebP (see recompress.go)
+	Recompress recompressConfig `json:"recompress"`
+
+	// Reminders for devices that haven't exported in a while (see
+	// backupreminder.go)
+	BackupReminder backupReminderConfig `json:"backup_reminder"`
+
+	// A daily activity summary for the operator (see summary.go)
+	UsageSummary usageSummaryConfig `json:"usage_summary"`
+
+	// Where notifications go (see notify.go)
+	Notifiers []notifierConfig `json:"notifiers"`
+	// Warn a device whose uploads over 30 days pass this many bytes; 0
+	// turns the warning off
+	QuotaWarningBytes int64 `json:"quota_warning_bytes"`
+
+	// Other app deployments served by this process (see tenant.go)
+	Tenants []tenant `json:"tenants"`
+
+	// Automatic temporary bans for clients that keep getting 429s
+	Abuse abuseConfig `json:"abuse"`
+
+	// Play Integrity / DeviceCheck checks on Upload and Import
+	Attestation attestationConfig `json:"attestation"`
+
+	// Operator credentials for the admin port (see auth.go)
+	AdminCredentials []adminCredential `json:"admin_credentials"`
+
+	// Only used when running with -fault_injection
+	FaultInjection []faultRule `json:"fault_injection"`
+}
+
+func loadConfig(path string) (*config, error) {
+	c := &config{
+		UploadQueueSeconds:    5,
+		ImportDownloadSeconds: 600,
+		ImportURL:             importURLConfig{WindowSeconds: 3600},
+	}
+	if path == "" {
+		return c, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	if err := validateBucketACLs(c); err != nil {
+		return nil, err
+	}
+	if err := validateExportDelivery(c); err != nil {
+		return nil, err
+	}
+	if err := validateTenants(c); err != nil {
+		return nil, err
+	}
+	if c.signer, err = newURLSigner(c.ObjectURLs); err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded config from %s\n", path)
+	return c, nil
+}
+
+// reloadConfig rereads the config file. Requests already in progress keep
+// the config they started with.
+func (s *Server) reloadConfig() error {
+	c, err := loadConfig(s.configPath)
+	if err != nil {
+		return err
+	}
+	if err := applyLogOutput(c); err != nil {
+		return err
+	}
+	s.setConfig(c)
+	if c.Maintenance != nil {
+		s.setMaintenance(*c.Maintenance)
+	}
+	return nil
+}
+
+func (s *Server) reloadConfigOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		if err := s.reloadConfig(); err != nil {
+			log.Printf("Error reloading config, keeping the old one: %v\n", err)
+		}
+	}
+}
+
+// ReloadConfig rereads the config file, like SIGHUP. It only takes POST,
+// so a viewer credential can't use it.
+func (s *Server) ReloadConfig(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if s.handleErr(s.reloadConfig(), "", w) {
+		return
+	}
+	w.Write(okResponse())
+}
+
+// debugLogging is whether the config's log_level is "debug"
+var debugLogging atomic.Bool
+
+// useProcessConfig applies the settings that belong to the process rather
+// than to a server, which is only the log level. Whichever config was
+// loaded last sets it.
+func useProcessConfig(c *config) {
+	debugLogging.Store(c.LogLevel == "debug")
+}
+
+// applyConfig applies the settings that aren't read from the config on
+// each use
+func (s *Server) applyConfig(c *config) {
+	useProcessConfig(c)
+	s.memory.SetLimit(c.MemoryBudgetMB << 20)
+}
+
+// debugf logs only when log_level is "debug"
+func debugf(format string, v ...interface{}) {
+	if debugLogging.Load() {
+		logAt(syslog.LOG_DEBUG, format, v...)
+	}
+}
@@ -0,0 +1,71 @@
+package potterylog
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// counterSet keeps in-process event counts, independent of Amplitude, so a
+// small deployment can be inspected with curl.
+type counterSet struct {
+	mu      sync.Mutex
+	started time.Time
+	counts  map[string]int64
+}
+
+// NewCounters sets up an empty set of counters
+func NewCounters() *counterSet {
+	return &counterSet{
+		mu:      sync.Mutex{},
+		started: time.Now(),
+		counts:  make(map[string]int64),
+	}
+}
+
+func (c *counterSet) Incr(name string) {
+	c.Add(name, 1)
+}
+
+func (c *counterSet) Add(name string, n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[name] += n
+}
+
+func (c *counterSet) Snapshot() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	snapshot := make(map[string]int64, len(c.counts))
+	for name, count := range c.counts {
+		snapshot[name] = count
+	}
+	return snapshot
+}
+
+// errorType buckets an error for the errors-by-type counters
+func errorType(err error) string {
+	if awserr, ok := err.(awserr.Error); ok {
+		return "aws-" + awserr.Code()
+	}
+	return "other"
+}
+
+func (s *Server) Stats(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, struct {
+		Status        string           `json:"status"`
+		Started       time.Time        `json:"started"`
+		UptimeSeconds int64            `json:"uptime_seconds"`
+		Counters      map[string]int64 `json:"counters"`
+		Analytics     deliveryGauges   `json:"analytics"`
+	}{
+		Status:        "ok",
+		Started:       s.counters.started,
+		UptimeSeconds: int64(time.Since(s.counters.started).Seconds()),
+		Counters:      s.counters.Snapshot(),
+		Analytics:     s.amplitude.Gauges(),
+	})
+}
@@ -0,0 +1,1383 @@
+package potterylog
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// opsDB is the operational database: export sessions and history, usage
+// for quotas, the admin audit log, and idempotency keys. It's SQLite in
+// -data_dir by default, so state that used to live only in memory survives
+// restarts. Larger deployments can point -db at Postgres so that several
+// replicas share it. Queries are written for SQLite and rewritten for
+// Postgres by rebind.
+type opsDB struct {
+	db       *sql.DB
+	postgres bool
+	// server names this process in export_sessions, since with Postgres
+	// other replicas' sessions are in the same table
+	server string
+	// clock timestamps rows
+	clock Clock
+}
+
+// migrations run in order, once each. Only ever append to this list.
+var migrations = []string{
+	`CREATE TABLE export_sessions (
+		id TEXT PRIMARY KEY,
+		device_id TEXT NOT NULL,
+		tenant TEXT NOT NULL,
+		location TEXT NOT NULL,
+		status TEXT NOT NULL,
+		started_at BIGINT NOT NULL,
+		ended_at BIGINT
+	)`,
+	`CREATE TABLE export_history (
+		device_id TEXT NOT NULL,
+		tenant TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		uri TEXT NOT NULL,
+		bytes BIGINT NOT NULL,
+		finished_at BIGINT NOT NULL
+	)`,
+	`CREATE INDEX export_history_device ON export_history (device_id, finished_at)`,
+	`CREATE TABLE usage (
+		tenant TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		day TEXT NOT NULL,
+		metric TEXT NOT NULL,
+		amount BIGINT NOT NULL,
+		PRIMARY KEY (tenant, device_id, day, metric)
+	)`,
+	`CREATE TABLE audit_log (
+		at BIGINT NOT NULL,
+		actor TEXT NOT NULL,
+		action TEXT NOT NULL,
+		detail TEXT NOT NULL
+	)`,
+	`CREATE TABLE idempotency_keys (
+		key TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		path TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		response BLOB NOT NULL,
+		created_at BIGINT NOT NULL,
+		PRIMARY KEY (key, device_id)
+	)`,
+	`ALTER TABLE export_sessions ADD COLUMN server TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE job_runs (
+		job TEXT NOT NULL,
+		server TEXT NOT NULL,
+		started_at BIGINT NOT NULL,
+		duration_ms BIGINT NOT NULL,
+		ok BOOLEAN NOT NULL,
+		error TEXT NOT NULL,
+		log TEXT NOT NULL
+	)`,
+	`CREATE INDEX job_runs_job ON job_runs (job, started_at)`,
+	`CREATE TABLE device_settings (
+		device_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (device_id, name)
+	)`,
+	`CREATE TABLE kept_originals (
+		bucket TEXT NOT NULL,
+		key TEXT NOT NULL,
+		delete_after BIGINT NOT NULL,
+		PRIMARY KEY (bucket, key)
+	)`,
+	`ALTER TABLE export_history ADD COLUMN id TEXT`,
+	`CREATE UNIQUE INDEX export_history_id ON export_history (id)`,
+	`CREATE TABLE import_results (
+		device_id TEXT NOT NULL,
+		archive_hash TEXT NOT NULL,
+		response BLOB NOT NULL,
+		created_at BIGINT NOT NULL,
+		PRIMARY KEY (device_id, archive_hash)
+	)`,
+	`CREATE TABLE escrowed_keys (
+		device_id TEXT NOT NULL,
+		key_id TEXT NOT NULL,
+		wrapped_key TEXT NOT NULL,
+		salt TEXT NOT NULL,
+		kdf TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		PRIMARY KEY (device_id, key_id)
+	)`,
+	`CREATE TABLE pot_webhooks (
+		id TEXT PRIMARY KEY,
+		library TEXT NOT NULL,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		statuses TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		last_delivery_at BIGINT,
+		last_result TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX pot_webhooks_library ON pot_webhooks (library)`,
+	`CREATE TABLE calendar_feeds (
+		device_id TEXT PRIMARY KEY,
+		token_sha256 TEXT NOT NULL UNIQUE,
+		created_at BIGINT NOT NULL
+	)`,
+	`CREATE TABLE share_feeds (
+		id TEXT PRIMARY KEY,
+		library TEXT NOT NULL UNIQUE,
+		title TEXT NOT NULL,
+		created_at BIGINT NOT NULL
+	)`,
+	`CREATE TABLE api_keys (
+		id TEXT PRIMARY KEY,
+		device_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		token_sha256 TEXT NOT NULL UNIQUE,
+		scope TEXT NOT NULL,
+		requests_per_minute INTEGER NOT NULL DEFAULT 0,
+		requests_per_day INTEGER NOT NULL DEFAULT 0,
+		day TEXT NOT NULL DEFAULT '',
+		requests_today INTEGER NOT NULL DEFAULT 0,
+		requests_total BIGINT NOT NULL DEFAULT 0,
+		created_at BIGINT NOT NULL,
+		last_used_at BIGINT
+	)`,
+	`CREATE INDEX api_keys_device ON api_keys (device_id)`,
+	`ALTER TABLE job_runs ADD COLUMN dry_run BOOLEAN NOT NULL DEFAULT FALSE`,
+	`CREATE TABLE debug_logs (
+		id TEXT PRIMARY KEY,
+		device_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		app_ownership TEXT NOT NULL,
+		path TEXT NOT NULL,
+		bytes BIGINT NOT NULL,
+		created_at BIGINT NOT NULL
+	)`,
+	`CREATE INDEX debug_logs_device ON debug_logs (device_id, created_at)`,
+	`CREATE TABLE image_webhooks (
+		id TEXT PRIMARY KEY,
+		device_id TEXT NOT NULL,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		last_delivery_at BIGINT,
+		last_result TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX image_webhooks_device ON image_webhooks (device_id)`,
+	`CREATE TABLE image_refs (
+		bucket TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		file_name TEXT NOT NULL,
+		blob_key TEXT NOT NULL,
+		PRIMARY KEY (bucket, device_id, file_name)
+	)`,
+	`CREATE INDEX image_refs_blob ON image_refs (bucket, blob_key)`,
+	`CREATE TABLE job_leases (
+		job TEXT PRIMARY KEY,
+		server TEXT NOT NULL,
+		expires_at BIGINT NOT NULL
+	)`,
+	// The search index (see search.go), with a Postgres version below
+	`CREATE VIRTUAL TABLE pot_search USING fts5(
+		library UNINDEXED, pot_id UNINDEXED, title, glaze, clay, status, notes, years,
+		prefix = '2 3'
+	)`,
+}
+
+// postgresMigrations replace migrations by version on Postgres, where
+// SQLite's syntax won't do
+var postgresMigrations = map[int]string{
+	30: `CREATE TABLE pot_search (
+		library TEXT NOT NULL,
+		pot_id TEXT NOT NULL,
+		document TSVECTOR NOT NULL,
+		PRIMARY KEY (library, pot_id)
+	);
+	CREATE INDEX pot_search_document ON pot_search USING GIN (document)`,
+}
+
+// OpenOpsDB opens the database and brings its schema up to date. location
+// is a SQLite file path or a postgres:// URL. Rows are timestamped by
+// clock.
+func OpenOpsDB(location string, clock Clock) (*opsDB, error) {
+	o := &opsDB{clock: clock}
+	o.server, _ = os.Hostname()
+
+	var err error
+	if strings.HasPrefix(location, "postgres://") || strings.HasPrefix(location, "postgresql://") {
+		o.postgres = true
+		o.db, err = sql.Open("postgres", location)
+	} else {
+		o.db, err = sql.Open("sqlite", "file:"+location+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !o.postgres {
+		// One connection, since SQLite allows one writer at a time anyway
+		o.db.SetMaxOpenConns(1)
+	}
+	if err := o.migrate(); err != nil {
+		o.db.Close()
+		return nil, err
+	}
+	return o, nil
+}
+
+// migrate applies pending migrations in one transaction. On Postgres it
+// locks schema_migrations first, so replicas starting together take turns.
+func (o *opsDB) migrate() error {
+	if _, err := o.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	tx, err := o.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if o.postgres {
+		if _, err := tx.Exec(`LOCK TABLE schema_migrations IN EXCLUSIVE MODE`); err != nil {
+			return err
+		}
+	}
+	var applied int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied); err != nil {
+		return err
+	}
+	for version := applied; version < len(migrations); version++ {
+		migration := migrations[version]
+		if replacement, ok := postgresMigrations[version+1]; ok && o.postgres {
+			migration = replacement
+		}
+		if _, err := tx.Exec(o.rebind(migration)); err != nil {
+			return fmt.Errorf("migration %d: %v", version+1, err)
+		}
+		if _, err := tx.Exec(o.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), version+1); err != nil {
+			return err
+		}
+		log.Printf("Applying database migration %d\n", version+1)
+	}
+	return tx.Commit()
+}
+
+// rebind adapts a SQLite query for Postgres, which numbers its
+// placeholders and calls BLOB BYTEA
+func (o *opsDB) rebind(query string) string {
+	if !o.postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return strings.ReplaceAll(b.String(), " BLOB ", " BYTEA ")
+}
+
+func (o *opsDB) queryRow(query string, args ...interface{}) *sql.Row {
+	return o.db.QueryRow(o.rebind(query), args...)
+}
+
+func (o *opsDB) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return o.db.Query(o.rebind(query), args...)
+}
+
+// exec runs a statement, logging rather than returning errors, for
+// bookkeeping that shouldn't fail the request it's part of
+func (o *opsDB) exec(query string, args ...interface{}) {
+	if _, err := o.db.Exec(o.rebind(query), args...); err != nil {
+		log.Printf("Database error: %v\n", err)
+	}
+}
+
+func (o *opsDB) ExportStarted(exp *export) {
+	o.exec(`INSERT INTO export_sessions (id, device_id, tenant, location, status, started_at, server) VALUES (?, ?, ?, ?, 'active', ?, ?)`,
+		exp.id, exp.deviceID, exp.tenant, exp.f.Name(), o.clock.Now().Unix(), o.server)
+}
+
+// ExportEnded marks the session "finished", "abandoned", or "failed"
+func (o *opsDB) ExportEnded(exp *export, status string) {
+	o.exec(`UPDATE export_sessions SET status = ?, ended_at = ? WHERE id = ?`, status, o.clock.Now().Unix(), exp.id)
+}
+
+// AbandonExports cleans up after this server's sessions that were still
+// active when it last stopped, deleting their partial archives
+func (o *opsDB) AbandonExports() {
+	rows, err := o.query(`SELECT id, location FROM export_sessions WHERE status = 'active' AND server = ?`, o.server)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		return
+	}
+	var ids, locations []string
+	for rows.Next() {
+		var id, location string
+		if err := rows.Scan(&id, &location); err == nil {
+			ids = append(ids, id)
+			locations = append(locations, location)
+		}
+	}
+	rows.Close()
+
+	for i, id := range ids {
+		os.Remove(locations[i])
+		o.exec(`UPDATE export_sessions SET status = 'abandoned', ended_at = ? WHERE id = ?`, o.clock.Now().Unix(), id)
+	}
+	if len(ids) > 0 {
+		log.Printf("Cleaned up %d exports interrupted by the last shutdown\n", len(ids))
+	}
+}
+
+// ExportFinished records a completed export in t's import bucket, at its
+// plain storage URL (see storedURL). kind is "app" or "server".
+func (o *opsDB) ExportFinished(t *tenant, deviceID, kind, uri string, bytes int64) string {
+	id := newID()
+	o.exec(`INSERT INTO export_history (id, device_id, tenant, kind, uri, bytes, finished_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		id, deviceID, t.Name, kind, uri, bytes, o.clock.Now().Unix())
+	return id
+}
+
+// exportRecord is a row of export_history. Exports recorded before ids were
+// added have no ID.
+type exportRecord struct {
+	ID         string    `json:"id"`
+	DeviceID   string    `json:"-"`
+	Kind       string    `json:"kind"`
+	URI        string    `json:"uri"`
+	Bytes      int64     `json:"bytes"`
+	FinishedAt time.Time `json:"finished_at"`
+	// ExpiresAt is filled in for responses, from export_retention_days
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+const exportRecordColumns = `COALESCE(id, ''), device_id, kind, uri, bytes, finished_at`
+
+func scanExportRecord(row interface{ Scan(...interface{}) error }) (exportRecord, error) {
+	var rec exportRecord
+	var finished int64
+	err := row.Scan(&rec.ID, &rec.DeviceID, &rec.Kind, &rec.URI, &rec.Bytes, &finished)
+	rec.FinishedAt = time.Unix(finished, 0).UTC()
+	return rec, err
+}
+
+// ExportHistory returns the device's finished exports, newest first
+func (o *opsDB) ExportHistory(deviceID string, limit int) ([]exportRecord, error) {
+	rows, err := o.query(`SELECT `+exportRecordColumns+` FROM export_history WHERE device_id = ? ORDER BY finished_at DESC LIMIT ?`, deviceID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []exportRecord{}
+	for rows.Next() {
+		rec, err := scanExportRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// ExportsFinishedBefore returns every device's exports that finished
+// before cutoff, oldest first
+func (o *opsDB) ExportsFinishedBefore(cutoff time.Time) ([]exportRecord, error) {
+	rows, err := o.query(`SELECT `+exportRecordColumns+` FROM export_history WHERE finished_at < ? ORDER BY finished_at`, cutoff.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []exportRecord{}
+	for rows.Next() {
+		rec, err := scanExportRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// ExportRecord looks up one finished export. It returns sql.ErrNoRows if
+// there's no such export.
+func (o *opsDB) ExportRecord(id string) (exportRecord, error) {
+	return scanExportRecord(o.queryRow(`SELECT `+exportRecordColumns+` FROM export_history WHERE id = ?`, id))
+}
+
+// ExportDeleted forgets an export whose zip the device deleted
+func (o *opsDB) ExportDeleted(deviceID, uri string) {
+	o.exec(`DELETE FROM export_history WHERE device_id = ? AND uri = ?`, deviceID, uri)
+}
+
+// LatestExportRecord is the device's newest export that has an ID
+func (o *opsDB) LatestExportRecord(deviceID string) (exportRecord, error) {
+	return scanExportRecord(o.queryRow(`SELECT `+exportRecordColumns+` FROM export_history
+		WHERE device_id = ? AND id IS NOT NULL ORDER BY finished_at DESC LIMIT 1`, deviceID))
+}
+
+// staleBackup is a device that has been active since its last export
+type staleBackup struct {
+	DeviceID   string
+	LastExport *time.Time
+	LastActive time.Time
+}
+
+// StaleBackups finds devices that uploaded images after their last export,
+// where that export (or, if they never exported, their first upload) is
+// before cutoff
+func (o *opsDB) StaleBackups(cutoff time.Time) ([]staleBackup, error) {
+	rows, err := o.query(`SELECT u.device_id, MIN(u.day), MAX(u.day),
+		(SELECT MAX(h.finished_at) FROM export_history h WHERE h.device_id = u.device_id)
+		FROM usage u WHERE u.metric = 'uploads' GROUP BY u.device_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var stale []staleBackup
+	for rows.Next() {
+		var deviceID, firstDay, lastDay string
+		var lastExport sql.NullInt64
+		if err := rows.Scan(&deviceID, &firstDay, &lastDay, &lastExport); err != nil {
+			return nil, err
+		}
+		first, _ := time.Parse("2006-01-02", firstDay)
+		last, _ := time.Parse("2006-01-02", lastDay)
+		d := staleBackup{DeviceID: deviceID, LastActive: last}
+		if lastExport.Valid {
+			exported := time.Unix(lastExport.Int64, 0).UTC()
+			// Usage is by day, so an upload on the day of the export might
+			// be in it
+			if !exported.Before(cutoff) || !last.After(exported.Truncate(24*time.Hour)) {
+				continue
+			}
+			d.LastExport = &exported
+		} else if !first.Before(cutoff) {
+			continue
+		}
+		stale = append(stale, d)
+	}
+	return stale, rows.Err()
+}
+
+// AddUsage counts toward the device's daily usage of metric in t
+func (o *opsDB) AddUsage(t *tenant, deviceID, metric string, amount int64) {
+	day := o.clock.Now().UTC().Format("2006-01-02")
+	o.exec(`INSERT INTO usage (tenant, device_id, day, metric, amount) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (tenant, device_id, day, metric) DO UPDATE SET amount = usage.amount + excluded.amount`,
+		t.Name, deviceID, day, metric, amount)
+}
+
+// Usage totals the device's usage of metric in t since the given day
+func (o *opsDB) Usage(t *tenant, deviceID, metric string, since time.Time) (int64, error) {
+	var total sql.NullInt64
+	err := o.queryRow(`SELECT SUM(amount) FROM usage WHERE tenant = ? AND device_id = ? AND metric = ? AND day >= ?`,
+		t.Name, deviceID, metric, since.UTC().Format("2006-01-02")).Scan(&total)
+	return total.Int64, err
+}
+
+// usageTotals is the whole server's activity on one day
+type usageTotals struct {
+	Uploads      int64 `json:"uploads"`
+	UploadBytes  int64 `json:"upload_bytes"`
+	Exports      int64 `json:"exports"`
+	ExportBytes  int64 `json:"export_bytes"`
+	Imports      int64 `json:"imports"`
+	NewDevices   int64 `json:"new_devices"`
+	AdminActions int64 `json:"admin_actions"`
+}
+
+// UsageOn totals every device's usage on the UTC day that starts at day
+func (o *opsDB) UsageOn(day time.Time) (usageTotals, error) {
+	var t usageTotals
+	dayStr := day.UTC().Format("2006-01-02")
+	rows, err := o.query(`SELECT metric, SUM(amount) FROM usage WHERE day = ? GROUP BY metric`, dayStr)
+	if err != nil {
+		return t, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var metric string
+		var amount int64
+		if err := rows.Scan(&metric, &amount); err != nil {
+			return t, err
+		}
+		switch metric {
+		case "uploads":
+			t.Uploads = amount
+		case "upload_bytes":
+			t.UploadBytes = amount
+		case "imports":
+			t.Imports = amount
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return t, err
+	}
+
+	start, end := day.Unix(), day.AddDate(0, 0, 1).Unix()
+	var exportBytes sql.NullInt64
+	if err := o.queryRow(`SELECT COUNT(*), SUM(bytes) FROM export_history WHERE finished_at >= ? AND finished_at < ?`,
+		start, end).Scan(&t.Exports, &exportBytes); err != nil {
+		return t, err
+	}
+	t.ExportBytes = exportBytes.Int64
+	// A device is new on the first day it has any usage
+	if err := o.queryRow(`SELECT COUNT(*) FROM (SELECT device_id FROM usage GROUP BY device_id HAVING MIN(day) = ?) AS firsts`,
+		dayStr).Scan(&t.NewDevices); err != nil {
+		return t, err
+	}
+	err = o.queryRow(`SELECT COUNT(*) FROM audit_log WHERE at >= ? AND at < ?`, start, end).Scan(&t.AdminActions)
+	return t, err
+}
+
+// JobRan records a job run, keeping the last 100 runs of each job
+func (o *opsDB) JobRan(r *jobRun) {
+	o.exec(`INSERT INTO job_runs (job, server, started_at, duration_ms, ok, dry_run, error, log) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.Job, o.server, r.Started.UnixNano()/int64(time.Millisecond), r.DurationMS, r.OK, r.DryRun, r.Error, strings.Join(r.Log, "\n"))
+	o.exec(`DELETE FROM job_runs WHERE job = ? AND started_at < (
+		SELECT MIN(started_at) FROM (SELECT started_at FROM job_runs WHERE job = ? ORDER BY started_at DESC LIMIT 100) AS recent)`,
+		r.Job, r.Job)
+}
+
+// TakeJobLease claims the job for this server for ttl, unless another
+// server's claim hasn't run out yet. It reports whether this server holds
+// the lease.
+func (o *opsDB) TakeJobLease(name string, ttl time.Duration) (bool, error) {
+	now := o.clock.Now()
+	res, err := o.db.Exec(o.rebind(`INSERT INTO job_leases (job, server, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (job) DO UPDATE SET server = excluded.server, expires_at = excluded.expires_at
+		WHERE job_leases.server = excluded.server OR job_leases.expires_at <= ?`),
+		name, o.server, now.Add(ttl).Unix(), now.Unix())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// JobRuns returns the job's most recent runs, newest first
+func (o *opsDB) JobRuns(name string, limit int) ([]jobRun, error) {
+	rows, err := o.query(`SELECT started_at, duration_ms, ok, dry_run, error, log FROM job_runs WHERE job = ? ORDER BY started_at DESC LIMIT ?`, name, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	runs := []jobRun{}
+	for rows.Next() {
+		r := jobRun{Job: name}
+		var startedMS int64
+		var logText string
+		if err := rows.Scan(&startedMS, &r.DurationMS, &r.OK, &r.DryRun, &r.Error, &logText); err != nil {
+			return nil, err
+		}
+		r.Started = time.Unix(0, startedMS*int64(time.Millisecond)).UTC()
+		r.Log = []string{}
+		if logText != "" {
+			r.Log = strings.Split(logText, "\n")
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// DeviceSetting returns one of the device's settings, or "" if it isn't set
+func (o *opsDB) DeviceSetting(deviceID, name string) string {
+	var value string
+	err := o.queryRow(`SELECT value FROM device_settings WHERE device_id = ? AND name = ?`, deviceID, name).Scan(&value)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Database error: %v\n", err)
+	}
+	return value
+}
+
+func (o *opsDB) SetDeviceSetting(deviceID, name, value string) error {
+	_, err := o.db.Exec(o.rebind(`INSERT INTO device_settings (device_id, name, value) VALUES (?, ?, ?)
+		ON CONFLICT (device_id, name) DO UPDATE SET value = excluded.value`), deviceID, name, value)
+	return err
+}
+
+type keptOriginal struct {
+	Bucket string
+	Key    string
+}
+
+// OriginalKept records an original image to delete after the given time
+func (o *opsDB) OriginalKept(bucket, key string, deleteAfter time.Time) {
+	o.exec(`INSERT INTO kept_originals (bucket, key, delete_after) VALUES (?, ?, ?)
+		ON CONFLICT (bucket, key) DO UPDATE SET delete_after = excluded.delete_after`, bucket, key, deleteAfter.Unix())
+}
+
+func (o *opsDB) ExpiredOriginals(now time.Time) ([]keptOriginal, error) {
+	rows, err := o.query(`SELECT bucket, key FROM kept_originals WHERE delete_after < ?`, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var expired []keptOriginal
+	for rows.Next() {
+		var k keptOriginal
+		if err := rows.Scan(&k.Bucket, &k.Key); err != nil {
+			return nil, err
+		}
+		expired = append(expired, k)
+	}
+	return expired, rows.Err()
+}
+
+func (o *opsDB) OriginalDeleted(bucket, key string) {
+	o.exec(`DELETE FROM kept_originals WHERE bucket = ? AND key = ?`, bucket, key)
+}
+
+func (o *opsDB) Audit(actor, action, detail string) {
+	o.exec(`INSERT INTO audit_log (at, actor, action, detail) VALUES (?, ?, ?, ?)`,
+		o.clock.Now().Unix(), actor, action, detail)
+}
+
+type auditEntry struct {
+	At     time.Time `json:"at"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Detail string    `json:"detail"`
+}
+
+// AuditLog returns the newest entries first
+func (o *opsDB) AuditLog(limit int) ([]auditEntry, error) {
+	rows, err := o.query(`SELECT at, actor, action, detail FROM audit_log ORDER BY at DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []auditEntry{}
+	for rows.Next() {
+		var e auditEntry
+		var at int64
+		if err := rows.Scan(&at, &e.Actor, &e.Action, &e.Detail); err != nil {
+			return nil, err
+		}
+		e.At = time.Unix(at, 0).UTC()
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// IdempotentResponse returns the stored response for a key, if any
+func (o *opsDB) IdempotentResponse(key, deviceID string) (path string, status int, response []byte, ok bool) {
+	err := o.queryRow(`SELECT path, status, response FROM idempotency_keys WHERE key = ? AND device_id = ?`,
+		key, deviceID).Scan(&path, &status, &response)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Database error: %v\n", err)
+	}
+	return path, status, response, err == nil
+}
+
+func (o *opsDB) SaveIdempotentResponse(key, deviceID, path string, status int, response []byte) {
+	o.exec(`INSERT INTO idempotency_keys (key, device_id, path, status, response, created_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (key, device_id) DO NOTHING`,
+		key, deviceID, path, status, response, o.clock.Now().Unix())
+}
+
+// PruneIdempotencyKeys forgets keys older than maxAge
+func (o *opsDB) PruneIdempotencyKeys(maxAge time.Duration) error {
+	_, err := o.db.Exec(o.rebind(`DELETE FROM idempotency_keys WHERE created_at < ?`), o.clock.Now().Add(-maxAge).Unix())
+	return err
+}
+
+// ImportResult returns the stored response for an archive the device
+// imported before, if any
+func (o *opsDB) ImportResult(deviceID, archiveHash string) ([]byte, bool) {
+	var response []byte
+	err := o.queryRow(`SELECT response FROM import_results WHERE device_id = ? AND archive_hash = ?`,
+		deviceID, archiveHash).Scan(&response)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Database error: %v\n", err)
+	}
+	return response, err == nil
+}
+
+func (o *opsDB) SaveImportResult(deviceID, archiveHash string, response []byte) {
+	o.exec(`INSERT INTO import_results (device_id, archive_hash, response, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (device_id, archive_hash) DO UPDATE SET response = excluded.response, created_at = excluded.created_at`,
+		deviceID, archiveHash, response, o.clock.Now().Unix())
+}
+
+// PruneImportResults forgets imports older than maxAge
+func (o *opsDB) PruneImportResults(maxAge time.Duration) error {
+	_, err := o.db.Exec(o.rebind(`DELETE FROM import_results WHERE created_at < ?`), o.clock.Now().Add(-maxAge).Unix())
+	return err
+}
+
+// EscrowKey stores a wrapped export key, replacing any with the same id
+func (o *opsDB) EscrowKey(deviceID string, k escrowedKey) error {
+	_, err := o.db.Exec(o.rebind(`INSERT INTO escrowed_keys (device_id, key_id, wrapped_key, salt, kdf, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (device_id, key_id) DO UPDATE SET wrapped_key = excluded.wrapped_key, salt = excluded.salt,
+			kdf = excluded.kdf, created_at = excluded.created_at`),
+		deviceID, k.KeyID, k.WrappedKey, k.Salt, k.KDF, o.clock.Now().Unix())
+	return err
+}
+
+// EscrowedKeys returns the device's escrowed keys, newest first
+func (o *opsDB) EscrowedKeys(deviceID string) ([]escrowedKey, error) {
+	rows, err := o.query(`SELECT key_id, wrapped_key, salt, kdf, created_at FROM escrowed_keys
+		WHERE device_id = ? ORDER BY created_at DESC`, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []escrowedKey{}
+	for rows.Next() {
+		var k escrowedKey
+		var created int64
+		if err := rows.Scan(&k.KeyID, &k.WrappedKey, &k.Salt, &k.KDF, &created); err != nil {
+			return nil, err
+		}
+		k.CreatedAt = time.Unix(created, 0).UTC()
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// DeleteEscrowedKey reports whether there was such a key to delete
+func (o *opsDB) DeleteEscrowedKey(deviceID, keyID string) (bool, error) {
+	res, err := o.db.Exec(o.rebind(`DELETE FROM escrowed_keys WHERE device_id = ? AND key_id = ?`), deviceID, keyID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// AddPotWebhook registers a webhook for a pot library
+func (o *opsDB) AddPotWebhook(h potWebhook) error {
+	_, err := o.db.Exec(o.rebind(`INSERT INTO pot_webhooks (id, library, url, secret, statuses, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`),
+		h.ID, h.library, h.URL, h.secret, strings.Join(h.Statuses, ","), h.CreatedAt.Unix())
+	return err
+}
+
+// PotWebhooks returns the library's webhooks, oldest first, with their
+// secrets but without Secret set
+func (o *opsDB) PotWebhooks(library string) ([]potWebhook, error) {
+	rows, err := o.query(`SELECT id, url, secret, statuses, created_at, last_delivery_at, last_result FROM pot_webhooks
+		WHERE library = ? ORDER BY created_at, id`, library)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hooks := []potWebhook{}
+	for rows.Next() {
+		h := potWebhook{library: library, Statuses: []string{}}
+		var statuses string
+		var created int64
+		var delivered sql.NullInt64
+		if err := rows.Scan(&h.ID, &h.URL, &h.secret, &statuses, &created, &delivered, &h.LastResult); err != nil {
+			return nil, err
+		}
+		if statuses != "" {
+			h.Statuses = strings.Split(statuses, ",")
+		}
+		h.CreatedAt = time.Unix(created, 0).UTC()
+		if delivered.Valid {
+			t := time.Unix(delivered.Int64, 0).UTC()
+			h.LastDeliveryAt = &t
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, rows.Err()
+}
+
+// PotWebhookDelivered records the result of the webhook's latest delivery
+func (o *opsDB) PotWebhookDelivered(id, result string) error {
+	_, err := o.db.Exec(o.rebind(`UPDATE pot_webhooks SET last_delivery_at = ?, last_result = ? WHERE id = ?`),
+		o.clock.Now().Unix(), result, id)
+	return err
+}
+
+// DeletePotWebhook reports whether the library had such a webhook to delete
+func (o *opsDB) DeletePotWebhook(library, id string) (bool, error) {
+	res, err := o.db.Exec(o.rebind(`DELETE FROM pot_webhooks WHERE library = ? AND id = ?`), library, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// AddImageWebhook registers a webhook for a device's images
+func (o *opsDB) AddImageWebhook(h imageWebhook) error {
+	_, err := o.db.Exec(o.rebind(`INSERT INTO image_webhooks (id, device_id, url, secret, created_at)
+		VALUES (?, ?, ?, ?, ?)`),
+		h.ID, h.deviceID, h.URL, h.secret, h.CreatedAt.Unix())
+	return err
+}
+
+// ImageWebhooks returns the device's webhooks, oldest first, with their
+// secrets but without Secret set
+func (o *opsDB) ImageWebhooks(deviceID string) ([]imageWebhook, error) {
+	rows, err := o.query(`SELECT id, url, secret, created_at, last_delivery_at, last_result FROM image_webhooks
+		WHERE device_id = ? ORDER BY created_at, id`, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hooks := []imageWebhook{}
+	for rows.Next() {
+		h := imageWebhook{deviceID: deviceID}
+		var created int64
+		var delivered sql.NullInt64
+		if err := rows.Scan(&h.ID, &h.URL, &h.secret, &created, &delivered, &h.LastResult); err != nil {
+			return nil, err
+		}
+		h.CreatedAt = time.Unix(created, 0).UTC()
+		if delivered.Valid {
+			t := time.Unix(delivered.Int64, 0).UTC()
+			h.LastDeliveryAt = &t
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, rows.Err()
+}
+
+// ImageWebhookDelivered records the result of the webhook's latest delivery
+func (o *opsDB) ImageWebhookDelivered(id, result string) error {
+	_, err := o.db.Exec(o.rebind(`UPDATE image_webhooks SET last_delivery_at = ?, last_result = ? WHERE id = ?`),
+		o.clock.Now().Unix(), result, id)
+	return err
+}
+
+// DeleteImageWebhook reports whether the device had such a webhook to
+// delete
+func (o *opsDB) DeleteImageWebhook(deviceID, id string) (bool, error) {
+	res, err := o.db.Exec(o.rebind(`DELETE FROM image_webhooks WHERE device_id = ? AND id = ?`), deviceID, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// SetCalendarFeed gives the device a calendar feed with the hashed token,
+// replacing any feed it had. The device is named by its data key (see
+// tenant.dataKey), which is also its pot library.
+func (o *opsDB) SetCalendarFeed(deviceID, tokenHash string) error {
+	tx, err := o.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(o.rebind(`DELETE FROM calendar_feeds WHERE device_id = ?`), deviceID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(o.rebind(`INSERT INTO calendar_feeds (device_id, token_sha256, created_at) VALUES (?, ?, ?)`),
+		deviceID, tokenHash, o.clock.Now().Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CalendarFeedDevice returns the device whose feed has the hashed token,
+// or "" if none does
+func (o *opsDB) CalendarFeedDevice(tokenHash string) (string, error) {
+	var deviceID string
+	err := o.queryRow(`SELECT device_id FROM calendar_feeds WHERE token_sha256 = ?`, tokenHash).Scan(&deviceID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return deviceID, err
+}
+
+// DeleteCalendarFeed reports whether the device had a feed to delete
+func (o *opsDB) DeleteCalendarFeed(deviceID string) (bool, error) {
+	res, err := o.db.Exec(o.rebind(`DELETE FROM calendar_feeds WHERE device_id = ?`), deviceID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// SetShareFeed gives the library a feed of its shared pots with the title,
+// keeping the feed's id if it already has one
+func (o *opsDB) SetShareFeed(library, title string) (shareFeed, error) {
+	_, err := o.db.Exec(o.rebind(`INSERT INTO share_feeds (id, library, title, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (library) DO UPDATE SET title = excluded.title`), newID(), library, title, o.clock.Now().Unix())
+	if err != nil {
+		return shareFeed{}, err
+	}
+	f, _, err := o.shareFeed(`library = ?`, library)
+	return f, err
+}
+
+// ShareFeed returns the feed with the id, and whether there is one
+func (o *opsDB) ShareFeed(id string) (shareFeed, bool, error) {
+	return o.shareFeed(`id = ?`, id)
+}
+
+// LibraryShareFeed returns the library's feed, and whether it has one
+func (o *opsDB) LibraryShareFeed(library string) (shareFeed, bool, error) {
+	return o.shareFeed(`library = ?`, library)
+}
+
+func (o *opsDB) shareFeed(where string, arg string) (shareFeed, bool, error) {
+	var f shareFeed
+	var created int64
+	err := o.queryRow(`SELECT id, library, title, created_at FROM share_feeds WHERE `+where, arg).
+		Scan(&f.ID, &f.library, &f.Title, &created)
+	if err == sql.ErrNoRows {
+		return f, false, nil
+	}
+	f.CreatedAt = time.Unix(created, 0).UTC()
+	return f, err == nil, err
+}
+
+// DeleteShareFeed reports whether the library had a feed to delete
+func (o *opsDB) DeleteShareFeed(library string) (bool, error) {
+	res, err := o.db.Exec(o.rebind(`DELETE FROM share_feeds WHERE library = ?`), library)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// AddAPIKey issues a key with the hash of its token
+func (o *opsDB) AddAPIKey(k *apiKey, tokenHash string) error {
+	_, err := o.db.Exec(o.rebind(`INSERT INTO api_keys (id, device_id, name, token_sha256, scope, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`),
+		k.ID, k.DeviceID, k.Name, tokenHash, k.Scope, k.CreatedAt.Unix())
+	return err
+}
+
+const apiKeyColumns = `id, device_id, name, scope, requests_per_minute, requests_per_day, day, requests_today,
+	requests_total, created_at, last_used_at`
+
+func (o *opsDB) scanAPIKey(row interface{ Scan(...interface{}) error }) (*apiKey, error) {
+	k := &apiKey{}
+	var day string
+	var created int64
+	var used sql.NullInt64
+	if err := row.Scan(&k.ID, &k.DeviceID, &k.Name, &k.Scope, &k.RequestsPerMinute, &k.RequestsPerDay, &day,
+		&k.RequestsToday, &k.RequestsTotal, &created, &used); err != nil {
+		return nil, err
+	}
+	// The count is for the day of the key's last request
+	if day != o.clock.Now().UTC().Format("2006-01-02") {
+		k.RequestsToday = 0
+	}
+	k.CreatedAt = time.Unix(created, 0).UTC()
+	if used.Valid {
+		t := time.Unix(used.Int64, 0).UTC()
+		k.LastUsedAt = &t
+	}
+	return k, nil
+}
+
+// APIKeyByToken returns the key with the hashed token, or nil if there's none
+func (o *opsDB) APIKeyByToken(tokenHash string) (*apiKey, error) {
+	k, err := o.scanAPIKey(o.queryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE token_sha256 = ?`, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return k, err
+}
+
+// APIKeys lists the device's keys, or every key if deviceID is "", oldest
+// first
+func (o *opsDB) APIKeys(deviceID string) ([]*apiKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys`
+	args := []interface{}{}
+	if deviceID != "" {
+		query += ` WHERE device_id = ?`
+		args = append(args, deviceID)
+	}
+	rows, err := o.query(query+` ORDER BY created_at, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []*apiKey{}
+	for rows.Next() {
+		k, err := o.scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// UseAPIKey counts a request against the key's daily limit, and reports
+// false without counting it if the key has already made perDay requests
+// today
+func (o *opsDB) UseAPIKey(id string, perDay int) (bool, error) {
+	now := o.clock.Now()
+	day := now.UTC().Format("2006-01-02")
+	res, err := o.db.Exec(o.rebind(`UPDATE api_keys SET
+		requests_today = CASE WHEN day = ? THEN requests_today + 1 ELSE 1 END,
+		day = ?, requests_total = requests_total + 1, last_used_at = ?
+		WHERE id = ? AND NOT (day = ? AND requests_today >= ?)`),
+		day, day, now.Unix(), id, day, perDay)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// SetAPIKeyLimits overrides the configured limits for a key; 0 goes back
+// to them. It reports whether there was such a key.
+func (o *opsDB) SetAPIKeyLimits(id string, perMinute, perDay int) (bool, error) {
+	res, err := o.db.Exec(o.rebind(`UPDATE api_keys SET requests_per_minute = ?, requests_per_day = ? WHERE id = ?`),
+		perMinute, perDay, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteAPIKey reports whether there was such a key to delete. With
+// deviceID "", it deletes any device's key.
+func (o *opsDB) DeleteAPIKey(deviceID, id string) (bool, error) {
+	query := `DELETE FROM api_keys WHERE id = ?`
+	args := []interface{}{id}
+	if deviceID != "" {
+		query += ` AND device_id = ?`
+		args = append(args, deviceID)
+	}
+	res, err := o.db.Exec(o.rebind(query), args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DebugLogSubmitted records a debug log the device sent
+func (o *opsDB) DebugLogSubmitted(deviceID string, l debugLog) error {
+	_, err := o.db.Exec(o.rebind(`INSERT INTO debug_logs (id, device_id, name, app_ownership, path, bytes, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		l.ID, deviceID, l.Name, l.AppOwnership, l.path, l.Bytes, l.SubmittedAt.Unix())
+	return err
+}
+
+// DebugLogs returns the device's debug logs submitted since then, newest
+// first
+func (o *opsDB) DebugLogs(deviceID string, since time.Time) ([]debugLog, error) {
+	rows, err := o.query(`SELECT id, name, app_ownership, path, bytes, created_at FROM debug_logs
+		WHERE device_id = ? AND created_at >= ? ORDER BY created_at DESC, id`, deviceID, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	logs := []debugLog{}
+	for rows.Next() {
+		var l debugLog
+		var created int64
+		if err := rows.Scan(&l.ID, &l.Name, &l.AppOwnership, &l.path, &l.Bytes, &created); err != nil {
+			return nil, err
+		}
+		l.SubmittedAt = time.Unix(created, 0).UTC()
+		logs = append(logs, l)
+	}
+	return logs, rows.Err()
+}
+
+// Idempotency keys are kept this long, which covers any retry an app makes
+const idempotencyKeyTTL = 24 * time.Hour
+
+// bufferedResponse is a ResponseWriter that keeps a copy of the body,
+// unless it's a download, like a direct export, which is too big to keep
+type bufferedResponse struct {
+	statusRecorder
+	body     []byte
+	download bool
+}
+
+func (r *bufferedResponse) Write(b []byte) (int, error) {
+	if strings.HasPrefix(r.Header().Get("Content-Disposition"), "attachment") {
+		r.download = true
+		r.body = nil
+	}
+	n, err := r.statusRecorder.Write(b)
+	if !r.download {
+		r.body = append(r.body, b[:n]...)
+	}
+	return n, err
+}
+
+// idempotent replays the stored response when a request repeats an
+// Idempotency-Key the device already used, so a retry after a dropped
+// connection doesn't upload or export twice. Server errors aren't stored,
+// so those can be retried for real.
+func (s *Server) idempotent(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get("Idempotency-Key")
+		if key == "" || s.ops == nil {
+			handler(w, req)
+			return
+		}
+		deviceID := req.FormValue("deviceId")
+		if path, status, response, ok := s.ops.IdempotentResponse(key, deviceID); ok {
+			if path != req.URL.Path {
+				s.handleErrCode(newAPIError("idempotency_key_reused", "That Idempotency-Key was used for a different request"), http.StatusUnprocessableEntity, deviceID, w)
+				return
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(status)
+			w.Write(response)
+			return
+		}
+
+		rec := &bufferedResponse{statusRecorder: statusRecorder{ResponseWriter: w}}
+		handler(rec, req)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		// A download isn't stored, and a retry gets it from the handler
+		// again
+		if rec.status < 500 && !rec.download {
+			s.ops.SaveIdempotentResponse(key, deviceID, req.URL.Path, rec.status, rec.body)
+		}
+	}
+}
+
+// AuditLog shows recent admin actions
+func (s *Server) AuditLog(w http.ResponseWriter, req *http.Request) {
+	limit, err := strconv.Atoi(req.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	entries, err := s.ops.AuditLog(limit)
+	if s.handleErr(err, "", w) {
+		return
+	}
+	writeJSON(w, struct {
+		Status  string       `json:"status"`
+		Entries []auditEntry `json:"entries"`
+	}{
+		Status:  "ok",
+		Entries: entries,
+	})
+}
+
+// imageRef is a device's file name for a content-addressed blob
+type imageRef struct {
+	DeviceID string
+	FileName string
+}
+
+// ImageRef returns the blob key the device's file name points at
+func (o *opsDB) ImageRef(bucket, deviceID, fileName string) (string, bool) {
+	var blobKey string
+	err := o.queryRow(`SELECT blob_key FROM image_refs WHERE bucket = ? AND device_id = ? AND file_name = ?`,
+		bucket, deviceID, fileName).Scan(&blobKey)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Database error: %v\n", err)
+	}
+	return blobKey, err == nil
+}
+
+// AddImageRef points the device's file name at a blob and returns the
+// blob it pointed at before, if any
+func (o *opsDB) AddImageRef(bucket, deviceID, fileName, blobKey string) (string, error) {
+	tx, err := o.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	var replaced string
+	err = tx.QueryRow(o.rebind(`SELECT blob_key FROM image_refs WHERE bucket = ? AND device_id = ? AND file_name = ?`),
+		bucket, deviceID, fileName).Scan(&replaced)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	if _, err := tx.Exec(o.rebind(`INSERT INTO image_refs (bucket, device_id, file_name, blob_key) VALUES (?, ?, ?, ?)
+		ON CONFLICT (bucket, device_id, file_name) DO UPDATE SET blob_key = excluded.blob_key`),
+		bucket, deviceID, fileName, blobKey); err != nil {
+		return "", err
+	}
+	return replaced, tx.Commit()
+}
+
+// ReleaseImageRef drops one reference to a blob and returns it and how
+// many references remain. The reference is the device's fileName for the
+// blob, or without a fileName its only one. Without a deviceId (older
+// clients), it's dropped only if no other device's could be meant. With
+// dryRun nothing is dropped, and the count is of what would remain.
+func (o *opsDB) ReleaseImageRef(bucket, deviceID, fileName, blobKey string, dryRun bool) (imageRef, int, error) {
+	tx, err := o.db.Begin()
+	if err != nil {
+		return imageRef{}, 0, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(o.rebind(`SELECT device_id, file_name FROM image_refs WHERE bucket = ? AND blob_key = ?`), bucket, blobKey)
+	if err != nil {
+		return imageRef{}, 0, err
+	}
+	count := 0
+	var matches []imageRef
+	for rows.Next() {
+		var ref imageRef
+		if err := rows.Scan(&ref.DeviceID, &ref.FileName); err != nil {
+			rows.Close()
+			return imageRef{}, 0, err
+		}
+		count++
+		if (deviceID == "" || ref.DeviceID == deviceID) && (fileName == "" || ref.FileName == fileName) {
+			matches = append(matches, ref)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return imageRef{}, 0, err
+	}
+	switch {
+	case len(matches) == 0:
+		return imageRef{}, count, nil
+	case len(matches) > 1 && deviceID == "":
+		return imageRef{}, count, nil
+	case len(matches) > 1:
+		return imageRef{}, count, errAmbiguousImage
+	}
+	ref := matches[0]
+	if dryRun {
+		return ref, count - 1, nil
+	}
+	if _, err := tx.Exec(o.rebind(`DELETE FROM image_refs WHERE bucket = ? AND device_id = ? AND file_name = ?`),
+		bucket, ref.DeviceID, ref.FileName); err != nil {
+		return imageRef{}, 0, err
+	}
+	return ref, count - 1, tx.Commit()
+}
+
+// ImageRefCount is how many references a blob has
+func (o *opsDB) ImageRefCount(bucket, blobKey string) (int, error) {
+	var n int
+	err := o.queryRow(`SELECT COUNT(*) FROM image_refs WHERE bucket = ? AND blob_key = ?`, bucket, blobKey).Scan(&n)
+	return n, err
+}
+
+// DeviceImageRefs maps the device's file names to blob keys
+func (o *opsDB) DeviceImageRefs(bucket, deviceID string) (map[string]string, error) {
+	rows, err := o.query(`SELECT file_name, blob_key FROM image_refs WHERE bucket = ? AND device_id = ?`, bucket, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	images := make(map[string]string)
+	for rows.Next() {
+		var name, blobKey string
+		if err := rows.Scan(&name, &blobKey); err != nil {
+			return nil, err
+		}
+		images[name] = blobKey
+	}
+	return images, rows.Err()
+}
+
+// BlobImageNames is the device's file names for a blob, sorted
+func (o *opsDB) BlobImageNames(bucket, deviceID, blobKey string) ([]string, error) {
+	rows, err := o.query(`SELECT file_name FROM image_refs WHERE bucket = ? AND device_id = ? AND blob_key = ? ORDER BY file_name`,
+		bucket, deviceID, blobKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// IndexPot adds a pot to the search index, replacing what was indexed for
+// it before
+func (o *opsDB) IndexPot(library string, doc potDocument) error {
+	tx, err := o.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(o.rebind(`DELETE FROM pot_search WHERE library = ? AND pot_id = ?`), library, doc.PotID); err != nil {
+		return err
+	}
+	if o.postgres {
+		// Title, then glaze and clay, then status, then notes and years
+		// rank highest, as the SQLite weights in SearchPots do
+		_, err = tx.Exec(o.rebind(`INSERT INTO pot_search (library, pot_id, document) VALUES (?, ?,
+			setweight(to_tsvector('simple', ?), 'A') ||
+			setweight(to_tsvector('simple', ?), 'B') ||
+			setweight(to_tsvector('simple', ?), 'C') ||
+			setweight(to_tsvector('simple', ?), 'D'))`),
+			library, doc.PotID, doc.Title, doc.Glaze+" "+doc.Clay, doc.Status, doc.Notes+" "+doc.Years)
+	} else {
+		_, err = tx.Exec(`INSERT INTO pot_search (library, pot_id, title, glaze, clay, status, notes, years) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			library, doc.PotID, doc.Title, doc.Glaze, doc.Clay, doc.Status, doc.Notes, doc.Years)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UnindexPot removes a deleted pot from the search index
+func (o *opsDB) UnindexPot(library, potID string) error {
+	_, err := o.db.Exec(o.rebind(`DELETE FROM pot_search WHERE library = ? AND pot_id = ?`), library, potID)
+	return err
+}
+
+// PotIndexEmpty reports whether nothing has been indexed for search yet
+func (o *opsDB) PotIndexEmpty() (bool, error) {
+	var n int
+	err := o.queryRow(`SELECT COUNT(*) FROM (SELECT 1 FROM pot_search LIMIT 1) AS indexed`).Scan(&n)
+	return n == 0, err
+}
+
+// SearchPots returns the ids of the library's pots with a word starting
+// with each of terms, best match first. Terms are lowercase letters and
+// digits, as tokenize makes them, so they need no quoting.
+func (o *opsDB) SearchPots(library string, terms []string) ([]string, error) {
+	var rows *sql.Rows
+	var err error
+	if o.postgres {
+		query := strings.Join(terms, ":* & ") + ":*"
+		rows, err = o.query(`SELECT pot_id FROM pot_search
+			WHERE library = ? AND document @@ to_tsquery('simple', ?)
+			ORDER BY ts_rank(document, to_tsquery('simple', ?)) DESC, pot_id`, library, query, query)
+	} else {
+		query := `"` + strings.Join(terms, `"* "`) + `"*`
+		// bm25 is lower for better matches; the weights are by column
+		rows, err = o.query(`SELECT pot_id FROM pot_search
+			WHERE pot_search MATCH ? AND library = ?
+			ORDER BY bm25(pot_search, 0, 0, 4, 3, 3, 2, 1, 1), pot_id`, query, library)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,321 @@
+package potterylog
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// A debug bundle is what the app sends to /pottery-log/debug when a user
+// reports a problem: its logs, a JSON dump of its state, and JSON about the
+// device, as parts of a multipart form. The server checks each part and
+// writes them to one zip in debug-logs under the data directory, with an index.json listing what's
+// in it, so the operator (or the device, see debuglogs.go) gets everything
+// about one report in one file. Older apps send a single data string,
+// which becomes a bundle with one log.
+
+const (
+	// maxDebugBundleBytes caps the whole request, and maxDebugPartBytes
+	// each part in it
+	maxDebugBundleBytes = 20 << 20
+	maxDebugPartBytes   = 10 << 20
+	// maxDebugLogParts is how many logs one bundle may have
+	maxDebugLogParts = 10
+)
+
+const debugPath = "/pottery-log/debug"
+
+const (
+	debugPartLogs   = "logs"
+	debugPartState  = "state"
+	debugPartDevice = "device"
+)
+
+var (
+	errDebugBundleTooLarge = newAPIError("debug_bundle_too_large",
+		fmt.Sprintf("The debug bundle is more than the server's limit of %s", formatBytes(maxDebugBundleBytes)),
+		formatBytes(maxDebugBundleBytes))
+	errEmptyDebugBundle = newAPIError("empty_debug_bundle", "The debug bundle has nothing in it")
+	errDebugLogNotText  = newAPIError("debug_log_not_text", "A log in the debug bundle isn't UTF-8 text")
+	errTooManyDebugLogs = newAPIError("too_many_debug_logs",
+		fmt.Sprintf("A debug bundle can have at most %d logs", maxDebugLogParts), maxDebugLogParts)
+)
+
+func errDebugPartNotJSON(part string) *apiError {
+	return newAPIError("debug_part_not_json", fmt.Sprintf("The debug bundle's %s part isn't a JSON object", part), part)
+}
+
+// debugBundleIndex is index.json in a bundle
+type debugBundleIndex struct {
+	DeviceID     string            `json:"device_id"`
+	Name         string            `json:"name"`
+	AppOwnership string            `json:"app_ownership"`
+	SubmittedAt  time.Time         `json:"submitted_at"`
+	Parts        []debugBundlePart `json:"parts"`
+}
+
+type debugBundlePart struct {
+	// Path is the part's file in the zip
+	Path        string `json:"path"`
+	Kind        string `json:"kind"`
+	ContentType string `json:"content_type"`
+	Bytes       int    `json:"bytes"`
+
+	data []byte
+}
+
+// readDebugPart reads the form's part named kind, from a file or else a
+// plain value. The bool is whether there is one.
+func readDebugPart(req *http.Request, kind string) ([]byte, bool, error) {
+	if files := formFiles(req, kind); len(files) > 0 {
+		data, err := readDebugFile(files[0])
+		return data, true, err
+	}
+	if values, ok := req.Form[kind]; ok && len(values) > 0 {
+		return []byte(values[0]), true, nil
+	}
+	return nil, false, nil
+}
+
+func readDebugFile(header *multipartFile) ([]byte, error) {
+	if header.Size > maxDebugPartBytes {
+		return nil, errDebugBundleTooLarge
+	}
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(io.LimitReader(file, maxDebugPartBytes+1))
+}
+
+// isText is whether data looks like a log: UTF-8 without NUL bytes
+func isText(data []byte) bool {
+	return utf8.Valid(data) && bytes.IndexByte(data, 0) < 0
+}
+
+// isJSONObject is whether data is a JSON object
+func isJSONObject(data []byte) bool {
+	return json.Valid(data) && bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+// debugBundleParts checks and collects the request's parts: logs as
+// files (or the legacy data value), and state and device as JSON objects
+func debugBundleParts(req *http.Request) ([]debugBundlePart, error) {
+	parts := []debugBundlePart{}
+	addLog := func(name string, data []byte) error {
+		if len(data) > maxDebugPartBytes {
+			return errDebugBundleTooLarge
+		}
+		if !isText(data) {
+			return errDebugLogNotText
+		}
+		parts = append(parts, debugBundlePart{
+			Path:        "logs/" + name,
+			Kind:        debugPartLogs,
+			ContentType: "text/plain; charset=utf-8",
+			Bytes:       len(data),
+			data:        data,
+		})
+		return nil
+	}
+
+	logFiles := formFiles(req, debugPartLogs)
+	if len(logFiles) > maxDebugLogParts {
+		return nil, errTooManyDebugLogs
+	}
+	used := make(map[string]bool)
+	for i, header := range logFiles {
+		data, err := readDebugFile(header)
+		if err != nil {
+			return nil, err
+		}
+		base := notFileNameChars.ReplaceAllString(path.Base(header.Filename), "")
+		base = strings.TrimLeft(base, ".")
+		if base == "" {
+			base = fmt.Sprintf("log-%d.txt", i+1)
+		}
+		name := base
+		for n := 2; used[name]; n++ {
+			name = suffixedName(base, n)
+		}
+		used[name] = true
+		if err := addLog(name, data); err != nil {
+			return nil, err
+		}
+	}
+	// Older apps send their log as data
+	if data := req.FormValue("data"); len(logFiles) == 0 && data != "" {
+		if err := addLog("app.log", []byte(data)); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, kind := range []string{debugPartState, debugPartDevice} {
+		data, ok, err := readDebugPart(req, kind)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || len(data) == 0 {
+			continue
+		}
+		if len(data) > maxDebugPartBytes {
+			return nil, errDebugBundleTooLarge
+		}
+		if !isJSONObject(data) {
+			return nil, errDebugPartNotJSON(kind)
+		}
+		parts = append(parts, debugBundlePart{
+			Path:        kind + ".json",
+			Kind:        kind,
+			ContentType: "application/json",
+			Bytes:       len(data),
+			data:        data,
+		})
+	}
+	if len(parts) == 0 {
+		return nil, errEmptyDebugBundle
+	}
+	return parts, nil
+}
+
+// writeDebugBundle writes the index and parts to a zip at location
+func writeDebugBundle(location string, index debugBundleIndex, parts []debugBundlePart) error {
+	file, err := os.Create(location)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(file)
+	index.Parts = parts
+	indexJSON, err := json.MarshalIndent(index, "", "  ")
+	if err == nil {
+		err = addBundleFile(zw, "index.json", index.SubmittedAt, indexJSON)
+	}
+	for _, p := range parts {
+		if err != nil {
+			break
+		}
+		err = addBundleFile(zw, p.Path, index.SubmittedAt, p.data)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(location)
+	}
+	return err
+}
+
+func addBundleFile(zw *zip.Writer, name string, modified time.Time, data []byte) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// limitDebugBundles caps the size of debug bundles. It has to come before
+// anything reads the form.
+func (s *Server) limitDebugBundles(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != debugPath {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		if req.ContentLength > maxDebugBundleBytes {
+			s.handleErrCode(errDebugBundleTooLarge, http.StatusRequestEntityTooLarge, req.URL.Query().Get("deviceId"), w)
+			return
+		}
+		req.Body = http.MaxBytesReader(w, req.Body, maxDebugBundleBytes)
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// debugBundleStatus is the HTTP status for an error checking a bundle
+func debugBundleStatus(err error) int {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		return http.StatusInternalServerError
+	}
+	switch apiErr.Code {
+	case "debug_bundle_too_large":
+		return http.StatusRequestEntityTooLarge
+	case "debug_log_not_text", "debug_part_not_json":
+		return http.StatusUnsupportedMediaType
+	}
+	return http.StatusBadRequest
+}
+
+// Debug stores a debug bundle and returns its id
+func (s *Server) Debug(w http.ResponseWriter, req *http.Request) {
+	// withForm has parsed the form already, so this only finds out
+	// whether that ran into limitDebugBundles
+	err := formError(req)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		s.handleErrCode(errDebugBundleTooLarge, http.StatusRequestEntityTooLarge, req.URL.Query().Get("deviceId"), w)
+		return
+	}
+	if s.handleErrCode(err, http.StatusBadRequest, req.URL.Query().Get("deviceId"), w) {
+		return
+	}
+	if !s.validateForm(w, req, deviceIDField, logNameField, appOwnershipField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	name := req.FormValue("name")
+	appOwnership := req.FormValue("appOwnership")
+	if appOwnership == "" {
+		appOwnership = "none"
+	}
+
+	parts, err := debugBundleParts(req)
+	if s.handleErrCode(err, debugBundleStatus(err), deviceID, w) {
+		return
+	}
+
+	now := s.Clock.Now().UTC().Truncate(time.Second)
+	location := filepath.Join(s.debugLogDir(), fmt.Sprintf("%s-%s-%d-%s.zip", appOwnership, deviceID, now.Unix(), name))
+	index := debugBundleIndex{DeviceID: deviceID, Name: name, AppOwnership: appOwnership, SubmittedAt: now}
+	if s.handleErr(writeDebugBundle(location, index, parts), deviceID, w) {
+		return
+	}
+	info, err := os.Stat(location)
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+	l := debugLog{
+		ID:           newID(),
+		Name:         name,
+		AppOwnership: appOwnership,
+		Bytes:        info.Size(),
+		SubmittedAt:  now,
+		path:         location,
+	}
+	if err := s.ops.DebugLogSubmitted(deviceID, l); err != nil {
+		log.Printf("Error recording debug log %s: %v\n", location, err)
+	}
+	writeJSON(w, struct {
+		Status string `json:"status"`
+		ID     string `json:"id"`
+	}{
+		Status: "ok",
+		ID:     l.ID,
+	})
+}
@@ -0,0 +1,101 @@
+package potterylog
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Debug bundles the app submits are written to debugLogDir for the operator,
+// and recorded in the operational database so the device can list its own
+// and download them again, for instance to attach one to a support email.
+
+// debugLogDir is where debug bundles are written, under the data directory
+func (s *Server) debugLogDir() string {
+	return filepath.Join(s.dataDir, "debug-logs")
+}
+
+// debugLogRetention is how far back a device's debug logs are listed
+const debugLogRetention = 30 * 24 * time.Hour
+
+var errNoSuchDebugLog = newAPIError("no_such_debug_log", "There is no debug log with that id")
+
+var debugLogIDField = field{Name: "logId", MaxLen: 128, Pattern: validIDPattern}
+
+type debugLog struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	AppOwnership string    `json:"app_ownership"`
+	Bytes        int64     `json:"bytes"`
+	SubmittedAt  time.Time `json:"submitted_at"`
+
+	path string
+}
+
+// DebugLogs lists the device's debug logs from the last 30 days, newest
+// first, or with logId returns that log as a download. Logs whose files
+// are gone, as after the server's /tmp is cleared, aren't listed.
+func (s *Server) DebugLogs(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField, debugLogIDField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	if !s.requireDevice(w, req, deviceID) {
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		s.handleErrCode(errMethodNotAllowed, http.StatusMethodNotAllowed, deviceID, w)
+		return
+	}
+	logs, err := s.ops.DebugLogs(deviceID, s.Clock.Now().Add(-debugLogRetention))
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+	available := []debugLog{}
+	for _, l := range logs {
+		if _, err := os.Stat(l.path); err == nil {
+			available = append(available, l)
+		}
+	}
+
+	logID := req.FormValue("logId")
+	if logID == "" {
+		writeJSON(w, struct {
+			Status string     `json:"status"`
+			Logs   []debugLog `json:"logs"`
+		}{
+			Status: "ok",
+			Logs:   available,
+		})
+		return
+	}
+	for _, l := range available {
+		if l.ID != logID {
+			continue
+		}
+		file, err := os.Open(l.path)
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		defer file.Close()
+		fileName := "pottery-log-debug-" + l.SubmittedAt.Format("2006-01-02-150405")
+		if l.Name != "" {
+			fileName += "-" + l.Name
+		}
+		// Logs from before bundles (debugbundle.go) are plain text
+		if strings.HasSuffix(l.path, ".zip") {
+			fileName += ".zip"
+			w.Header().Set("Content-Type", "application/zip")
+		} else {
+			fileName += ".log"
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+		http.ServeContent(w, req, fileName, l.SubmittedAt, file)
+		return
+	}
+	s.handleErrCode(errNoSuchDebugLog, http.StatusNotFound, deviceID, w)
+}
@@ -0,0 +1,342 @@
+package potterylog
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// devS3 speaks just enough of the S3 API for s3Store: object puts, gets
+// with ranges and conditions, heads, deletes, listing, and multipart
+// uploads. Objects are kept in a fakeStore. With -dev the server runs one
+// and talks to it through the same client code it uses for AWS, so a
+// contributor gets a working setup with one command and no credentials.
+// It checks no signatures and knows nothing of ACLs.
+type devS3 struct {
+	objects *fakeStore
+	// uploadsDir holds the parts of multipart uploads in progress
+	uploadsDir string
+
+	mu      sync.Mutex
+	pending map[string]pendingUpload
+}
+
+type pendingUpload struct {
+	bucket      string
+	key         string
+	contentType string
+}
+
+func newDevS3(dir string) *devS3 {
+	uploadsDir := filepath.Join(dir, "uploads")
+	os.MkdirAll(uploadsDir, 0777)
+	return &devS3{
+		objects:    newFakeStore(dir, ""),
+		uploadsDir: uploadsDir,
+		mu:         sync.Mutex{},
+		pending:    make(map[string]pendingUpload),
+	}
+}
+
+// startDevS3 serves a devS3 kept in dir at addr, and returns a store that
+// uses it, putting objects with acl
+func startDevS3(addr, dir string, acl func(bucketName string) *string) (*s3Store, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		log.Printf("Embedded S3 stopped: %v\n", http.Serve(l, newDevS3(dir)))
+	}()
+	return newS3StoreAt("http://"+l.Addr().String(), acl), nil
+}
+
+// newS3StoreAt is an s3Store for an S3-compatible server at endpoint, with
+// path-style URLs
+func newS3StoreAt(endpoint string, acl func(bucketName string) *string) *s3Store {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:           aws.String("us-east-2"),
+		Endpoint:         aws.String(endpoint),
+		S3ForcePathStyle: aws.Bool(true),
+		DisableSSL:       aws.Bool(strings.HasPrefix(endpoint, "http://")),
+		Credentials:      credentials.NewStaticCredentials("dev", "dev", ""),
+	}))
+	return &s3Store{svc: s3.New(sess), baseURL: strings.TrimSuffix(endpoint, "/"), acl: acl}
+}
+
+type s3ErrorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+}
+
+type listBucketResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	IsTruncated bool
+	Contents    []listedObject
+}
+
+type listedObject struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified string
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+type completeMultipartUpload struct {
+	Parts []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+func (d *devS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	query := req.URL.Query()
+	uploadID := query.Get("uploadId")
+	switch {
+	case bucket == "":
+		s3Error(w, http.StatusBadRequest, "InvalidBucketName", "A bucket is required")
+	case key == "" && req.Method == http.MethodGet:
+		d.list(w, bucket, query.Get("prefix"))
+	case key == "":
+		s3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "Only listing is supported on buckets")
+	case req.Method == http.MethodPost && query.Has("uploads"):
+		d.createUpload(w, req, bucket, key)
+	case req.Method == http.MethodPut && uploadID != "":
+		d.uploadPart(w, req, uploadID, query.Get("partNumber"))
+	case req.Method == http.MethodPost && uploadID != "":
+		d.completeUpload(w, req, uploadID)
+	case req.Method == http.MethodDelete && uploadID != "":
+		d.abortUpload(w, uploadID)
+	case req.Method == http.MethodPut:
+		d.put(w, req, bucket, key)
+	case req.Method == http.MethodGet || req.Method == http.MethodHead:
+		d.get(w, req, bucket, key)
+	case req.Method == http.MethodDelete:
+		d.objects.Delete(bucket, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", req.Method+" is not supported")
+	}
+}
+
+func s3Error(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(s3ErrorResponse{Code: code, Message: message})
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Embedded S3: error writing a response: %v\n", err)
+	}
+}
+
+func (d *devS3) put(w http.ResponseWriter, req *http.Request, bucket, key string) {
+	if err := d.objects.write(bucket, key, req.Body, req.Header.Get("Content-Type")); err != nil {
+		s3Error(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	if info, err := d.objects.Head(bucket, key); err == nil {
+		w.Header().Set("ETag", `"`+info.ETag+`"`)
+	}
+}
+
+func (d *devS3) get(w http.ResponseWriter, req *http.Request, bucket, key string) {
+	cond := FetchConditions{
+		Range:       req.Header.Get("Range"),
+		IfNoneMatch: req.Header.Get("If-None-Match"),
+	}
+	if since, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil {
+		cond.IfModifiedSince = since
+	}
+	obj, err := d.objects.Fetch(bucket, key, cond)
+	if os.IsNotExist(err) {
+		s3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	if err != nil {
+		s3Error(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	switch obj.Status {
+	case http.StatusNotModified:
+		w.Header().Set("ETag", obj.ETag)
+		w.WriteHeader(obj.Status)
+		return
+	case http.StatusRequestedRangeNotSatisfiable:
+		s3Error(w, obj.Status, "InvalidRange", "The requested range is not satisfiable")
+		return
+	}
+	defer obj.Body.Close()
+	header := w.Header()
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+	header.Set("ETag", obj.ETag)
+	header.Set("Last-Modified", obj.LastModified.UTC().Format(http.TimeFormat))
+	if obj.ContentType != "" {
+		header.Set("Content-Type", obj.ContentType)
+	}
+	if obj.ContentRange != "" {
+		header.Set("Content-Range", obj.ContentRange)
+	}
+	w.WriteHeader(obj.Status)
+	if req.Method == http.MethodGet {
+		io.Copy(w, obj.Body)
+	}
+}
+
+func (d *devS3) list(w http.ResponseWriter, bucket, prefix string) {
+	keys, err := d.objects.List(bucket, prefix)
+	if err != nil {
+		s3Error(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	sort.Strings(keys)
+	result := listBucketResult{Name: bucket, Prefix: prefix}
+	for _, key := range keys {
+		info, err := d.objects.Head(bucket, key)
+		if err != nil {
+			continue
+		}
+		modified := time.Time{}
+		if stat, err := os.Stat(d.objects.path("objects", bucket, key)); err == nil {
+			modified = stat.ModTime()
+		}
+		result.Contents = append(result.Contents, listedObject{
+			Key:          key,
+			Size:         info.Size,
+			ETag:         `"` + info.ETag + `"`,
+			LastModified: modified.UTC().Format(time.RFC3339),
+		})
+	}
+	result.KeyCount = len(result.Contents)
+	writeXML(w, result)
+}
+
+func (d *devS3) createUpload(w http.ResponseWriter, req *http.Request, bucket, key string) {
+	id := newID()
+	if err := os.MkdirAll(filepath.Join(d.uploadsDir, id), 0777); err != nil {
+		s3Error(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	d.mu.Lock()
+	d.pending[id] = pendingUpload{bucket: bucket, key: key, contentType: req.Header.Get("Content-Type")}
+	d.mu.Unlock()
+	writeXML(w, initiateMultipartUploadResult{Bucket: bucket, Key: key, UploadId: id})
+}
+
+func (d *devS3) upload(id string) (pendingUpload, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	upload, ok := d.pending[id]
+	return upload, ok
+}
+
+func (d *devS3) uploadPart(w http.ResponseWriter, req *http.Request, id, partNumber string) {
+	if _, ok := d.upload(id); !ok {
+		s3Error(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+	n, err := strconv.Atoi(partNumber)
+	if err != nil || n < 1 {
+		s3Error(w, http.StatusBadRequest, "InvalidArgument", "Invalid partNumber")
+		return
+	}
+	file, err := os.Create(filepath.Join(d.uploadsDir, id, strconv.Itoa(n)))
+	if err != nil {
+		s3Error(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	defer file.Close()
+	hash := md5.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), req.Body); err != nil {
+		s3Error(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	w.Header().Set("ETag", `"`+hex.EncodeToString(hash.Sum(nil))+`"`)
+}
+
+func (d *devS3) completeUpload(w http.ResponseWriter, req *http.Request, id string) {
+	upload, ok := d.upload(id)
+	if !ok {
+		s3Error(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+	var body completeMultipartUpload
+	if err := xml.NewDecoder(req.Body).Decode(&body); err != nil || len(body.Parts) == 0 {
+		s3Error(w, http.StatusBadRequest, "MalformedXML", "The parts list could not be read")
+		return
+	}
+	var parts []io.Reader
+	for _, part := range body.Parts {
+		file, err := os.Open(filepath.Join(d.uploadsDir, id, strconv.Itoa(part.PartNumber)))
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "InvalidPart", "Part "+strconv.Itoa(part.PartNumber)+" was never uploaded")
+			return
+		}
+		defer file.Close()
+		parts = append(parts, file)
+	}
+	if err := d.objects.write(upload.bucket, upload.key, io.MultiReader(parts...), upload.contentType); err != nil {
+		s3Error(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	d.abortUpload(nil, id)
+	info, _ := d.objects.Head(upload.bucket, upload.key)
+	writeXML(w, completeMultipartUploadResult{
+		Location: req.URL.Path,
+		Bucket:   upload.bucket,
+		Key:      upload.key,
+		ETag:     `"` + info.ETag + `"`,
+	})
+}
+
+// abortUpload forgets an upload's parts. w is nil when completeUpload is
+// cleaning up.
+func (d *devS3) abortUpload(w http.ResponseWriter, id string) {
+	d.mu.Lock()
+	delete(d.pending, id)
+	d.mu.Unlock()
+	os.RemoveAll(filepath.Join(d.uploadsDir, id))
+	if w != nil {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,35 @@
+package potterylog
+
+import (
+	"bytes"
+	"image"
+	_ "image/gif"
+	"io"
+)
+
+// The measure stage records the stored image's dimensions, so Upload can
+// return them and the app doesn't have to decode the file again. Images
+// the server can't decode, like HEIC, are left at 0x0.
+
+// EXIF segments are at most 64KB and come near the start of a JPEG
+const maxJPEGHeader = 128 << 10
+
+func measureImage(s *Server, item *uploadItem) error {
+	head := make([]byte, maxJPEGHeader)
+	n, err := io.ReadFull(item.Body, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	head = head[:n]
+	config, format, err := image.DecodeConfig(io.MultiReader(bytes.NewReader(head), item.Body))
+	if err != nil {
+		return err
+	}
+	item.Width, item.Height = config.Width, config.Height
+	// Orientations 5 to 8 are rotated a quarter turn, and that's how the
+	// app shows them
+	if format == "jpeg" && jpegOrientation(head) >= 5 {
+		item.Width, item.Height = item.Height, item.Width
+	}
+	return nil
+}
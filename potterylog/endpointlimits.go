@@ -0,0 +1,74 @@
+package potterylog
+
+import (
+	"net/http"
+	"time"
+)
+
+// The config's endpoint_limits caps how many requests to an endpoint run at
+// once, by path, so that an app-wide backup prompt can't have every device
+// importing or uploading on a small server at the same time. Past the cap,
+// up to queue more requests wait up to queue_seconds for a turn, before the
+// server has read their bodies, and the rest get a 429 with Retry-After.
+// For example:
+//
+//	"endpoint_limits": {
+//	  "/pottery-log/import": {"concurrency": 2, "queue": 4, "queue_seconds": 30},
+//	  "/pottery-log-images/upload": {"concurrency": 10, "queue": 20}
+//	}
+//
+// These apply across tenants, on top of max_uploads and max_exports.
+
+// defaultEndpointQueueSeconds is how long a queued request waits when the
+// limit doesn't say
+const defaultEndpointQueueSeconds = 10
+
+type endpointLimit struct {
+	Concurrency  int `json:"concurrency"`
+	Queue        int `json:"queue"`
+	QueueSeconds int `json:"queue_seconds"`
+}
+
+func (l endpointLimit) wait() time.Duration {
+	if l.QueueSeconds > 0 {
+		return time.Duration(l.QueueSeconds) * time.Second
+	}
+	return defaultEndpointQueueSeconds * time.Second
+}
+
+var errEndpointBusy = newAPIError("endpoint_busy", "The server is busy with other requests like this one. Please try again shortly.")
+
+type endpointUse struct {
+	InUse   int `json:"in_use"`
+	Waiting int `json:"waiting"`
+}
+
+// endpointUsage is how many requests are running and waiting on each
+// limited endpoint
+func (s *Server) endpointUsage() map[string]endpointUse {
+	usage := make(map[string]endpointUse)
+	s.endpointSlots.Each(func(path string, slots *semaphore) {
+		usage[path] = endpointUse{InUse: slots.InUse(), Waiting: slots.Waiting()}
+	})
+	return usage
+}
+
+// limitEndpoints applies endpoint_limits. It has to come before anything
+// reads the form, so waiting requests don't hold their bodies in memory.
+func (s *Server) limitEndpoints(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		limit, ok := s.config().EndpointLimits[req.URL.Path]
+		if !ok || limit.Concurrency <= 0 {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		slots := s.endpointSlots.Get(req.URL.Path)
+		if !slots.AcquireQueued(limit.Concurrency, limit.Queue, limit.wait()) {
+			s.counters.Incr("endpoint-busy")
+			s.tooBusy(w, errEndpointBusy, req.URL.Query().Get("deviceId"), limit.wait())
+			return
+		}
+		defer slots.Release()
+		handler.ServeHTTP(w, req)
+	})
+}
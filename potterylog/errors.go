@@ -0,0 +1,413 @@
+package potterylog
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// apiError is an error the app knows how to show. Code is stable across
+// releases so the app can react to it; Message is English, and the app can
+// pick a translation from the response's translations map instead.
+type apiError struct {
+	Code    string
+	Message string
+	// args fill in the translations' %s verbs
+	args []interface{}
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func newAPIError(code, message string, args ...interface{}) *apiError {
+	return &apiError{Code: code, Message: message, args: args}
+}
+
+func errMissingField(fields ...string) *apiError {
+	if len(fields) == 0 {
+		return newAPIError("missing_field", "Missing required field", "")
+	}
+	names := strings.Join(fields, " or ")
+	return newAPIError("missing_field", "Missing required field "+names, names)
+}
+
+var (
+	errInvalidDeviceID   = newAPIError("invalid_device_id", "Invalid deviceId")
+	errMethodNotAllowed  = newAPIError("method_not_allowed", "Method not allowed")
+	errNotFound          = newAPIError("not_found", "Not found")
+	errNoExport          = newAPIError("no_export", "There is no export")
+	errExportFinished    = newAPIError("export_finished", "The export has finished")
+	errNoSpace           = newAPIError("no_space", "The server is out of storage space. Please try again later.")
+	errInternal          = newAPIError("internal", "Something went wrong on the server. Please try again.")
+	errAttestationFailed = newAPIError("attestation_failed", "This request could not be verified as coming from Pottery Log")
+)
+
+// errorTranslations has each error code's message in the languages the app
+// ships, as a format for the error's args. Codes without an entry are only
+// shown in English.
+var errorTranslations = map[string]map[string]string{
+	"missing_field": {
+		"es": "Falta el campo obligatorio %s",
+		"fr": "Champ obligatoire manquant : %s",
+		"de": "Pflichtfeld fehlt: %s",
+	},
+	"invalid_device_id": {
+		"es": "El identificador del dispositivo no es válido",
+		"fr": "L'identifiant de l'appareil n'est pas valide",
+		"de": "Ungültige Geräte-ID",
+	},
+	"field_too_long": {
+		"es": "%s es demasiado largo",
+		"fr": "%s est trop long",
+		"de": "%s ist zu lang",
+	},
+	"invalid_field": {
+		"es": "%s no es válido",
+		"fr": "%s n'est pas valide",
+		"de": "%s ist ungültig",
+	},
+	"no_such_export": {
+		"es": "No existe esa exportación",
+		"fr": "Cette exportation n'existe pas",
+		"de": "Diesen Export gibt es nicht",
+	},
+	"no_such_key": {
+		"es": "No hay ninguna clave guardada con ese identificador",
+		"fr": "Aucune clé enregistrée ne correspond à cet identifiant",
+		"de": "Es ist kein Schlüssel mit dieser ID gespeichert",
+	},
+	"metadata_encrypted": {
+		"es": "Estos datos están cifrados, así que el servidor no puede leerlos",
+		"fr": "Ces données sont chiffrées, le serveur ne peut donc pas les lire",
+		"de": "Diese Daten sind verschlüsselt, daher kann der Server sie nicht lesen",
+	},
+	"not_an_export": {
+		"es": "%s no es una exportación",
+		"fr": "%s n'est pas une exportation",
+		"de": "%s ist kein Export",
+	},
+	"no_export": {
+		"es": "No hay ninguna exportación en curso",
+		"fr": "Aucune exportation en cours",
+		"de": "Es läuft kein Export",
+	},
+	"export_finished": {
+		"es": "La exportación ya terminó",
+		"fr": "L'exportation est déjà terminée",
+		"de": "Der Export ist bereits abgeschlossen",
+	},
+	"exports_busy": {
+		"es": "El servidor está ocupado con otras copias de seguridad. Inténtalo de nuevo en unos minutos.",
+		"fr": "Le serveur est occupé par d'autres sauvegardes. Réessayez dans quelques minutes.",
+		"de": "Der Server ist mit anderen Sicherungen beschäftigt. Bitte versuche es in ein paar Minuten erneut.",
+	},
+	"uploads_busy": {
+		"es": "El servidor está ocupado con otras subidas. Inténtalo de nuevo en breve.",
+		"fr": "Le serveur est occupé par d'autres envois. Réessayez dans un instant.",
+		"de": "Der Server ist mit anderen Uploads beschäftigt. Bitte versuche es gleich erneut.",
+	},
+	"endpoint_busy": {
+		"es": "El servidor está ocupado con otras solicitudes como esta. Inténtalo de nuevo en breve.",
+		"fr": "Le serveur est occupé par d'autres requêtes comme celle-ci. Réessayez dans un instant.",
+		"de": "Der Server ist mit anderen solchen Anfragen beschäftigt. Bitte versuche es gleich erneut.",
+	},
+	"memory_busy": {
+		"es": "El servidor está ocupado con otras solicitudes grandes. Inténtalo de nuevo en breve.",
+		"fr": "Le serveur est occupé par d'autres requêtes volumineuses. Réessayez dans un instant.",
+		"de": "Der Server ist mit anderen großen Anfragen beschäftigt. Bitte versuche es gleich erneut.",
+	},
+	"portfolios_busy": {
+		"es": "El servidor está ocupado con otros portafolios. Inténtalo de nuevo en un minuto.",
+		"fr": "Le serveur est occupé par d'autres portfolios. Réessayez dans une minute.",
+		"de": "Der Server ist mit anderen Portfolios beschäftigt. Bitte versuche es in einer Minute erneut.",
+	},
+	"too_many_pots": {
+		"es": "Un portafolio puede tener como máximo %d piezas",
+		"fr": "Un portfolio peut contenir au plus %d pièces",
+		"de": "Ein Portfolio kann höchstens %d Stücke enthalten",
+	},
+	"no_calendar_feed": {
+		"es": "Este dispositivo no tiene un calendario",
+		"fr": "Cet appareil n'a pas de calendrier",
+		"de": "Dieses Gerät hat keinen Kalender",
+	},
+	"no_share_feed": {
+		"es": "No hay ningún feed de piezas compartidas",
+		"fr": "Il n'y a pas de flux de pièces partagées",
+		"de": "Es gibt keinen Feed mit geteilten Stücken",
+	},
+	"no_shared_pots": {
+		"es": "No hay piezas compartidas con las que hacer un sitio",
+		"fr": "Il n'y a aucune pièce partagée pour créer un site",
+		"de": "Es gibt keine geteilten Stücke für eine Website",
+	},
+	"invalid_api_key": {
+		"es": "Esta clave de API no es válida",
+		"fr": "Cette clé d'API n'est pas valide",
+		"de": "Dieser API-Schlüssel ist ungültig",
+	},
+	"api_key_read_only": {
+		"es": "Esta clave de API solo puede leer",
+		"fr": "Cette clé d'API ne peut que lire",
+		"de": "Dieser API-Schlüssel kann nur lesen",
+	},
+	"api_key_not_allowed": {
+		"es": "Las claves de API no pueden gestionar claves de API",
+		"fr": "Les clés d'API ne peuvent pas gérer les clés d'API",
+		"de": "API-Schlüssel können keine API-Schlüssel verwalten",
+	},
+	"api_key_rate_limited": {
+		"es": "Esta clave de API ha hecho demasiadas solicitudes. Ve más despacio.",
+		"fr": "Cette clé d'API a fait trop de requêtes. Ralentissez, s'il vous plaît.",
+		"de": "Dieser API-Schlüssel hat zu viele Anfragen gestellt. Bitte langsamer.",
+	},
+	"api_key_quota": {
+		"es": "Esta clave de API ha agotado sus solicitudes de hoy",
+		"fr": "Cette clé d'API a épuisé ses requêtes pour aujourd'hui",
+		"de": "Dieser API-Schlüssel hat seine Anfragen für heute aufgebraucht",
+	},
+	"no_such_api_key": {
+		"es": "No hay ninguna clave de API con ese identificador",
+		"fr": "Aucune clé d'API ne correspond à cet identifiant",
+		"de": "Es gibt keinen API-Schlüssel mit dieser ID",
+	},
+	"too_many_api_keys": {
+		"es": "Este dispositivo ya tiene todas las claves de API que puede tener",
+		"fr": "Cet appareil a déjà autant de clés d'API que possible",
+		"de": "Dieses Gerät hat bereits so viele API-Schlüssel wie möglich",
+	},
+	"invalid_export": {
+		"es": "No se encontró metadata.json en el archivo zip",
+		"fr": "Aucun fichier metadata.json dans le fichier zip",
+		"de": "Keine metadata.json in der ZIP-Datei gefunden",
+	},
+	"invalid_archive": {
+		"es": "La copia de seguridad no es un archivo zip válido",
+		"fr": "La sauvegarde n'est pas un fichier zip valide",
+		"de": "Die Sicherung ist keine gültige ZIP-Datei",
+	},
+	"invalid_metadata": {
+		"es": "No se pueden leer los metadatos de la copia de seguridad",
+		"fr": "Les métadonnées de la sauvegarde sont illisibles",
+		"de": "Die Metadaten der Sicherung können nicht gelesen werden",
+	},
+	"invalid_current_metadata": {
+		"es": "No se pueden leer los metadatos actuales",
+		"fr": "Les métadonnées actuelles sont illisibles",
+		"de": "Die aktuellen Metadaten können nicht gelesen werden",
+	},
+	"invalid_image_url": {
+		"es": "El enlace debe ser una URL http o https",
+		"fr": "Le lien doit être une URL http ou https",
+		"de": "Der Link muss eine http- oder https-URL sein",
+	},
+	"private_image_url": {
+		"es": "El enlace apunta a una dirección privada",
+		"fr": "Le lien pointe vers une adresse privée",
+		"de": "Der Link verweist auf eine private Adresse",
+	},
+	"image_url_timeout": {
+		"es": "La descarga de la imagen tardó demasiado",
+		"fr": "Le téléchargement de l'image a pris trop de temps",
+		"de": "Das Herunterladen des Bildes hat zu lange gedauert",
+	},
+	"image_url_unreachable": {
+		"es": "No se pudo conectar con el servidor de la imagen",
+		"fr": "Le serveur de l'image est injoignable",
+		"de": "Der Server des Bildes ist nicht erreichbar",
+	},
+	"image_url_failed": {
+		"es": "No se pudo descargar la imagen (estado %s)",
+		"fr": "L'image n'a pas pu être téléchargée (statut %s)",
+		"de": "Das Bild konnte nicht heruntergeladen werden (Status %s)",
+	},
+	"image_too_large": {
+		"es": "La imagen supera el límite del servidor de %s",
+		"fr": "L'image dépasse la limite du serveur de %s",
+		"de": "Das Bild überschreitet die Grenze des Servers von %s",
+	},
+	"not_an_image": {
+		"es": "El enlace no es de una imagen",
+		"fr": "Le lien ne mène pas à une image",
+		"de": "Der Link führt nicht zu einem Bild",
+	},
+	"client_events_rate_limited": {
+		"es": "Demasiados eventos del cliente. Ve más despacio.",
+		"fr": "Trop d'événements client. Ralentissez, s'il vous plaît.",
+		"de": "Zu viele Client-Ereignisse. Bitte langsamer.",
+	},
+	"no_such_debug_log": {
+		"es": "No hay ningún registro de depuración con ese identificador",
+		"fr": "Il n'y a aucun journal de débogage avec cet identifiant",
+		"de": "Es gibt kein Debug-Protokoll mit dieser ID",
+	},
+	"debug_bundle_too_large": {
+		"es": "El paquete de depuración supera el límite del servidor de %s",
+		"fr": "Le paquet de débogage dépasse la limite du serveur de %s",
+		"de": "Das Debug-Paket überschreitet die Grenze des Servers von %s",
+	},
+	"empty_debug_bundle": {
+		"es": "El paquete de depuración está vacío",
+		"fr": "Le paquet de débogage est vide",
+		"de": "Das Debug-Paket ist leer",
+	},
+	"debug_log_not_text": {
+		"es": "Un registro del paquete de depuración no es texto UTF-8",
+		"fr": "Un journal du paquet de débogage n'est pas du texte UTF-8",
+		"de": "Ein Protokoll im Debug-Paket ist kein UTF-8-Text",
+	},
+	"too_many_debug_logs": {
+		"es": "Un paquete de depuración puede tener como máximo %d registros",
+		"fr": "Un paquet de débogage peut contenir au plus %d journaux",
+		"de": "Ein Debug-Paket kann höchstens %d Protokolle enthalten",
+	},
+	"debug_part_not_json": {
+		"es": "La parte %s del paquete de depuración no es un objeto JSON",
+		"fr": "La partie %s du paquet de débogage n'est pas un objet JSON",
+		"de": "Der Teil %s des Debug-Pakets ist kein JSON-Objekt",
+	},
+	"legacy_import_unreadable": {
+		"es": "No se puede leer la exportación de %s",
+		"fr": "L'export %s est illisible",
+		"de": "Der %s-Export kann nicht gelesen werden",
+	},
+	"legacy_import_empty": {
+		"es": "No hay piezas en la exportación de %s",
+		"fr": "L'export %s ne contient aucune pièce",
+		"de": "Der %s-Export enthält keine Stücke",
+	},
+	"legacy_photo_missing": {
+		"es": "La foto no está en el archivo subido",
+		"fr": "La photo ne se trouve pas dans le fichier envoyé",
+		"de": "Das Foto ist nicht in der hochgeladenen Datei",
+	},
+	"no_space": {
+		"es": "El servidor no tiene espacio de almacenamiento. Inténtalo de nuevo más tarde.",
+		"fr": "Le serveur n'a plus d'espace de stockage. Réessayez plus tard.",
+		"de": "Der Server hat keinen Speicherplatz mehr. Bitte versuche es später erneut.",
+	},
+	"file_name_taken": {
+		"es": "Ya se subió otra imagen con este nombre",
+		"fr": "Une autre image portant ce nom a déjà été envoyée",
+		"de": "Ein anderes Bild mit diesem Namen wurde bereits hochgeladen",
+	},
+	"no_such_webhook": {
+		"es": "No hay ningún webhook con ese identificador",
+		"fr": "Aucun webhook ne correspond à cet identifiant",
+		"de": "Es gibt keinen Webhook mit dieser ID",
+	},
+	"too_many_webhooks": {
+		"es": "Este estudio ya tiene el máximo de webhooks",
+		"fr": "Cet atelier a déjà le nombre maximal de webhooks",
+		"de": "Dieses Studio hat bereits die maximale Anzahl an Webhooks",
+	},
+	"too_many_image_webhooks": {
+		"es": "Este dispositivo ya tiene el máximo de webhooks",
+		"fr": "Cet appareil a déjà le nombre maximal de webhooks",
+		"de": "Dieses Gerät hat bereits die maximale Anzahl an Webhooks",
+	},
+	"not_export_link": {
+		"es": "El enlace debe ser un enlace de exportación de Pottery Log",
+		"fr": "Le lien doit être un lien d'exportation Pottery Log",
+		"de": "Der Link muss ein Pottery-Log-Exportlink sein",
+	},
+	"import_limit": {
+		"es": "Se han restaurado demasiadas copias de seguridad desde enlaces recientemente. Inténtalo de nuevo más tarde.",
+		"fr": "Trop de sauvegardes ont été restaurées depuis des liens récemment. Réessayez plus tard.",
+		"de": "In letzter Zeit wurden zu viele Sicherungen über Links wiederhergestellt. Bitte versuche es später erneut.",
+	},
+	"device_unauthorized": {
+		"es": "Este dispositivo no está autorizado",
+		"fr": "Cet appareil n'est pas autorisé",
+		"de": "Dieses Gerät ist nicht berechtigt",
+	},
+	"device_blocked": {
+		"es": "Este dispositivo ha sido bloqueado. Ponte en contacto con el soporte.",
+		"fr": "Cet appareil a été bloqué. Veuillez contacter l'assistance.",
+		"de": "Dieses Gerät wurde gesperrt. Bitte wende dich an den Support.",
+	},
+	"pot_not_found": {
+		"es": "No hay ninguna pieza con ese identificador",
+		"fr": "Aucune pièce ne correspond à cet identifiant",
+		"de": "Es gibt kein Stück mit dieser ID",
+	},
+	"internal": {
+		"es": "Algo salió mal en el servidor. Inténtalo de nuevo.",
+		"fr": "Une erreur s'est produite sur le serveur. Veuillez réessayer.",
+		"de": "Auf dem Server ist etwas schiefgelaufen. Bitte versuche es erneut.",
+	},
+	"not_found": {
+		"es": "No encontrado",
+		"fr": "Introuvable",
+		"de": "Nicht gefunden",
+	},
+}
+
+// errorCode is the stable code for err, falling back to one based on the
+// response status for errors that don't have their own
+func errorCode(err error, status int) string {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	switch status {
+	case http.StatusBadRequest:
+		return "bad_request"
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusTooManyRequests:
+		return "busy"
+	case http.StatusServiceUnavailable:
+		return "unavailable"
+	}
+	return "internal"
+}
+
+// publicError turns an error into one that's safe to send to the app.
+// Server errors from AWS or the filesystem can include bucket names, paths,
+// and AWS request ids, so they're replaced with a generic message; the full
+// error is logged with the request id. Client errors describe the request,
+// so their messages are kept.
+func publicError(err error, status int) error {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		return errNoSpace
+	}
+	if status >= 500 {
+		return errInternal
+	}
+	return err
+}
+
+// translations of err's message by language, or nil
+func translations(err error) map[string]string {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		return nil
+	}
+	formats := errorTranslations[apiErr.Code]
+	if len(formats) == 0 {
+		return nil
+	}
+	translated := make(map[string]string, len(formats))
+	for lang, format := range formats {
+		if len(apiErr.args) > 0 {
+			translated[lang] = strings.TrimRight(fmt.Sprintf(format, apiErr.args...), " :")
+		} else {
+			translated[lang] = format
+		}
+	}
+	return translated
+}
@@ -0,0 +1,260 @@
+package potterylog
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// event is something logEvent can send. Each kind of event is its own type,
+// and its JSON fields are the event's properties, so a misspelled or
+// mistyped property is a compile error rather than a dropped tag. New
+// properties can be added to a type without touching its callers.
+type event interface {
+	eventType() string
+}
+
+// plainEvent is an event with no properties
+type plainEvent string
+
+func (e plainEvent) eventType() string { return string(e) }
+
+func (e plainEvent) MarshalJSON() ([]byte, error) { return []byte("{}"), nil }
+
+const (
+	AddWebhookEvent      plainEvent = "server-add-webhook"
+	AutoBanEvent         plainEvent = "server-auto-ban"
+	CalendarFeedEvent    plainEvent = "server-calendar-feed"
+	CreatePotEvent       plainEvent = "server-create-pot"
+	CreateStudioEvent    plainEvent = "server-create-studio"
+	DeleteEvent          plainEvent = "server-delete"
+	DeletePotEvent       plainEvent = "server-delete-pot"
+	EscrowKeyEvent       plainEvent = "server-escrow-key"
+	ExportBusyEvent      plainEvent = "server-export-busy"
+	ExportImageEvent     plainEvent = "server-export-image"
+	ImportVersionEvent   plainEvent = "server-import-version"
+	IssueAPIKeyEvent     plainEvent = "server-issue-api-key"
+	RecoverKeyEvent      plainEvent = "server-recover-key"
+	RegisterDeviceEvent  plainEvent = "server-register-device"
+	RestoreMetadataEvent plainEvent = "server-restore-metadata"
+	RevokeAPIKeyEvent    plainEvent = "server-revoke-api-key"
+	ShareFeedEvent       plainEvent = "server-share-feed"
+	SharePotEvent        plainEvent = "server-share-pot"
+	UnsharePotEvent      plainEvent = "server-unshare-pot"
+	UpdatePotEvent       plainEvent = "server-update-pot"
+	UploadBusyEvent      plainEvent = "server-upload-busy"
+	ViewShareEvent       plainEvent = "server-view-share"
+)
+
+// millis is a duration that's sent as whole milliseconds
+type millis time.Duration
+
+func (m millis) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(m).Milliseconds())
+}
+
+type ErrorEvent struct {
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+func (ErrorEvent) eventType() string { return "server-error" }
+
+type UploadEvent struct {
+	Bytes       int64  `json:"bytes"`
+	ContentType string `json:"content_type"`
+}
+
+func (UploadEvent) eventType() string { return "server-upload" }
+
+// UploadFromURLEvent is an image the server fetched from Host for the app
+type UploadFromURLEvent struct {
+	Bytes       int64  `json:"bytes"`
+	ContentType string `json:"content_type"`
+	Host        string `json:"host"`
+	Duration    millis `json:"duration_ms"`
+}
+
+func (UploadFromURLEvent) eventType() string { return "server-upload-from-url" }
+
+type StartExportEvent struct {
+	CopiedImages int `json:"copied_images"`
+}
+
+func (StartExportEvent) eventType() string { return "server-start-export" }
+
+// ExportFinishedEvent is an export the app built. Duration runs from the
+// start of the export, and Phases has the milliseconds spent in each phase
+// (see phases.go).
+type ExportFinishedEvent struct {
+	Bytes    int64            `json:"bytes"`
+	Images   int              `json:"images"`
+	Duration millis           `json:"duration_ms"`
+	Phases   map[string]int64 `json:"phases_ms"`
+}
+
+func (ExportFinishedEvent) eventType() string { return "server-finish-export" }
+
+// ServerExportEvent is an export the server built from its own copy of the
+// device's data
+type ServerExportEvent struct {
+	Bytes    int64            `json:"bytes"`
+	Images   int              `json:"images"`
+	Duration millis           `json:"duration_ms"`
+	Phases   map[string]int64 `json:"phases_ms"`
+}
+
+func (ServerExportEvent) eventType() string { return "server-server-export" }
+
+// ImportEvent is an import, which is Cached if the same archive was
+// imported recently and nothing was uploaded. Skipped images were already
+// stored by an earlier import, and Failed ones were damaged and left out.
+type ImportEvent struct {
+	Bytes    int64            `json:"bytes"`
+	Images   int              `json:"images"`
+	Skipped  int              `json:"skipped"`
+	Failed   int              `json:"failed"`
+	Duration millis           `json:"duration_ms"`
+	Phases   map[string]int64 `json:"phases_ms"`
+	Cached   bool             `json:"cached"`
+}
+
+func (ImportEvent) eventType() string { return "server-import" }
+
+type DeleteExportsEvent struct {
+	Count int `json:"count"`
+}
+
+func (DeleteExportsEvent) eventType() string { return "server-delete-exports" }
+
+// BackupReminderEvent has Days since the last export, or NeverExported
+type BackupReminderEvent struct {
+	Days          int  `json:"days,omitempty"`
+	NeverExported bool `json:"never_exported,omitempty"`
+}
+
+func (BackupReminderEvent) eventType() string { return "server-backup-reminder" }
+
+type BackupMetadataEvent struct {
+	Bytes     int  `json:"bytes"`
+	Unchanged bool `json:"unchanged"`
+	Encrypted bool `json:"encrypted"`
+}
+
+func (BackupMetadataEvent) eventType() string { return "server-backup-metadata" }
+
+// PotImagesEvent is a change to a pot's images, where Change is "attach",
+// "detach", "reorder", or "cover"
+type PotImagesEvent struct {
+	Change string `json:"-"`
+	Images int    `json:"images"`
+}
+
+func (e PotImagesEvent) eventType() string {
+	switch e.Change {
+	case "reorder":
+		return "server-reorder-images"
+	case "cover":
+		return "server-set-cover"
+	}
+	return "server-" + e.Change + "-image"
+}
+
+type CollageEvent struct {
+	Images int `json:"images"`
+	Bytes  int `json:"bytes"`
+}
+
+func (CollageEvent) eventType() string { return "server-collage" }
+
+type SearchEvent struct {
+	Results int `json:"results"`
+}
+
+func (SearchEvent) eventType() string { return "server-search" }
+
+type StudioMemberEvent struct {
+	Role string `json:"role"`
+}
+
+func (StudioMemberEvent) eventType() string { return "server-studio-member" }
+
+type ExportTableEvent struct {
+	Format string `json:"format"`
+	Pots   int    `json:"pots"`
+	Bytes  int    `json:"bytes"`
+}
+
+func (ExportTableEvent) eventType() string { return "server-export-table" }
+
+type PortfolioEvent struct {
+	Pots     int    `json:"pots"`
+	Images   int    `json:"images"`
+	Bytes    int    `json:"bytes"`
+	Duration millis `json:"duration_ms"`
+}
+
+func (PortfolioEvent) eventType() string { return "server-portfolio" }
+
+type StaticSiteEvent struct {
+	Pots     int    `json:"pots"`
+	Images   int    `json:"images"`
+	Bytes    int64  `json:"bytes"`
+	Duration millis `json:"duration_ms"`
+}
+
+func (StaticSiteEvent) eventType() string { return "server-static-site" }
+
+type ImportPreviewEvent struct {
+	Pots   int   `json:"pots"`
+	Images int   `json:"images"`
+	Bytes  int64 `json:"bytes"`
+}
+
+func (ImportPreviewEvent) eventType() string { return "server-import-preview" }
+
+type RecompressEvent struct {
+	BytesBefore int64 `json:"bytes_before"`
+	BytesAfter  int   `json:"bytes_after"`
+}
+
+func (RecompressEvent) eventType() string { return "server-recompress" }
+
+type RecompressSettingEvent struct {
+	Enabled bool `json:"enabled"`
+}
+
+func (RecompressSettingEvent) eventType() string { return "server-recompress-setting" }
+
+type AttestationFailedEvent struct {
+	Mode string `json:"mode"`
+}
+
+func (AttestationFailedEvent) eventType() string { return "server-attestation-failed" }
+
+type MaintenanceRejectEvent struct {
+	Path string `json:"path"`
+}
+
+func (MaintenanceRejectEvent) eventType() string { return "server-maintenance-reject" }
+
+type JobEvent struct {
+	Job string `json:"job"`
+	MS  int64  `json:"ms"`
+	OK  bool   `json:"ok"`
+}
+
+func (JobEvent) eventType() string { return "server-job" }
+
+type VerifyEvent struct {
+	Checked int `json:"checked"`
+	Corrupt int `json:"corrupt"`
+}
+
+func (VerifyEvent) eventType() string { return "server-verify" }
+
+type VerifyCorruptEvent struct {
+	Problem  string `json:"problem"`
+	Repaired bool   `json:"repaired"`
+}
+
+func (VerifyCorruptEvent) eventType() string { return "server-verify-corrupt" }
@@ -0,0 +1,170 @@
+package potterylog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With export_delivery set to "direct" in the config, finish-export answers
+// with the archive itself instead of storing it in the exports bucket, for
+// self-hosted servers that don't want a second bucket. The archive stays in
+// the export temp directory until cleanTempDir removes it 6 hours later, along with its
+// export history entry, so a download that drops can be resumed with
+// Range: by retrying finish-export with the same exportId, or from the
+// archive's uri. Both need the device token.
+
+const (
+	exportDeliveryBucket = "bucket"
+	exportDeliveryDirect = "direct"
+)
+
+const exportDownloadPath = "/pottery-log/export-download/"
+
+func validateExportDelivery(c *config) error {
+	switch c.ExportDelivery {
+	case "", exportDeliveryBucket, exportDeliveryDirect:
+		return nil
+	}
+	return fmt.Errorf("export_delivery: %q must be %s or %s", c.ExportDelivery, exportDeliveryBucket, exportDeliveryDirect)
+}
+
+// exportFile is where an export's archive is built, and kept after a
+// direct export finishes
+func (e *exports) exportFile(deviceID, exportID string) string {
+	return filepath.Join(e.tempDir, deviceID+"-"+exportID+".zip")
+}
+
+// exportDownload describes a finished direct export. It's kept next to the
+// archive, and its being there is what marks the archive finished.
+type exportDownload struct {
+	HistoryID      string    `json:"history_id"`
+	URI            string    `json:"uri"`
+	Images         int       `json:"images"`
+	SHA256         string    `json:"sha256"`
+	ManifestSHA256 string    `json:"manifest_sha256"`
+	FinishedAt     time.Time `json:"finished_at"`
+}
+
+func (e *exports) exportDownloadInfoFile(deviceID, exportID string) string {
+	return strings.TrimSuffix(e.exportFile(deviceID, exportID), ".zip") + ".json"
+}
+
+func (s *Server) exportDownloadURI(req *http.Request, deviceID, exportID string) string {
+	return s.publicLink(req, exportDownloadPath+deviceID+"/"+exportID+".zip")
+}
+
+// keepExportDownload marks the finished export's archive as a download
+func (e *exports) keepExportDownload(exp *export, d *exportDownload) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(e.exportDownloadInfoFile(exp.deviceID, exp.id), data, 0644)
+}
+
+// finishedExportDownload opens the device's finished direct export, or
+// returns nil if there isn't one or it's been cleaned up
+func (e *exports) finishedExportDownload(deviceID, exportID string) (*exportDownload, *os.File) {
+	if exportID == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(e.exportDownloadInfoFile(deviceID, exportID))
+	if err != nil {
+		return nil, nil
+	}
+	var d exportDownload
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, nil
+	}
+	file, err := os.Open(e.exportFile(deviceID, exportID))
+	if err != nil {
+		return nil, nil
+	}
+	return &d, file
+}
+
+// serveExportDownload answers with the archive, or the Range of it asked
+// for. What finish-export otherwise answers with goes in headers.
+func serveExportDownload(w http.ResponseWriter, req *http.Request, d *exportDownload, file io.ReadSeeker) {
+	header := w.Header()
+	fileName := "pottery_log_export_" + d.FinishedAt.Format("2006_01_02") + ".zip"
+	header.Set("Content-Type", "application/zip")
+	header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	// If-Range is checked against this, so a resumed download can't mix
+	// two archives
+	header.Set("ETag", `"`+d.SHA256+`"`)
+	header.Set("X-Export-Uri", d.URI)
+	header.Set("X-Export-Id", d.HistoryID)
+	header.Set("X-Export-Images", strconv.Itoa(d.Images))
+	header.Set("X-Export-Sha256", d.SHA256)
+	header.Set("X-Export-Manifest-Sha256", d.ManifestSHA256)
+	header.Set("X-Export-Expires-At", d.FinishedAt.Add(tempFileMaxAge).UTC().Format(time.RFC3339))
+	http.ServeContent(w, req, fileName, d.FinishedAt, file)
+}
+
+// ExportDownload serves /pottery-log/export-download/<deviceId>/<exportId>.zip,
+// a finished direct export
+func (s *Server) ExportDownload(w http.ResponseWriter, req *http.Request) {
+	deviceID, fileName, ok := s.proxyPath(w, req, exportDownloadPath)
+	if !ok || !s.requireDevice(w, req, deviceID) {
+		return
+	}
+	exportID := strings.TrimSuffix(fileName, ".zip")
+	if exportID == fileName || !validID(exportID) {
+		s.handleErrCode(errNotFound, http.StatusNotFound, deviceID, w)
+		return
+	}
+	d, file := s.Exports.finishedExportDownload(deviceID, exportID)
+	if d == nil {
+		s.handleErrCode(errNotFound, http.StatusNotFound, deviceID, w)
+		return
+	}
+	defer file.Close()
+	serveExportDownload(w, req, d, file)
+}
+
+// forgetExportDownload is for when cleanTempDir removes a finished direct
+// export's info file at location. Its archive goes with it, and so does
+// its export history entry, whose link would no longer work.
+func (e *exports) forgetExportDownload(location string) {
+	base := strings.TrimSuffix(filepath.Base(location), ".json")
+	i := strings.LastIndex(base, "-")
+	if i < 0 {
+		return
+	}
+	deviceID, exportID := base[:i], base[i+1:]
+	data, err := ioutil.ReadFile(location)
+	if err != nil {
+		return
+	}
+	var d exportDownload
+	if err := json.Unmarshal(data, &d); err != nil || d.URI == "" {
+		return
+	}
+	os.Remove(e.exportFile(deviceID, exportID))
+	e.db.ExportDeleted(deviceID, d.URI)
+}
+
+// keptExportDownload is the archive of the device's direct export at uri,
+// from its export history, if it hasn't been cleaned up. Restoring one
+// reads it here, since it isn't in any bucket.
+func (e *exports) keptExportDownload(deviceID, uri string) (string, bool) {
+	prefix := exportDownloadPath + deviceID + "/"
+	i := strings.Index(uri, prefix)
+	if i < 0 {
+		return "", false
+	}
+	exportID := strings.TrimSuffix(uri[i+len(prefix):], ".zip")
+	if !validID(exportID) || !fileExists(e.exportDownloadInfoFile(deviceID, exportID)) {
+		return "", false
+	}
+	return e.exportFile(deviceID, exportID), true
+}
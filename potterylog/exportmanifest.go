@@ -0,0 +1,175 @@
+package potterylog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// A phone restoring a backup over a flaky connection fetches the export in
+// chunks from the export proxy, using Range and If-Range. The manifest lists
+// each chunk's offset and SHA-256 so the app can check what it has, resume
+// after a drop, and refetch only the chunks that don't match.
+
+const (
+	defaultManifestChunkBytes = 4 << 20
+	minManifestChunkBytes     = 256 << 10
+	maxManifestChunkBytes     = 64 << 20
+	// manifests holds at most this many, since exports are only restored
+	// now and then
+	maxCachedManifests = 100
+)
+
+type exportChunk struct {
+	Index  int    `json:"index"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	SHA256 string `json:"sha256"`
+}
+
+type exportManifest struct {
+	Name string `json:"name"`
+	// URL is the export proxy path to request the chunks from
+	URL string `json:"url"`
+	// ETag goes in If-Range, so a chunk of a replaced export isn't
+	// mixed in with the old one
+	ETag       string        `json:"etag"`
+	Size       int64         `json:"size"`
+	ChunkBytes int64         `json:"chunkBytes"`
+	SHA256     string        `json:"sha256"`
+	Chunks     []exportChunk `json:"chunks"`
+}
+
+// manifestCache holds computed manifests by bucket, key, etag, and chunk size,
+// because hashing means reading the whole export and a retrying client
+// asks again
+type manifestCache struct {
+	mu    sync.Mutex
+	built map[string]exportManifest
+}
+
+func (c *manifestCache) Get(cacheKey string) (exportManifest, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.built[cacheKey]
+	return m, ok
+}
+
+func (c *manifestCache) Put(cacheKey string, m exportManifest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.built == nil {
+		c.built = make(map[string]exportManifest)
+	}
+	if len(c.built) >= maxCachedManifests {
+		for k := range c.built {
+			delete(c.built, k)
+			break
+		}
+	}
+	c.built[cacheKey] = m
+}
+
+// buildExportManifest reads the export in the bucket once, hashing each
+// chunk and the whole
+func (s *Server) buildExportManifest(bucketName, deviceID, name string, chunkBytes int64) (exportManifest, error) {
+	key := deviceID + "/" + name
+	info, err := s.Storage.Head(bucketName, key)
+	if isNotFound(err) {
+		return exportManifest{}, errNoSuchExport
+	}
+	if err != nil {
+		return exportManifest{}, err
+	}
+	cacheKey := bucketName + "/" + key + " " + info.ETag + " " + strconv.FormatInt(chunkBytes, 10)
+	if m, ok := s.manifests.Get(cacheKey); ok {
+		return m, nil
+	}
+
+	obj, err := s.Storage.Fetch(bucketName, key, FetchConditions{})
+	if isNotFound(err) {
+		return exportManifest{}, errNoSuchExport
+	}
+	if err != nil {
+		return exportManifest{}, err
+	}
+	defer obj.Body.Close()
+
+	m := exportManifest{
+		Name:       name,
+		URL:        exportProxyPath + key,
+		ETag:       `"` + info.ETag + `"`,
+		ChunkBytes: chunkBytes,
+		Chunks:     []exportChunk{},
+	}
+	whole := sha256.New()
+	for {
+		chunk := sha256.New()
+		n, err := io.Copy(io.MultiWriter(chunk, whole), io.LimitReader(obj.Body, chunkBytes))
+		if err != nil {
+			return exportManifest{}, err
+		}
+		if n == 0 {
+			break
+		}
+		m.Chunks = append(m.Chunks, exportChunk{
+			Index:  len(m.Chunks),
+			Offset: m.Size,
+			Length: n,
+			SHA256: hex.EncodeToString(chunk.Sum(nil)),
+		})
+		m.Size += n
+	}
+	m.SHA256 = hex.EncodeToString(whole.Sum(nil))
+	s.manifests.Put(cacheKey, m)
+	return m, nil
+}
+
+// ExportManifest describes the device's stored export name as chunks of
+// chunkBytes (4MB by default) to download from the export proxy
+func (s *Server) ExportManifest(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	if !s.requireDevice(w, req, deviceID) {
+		return
+	}
+	name := req.FormValue("name")
+	if name == "" {
+		s.handleErrCode(errMissingField("name"), http.StatusBadRequest, deviceID, w)
+		return
+	}
+	if !isExportZip(name) {
+		s.handleErrCode(errNotAnExport(name), http.StatusBadRequest, deviceID, w)
+		return
+	}
+	chunkBytes := int64(defaultManifestChunkBytes)
+	if v := req.FormValue("chunkBytes"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < minManifestChunkBytes || n > maxManifestChunkBytes {
+			s.handleErrCode(errInvalidField("chunkBytes"), http.StatusBadRequest, deviceID, w)
+			return
+		}
+		chunkBytes = n
+	}
+
+	m, err := s.buildExportManifest(requestTenant(req).importBucket(), deviceID, name, chunkBytes)
+	if err == errNoSuchExport {
+		s.handleErrCode(err, http.StatusNotFound, deviceID, w)
+		return
+	}
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+	writeJSON(w, struct {
+		Status string `json:"status"`
+		exportManifest
+	}{
+		Status:         "ok",
+		exportManifest: m,
+	})
+}
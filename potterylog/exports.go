@@ -0,0 +1,524 @@
+package potterylog
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metadataFileName = "metadata.json"
+
+// Exports that see no activity for this long are abandoned, and are
+// discarded when their slot is needed
+const exportIdleTimeout = time.Hour
+
+// Files in the temp directory that aren't in use are removed after this long
+const tempFileMaxAge = 6 * time.Hour
+
+var errExportsBusy = newAPIError("exports_busy", "The server is busy with other backups. Please try again in a few minutes.")
+
+type export struct {
+	mu    sync.Mutex
+	clock Clock
+	// db records the export in export_sessions, unless it's nil
+	db       *opsDB
+	id       string
+	deviceID string
+	tenant   string
+	started  time.Time
+	active   time.Time
+	f        *os.File
+	w        *zip.Writer
+	// sum hashes the archive as it's written
+	sum      hash.Hash
+	finished bool
+	// images counts the entries added besides the metadata
+	images int
+	// entries are the images in the archive so far, so the app can resend
+	// any that never arrived
+	entries []exportEntry
+	phases  *phaseTimes
+
+	// Images are compressed into staging files concurrently, then a single
+	// writer goroutine appends them to the archive. adding counts the
+	// entries being staged, so Finish can wait for them.
+	adding     sync.WaitGroup
+	appends    chan *stagedEntry
+	written    chan struct{}
+	stopWriter sync.Once
+}
+
+// exportEntry is an image in an export archive
+type exportEntry struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Bytes int64  `json:"bytes"`
+}
+
+// stagedEntry is a compressed archive entry waiting to be appended
+type stagedEntry struct {
+	entry  exportEntry
+	header *zip.FileHeader
+	f      *os.File
+	done   chan error
+}
+
+// exports are keyed by a generated export id, so a device can run more than
+// one export at once.
+type exports struct {
+	mu sync.Mutex
+	// clock is when exports start and are active, for expiring them
+	clock Clock
+	// db records exports in export_sessions, and history keeps the
+	// metadata they start with. tempDir holds export archives while
+	// they're built and imports while they're read. openStores sets them.
+	db      *opsDB
+	history *metadataStore
+	tempDir string
+	exports map[string]*export
+	// latest is each device's newest export id, for older clients that
+	// don't send exportId
+	latest map[string]string
+}
+
+// NewExports sets up the exports, timed by clock
+func NewExports(clock Clock) *exports {
+	return &exports{
+		mu:      sync.Mutex{},
+		clock:   clock,
+		exports: make(map[string]*export),
+		latest:  make(map[string]string),
+	}
+}
+
+// Start begins an export for the device in the tenant t, with the export
+// caps in c, saving the metadata to its history
+func (e *exports) Start(c *config, t *tenant, deviceID, metadata string) (*export, error) {
+	if _, err := e.history.Save(t.dataKey(deviceID), metadata); err != nil {
+		log.Printf("Error saving metadata history: %v\n", err)
+	}
+	return e.begin(c, t, deviceID, metadata)
+}
+
+// begin starts an export of metadata for the device, within t's export
+// caps under c. Start and server exports both go through it.
+func (e *exports) begin(c *config, t *tenant, deviceID, metadata string) (*export, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.reserve(c, t, deviceID); err != nil {
+		return nil, err
+	}
+
+	exportID := newID()
+	exp, err := NewExport(e.exportFile(deviceID, exportID), metadata, e.clock)
+	if err != nil {
+		return nil, err
+	}
+	exp.id = exportID
+	exp.deviceID = deviceID
+	exp.tenant = t.Name
+	exp.db = e.db
+
+	e.exports[exportID] = exp
+	e.latest[deviceID] = exportID
+	e.db.ExportStarted(exp)
+
+	return exp, nil
+}
+
+// Get finds the device's export with the given id, or its newest export if
+// exportID is empty
+func (e *exports) Get(deviceID, exportID string) *export {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if exportID == "" {
+		exportID = e.latest[deviceID]
+	}
+	exp := e.exports[exportID]
+	if exp == nil || exp.deviceID != deviceID {
+		return nil
+	}
+	return exp
+}
+
+func (e *exports) Remove(exp *export) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.exports, exp.id)
+	if e.latest[exp.deviceID] == exp.id {
+		delete(e.latest, exp.deviceID)
+	}
+}
+
+// Discard removes an export that will never be finished and deletes its
+// archive, recording why in export_sessions
+func (e *exports) Discard(exp *export, status string) {
+	e.Remove(exp)
+	exp.discard()
+	e.db.ExportEnded(exp, status)
+}
+
+// reserve checks the free space for the archive and t's export caps in c for the
+// device, discarding abandoned exports if that makes room. The caller
+// holds e.mu, which is released while they're discarded.
+func (e *exports) reserve(c *config, t *tenant, deviceID string) error {
+	// An archive can be as big as everything the device has uploaded, so
+	// leave room for the rest of what's written to the temp disk
+	if free, err := freeDiskSpace(e.tempDir); err != nil {
+		log.Printf("Error checking free space in %s: %v\n", e.tempDir, err)
+	} else if free < importDiskMargin {
+		log.Printf("No room to start an export, with %s free in %s\n", formatBytes(free), e.tempDir)
+		return errExportsBusy
+	}
+
+	maxExports, maxPerDevice := t.maxExports(c), t.maxExportsPerDevice(c)
+
+	full := func() bool {
+		perTenant, perDevice := 0, 0
+		for _, exp := range e.exports {
+			if exp.tenant == t.Name {
+				perTenant++
+			}
+			if exp.deviceID == deviceID {
+				perDevice++
+			}
+		}
+		return (maxExports > 0 && perTenant >= maxExports) ||
+			(maxPerDevice > 0 && perDevice >= maxPerDevice)
+	}
+	if !full() {
+		return nil
+	}
+	expired := e.takeIdle()
+	e.mu.Unlock()
+	e.discardAbandoned(expired)
+	e.mu.Lock()
+	if full() {
+		return errExportsBusy
+	}
+	return nil
+}
+
+// ExpireIdle discards exports that have been abandoned
+func (e *exports) ExpireIdle(r *jobRun) error {
+	e.mu.Lock()
+	expired := e.takeIdle()
+	e.mu.Unlock()
+	e.discardAbandoned(expired)
+	if len(expired) > 0 {
+		r.Logf("Discarded %d abandoned exports", len(expired))
+	}
+	return nil
+}
+
+// takeIdle removes abandoned exports from e and returns them. The caller
+// holds e.mu, and discards them once it's released it, since discarding
+// waits for their writers.
+func (e *exports) takeIdle() []*export {
+	var expired []*export
+	for id, exp := range e.exports {
+		if exp.idleSince(exportIdleTimeout) {
+			expired = append(expired, exp)
+			delete(e.exports, id)
+			if e.latest[exp.deviceID] == id {
+				delete(e.latest, exp.deviceID)
+			}
+		}
+	}
+	return expired
+}
+
+func (e *exports) discardAbandoned(expired []*export) {
+	for _, exp := range expired {
+		log.Printf("Discarding abandoned export %s for device %s\n", exp.id, exp.deviceID)
+		exp.discard()
+		e.db.ExportEnded(exp, "abandoned")
+	}
+}
+
+// cleanTempDir deletes leftover files in the temp directory, like downloaded
+// imports, that aren't part of an export in progress
+func (e *exports) cleanTempDir(r *jobRun) error {
+	e.mu.Lock()
+	inUse := make(map[string]bool)
+	for _, exp := range e.exports {
+		inUse[exp.f.Name()] = true
+	}
+	e.mu.Unlock()
+
+	entries, err := ioutil.ReadDir(e.tempDir)
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, entry := range entries {
+		location := filepath.Join(e.tempDir, entry.Name())
+		if inUse[location] || e.clock.Now().Sub(entry.ModTime()) < tempFileMaxAge {
+			continue
+		}
+		if strings.HasSuffix(location, ".json") {
+			e.forgetExportDownload(location)
+		}
+		if err := os.Remove(location); err == nil {
+			removed++
+		}
+	}
+	if removed > 0 {
+		r.Logf("Removed %d old files from %s", removed, e.tempDir)
+	}
+	return nil
+}
+
+func (e *exports) Count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return len(e.exports)
+}
+
+// NewExport sets up an export archive at location, timed by clock
+func NewExport(location, metadata string, clock Clock) (*export, error) {
+	debugf("Starting export at %v\n", location)
+
+	// Truncates if the file exists
+	file, err := os.Create(location)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.New()
+	exp := &export{
+		mu:       sync.Mutex{},
+		clock:    clock,
+		started:  clock.Now(),
+		active:   clock.Now(),
+		f:        file,
+		w:        zip.NewWriter(io.MultiWriter(file, sum)),
+		sum:      sum,
+		finished: false,
+		phases:   newPhaseTimes(),
+		appends:  make(chan *stagedEntry),
+		written:  make(chan struct{}),
+	}
+
+	// The metadata's time is the export's date, for import previews
+	metadataFile, err := exp.w.CreateHeader(&zip.FileHeader{
+		Name:     metadataFileName,
+		Method:   zip.Deflate,
+		Modified: clock.Now(),
+	})
+	if err != nil {
+		exp.f.Close()
+		return nil, err
+	}
+
+	_, err = metadataFile.Write([]byte(metadata))
+	if err != nil {
+		exp.f.Close()
+		return nil, err
+	}
+
+	go exp.writeEntries()
+	return exp, nil
+}
+
+func (e *export) AddImage(imageFile multipart.File, imageFileHeader *multipart.FileHeader) (exportEntry, error) {
+	return e.addEntry(imageFileHeader.Filename, imageFileHeader.Header.Get("Content-Type"), "read", imageFile)
+}
+
+// AddObject copies an image that is already in store into the archive
+func (e *export) AddObject(store Storage, bucketName, key, name string) error {
+	body, contentType, err := store.Get(bucketName, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = e.addEntry(name, contentType, "download", body)
+	return err
+}
+
+// addEntry copies r into the archive. Time spent reading r counts toward
+// readPhase, and the rest toward "zip". Entries can be added concurrently.
+func (e *export) addEntry(name, contentType, readPhase string, r io.Reader) (exportEntry, error) {
+	e.mu.Lock()
+	if e.finished {
+		e.mu.Unlock()
+		return exportEntry{}, errExportFinished
+	}
+	e.active = e.clock.Now()
+	e.adding.Add(1)
+	e.mu.Unlock()
+	defer e.adding.Done()
+
+	start := time.Now()
+	tr := &timedReader{r: r}
+	staged, err := stageEntry(filepath.Dir(e.f.Name()), name, contentType, tr)
+	if err == nil {
+		e.appends <- staged
+		err = <-staged.done
+	}
+	e.phases.Add(readPhase, tr.elapsed)
+	e.phases.Add("zip", time.Since(start)-tr.elapsed)
+	if err != nil {
+		return exportEntry{}, err
+	}
+	return staged.entry, nil
+}
+
+// stageEntry compresses r into a temporary file in dir, ready to be
+// appended to an archive as is
+func stageEntry(dir, name, contentType string, r io.Reader) (*stagedEntry, error) {
+	f, err := ioutil.TempFile(dir, "stage-")
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*stagedEntry, error) {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	compressed, err := flate.NewWriter(f, flate.DefaultCompression)
+	if err != nil {
+		return fail(err)
+	}
+	crc := crc32.NewIEEE()
+	size, err := io.Copy(io.MultiWriter(compressed, crc), r)
+	if err != nil {
+		return fail(err)
+	}
+	if err := compressed.Close(); err != nil {
+		return fail(err)
+	}
+	compressedSize, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+
+	return &stagedEntry{
+		entry: exportEntry{
+			ID:    newID(),
+			Name:  name,
+			Bytes: size,
+		},
+		header: &zip.FileHeader{
+			Name:               name,
+			Method:             zip.Deflate,
+			Comment:            contentType,
+			CRC32:              crc.Sum32(),
+			CompressedSize64:   uint64(compressedSize),
+			UncompressedSize64: uint64(size),
+		},
+		f:    f,
+		done: make(chan error, 1),
+	}, nil
+}
+
+// writeEntries appends staged entries to the archive until e.appends is
+// closed
+func (e *export) writeEntries() {
+	defer close(e.written)
+	for entry := range e.appends {
+		entry.done <- e.appendEntry(entry)
+		entry.f.Close()
+		os.Remove(entry.f.Name())
+	}
+}
+
+func (e *export) appendEntry(entry *stagedEntry) error {
+	w, err := e.w.CreateRaw(entry.header)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, entry.f); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.images++
+	e.entries = append(e.entries, entry.entry)
+	e.mu.Unlock()
+	return nil
+}
+
+// Contents lists the images in the archive so far, in archive order
+func (e *export) Contents() []exportEntry {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]exportEntry{}, e.entries...)
+}
+
+// stopWriting waits for entries being added, then stops the writer
+// goroutine. The caller has set e.finished, and doesn't hold e.mu.
+func (e *export) stopWriting() {
+	e.stopWriter.Do(func() {
+		e.adding.Wait()
+		close(e.appends)
+		<-e.written
+	})
+}
+
+func (e *export) idleSince(timeout time.Duration) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.clock.Now().Sub(e.active) > timeout
+}
+
+// discard closes and deletes an export that will never be finished
+func (e *export) discard() {
+	e.mu.Lock()
+	e.finished = true
+	e.mu.Unlock()
+
+	e.stopWriting()
+	e.f.Close()
+	os.Remove(e.f.Name())
+}
+
+func (e *export) Finish() (*os.File, error) {
+	e.mu.Lock()
+	if e.finished {
+		e.mu.Unlock()
+		return nil, errExportFinished
+	}
+	e.finished = true
+	e.mu.Unlock()
+
+	e.stopWriting()
+	err := e.phases.Time("zip", e.w.Close)
+	if err != nil {
+		e.f.Close()
+		return nil, err
+	}
+
+	_, err = e.f.Seek(0, 0)
+	if err != nil {
+		e.f.Close()
+		return nil, err
+	}
+	if e.db != nil {
+		e.db.ExportEnded(e, "finished")
+	}
+
+	return e.f, nil
+}
+
+// SHA256 is the hex SHA-256 of the finished archive
+func (e *export) SHA256() string {
+	return hex.EncodeToString(e.sum.Sum(nil))
+}
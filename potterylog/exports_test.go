@@ -0,0 +1,29 @@
+package potterylog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportsAreBuiltUnderDataDir(t *testing.T) {
+	dir := t.TempDir()
+	h, err := newTestHarness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	var started struct {
+		ExportID string `json:"export_id"`
+	}
+	postForm(t, h, "/pottery-log/export", map[string]string{"deviceId": "device1", "metadata": `{"pots":[]}`}, "", "", nil, &started)
+	archive := h.srv.Exports.exportFile("device1", started.ExportID)
+	if !strings.HasPrefix(archive, filepath.Join(dir, "exports")+string(filepath.Separator)) {
+		t.Fatalf("the export is built at %s, outside the data dir %s", archive, dir)
+	}
+	if _, err := os.Stat(archive); err != nil {
+		t.Fatalf("the export's archive isn't there: %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package potterylog
+
+import (
+	"database/sql"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Finished exports stay in the import bucket as
+// <deviceId>/pottery_log_export_<date>_<exportId>.zip (or
+// pottery_log_server_export_ for server-built ones). Users can list theirs
+// and delete old ones, since an old backup can still hold photos they've
+// since deleted.
+
+var errNoSuchExport = newAPIError("no_such_export", "There is no such export")
+
+func errNotAnExport(name string) *apiError {
+	return newAPIError("not_an_export", name+" is not an export", name)
+}
+
+type exportZip struct {
+	Name string `json:"name"`
+	URI  string `json:"uri"`
+	Size int64  `json:"size"`
+}
+
+// exportZipName names an archive by its date, so names sort by age, and by
+// id, so two archives made the same day don't replace each other
+func (s *Server) exportZipName(prefix, id string) string {
+	return prefix + s.Clock.Now().Format("2006_01_02") + "_" + id + ".zip"
+}
+
+func isExportZip(name string) bool {
+	return strings.HasPrefix(name, "pottery_log_") && strings.HasSuffix(name, ".zip") &&
+		fileNamePattern.MatchString(name)
+}
+
+// deviceExportZips lists a device's exports stored in the bucket, newest
+// name first
+func (s *Server) deviceExportZips(bucketName, deviceID string) ([]exportZip, error) {
+	keys, err := s.Storage.List(bucketName, deviceID+"/")
+	if err != nil {
+		return nil, err
+	}
+	zips := []exportZip{}
+	for _, key := range keys {
+		name := path.Base(key)
+		if key != deviceID+"/"+name || !isExportZip(name) {
+			continue
+		}
+		info, err := s.Storage.Head(bucketName, key)
+		if err != nil {
+			return nil, err
+		}
+		zips = append(zips, exportZip{Name: name, URI: s.objectUrl(bucketName, key), Size: info.Size})
+	}
+	sort.Slice(zips, func(i, j int) bool {
+		return zips[i].Name > zips[j].Name
+	})
+	return zips, nil
+}
+
+// ExportZips lists the device's stored exports on GET, and deletes the ones
+// named by the repeatable name field on POST or DELETE
+func (s *Server) ExportZips(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	if !s.requireDevice(w, req, deviceID) {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		zips, err := s.deviceExportZips(requestTenant(req).importBucket(), deviceID)
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		writeJSON(w, struct {
+			Status  string      `json:"status"`
+			Exports []exportZip `json:"exports"`
+		}{
+			Status:  "ok",
+			Exports: zips,
+		})
+	case http.MethodPost, http.MethodDelete:
+		names := req.Form["name"]
+		if len(names) == 0 {
+			s.handleErrCode(errMissingField("name"), http.StatusBadRequest, deviceID, w)
+			return
+		}
+		for _, name := range names {
+			if !isExportZip(name) {
+				s.handleErrCode(errNotAnExport(name), http.StatusBadRequest, deviceID, w)
+				return
+			}
+		}
+		bucketName := requestTenant(req).importBucket()
+		for _, name := range names {
+			if err := s.Storage.Delete(bucketName, deviceID+"/"+name); s.handleErr(err, deviceID, w) {
+				return
+			}
+			s.ops.ExportDeleted(deviceID, s.Storage.URL(bucketName, deviceID+"/"+name))
+		}
+		s.logEvent(deviceID, DeleteExportsEvent{Count: len(names)})
+		w.Write(okResponse())
+	default:
+		s.handleErrCode(errMethodNotAllowed, http.StatusMethodNotAllowed, deviceID, w)
+	}
+}
+
+// ExportHistory lists the device's finished exports. An entry's id can be
+// passed to /pottery-log/import as exportHistoryId to restore it.
+func (s *Server) ExportHistory(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	if !s.requireDevice(w, req, deviceID) {
+		return
+	}
+	records, err := s.ops.ExportHistory(deviceID, 100)
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+	bucketName := requestTenant(req).importBucket()
+	for i := range records {
+		records[i].URI = s.resignURL(bucketName, records[i].URI)
+		records[i].ExpiresAt = s.exportExpiry(records[i].FinishedAt)
+	}
+	writeJSON(w, struct {
+		Status  string         `json:"status"`
+		Exports []exportRecord `json:"exports"`
+	}{
+		Status:  "ok",
+		Exports: records,
+	})
+}
+
+// exportExpiry is when an export finished at finished will be deleted, or
+// nil if exports are kept
+func (s *Server) exportExpiry(finished time.Time) *time.Time {
+	days := s.config().ExportRetentionDays
+	if days <= 0 {
+		return nil
+	}
+	expires := finished.Add(time.Duration(days) * 24 * time.Hour).UTC().Truncate(time.Second)
+	return &expires
+}
+
+// expireExports deletes exports older than export_retention_days, or on a
+// dry run logs their keys
+func (s *Server) expireExports(r *jobRun) error {
+	days := s.config().ExportRetentionDays
+	if days <= 0 {
+		return nil
+	}
+	records, err := s.ops.ExportsFinishedBefore(s.Clock.Now().Add(-time.Duration(days) * 24 * time.Hour))
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		bucketName := s.tenantOf(rec.DeviceID).importBucket()
+		if r.DryRun {
+			if key, ok := s.objectKey(bucketName, rec.URI); ok {
+				r.Logf("Would delete %s/%s", bucketName, key)
+			}
+			continue
+		}
+		if key, ok := s.objectKey(bucketName, rec.URI); ok {
+			if err := s.Storage.Delete(bucketName, key); err != nil {
+				r.Logf("Error deleting %s: %v", rec.URI, err)
+				continue
+			}
+		}
+		s.ops.ExportDeleted(rec.DeviceID, rec.URI)
+	}
+	if len(records) > 0 && r.DryRun {
+		r.Logf("Would delete %d exports older than %d days", len(records), days)
+	} else if len(records) > 0 {
+		r.Logf("Deleted %d exports older than %d days", len(records), days)
+	}
+	return nil
+}
+
+// exportHistoryURI finds the stored export an import asked for by id, or the
+// device's latest one for "latest". Another device's export is treated as
+// missing.
+func (s *Server) exportHistoryURI(deviceID, id string) (string, error) {
+	var rec exportRecord
+	var err error
+	if id == "latest" {
+		rec, err = s.ops.LatestExportRecord(deviceID)
+	} else {
+		rec, err = s.ops.ExportRecord(id)
+	}
+	if err == sql.ErrNoRows || (err == nil && rec.DeviceID != deviceID) {
+		return "", errNoSuchExport
+	}
+	return rec.URI, err
+}
@@ -0,0 +1,272 @@
+package potterylog
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const fakeStoragePath = "/fake-storage/"
+
+// fakeStore keeps objects in a local directory and serves them itself, so
+// the whole app flow works without AWS credentials. Objects live at
+// dir/objects/<bucket>/<key>, with their content type in dir/types/.
+type fakeStore struct {
+	dir     string
+	baseURL string
+}
+
+func newFakeStore(dir, baseURL string) *fakeStore {
+	os.MkdirAll(filepath.Join(dir, "objects"), 0777)
+	os.MkdirAll(filepath.Join(dir, "types"), 0777)
+	return &fakeStore{dir: dir, baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+func (s *fakeStore) path(kind, bucketName, key string) string {
+	return filepath.Join(s.dir, kind, bucketName, filepath.FromSlash(filepath.Clean("/"+key)))
+}
+
+func (s *fakeStore) Put(bucketName, key string, body io.ReadSeeker, contentType string) error {
+	return s.write(bucketName, key, body, contentType)
+}
+
+// write stores an object from a reader that needn't seek
+func (s *fakeStore) write(bucketName, key string, body io.Reader, contentType string) error {
+	location := s.path("objects", bucketName, key)
+	if err := os.MkdirAll(filepath.Dir(location), 0777); err != nil {
+		return err
+	}
+	file, err := os.Create(location)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, body); err != nil {
+		return err
+	}
+
+	typeLocation := s.path("types", bucketName, key)
+	if err := os.MkdirAll(filepath.Dir(typeLocation), 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(typeLocation, []byte(contentType), 0666)
+}
+
+func (s *fakeStore) PutFile(bucketName, key string, file *os.File, contentType string, progress func(stored int64)) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := s.Put(bucketName, key, file, contentType); err != nil {
+		return err
+	}
+	if progress != nil {
+		if info, err := file.Stat(); err == nil {
+			progress(info.Size())
+		}
+	}
+	return nil
+}
+
+func (s *fakeStore) Get(bucketName, key string) (io.ReadCloser, string, error) {
+	file, err := os.Open(s.path("objects", bucketName, key))
+	if err != nil {
+		return nil, "", err
+	}
+	contentType, _ := ioutil.ReadFile(s.path("types", bucketName, key))
+	return file, string(contentType), nil
+}
+
+// Fetch does what S3 would with the conditions, for a single byte range
+func (s *fakeStore) Fetch(bucketName, key string, cond FetchConditions) (*FetchedObject, error) {
+	info, err := s.Head(bucketName, key)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(s.path("objects", bucketName, key))
+	if err != nil {
+		return nil, err
+	}
+	etag := `"` + info.ETag + `"`
+	modified := stat.ModTime().Truncate(time.Second)
+	if cond.IfNoneMatch != "" {
+		if cond.IfNoneMatch == "*" || strings.Contains(cond.IfNoneMatch, etag) {
+			return &FetchedObject{Status: http.StatusNotModified, ETag: etag}, nil
+		}
+	} else if !cond.IfModifiedSince.IsZero() && !modified.After(cond.IfModifiedSince) {
+		return &FetchedObject{Status: http.StatusNotModified, ETag: etag}, nil
+	}
+
+	body, contentType, err := s.Get(bucketName, key)
+	if err != nil {
+		return nil, err
+	}
+	obj := &FetchedObject{
+		Status:       http.StatusOK,
+		Body:         body,
+		ContentType:  contentType,
+		Size:         info.Size,
+		ETag:         etag,
+		LastModified: modified,
+	}
+	if cond.Range == "" {
+		return obj, nil
+	}
+	start, end, ok := parseByteRange(cond.Range, info.Size)
+	if !ok {
+		body.Close()
+		return &FetchedObject{Status: http.StatusRequestedRangeNotSatisfiable}, nil
+	}
+	file := body.(*os.File)
+	obj.Status = http.StatusPartialContent
+	obj.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(file, start, end-start+1), file}
+	obj.Size = end - start + 1
+	obj.ContentRange = fmt.Sprintf("bytes %d-%d/%d", start, end, info.Size)
+	return obj, nil
+}
+
+// parseByteRange reads a single "bytes=a-b", "bytes=a-", or "bytes=-n"
+func parseByteRange(header string, size int64) (int64, int64, bool) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	dash := strings.Index(spec, "-")
+	if spec == header || dash < 0 || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last := spec[:dash], spec[dash+1:]
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, size > 0
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
+
+func (s *fakeStore) Download(ctx context.Context, bucketName, key string, file *os.File) error {
+	body, _, err := s.Get(bucketName, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(file, contextReader{ctx, body})
+	return err
+}
+
+// contextReader fails reads once ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+func (s *fakeStore) Exists(bucketName, key string) bool {
+	_, err := os.Stat(s.path("objects", bucketName, key))
+	return err == nil
+}
+
+func (s *fakeStore) Head(bucketName, key string) (ObjectInfo, error) {
+	file, err := os.Open(s.path("objects", bucketName, key))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer file.Close()
+	hash := md5.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	contentType, _ := ioutil.ReadFile(s.path("types", bucketName, key))
+	return ObjectInfo{Key: key, Size: size, ETag: hex.EncodeToString(hash.Sum(nil)), ContentType: string(contentType)}, nil
+}
+
+func (s *fakeStore) Delete(bucketName, key string) error {
+	os.Remove(s.path("types", bucketName, key))
+	err := os.Remove(s.path("objects", bucketName, key))
+	if os.IsNotExist(err) {
+		// Like S3, deleting a missing object is fine
+		return nil
+	}
+	return err
+}
+
+func (s *fakeStore) List(bucketName, prefix string) ([]string, error) {
+	root := filepath.Join(s.dir, "objects", bucketName)
+	var keys []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (s *fakeStore) URL(bucketName, key string) string {
+	return s.baseURL + fakeStoragePath + bucketName + "/" + key
+}
+
+func (s *fakeStore) Key(bucketName, url string) (string, bool) {
+	prefix := s.baseURL + fakeStoragePath + bucketName + "/"
+	if !strings.HasPrefix(url, prefix) || url == prefix {
+		return "", false
+	}
+	return strings.TrimPrefix(url, prefix), true
+}
+
+// ServeHTTP serves the objects at their URLs
+func (s *fakeStore) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, fakeStoragePath), "/", 2)
+	if len(parts) != 2 || !s.Exists(parts[0], parts[1]) {
+		http.NotFound(w, req)
+		return
+	}
+	if contentType, err := ioutil.ReadFile(s.path("types", parts[0], parts[1])); err == nil {
+		w.Header().Set("Content-Type", string(contentType))
+	}
+	http.ServeFile(w, req, s.path("objects", parts[0], parts[1]))
+}
@@ -0,0 +1,59 @@
+package potterylog
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// faultRule makes matching requests slow or unreliable. Rates are
+// probabilities from 0 to 1.
+type faultRule struct {
+	// Path prefix the rule applies to, e.g. "/pottery-log/export-image"
+	Path      string  `json:"path"`
+	LatencyMS int     `json:"latency_ms"`
+	ErrorRate float64 `json:"error_rate"`
+	DropRate  float64 `json:"drop_rate"`
+}
+
+// injectFaults applies the config's fault_injection rules. It's only
+// installed with -fault_injection, so production servers can't be made
+// flaky by a stray config entry.
+func (s *Server) injectFaults(handler http.Handler) http.Handler {
+	log.Print("Fault injection is enabled.\n")
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, rule := range s.config().FaultInjection {
+			if !strings.HasPrefix(req.URL.Path, rule.Path) {
+				continue
+			}
+			if rule.LatencyMS > 0 {
+				time.Sleep(time.Duration(rule.LatencyMS) * time.Millisecond)
+			}
+			if rand.Float64() < rule.DropRate {
+				dropConnection(w)
+				return
+			}
+			if rand.Float64() < rule.ErrorRate {
+				s.handleErr(errors.New("Injected fault"), req.URL.Query().Get("deviceId"), w)
+				return
+			}
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// dropConnection closes the connection without sending a response
+func dropConnection(w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	conn.Close()
+}
@@ -0,0 +1,67 @@
+package potterylog
+
+import (
+	"hash/fnv"
+	"net/http"
+)
+
+// featureFlag gates a server behavior per device. A device gets the flag if
+// it is listed in Devices, or if it falls within the Rollout percentage.
+type featureFlag struct {
+	Enabled bool     `json:"enabled"`
+	Rollout int      `json:"rollout"`
+	Devices []string `json:"devices"`
+}
+
+func (f featureFlag) enabledFor(name, deviceID string) bool {
+	if !f.Enabled {
+		return false
+	}
+	for _, d := range f.Devices {
+		if d == deviceID {
+			return true
+		}
+	}
+	return rolloutBucket(name, deviceID) < f.Rollout
+}
+
+// rolloutBucket puts a device in a stable bucket 0-99 for a given flag. The
+// flag name is mixed in so that the same devices aren't always first.
+func rolloutBucket(name, deviceID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(deviceID))
+	return int(h.Sum32() % 100)
+}
+
+// flagEnabled is how handlers check whether a feature is on for a device
+func (s *Server) flagEnabled(name, deviceID string) bool {
+	flag, ok := s.config().FeatureFlags[name]
+	return ok && flag.enabledFor(name, deviceID)
+}
+
+func (s *Server) deviceFlags(deviceID string) map[string]bool {
+	flags := make(map[string]bool)
+	for name, flag := range s.config().FeatureFlags {
+		flags[name] = flag.enabledFor(name, deviceID)
+	}
+	return flags
+}
+
+func (s *Server) Config(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+
+	writeJSON(w, struct {
+		Status      string          `json:"status"`
+		Maintenance bool            `json:"maintenance"`
+		Flags       map[string]bool `json:"flags"`
+	}{
+		Status:      "ok",
+		Maintenance: s.inMaintenance(),
+		Flags:       s.deviceFlags(deviceID),
+	})
+}
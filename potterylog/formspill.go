@@ -0,0 +1,307 @@
+package potterylog
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Multipart forms, like uploads and imports, keep up to form_memory_mb
+// (default 32, net/http's own threshold) of their files in memory and
+// spill the rest to temporary files. Those go in upload-tmp under -data_dir
+// rather than /tmp, which is often a small RAM-backed tmpfs, so spilling
+// saves memory instead of moving it. withForm deletes a request's files
+// when it's done, and the form-spill-cleanup job deletes any left behind by
+// a crash.
+
+const defaultFormMemoryMB = 32
+
+func (s *Server) formMemoryLimit() int64 {
+	if mb := s.config().FormMemoryMB; mb > 0 {
+		return mb << 20
+	}
+	return defaultFormMemoryMB << 20
+}
+
+// setFormSpillDir makes upload-tmp under s's dataDir its spill directory
+func (s *Server) setFormSpillDir() error {
+	dir := filepath.Join(s.dataDir, "upload-tmp")
+	// Anything there is left from before the server started
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	s.formSpillDir = dir
+	return nil
+}
+
+// Routes that take files parse their forms with withForm, innermost, so
+// that the checks that can turn a request away, like the blocklist,
+// maintenance, and conditional uploads, run before the body is read.
+// Those checks only look at the query and url-encoded bodies (see
+// preFormValue), which net/http parses without spilling anything. A device
+// that only names itself in a multipart body is checked against the
+// blocklist as soon as its deviceId field is read, so nothing after the
+// field is read or spilled for a blocked device.
+
+// multipartFile is a file from a multipart form, in memory or spilled to
+// formSpillDir
+type multipartFile struct {
+	Filename string
+	Header   textproto.MIMEHeader
+	Size     int64
+
+	data []byte
+	path string
+}
+
+// Open opens the file for reading
+func (f *multipartFile) Open() (multipart.File, error) {
+	if f.path != "" {
+		return os.Open(f.path)
+	}
+	return memoryFile{io.NewSectionReader(bytes.NewReader(f.data), 0, f.Size)}, nil
+}
+
+// FileHeader describes f as net/http would
+func (f *multipartFile) FileHeader() *multipart.FileHeader {
+	return &multipart.FileHeader{Filename: f.Filename, Header: f.Header, Size: f.Size}
+}
+
+type memoryFile struct {
+	*io.SectionReader
+}
+
+func (memoryFile) Close() error {
+	return nil
+}
+
+// parsedForm is what withForm found in a request's multipart form. err is
+// why the form couldn't be read, if it couldn't.
+type parsedForm struct {
+	files map[string][]*multipartFile
+	err   error
+}
+
+func (f *parsedForm) removeAll() {
+	for _, files := range f.files {
+		for _, file := range files {
+			if file.path != "" {
+				os.Remove(file.path)
+			}
+		}
+	}
+}
+
+type parsedFormKey struct{}
+
+// withForm parses a multipart form with the form_memory_mb threshold,
+// spilling to formSpillDir, before handler runs, unless the IP or device
+// is blocked. A form that can't be parsed is left for the handler to find
+// out about, from formFile or formError.
+func (s *Server) withForm(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType != "multipart/form-data" {
+			handler(w, req)
+			return
+		}
+		ip := clientIP(req)
+		if s.blocks.Blocked(ip, preFormValue(req, "deviceId")) {
+			s.handleErrCode(errBlocked, http.StatusForbidden, preFormValue(req, "deviceId"), w)
+			return
+		}
+		form := readMultipartForm(req, s.formMemoryLimit(), s.formSpillDir, func(deviceID string) bool {
+			return s.blocks.Blocked(ip, deviceID)
+		})
+		defer form.removeAll()
+		if form.err == errBlocked {
+			s.handleErrCode(errBlocked, http.StatusForbidden, req.Form.Get("deviceId"), w)
+			return
+		}
+		if form.err != nil {
+			debugf("Error parsing the form of %s: %v\n", req.URL.Path, form.err)
+		}
+		// withTenant only saw the query and url-encoded bodies
+		s.rememberTenant(req, req.Form.Get("deviceId"))
+		handler(w, req.WithContext(context.WithValue(req.Context(), parsedFormKey{}, form)))
+	}
+}
+
+// readMultipartForm reads req's multipart form as ParseMultipartForm
+// does, but spilling files to dir. Its values go in req.Form and
+// req.PostForm, on req itself so middleware outside withForm sees them.
+// It stops with errBlocked at a deviceId field for which blocked is true.
+func readMultipartForm(req *http.Request, maxMemory int64, dir string, blocked func(deviceID string) bool) *parsedForm {
+	form := &parsedForm{files: make(map[string][]*multipartFile)}
+	values := make(url.Values)
+	defer func() {
+		if req.Form == nil {
+			req.ParseForm()
+		}
+		for name, vs := range values {
+			req.Form[name] = append(req.Form[name], vs...)
+			req.PostForm[name] = append(req.PostForm[name], vs...)
+		}
+		// So net/http doesn't try to read the body again
+		req.MultipartForm = &multipart.Form{Value: values, File: map[string][]*multipart.FileHeader{}}
+	}()
+
+	reader, err := req.MultipartReader()
+	if err != nil {
+		form.err = err
+		return form
+	}
+	// Values may use 10 MB beyond the memory threshold, as with net/http
+	maxValueBytes := maxMemory + 10<<20
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return form
+		}
+		if err != nil {
+			form.err = err
+			return form
+		}
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+		var buf bytes.Buffer
+		if part.FileName() == "" {
+			n, err := io.CopyN(&buf, part, maxValueBytes+1)
+			if err != nil && err != io.EOF {
+				form.err = err
+				return form
+			}
+			maxValueBytes -= n
+			if maxValueBytes < 0 {
+				form.err = multipart.ErrMessageTooLarge
+				return form
+			}
+			values[name] = append(values[name], buf.String())
+			if name == "deviceId" && blocked(buf.String()) {
+				form.err = errBlocked
+				return form
+			}
+			continue
+		}
+
+		file := &multipartFile{Filename: part.FileName(), Header: part.Header}
+		n, err := io.CopyN(&buf, part, maxMemory+1)
+		if err != nil && err != io.EOF {
+			form.err = err
+			return form
+		}
+		if n <= maxMemory {
+			file.data = buf.Bytes()
+			file.Size = n
+			maxMemory -= n
+			maxValueBytes -= n
+		} else {
+			file.path, file.Size, err = spillFormFile(dir, io.MultiReader(&buf, part))
+			if err != nil {
+				form.err = err
+				return form
+			}
+		}
+		form.files[name] = append(form.files[name], file)
+	}
+}
+
+func spillFormFile(dir string, r io.Reader) (string, int64, error) {
+	f, err := os.CreateTemp(dir, "multipart-")
+	if err != nil {
+		return "", 0, err
+	}
+	size, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+	return f.Name(), size, nil
+}
+
+// formFiles is the files withForm found under name
+func formFiles(req *http.Request, name string) []*multipartFile {
+	if form, ok := req.Context().Value(parsedFormKey{}).(*parsedForm); ok {
+		return form.files[name]
+	}
+	return nil
+}
+
+// formError is why withForm couldn't read the request's form, if it
+// couldn't
+func formError(req *http.Request) error {
+	if form, ok := req.Context().Value(parsedFormKey{}).(*parsedForm); ok {
+		return form.err
+	}
+	return nil
+}
+
+// formFile is req.FormFile for routes behind withForm
+func formFile(req *http.Request, name string) (multipart.File, *multipart.FileHeader, error) {
+	if err := formError(req); err != nil {
+		return nil, nil, err
+	}
+	files := formFiles(req, name)
+	if len(files) == 0 {
+		return nil, nil, http.ErrMissingFile
+	}
+	file, err := files[0].Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, files[0].FileHeader(), nil
+}
+
+// preFormValue is req.FormValue for middleware that runs before withForm:
+// from the query or a url-encoded body, but never a multipart body, which
+// isn't read until the route's own checks pass
+func preFormValue(req *http.Request, key string) string {
+	if req.Form != nil {
+		return req.Form.Get(key)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		return req.URL.Query().Get(key)
+	}
+	return req.FormValue(key)
+}
+
+// cleanFormSpillDir deletes spilled files old enough that their request
+// must be over
+func (s *Server) cleanFormSpillDir(r *jobRun) error {
+	if s.formSpillDir == "" {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(s.formSpillDir)
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, entry := range entries {
+		if time.Since(entry.ModTime()) < tempFileMaxAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.formSpillDir, entry.Name())); err == nil {
+			removed++
+		}
+	}
+	if removed > 0 {
+		r.Logf("Removed %d old files from %s", removed, s.formSpillDir)
+	}
+	return nil
+}
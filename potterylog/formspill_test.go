@@ -0,0 +1,80 @@
+package potterylog
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestBlockedDeviceFormsAreNotSpilled(t *testing.T) {
+	h, err := newTestHarness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.srv.setFormSpillDir(); err != nil {
+		t.Fatal(err)
+	}
+	c := *h.srv.config()
+	c.FormMemoryMB = 1
+	h.srv.setConfig(&c)
+	if err := h.srv.blocks.Add("", "device1", "test", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	called := false
+	handler := h.srv.withForm(func(w http.ResponseWriter, req *http.Request) {
+		called = true
+	})
+	send := func(deviceID string) (*httptest.ResponseRecorder, *countingReader) {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("deviceId", deviceID)
+		part, err := form.CreateFormFile("image", "pot.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(make([]byte, 4<<20))
+		form.Close()
+		counted := &countingReader{r: &body}
+		req := httptest.NewRequest(http.MethodPost, "/pottery-log-images/upload", counted)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w, counted
+	}
+
+	w, counted := send("device1")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("blocked device: got %d, want 403", w.Code)
+	}
+	if called {
+		t.Error("the handler ran for a blocked device")
+	}
+	if counted.n > 64<<10 {
+		t.Errorf("read %d bytes of a blocked device's form", counted.n)
+	}
+	if spilled, _ := ioutil.ReadDir(h.srv.formSpillDir); len(spilled) != 0 {
+		t.Errorf("spilled %d files for a blocked device", len(spilled))
+	}
+
+	if w, _ := send("device2"); w.Code != http.StatusOK || !called {
+		t.Errorf("allowed device: got %d, handler called %v", w.Code, called)
+	}
+}
@@ -0,0 +1,248 @@
+package potterylog
+
+import (
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sharePath = "/pottery-log/share/"
+
+type shareRef struct {
+	// DeviceID is the pot's library: a deviceId or a studio's library
+	DeviceID string    `json:"device_id"`
+	PotID    string    `json:"pot_id"`
+	Created  time.Time `json:"created"`
+}
+
+// shareStore maps public share ids to pots, saved as a single JSON file
+type shareStore struct {
+	mu       sync.Mutex
+	location string
+	refs     map[string]shareRef
+	clock    Clock
+}
+
+// NewShareStore loads the share index from the given file
+func NewShareStore(location string, clock Clock) (*shareStore, error) {
+	s := &shareStore{
+		mu:       sync.Mutex{},
+		location: location,
+		refs:     make(map[string]shareRef),
+		clock:    clock,
+	}
+	data, err := ioutil.ReadFile(location)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, json.Unmarshal(data, &s.refs)
+}
+
+func (s *shareStore) save() error {
+	data, err := json.Marshal(s.refs)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.location+".tmp", data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(s.location+".tmp", s.location)
+}
+
+func (s *shareStore) Add(deviceID, potID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shareID := newID()
+	s.refs[shareID] = shareRef{DeviceID: deviceID, PotID: potID, Created: s.clock.Now()}
+	return shareID, s.save()
+}
+
+func (s *shareStore) Get(shareID string) (shareRef, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ref, ok := s.refs[shareID]
+	return ref, ok
+}
+
+// Library returns the share ids and refs of the library's shared pots
+func (s *shareStore) Library(library string) map[string]shareRef {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs := make(map[string]shareRef)
+	for shareID, ref := range s.refs {
+		if ref.DeviceID == library {
+			refs[shareID] = ref
+		}
+	}
+	return refs
+}
+
+func (s *shareStore) Remove(shareID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.refs, shareID)
+	return s.save()
+}
+
+// publicLink is the public URL of path on this server
+func (s *Server) publicLink(req *http.Request, path string) string {
+	base := s.publicURL
+	if base == "" {
+		base = "https://" + req.Host
+	}
+	return strings.TrimSuffix(base, "/") + path
+}
+
+func (s *Server) shareURL(req *http.Request, shareID string) string {
+	return s.publicLink(req, sharePath+shareID)
+}
+
+// SharePot serves /v2/pots/<id>/share: POST creates (or returns) the pot's
+// public link and DELETE revokes it.
+func (s *Server) SharePot(w http.ResponseWriter, req *http.Request, deviceID, library, potID string) {
+	p, err := s.pots.Get(library, potID)
+	if s.handlePotErr(err, deviceID, w) {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPost:
+		if p.ShareID == "" {
+			shareID, err := s.shares.Add(library, potID)
+			if s.handleErr(err, deviceID, w) {
+				return
+			}
+			p, err = s.pots.Update(library, potID, func(p *pot) error {
+				p.ShareID = shareID
+				return nil
+			})
+			if s.handlePotErr(err, deviceID, w) {
+				return
+			}
+			s.logEvent(deviceID, SharePotEvent)
+		}
+		writeJSON(w, struct {
+			Status string `json:"status"`
+			URL    string `json:"url"`
+		}{
+			Status: "ok",
+			URL:    s.shareURL(req, p.ShareID),
+		})
+
+	case http.MethodDelete:
+		if p.ShareID != "" {
+			if s.handleErr(s.shares.Remove(p.ShareID), deviceID, w) {
+				return
+			}
+			_, err = s.pots.Update(library, potID, func(p *pot) error {
+				p.ShareID = ""
+				return nil
+			})
+			if s.handlePotErr(err, deviceID, w) {
+				return
+			}
+			s.logEvent(deviceID, UnsharePotEvent)
+		}
+		w.Write(okResponse())
+
+	default:
+		s.handleErrCode(errMethodNotAllowed, http.StatusMethodNotAllowed, deviceID, w)
+	}
+}
+
+type galleryPage struct {
+	Pot         *pot
+	URL         string
+	Description string
+	ImageURLs   []string
+	Notes       []potNote
+	Stylesheet  string
+	// CoverURL is the image used for link previews
+	CoverURL string
+	// Home links back to the list of pots, on a static site
+	Home string
+}
+
+// newGalleryPage lays out a pot's page, with its images at imageURL(key)
+func newGalleryPage(p *pot, url string, imageURL func(key string) string) galleryPage {
+	page := galleryPage{
+		Pot:         p,
+		URL:         url,
+		Description: potDescription(p),
+		Stylesheet:  publicStaticPath + "gallery.css",
+	}
+	for _, key := range p.Images {
+		page.ImageURLs = append(page.ImageURLs, imageURL(key))
+	}
+	if cover := p.coverImage(); cover != "" {
+		page.CoverURL = imageURL(cover)
+	}
+	page.Notes = append(page.Notes, p.Notes...)
+	sort.Slice(page.Notes, func(i, j int) bool {
+		return page.Notes[i].Date.Before(page.Notes[j].Date)
+	})
+	return page
+}
+
+// Gallery renders the public page for a share link
+func (s *Server) Gallery(w http.ResponseWriter, req *http.Request) {
+	shareID := strings.TrimPrefix(req.URL.Path, sharePath)
+	ref, ok := s.shares.Get(shareID)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	p, err := s.pots.Get(ref.DeviceID, ref.PotID)
+	if err != nil {
+		log.Printf("Share %s points to a missing pot: %v\n", shareID, err)
+		http.NotFound(w, req)
+		return
+	}
+
+	bucketName := requestTenant(req).imageBucket()
+	page := newGalleryPage(p, s.shareURL(req, shareID), func(key string) string {
+		return s.objectUrl(bucketName, key)
+	})
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := galleryTemplate.Execute(w, page); err != nil {
+		log.Printf("Error rendering gallery page: %v\n", err)
+		return
+	}
+	s.logEvent(ref.DeviceID, ViewShareEvent)
+}
+
+func potDescription(p *pot) string {
+	var parts []string
+	if p.Clay != "" {
+		parts = append(parts, p.Clay)
+	}
+	if p.Glaze != "" {
+		parts = append(parts, p.Glaze)
+	}
+	if p.Status != "" {
+		parts = append(parts, p.Status)
+	}
+	if len(parts) == 0 {
+		return "Made with Pottery Log"
+	}
+	return strings.Join(parts, " · ")
+}
+
+// galleryTemplate is static/gallery.html, with static/site-index.html for
+// static sites (see static.go)
+var galleryTemplate *template.Template
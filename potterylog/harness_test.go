@@ -0,0 +1,49 @@
+package potterylog
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"time"
+)
+
+// testHarness runs a Server in-process, with memory storage, a fake clock,
+// and a recording event sink, so a test can go from Upload to Export to
+// Import over HTTP with nothing but a temporary directory for the database
+// and stores.
+type testHarness struct {
+	Server  *httptest.Server
+	Storage *memStore
+	Clock   *fakeClock
+	Events  *recordingSink
+
+	srv *Server
+}
+
+// newTestHarness starts a server keeping its stores in dir
+func newTestHarness(dir string) (*testHarness, error) {
+	clock := newFakeClock(time.Now())
+	h := &testHarness{
+		Storage: newMemStore(clock),
+		Clock:   clock,
+		Events:  &recordingSink{},
+	}
+	srv := NewServer()
+	h.srv = srv
+	srv.Storage = h.Storage
+	srv.Exports = NewExports(h.Clock)
+	srv.Events = h.Events
+	srv.Clock = h.Clock
+	srv.dataDir = dir
+	if err := srv.openStores(filepath.Join(dir, "pottery-log.db")); err != nil {
+		return nil, err
+	}
+	loadGalleryTemplate()
+	h.Server = httptest.NewServer(srv.Handler())
+	return h, nil
+}
+
+// Close stops the server and closes the database
+func (h *testHarness) Close() {
+	h.Server.Close()
+	h.srv.ops.db.Close()
+}
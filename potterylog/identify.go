@@ -0,0 +1,199 @@
+package potterylog
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Amplitude builds cohorts from user properties, which it only learns from
+// identify calls. The app reports its platform, version, and plan in
+// headers; devices whose properties changed are sent to Amplitude by the
+// amplitude-identify job, and every event carries the platform and version.
+const (
+	platformHeader   = "X-App-Platform"
+	appVersionHeader = "X-App-Version"
+	planHeader       = "X-App-Plan"
+)
+
+// serverDeviceID stands in for a device in events from the server itself,
+// like jobs. Amplitude rejects device ids shorter than 5 characters.
+const serverDeviceID = "pottery-log-server"
+
+type deviceProperties struct {
+	Platform   string `json:"platform,omitempty"`
+	AppVersion string `json:"app_version,omitempty"`
+	Plan       string `json:"plan,omitempty"`
+}
+
+// The device settings that hold each property
+var devicePropertySettings = []string{"platform", "app-version", "plan"}
+
+func (p *deviceProperties) fields() []*string {
+	return []*string{&p.Platform, &p.AppVersion, &p.Plan}
+}
+
+// identityStore caches each device's properties from device_settings and
+// remembers which devices changed since the last identify
+type identityStore struct {
+	db      *opsDB
+	mu      sync.Mutex
+	props   map[string]deviceProperties
+	changed map[string]bool
+}
+
+// NewIdentityStore sets up an empty identity store that reads and saves
+// properties in db
+func NewIdentityStore(db *opsDB) *identityStore {
+	return &identityStore{
+		db:      db,
+		mu:      sync.Mutex{},
+		props:   make(map[string]deviceProperties),
+		changed: make(map[string]bool),
+	}
+}
+
+func (s *identityStore) Get(deviceID string) deviceProperties {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(deviceID)
+}
+
+// get is Get for callers that hold s.mu
+func (s *identityStore) get(deviceID string) deviceProperties {
+	if p, ok := s.props[deviceID]; ok {
+		return p
+	}
+	var p deviceProperties
+	for i, field := range p.fields() {
+		*field = s.db.DeviceSetting(deviceID, devicePropertySettings[i])
+	}
+	s.props[deviceID] = p
+	return p
+}
+
+// Update saves the properties that are set in update, and marks the device
+// for identifying if any changed
+func (s *identityStore) Update(deviceID string, update deviceProperties) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.get(deviceID)
+	updated := update.fields()
+	for i, field := range p.fields() {
+		if *updated[i] == "" || *updated[i] == *field {
+			continue
+		}
+		if err := s.db.SetDeviceSetting(deviceID, devicePropertySettings[i], *updated[i]); err != nil {
+			return err
+		}
+		*field = *updated[i]
+		s.changed[deviceID] = true
+	}
+	s.props[deviceID] = p
+	return nil
+}
+
+// takeChanged returns the devices that changed since it was last called
+func (s *identityStore) takeChanged() map[string]deviceProperties {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := make(map[string]deviceProperties, len(s.changed))
+	for deviceID := range s.changed {
+		changed[deviceID] = s.props[deviceID]
+	}
+	s.changed = make(map[string]bool)
+	return changed
+}
+
+func (s *identityStore) markChanged(deviceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.changed[deviceID] = true
+}
+
+// recordDeviceProperties keeps the properties the app sends in headers
+func (s *Server) recordDeviceProperties(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(w, req)
+
+		update := deviceProperties{
+			Platform:   req.Header.Get(platformHeader),
+			AppVersion: req.Header.Get(appVersionHeader),
+			Plan:       req.Header.Get(planHeader),
+		}
+		if update == (deviceProperties{}) {
+			return
+		}
+		// As in logRequests, only look at the form if the handler parsed it
+		deviceID := req.URL.Query().Get("deviceId")
+		if req.Form != nil {
+			deviceID = req.Form.Get("deviceId")
+		}
+		if deviceID == "" || !validID(deviceID) {
+			return
+		}
+		if err := s.identities.Update(deviceID, update); err != nil {
+			log.Printf("Error saving properties for %s: %v\n", deviceID, err)
+		}
+	})
+}
+
+// identifyDevices sends an identify call for each device whose properties
+// changed, with its tenant's API key or apiKey for the default tenant
+func (s *Server) identifyDevices(apiKey string) func(r *jobRun) error {
+	client := &http.Client{}
+	return func(r *jobRun) error {
+		sent := 0
+		for deviceID, p := range s.identities.takeChanged() {
+			t := s.tenantOf(deviceID)
+			key := apiKey
+			if t != defaultTenant {
+				key = t.AmplitudeAPIKey
+			}
+			if key == "" {
+				continue
+			}
+			identification, err := json.Marshal([]interface{}{struct {
+				DeviceID       string            `json:"device_id"`
+				Platform       string            `json:"platform,omitempty"`
+				AppVersion     string            `json:"app_version,omitempty"`
+				UserProperties map[string]string `json:"user_properties"`
+			}{
+				DeviceID:   deviceID,
+				Platform:   p.Platform,
+				AppVersion: p.AppVersion,
+				UserProperties: map[string]string{
+					"platform":    p.Platform,
+					"app_version": p.AppVersion,
+					"plan":        p.Plan,
+					"tenant":      t.Name,
+				},
+			}})
+			if err != nil {
+				return err
+			}
+			resp, err := client.PostForm("https://api.amplitude.com/identify", url.Values{
+				"api_key":        {key},
+				"identification": {string(identification)},
+			})
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode > 204 {
+					err = fmt.Errorf("Amplitude returned status %v", resp.StatusCode)
+				}
+			}
+			if err != nil {
+				r.Logf("Identify for %s failed: %v", deviceID, err)
+				s.identities.markChanged(deviceID)
+				continue
+			}
+			sent++
+		}
+		r.Logf("Identified %d devices", sent)
+		return nil
+	}
+}
@@ -0,0 +1,322 @@
+package potterylog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every upload gets a small JSON sidecar next to it in the image bucket, at
+// image-meta/<deviceId>/<fileName>.json: when the photo was taken, its
+// dimensions, the name it was sent with, and the pot it was added to. File
+// names alone aren't enough to put a reinstalled app's photos back on the
+// right pots, since they get suffixed on conflict or recompression, and
+// content-addressed images have no name in their key at all. The sidecar
+// is keyed by the name the device knows, so it works either way, and
+// /pottery-log-images/list returns it with each image.
+const imageMetaPrefix = "image-meta/"
+
+var (
+	// potId is the app's id for the pot the image belongs to
+	imagePotIDField = field{Name: "potId", MaxLen: 128, Pattern: validIDPattern}
+	// capturedAt (RFC 3339) is when the photo was taken, if the app knows
+	// better than the image's EXIF
+	imageCapturedAtField = field{Name: "capturedAt", MaxLen: 64, Pattern: uriPattern}
+)
+
+// imageMeta is an upload's sidecar
+type imageMeta struct {
+	FileName         string `json:"file_name"`
+	OriginalFileName string `json:"original_file_name"`
+	PotID            string `json:"pot_id,omitempty"`
+	// CapturedAt is from the app or else the photo's EXIF, in UTC if the
+	// camera didn't record its time zone
+	CapturedAt  *time.Time `json:"captured_at,omitempty"`
+	Width       int        `json:"width"`
+	Height      int        `json:"height"`
+	ContentType string     `json:"content_type"`
+	Bytes       int64      `json:"bytes"`
+	UploadedAt  time.Time  `json:"uploaded_at"`
+}
+
+func imageMetaKey(deviceID, fileName string) string {
+	return imageMetaPrefix + deviceID + "/" + fileName + ".json"
+}
+
+// readCaptureTime takes the capture time from a JPEG's EXIF when the app
+// didn't send one
+func readCaptureTime(s *Server, item *uploadItem) error {
+	if !item.CapturedAt.IsZero() || item.Imported {
+		return nil
+	}
+	head := make([]byte, maxJPEGHeader)
+	n, err := io.ReadFull(item.Body, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	if tiff := jpegEXIF(head[:n]); tiff != nil {
+		item.CapturedAt = exifCaptureTime(tiff)
+	}
+	return nil
+}
+
+// writeImageMeta is the sidecar stage. An image uploaded again keeps the
+// pot and capture time its sidecar already has, unless this upload says
+// otherwise.
+func writeImageMeta(s *Server, item *uploadItem) error {
+	if item.Imported {
+		return nil
+	}
+	meta := imageMeta{
+		FileName:         item.FileName,
+		OriginalFileName: item.OriginalFileName,
+		PotID:            item.PotID,
+		Width:            item.Width,
+		Height:           item.Height,
+		ContentType:      item.ContentType,
+		Bytes:            item.Size,
+		UploadedAt:       s.Clock.Now().UTC().Truncate(time.Second),
+	}
+	if !item.CapturedAt.IsZero() {
+		capturedAt := item.CapturedAt
+		meta.CapturedAt = &capturedAt
+	}
+	key := imageMetaKey(item.DeviceID, item.FileName)
+	if old, err := s.readImageMeta(item.Bucket, key); err == nil {
+		if meta.PotID == "" {
+			meta.PotID = old.PotID
+		}
+		if meta.CapturedAt == nil {
+			meta.CapturedAt = old.CapturedAt
+		}
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return s.Storage.Put(item.Bucket, key, bytes.NewReader(data), "application/json")
+}
+
+func (s *Server) readImageMeta(bucketName, key string) (*imageMeta, error) {
+	body, _, err := s.Storage.Get(bucketName, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	meta := &imageMeta{}
+	return meta, json.Unmarshal(data, meta)
+}
+
+// imageMetaKeys are the stored sidecars of the device's image key, or for
+// a content-addressed image, of the device's name for it. Without that name
+// its sidecars are left.
+func (s *Server) imageMetaKeys(bucketName, deviceID, key, name string) []string {
+	names := []string{}
+	switch {
+	case strings.HasPrefix(key, blobPrefix):
+		if deviceID != "" && name != "" {
+			names = append(names, name)
+		}
+	case deviceID == "":
+		if parts := strings.SplitN(key, "/", 2); len(parts) == 2 {
+			deviceID = parts[0]
+			names = append(names, parts[1])
+		}
+	case strings.HasPrefix(key, deviceID+"/"):
+		names = append(names, strings.TrimPrefix(key, deviceID+"/"))
+	}
+	keys := []string{}
+	for _, name := range names {
+		if metaKey := imageMetaKey(deviceID, name); s.Storage.Exists(bucketName, metaKey) {
+			keys = append(keys, metaKey)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// deleteImageMeta deletes sidecars along with their image and returns
+// them. A sidecar that can't be deleted is only logged, since its image is
+// already gone.
+func (s *Server) deleteImageMeta(bucketName string, keys []string, dryRun bool) []string {
+	if dryRun {
+		return keys
+	}
+	for _, key := range keys {
+		if err := s.Storage.Delete(bucketName, key); err != nil {
+			log.Printf("Error deleting sidecar %s: %v\n", key, err)
+		}
+	}
+	return keys
+}
+
+// imageItemFields sets the sidecar's fields of an upload from the form
+func (s *Server) imageItemFields(w http.ResponseWriter, req *http.Request, item *uploadItem) bool {
+	item.PotID = req.FormValue("potId")
+	if capturedAt := req.FormValue("capturedAt"); capturedAt != "" {
+		t, err := time.Parse(time.RFC3339, capturedAt)
+		if err != nil {
+			s.handleErrCode(errInvalidField("capturedAt"), http.StatusBadRequest, item.DeviceID, w)
+			return false
+		}
+		item.CapturedAt = t
+	}
+	return true
+}
+
+// exifCaptureTime is DateTimeOriginal from EXIF, or else DateTime, with
+// OffsetTimeOriginal's zone if there is one
+func exifCaptureTime(tiff []byte) time.Time {
+	if len(tiff) < 8 {
+		return time.Time{}
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return time.Time{}
+	}
+	ifd0 := int(order.Uint32(tiff[4:]))
+	var taken, offset string
+	if entry := exifEntry(tiff, order, ifd0, 0x8769); entry != nil {
+		exifIFD := int(order.Uint32(entry[8:]))
+		taken = exifString(tiff, order, exifEntry(tiff, order, exifIFD, 0x9003))
+		offset = exifString(tiff, order, exifEntry(tiff, order, exifIFD, 0x9011))
+	}
+	if taken == "" {
+		taken = exifString(tiff, order, exifEntry(tiff, order, ifd0, 0x0132))
+	}
+	if t, err := time.Parse("2006:01:02 15:04:05-07:00", taken+offset); err == nil && offset != "" {
+		return t
+	}
+	t, err := time.Parse("2006:01:02 15:04:05", taken)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// exifEntry finds the 12-byte entry for tag in the IFD at offset ifd
+func exifEntry(tiff []byte, order binary.ByteOrder, ifd int, tag uint16) []byte {
+	if ifd <= 0 || ifd+2 > len(tiff) {
+		return nil
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return nil
+		}
+		if order.Uint16(tiff[entry:]) == tag {
+			return tiff[entry : entry+12]
+		}
+	}
+	return nil
+}
+
+// exifString is an ASCII entry's value
+func exifString(tiff []byte, order binary.ByteOrder, entry []byte) string {
+	if entry == nil || order.Uint16(entry[2:]) != 2 {
+		return ""
+	}
+	count := int(order.Uint32(entry[4:]))
+	var value []byte
+	if count <= 4 {
+		value = entry[8 : 8+count]
+	} else {
+		start := int(order.Uint32(entry[8:]))
+		if start < 0 || start+count > len(tiff) {
+			return ""
+		}
+		value = tiff[start : start+count]
+	}
+	return strings.TrimRight(string(value), "\x00 ")
+}
+
+// imageMetaReads is how many sidecars List reads at once
+const imageMetaReads = 8
+
+type listedImage struct {
+	FileName string     `json:"fileName"`
+	Key      string     `json:"key"`
+	URI      string     `json:"uri"`
+	Meta     *imageMeta `json:"meta"`
+}
+
+// ListImages lists the device's uploaded images with their sidecars. Meta
+// is null for images uploaded before sidecars were kept.
+func (s *Server) ListImages(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	if !s.requireDevice(w, req, deviceID) {
+		return
+	}
+	bucketName := requestTenant(req).imageBucket()
+	keys, err := s.deviceImages(bucketName, deviceID)
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+	metaKeys, err := s.Storage.List(bucketName, imageMetaPrefix+deviceID+"/")
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+	hasMeta := make(map[string]bool, len(metaKeys))
+	for _, key := range metaKeys {
+		hasMeta[key] = true
+	}
+
+	images := make([]*listedImage, 0, len(keys))
+	for name, key := range keys {
+		images = append(images, &listedImage{FileName: name, Key: key, URI: s.objectUrl(bucketName, key)})
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].FileName < images[j].FileName })
+
+	work := make(chan *listedImage)
+	var wg sync.WaitGroup
+	for i := 0; i < imageMetaReads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for image := range work {
+				meta, err := s.readImageMeta(bucketName, imageMetaKey(deviceID, image.FileName))
+				if err != nil {
+					debugf("Error reading the sidecar of %s/%s: %v\n", deviceID, image.FileName, err)
+					continue
+				}
+				image.Meta = meta
+			}
+		}()
+	}
+	for _, image := range images {
+		if hasMeta[imageMetaKey(deviceID, image.FileName)] {
+			work <- image
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	writeJSON(w, struct {
+		Status string         `json:"status"`
+		Images []*listedImage `json:"images"`
+	}{
+		Status: "ok",
+		Images: images,
+	})
+}
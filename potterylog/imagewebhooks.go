@@ -0,0 +1,246 @@
+package potterylog
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Users can register webhooks for their device's images, to mirror them
+// to a backup of their own, like a NAS. Every image stored for the device,
+// whether uploaded or imported, and every one it deletes is POSTed as JSON
+// with its key and size, signed like studio webhooks (see potwebhooks.go).
+// An upload's uri is where the receiver can fetch the image.
+type imageWebhookConfig struct {
+	// Webhooks per device (default 3)
+	MaxPerDevice int `json:"max_per_device"`
+	// Deliver to loopback and private network addresses, for self-hosted
+	// servers on the same network as the backup
+	AllowPrivateAddresses bool `json:"allow_private_addresses"`
+}
+
+func (c imageWebhookConfig) maxPerDevice() int {
+	if c.MaxPerDevice > 0 {
+		return c.MaxPerDevice
+	}
+	return 3
+}
+
+const (
+	imageUploadedEvent = "image.uploaded"
+	imageDeletedEvent  = "image.deleted"
+)
+
+var errTooManyImageWebhooks = newAPIError("too_many_image_webhooks", "This device has as many webhooks as it can have")
+
+type imageWebhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Secret is only in the response that creates the webhook
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// The latest delivery's time and result: "ok" or what went wrong
+	LastDeliveryAt *time.Time `json:"last_delivery_at"`
+	LastResult     string     `json:"last_result,omitempty"`
+
+	deviceID string
+	secret   string
+}
+
+type imageChange struct {
+	Event    string `json:"event"`
+	DeviceID string `json:"device_id"`
+	Key      string `json:"key"`
+	// FileName is the name the app knows the image by, which differs from
+	// the key's for content-addressed images
+	FileName    string `json:"file_name"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+	// ETag is the hex MD5 of an uploaded image
+	ETag     string    `json:"etag,omitempty"`
+	URI      string    `json:"uri,omitempty"`
+	Imported bool      `json:"imported,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// imageUploaded is the upload stage that tells the device's webhooks
+func imageUploaded(s *Server, item *uploadItem) error {
+	hooks, err := s.ops.ImageWebhooks(item.DeviceID)
+	if err != nil {
+		return err
+	}
+	s.sendImageChange(hooks, imageChange{
+		Event:       imageUploadedEvent,
+		DeviceID:    item.DeviceID,
+		Key:         item.Key,
+		FileName:    item.FileName,
+		Size:        item.Size,
+		ContentType: item.ContentType,
+		ETag:        item.ETag,
+		URI:         item.URI,
+		Imported:    item.Imported,
+		At:          s.Clock.Now(),
+	})
+	return nil
+}
+
+// imageDeleting finds the device's webhooks and what they'll be told about
+// the image before it's deleted, while its size and name can still be
+// looked up. The function it returns tells them, once the image is gone.
+// fileName is the name being deleted, if the client said which.
+func (s *Server) imageDeleting(deviceID, bucketName, key, fileName string) func() {
+	if deviceID == "" {
+		return func() {}
+	}
+	hooks, err := s.ops.ImageWebhooks(deviceID)
+	if err != nil {
+		log.Printf("Error finding image webhooks for %s: %v\n", deviceID, err)
+		return func() {}
+	}
+	if len(hooks) == 0 {
+		return func() {}
+	}
+	if fileName == "" {
+		fileName = s.imageName(bucketName, deviceID, key)
+	}
+	change := imageChange{
+		Event:    imageDeletedEvent,
+		DeviceID: deviceID,
+		Key:      key,
+		FileName: fileName,
+	}
+	if info, err := s.Storage.Head(bucketName, key); err == nil {
+		change.Size = info.Size
+		change.ContentType = info.ContentType
+	}
+	return func() {
+		change.At = s.Clock.Now()
+		s.sendImageChange(hooks, change)
+	}
+}
+
+func (s *Server) sendImageChange(hooks []imageWebhook, change imageChange) {
+	if len(hooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(change)
+	if err != nil {
+		log.Printf("Error encoding a change of image %s: %v\n", change.Key, err)
+		return
+	}
+	for _, h := range hooks {
+		go s.deliverImageWebhook(h, change.Event, body)
+	}
+}
+
+// deliverImageWebhook posts a change, retrying failures, and records how
+// the last attempt went
+func (s *Server) deliverImageWebhook(h imageWebhook, event string, body []byte) {
+	delivery := newID()
+	allowPrivate := s.config().ImageWebhooks.AllowPrivateAddresses
+	post := func() error {
+		s.imageWebhookSlots <- struct{}{}
+		defer func() { <-s.imageWebhookSlots }()
+		return postSignedWebhook(h.URL, h.secret, event, delivery, body, allowPrivate)
+	}
+	err := post()
+	for _, delay := range potWebhookRetries {
+		if err == nil || err == errPrivateAddress {
+			break
+		}
+		time.Sleep(delay)
+		err = post()
+	}
+	result := "ok"
+	if err != nil {
+		log.Printf("Error delivering to image webhook %s: %v\n", h.ID, err)
+		s.counters.Incr("image-webhook-failed")
+		result = err.Error()
+	} else {
+		s.counters.Incr("image-webhook-delivered")
+	}
+	if err := s.ops.ImageWebhookDelivered(h.ID, result); err != nil {
+		log.Printf("Error recording a delivery to image webhook %s: %v\n", h.ID, err)
+	}
+}
+
+// ImageWebhooks serves /pottery-log/image-webhooks for a device: GET lists
+// its webhooks, POST with url adds one, and DELETE with webhookId removes
+// one
+func (s *Server) ImageWebhooks(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	if !s.requireDevice(w, req, deviceID) {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		hooks, err := s.ops.ImageWebhooks(deviceID)
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		writeJSON(w, struct {
+			Status   string         `json:"status"`
+			Webhooks []imageWebhook `json:"webhooks"`
+		}{
+			Status:   "ok",
+			Webhooks: hooks,
+		})
+	case http.MethodPost:
+		if !s.validateForm(w, req, webhookURLField) {
+			return
+		}
+		u, err := url.Parse(req.FormValue("url"))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			s.handleErrCode(errInvalidField("url"), http.StatusBadRequest, deviceID, w)
+			return
+		}
+		hooks, err := s.ops.ImageWebhooks(deviceID)
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		if len(hooks) >= s.config().ImageWebhooks.maxPerDevice() {
+			s.handleErrCode(errTooManyImageWebhooks, http.StatusConflict, deviceID, w)
+			return
+		}
+		h := imageWebhook{
+			ID:        newID(),
+			URL:       u.String(),
+			CreatedAt: s.Clock.Now().Truncate(time.Second),
+			deviceID:  deviceID,
+			secret:    newID() + newID(),
+		}
+		if s.handleErr(s.ops.AddImageWebhook(h), deviceID, w) {
+			return
+		}
+		h.Secret = h.secret
+		s.logEvent(deviceID, AddWebhookEvent)
+		writeJSON(w, struct {
+			Status  string       `json:"status"`
+			Webhook imageWebhook `json:"webhook"`
+		}{
+			Status:  "ok",
+			Webhook: h,
+		})
+	case http.MethodDelete:
+		if !s.validateForm(w, req, webhookIDField) {
+			return
+		}
+		deleted, err := s.ops.DeleteImageWebhook(deviceID, req.FormValue("webhookId"))
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		if !deleted {
+			s.handleErrCode(errNoSuchWebhook, http.StatusNotFound, deviceID, w)
+			return
+		}
+		w.Write(okResponse())
+	default:
+		s.handleErrCode(errMethodNotAllowed, http.StatusMethodNotAllowed, deviceID, w)
+	}
+}
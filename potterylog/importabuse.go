@@ -0,0 +1,130 @@
+package potterylog
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sync"
+	"time"
+)
+
+// An importURL makes the server download an archive and copy its images
+// into the device's folder, so without limits a client could use it to
+// have the server mirror objects it shouldn't. Links must point at an
+// export zip in the tenant's import bucket or one of import_url's
+// allowed_buckets, and each device and IP may only download so much per
+// window. A client that goes over is refused with a 429, which counts
+// toward automatic bans, and the operator gets an import-abuse
+// notification.
+type importURLConfig struct {
+	// Buckets importURL may point into besides the tenant's import bucket
+	AllowedBuckets []string `json:"allowed_buckets"`
+	// Caps per device and per IP within WindowSeconds; 0 means no limit
+	MaxImports    int   `json:"max_imports"`
+	MaxBytes      int64 `json:"max_bytes"`
+	WindowSeconds int   `json:"window_seconds"`
+}
+
+var (
+	errNotExportLink  = newAPIError("not_export_link", "The link must be a Pottery Log export link")
+	errImportURLLimit = newAPIError("import_limit", "Too many backups have been restored from links recently. Please try again later.")
+)
+
+// importSource finds the bucket and key an importURL points at, in t's
+// import bucket or an allowed one, or returns errNotExportLink
+func (s *Server) importSource(t *tenant, urlString string) (string, string, error) {
+	buckets := append([]string{t.importBucket()}, s.config().ImportURL.AllowedBuckets...)
+	for _, bucketName := range buckets {
+		if key, ok := s.objectKey(bucketName, urlString); ok && isExportZip(path.Base(key)) {
+			return bucketName, key, nil
+		}
+	}
+	return "", "", errNotExportLink
+}
+
+type importDownload struct {
+	at    time.Time
+	bytes int64
+}
+
+// importVolumes are the recent URL imports by "ip:<addr>" and
+// "device:<id>". Like strikes, they aren't persisted.
+type importVolumes struct {
+	mu      sync.Mutex
+	recent  map[string][]importDownload
+	alerted map[string]time.Time
+}
+
+// allowImportDownload records a download of size bytes for the IP and
+// device, or refuses it if either would go over import_url's caps
+func (s *Server) allowImportDownload(ip, deviceID, urlString string, size int64) error {
+	c := s.config().ImportURL
+	if c.MaxImports <= 0 && c.MaxBytes <= 0 {
+		return nil
+	}
+	window := time.Duration(c.WindowSeconds) * time.Second
+	now := s.Clock.Now()
+
+	s.importVolume.mu.Lock()
+	defer s.importVolume.mu.Unlock()
+
+	keys := []string{"device:" + deviceID}
+	if ip != "" {
+		keys = append(keys, "ip:"+ip)
+	}
+	for _, key := range keys {
+		recent := s.importVolume.recent[key][:0]
+		var bytes int64
+		for _, d := range s.importVolume.recent[key] {
+			if now.Sub(d.at) < window {
+				recent = append(recent, d)
+				bytes += d.bytes
+			}
+		}
+		if len(recent) == 0 {
+			delete(s.importVolume.recent, key)
+		} else {
+			s.importVolume.recent[key] = recent
+		}
+		overCount := c.MaxImports > 0 && len(recent)+1 > c.MaxImports
+		overBytes := c.MaxBytes > 0 && bytes+size > c.MaxBytes
+		if overCount || overBytes {
+			log.Printf("Refusing an import of %s from %s for %s: %d imports and %s within %v\n",
+				formatBytes(size), urlString, key, len(recent), formatBytes(bytes), window)
+			s.counters.Incr("import-url-refused")
+			s.alertImportAbuse(key, deviceID, urlString, len(recent), bytes, window, now)
+			return errImportURLLimit
+		}
+	}
+	for _, key := range keys {
+		s.importVolume.recent[key] = append(s.importVolume.recent[key], importDownload{at: now, bytes: size})
+	}
+	return nil
+}
+
+// alertImportAbuse tells the operator about a refused client, once per
+// window. The caller holds s.importVolume.mu.
+func (s *Server) alertImportAbuse(key, deviceID, urlString string, imports int, bytes int64, window time.Duration, now time.Time) {
+	if last, ok := s.importVolume.alerted[key]; ok && now.Sub(last) < window {
+		return
+	}
+	for k, last := range s.importVolume.alerted {
+		if now.Sub(last) >= window {
+			delete(s.importVolume.alerted, k)
+		}
+	}
+	s.importVolume.alerted[key] = now
+	go s.notify(notification{
+		Kind:  notifyImportAbuse,
+		Title: "Import from URL refused",
+		Body: fmt.Sprintf("%s restored %d backups (%s) from links within %v and was refused another, from %s.",
+			key, imports, formatBytes(bytes), window, urlString),
+		Data: map[string]interface{}{
+			"client":    key,
+			"device_id": deviceID,
+			"imports":   imports,
+			"bytes":     bytes,
+			"url":       urlString,
+		},
+	})
+}
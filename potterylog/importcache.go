@@ -0,0 +1,48 @@
+package potterylog
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Import results are kept this long, so an app retrying a failed or
+// interrupted import doesn't upload every image again
+const importResultTTL = 24 * time.Hour
+
+type importResponse struct {
+	Status   string            `json:"status"`
+	Metadata string            `json:"metadata"`
+	ImageMap map[string]string `json:"image_map"`
+	// Skipped counts images that were already stored from an earlier
+	// import, and weren't uploaded again
+	Skipped int `json:"skipped"`
+	// Errors are the images that couldn't be restored. The rest of the
+	// archive is imported anyway.
+	Errors []importFileError `json:"errors,omitempty"`
+	// Cached is set when the archive was imported before and nothing was
+	// uploaded this time
+	Cached bool `json:"cached,omitempty"`
+	// Merged is set for a merge import
+	Merged *mergeSummary `json:"merged,omitempty"`
+}
+
+// importFileError is why one image in an archive couldn't be imported
+type importFileError struct {
+	Name    string `json:"name"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// archiveManifestHash identifies an archive by its entries' names, sizes,
+// and checksums, which are in the zip's central directory, so it's known
+// without reading the whole file
+func archiveManifestHash(r *zip.Reader) string {
+	h := sha256.New()
+	for _, f := range r.File {
+		fmt.Fprintf(h, "%s\x00%d\x00%08x\x00%s\n", f.Name, f.UncompressedSize64, f.CRC32, f.Comment)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,53 @@
+package potterylog
+
+import (
+	"net/http"
+	"regexp"
+)
+
+// An import normally hands back the archive's metadata for the app to
+// replace its own with. With mode=merge it's merged into the device's
+// current metadata instead (see mergeAppMetadata), for consolidating two
+// devices' histories. The current metadata is currentMetadata if the app
+// sends it, or else the device's latest version on the server.
+
+const importModeMerge = "merge"
+
+var importModeField = field{Name: "mode", Pattern: regexp.MustCompile(`^(replace|merge)$`)}
+
+var errInvalidCurrentMetadata = newAPIError("invalid_current_metadata", "The current metadata can't be read")
+
+// currentImportMetadata is the metadata a merge import merges into. If it
+// can't be found, it responds and returns false.
+func (s *Server) currentImportMetadata(w http.ResponseWriter, req *http.Request, deviceID string) ([]byte, bool) {
+	if current := req.FormValue("currentMetadata"); current != "" {
+		return []byte(current), true
+	}
+	// The server's copy is the device's own data
+	if !s.requireDevice(w, req, deviceID) {
+		return nil, false
+	}
+	version, current, err := s.metadataHistory.Latest(requestTenant(req).dataKey(deviceID))
+	if err == errNoMetadataVersion {
+		return []byte("{}"), true
+	}
+	if err == nil && version.Encrypted {
+		err = errMetadataEncrypted
+	}
+	if s.handleMetadataErr(err, deviceID, w) {
+		return nil, false
+	}
+	return current, true
+}
+
+// merge merges the imported metadata into current. If it can't, it
+// responds and returns false.
+func (resp *importResponse) merge(s *Server, w http.ResponseWriter, current []byte, deviceID string) bool {
+	merged, summary, err := mergeAppMetadata(current, []byte(resp.Metadata))
+	if s.handleErrCode(err, http.StatusBadRequest, deviceID, w) {
+		return false
+	}
+	resp.Metadata = string(merged)
+	resp.Merged = summary
+	return true
+}
@@ -0,0 +1,261 @@
+package potterylog
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// An import preview describes a backup before it's restored, so the app can
+// ask "Restore 214 pots from March 3?" first. It reads only the zip's
+// central directory and metadata.json. A stored export is read in ranges
+// straight from the bucket rather than downloaded, and nothing is uploaded.
+
+var (
+	errNoMetadata      = newAPIError("invalid_export", "No "+metadataFileName+" found in the zip file")
+	errInvalidArchive  = newAPIError("invalid_archive", "The backup isn't a valid zip file")
+	errInvalidMetadata = newAPIError("invalid_metadata", "The backup's metadata can't be read")
+)
+
+// rangeReadBytes is the least read from storage at a time, so the central
+// directory and metadata take a few requests instead of one per entry
+const rangeReadBytes = 256 << 10
+
+// objectReaderAt reads a stored object in ranges, keeping the last one
+type objectReaderAt struct {
+	store      Storage
+	bucketName string
+	key        string
+	size       int64
+
+	offset int64
+	buf    []byte
+	// modified is the object's Last-Modified, once it's been read
+	modified time.Time
+}
+
+func (r *objectReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if off < r.offset || off+int64(len(p)) > r.offset+int64(len(r.buf)) {
+		if err := r.fill(off, int64(len(p))); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf[off-r.offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *objectReaderAt) fill(off, length int64) error {
+	end := off + max(length, rangeReadBytes)
+	if end > r.size {
+		end = r.size
+	}
+	obj, err := r.store.Fetch(r.bucketName, r.key, FetchConditions{Range: fmt.Sprintf("bytes=%d-%d", off, end-1)})
+	if err != nil {
+		return err
+	}
+	if obj.Body == nil {
+		return fmt.Errorf("reading %s: status %d", r.key, obj.Status)
+	}
+	defer obj.Body.Close()
+	buf, err := ioutil.ReadAll(obj.Body)
+	if err != nil {
+		return err
+	}
+	if obj.Status == http.StatusOK {
+		// The whole object, if storage ignored the range
+		buf = buf[min(off, int64(len(buf))):]
+	}
+	r.offset, r.buf, r.modified = off, buf, obj.LastModified
+	return nil
+}
+
+type importPreview struct {
+	Status string `json:"status"`
+	Pots   int    `json:"pots"`
+	Images int    `json:"images"`
+	// Bytes is the size of the zip, and ImageBytes of the images in it
+	Bytes      int64 `json:"bytes"`
+	ImageBytes int64 `json:"image_bytes"`
+	// ExportedAt is when the export was made, if the zip says or it's a
+	// stored export
+	ExportedAt *time.Time `json:"exported_at"`
+}
+
+// previewArchive counts what's in an export zip
+func previewArchive(r *zip.Reader, size int64) (*importPreview, error) {
+	preview := &importPreview{Status: "ok", Bytes: size}
+	var metadata *zip.File
+	for _, f := range r.File {
+		switch {
+		case f.Name == metadataFileName:
+			metadata = f
+		case !f.FileInfo().IsDir():
+			preview.Images++
+			preview.ImageBytes += int64(f.UncompressedSize64)
+		}
+	}
+	if metadata == nil {
+		return nil, errNoMetadata
+	}
+	// Exports from before the metadata's time was recorded have none
+	if metadata.ModifiedDate != 0 {
+		exportedAt := metadata.Modified.UTC()
+		preview.ExportedAt = &exportedAt
+	}
+	rc, err := metadata.Open()
+	if err != nil {
+		return nil, errInvalidMetadata
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, errInvalidMetadata
+	}
+	potsByID, err := appMetadataPots(data)
+	if err != nil {
+		return nil, errInvalidMetadata
+	}
+	preview.Pots = len(potsByID)
+	return preview, nil
+}
+
+// ImportPreview describes the backup at importURL, the stored export
+// exportHistoryId, or the uploaded zip import, without importing it. An
+// upload from another app is described as it would be converted.
+func (s *Server) ImportPreview(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField, importURLField, exportHistoryIDField, importSourceField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	url := req.FormValue("importURL")
+	source := req.FormValue("source")
+	// keptFile is a direct export to preview from the export temp directory
+	var keptFile string
+	if historyID := req.FormValue("exportHistoryId"); historyID != "" {
+		if !s.requireDevice(w, req, deviceID) {
+			return
+		}
+		var err error
+		url, err = s.exportHistoryURI(deviceID, historyID)
+		if err == errNoSuchExport {
+			s.handleErrCode(err, http.StatusNotFound, deviceID, w)
+			return
+		}
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		keptFile, _ = s.Exports.keptExportDownload(deviceID, url)
+	}
+
+	var r *zip.Reader
+	var size int64
+	var lastModified time.Time
+	if source != "" && source != importSourcePotteryLog {
+		// An export from another app is previewed as it would be imported
+		upload, uploadHeader, err := formFile(req, "import")
+		if upload == nil {
+			s.handleErrCode(errMissingField("import"), http.StatusBadRequest, deviceID, w)
+			return
+		}
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		defer upload.Close()
+		converted, _, err := s.convertLegacyImport(source, upload, uploadHeader.Size)
+		if err == errMemoryBusy {
+			s.tooBusy(w, err, deviceID, 30*time.Second)
+			return
+		}
+		if s.handleErrCode(err, legacyImportStatus(err), deviceID, w) {
+			return
+		}
+		defer os.Remove(converted.Name())
+		defer converted.Close()
+		info, err := converted.Stat()
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		size = info.Size()
+		r, err = zip.NewReader(converted, size)
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+	} else if keptFile != "" {
+		rc, err := zip.OpenReader(keptFile)
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		defer rc.Close()
+		r = &rc.Reader
+		if info, err := os.Stat(keptFile); err == nil {
+			size = info.Size()
+			lastModified = info.ModTime()
+		}
+	} else if url != "" {
+		bucketName, key, err := s.importSource(requestTenant(req), url)
+		if s.handleErrCode(err, http.StatusBadRequest, deviceID, w) {
+			return
+		}
+		info, err := s.Storage.Head(bucketName, key)
+		if isNotFound(err) {
+			s.handleErrCode(errNoSuchExport, http.StatusNotFound, deviceID, w)
+			return
+		}
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		size = info.Size
+		ra := &objectReaderAt{store: s.Storage, bucketName: bucketName, key: key, size: size}
+		r, err = zip.NewReader(ra, size)
+		lastModified = ra.modified
+		if errors.Is(err, zip.ErrFormat) {
+			s.handleErrCode(errInvalidArchive, http.StatusBadRequest, deviceID, w)
+			return
+		}
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+	} else {
+		zipFile, zipFileHeader, err := formFile(req, "import")
+		if zipFile == nil {
+			s.handleErrCode(errMissingField("importURL", "import", "exportHistoryId"), http.StatusBadRequest, deviceID, w)
+			return
+		}
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		defer zipFile.Close()
+		size = zipFileHeader.Size
+		r, err = zip.NewReader(zipFile, size)
+		if err != nil {
+			s.handleErrCode(errInvalidArchive, http.StatusBadRequest, deviceID, w)
+			return
+		}
+	}
+
+	preview, err := previewArchive(r, size)
+	if err == errNoMetadata || err == errInvalidMetadata {
+		s.handleErrCode(err, http.StatusBadRequest, deviceID, w)
+		return
+	}
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+	if preview.ExportedAt == nil && !lastModified.IsZero() {
+		exportedAt := lastModified.UTC()
+		preview.ExportedAt = &exportedAt
+	}
+	s.logEvent(deviceID, ImportPreviewEvent{Pots: preview.Pots, Images: preview.Images, Bytes: size})
+	writeJSON(w, preview)
+}
@@ -0,0 +1,465 @@
+package potterylog
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// `pottery-log-server init-storage` sets up every tenant's buckets the way
+// the server expects them, so a new deployment doesn't have to work it out
+// from the source: it creates missing buckets, sets Object Ownership and
+// Block Public Access to match bucket_acls, grants public reads on image
+// buckets by policy when they don't use the public-read ACL, allows the
+// app's origins to load objects with CORS, and has S3 clean up multipart
+// uploads the server didn't get to abort. Rules it manages are marked with
+// storageRuleID, and any others on the bucket are left alone. It then
+// prints the IAM policy the server's own credentials need.
+//
+// Exports and recompressed originals aren't expired by lifecycle rules.
+// The server's expire-exports and expire-originals jobs delete them, so
+// the database stays in step with the buckets.
+
+const (
+	storageRuleID = "pottery-log"
+	publicReadSid = "PotteryLogPublicRead"
+	// abortMultipartDays is how long S3 keeps the parts of an abandoned
+	// multipart upload, after a crash or restart
+	abortMultipartDays = 1
+)
+
+type policyDocument struct {
+	Version   string            `json:"Version"`
+	Statement []policyStatement `json:"Statement"`
+}
+
+type policyStatement struct {
+	Sid       string      `json:"Sid,omitempty"`
+	Effect    string      `json:"Effect"`
+	Principal interface{} `json:"Principal,omitempty"`
+	Action    interface{} `json:"Action"`
+	Resource  interface{} `json:"Resource"`
+}
+
+// initStorage runs the init-storage command with its args
+func initStorage(args []string) {
+	flags := flag.NewFlagSet("init-storage", flag.ExitOnError)
+	configFile := flags.String("config", "", "path to the JSON config file the server runs with")
+	profile := flags.String("profile", awsProfile, "profile in ~/.aws/credentials to set up the buckets with")
+	checkOnly := flags.Bool("check", false, "list what's missing or different without changing anything, and exit 1 if anything is")
+	policyOnly := flags.Bool("policy_only", false, "print the IAM policy for the server's credentials and exit")
+	origins := flags.String("cors_origins", "*", "comma-separated origins allowed to load images and exports in a browser")
+	flags.Parse(args)
+
+	c, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Error loading config: %v\n", err)
+	}
+	srv := &Server{Settings: c}
+	buckets := srv.configuredBuckets()
+	if *policyOnly {
+		printServerPolicy(c, buckets)
+		return
+	}
+
+	store := newS3StoreForProfile(*profile, srv.objectACL)
+	srv.Storage = store
+	st := &storageSetup{
+		server:  srv,
+		svc:     store.svc,
+		region:  aws.StringValue(store.svc.Config.Region),
+		check:   *checkOnly,
+		origins: strings.Split(*origins, ","),
+	}
+	names := make([]string, 0, len(buckets))
+	for bucketName := range buckets {
+		names = append(names, bucketName)
+	}
+	sort.Strings(names)
+	for _, bucketName := range names {
+		st.setUp(bucketName, buckets[bucketName])
+	}
+
+	switch {
+	case st.errors > 0:
+		log.Fatalf("%d problems setting up storage, listed above\n", st.errors)
+	case st.check && st.changes > 0:
+		log.Printf("%d changes needed. Run init-storage without -check to make them.\n", st.changes)
+		os.Exit(1)
+	case st.check:
+		log.Print("Storage is set up.\n")
+	default:
+		// Make sure the server could use what was set up
+		check := &selfCheck{server: srv}
+		check.checkBuckets()
+		if check.errors > 0 {
+			log.Fatalf("The buckets are set up, but %d checks failed\n", check.errors)
+		}
+		log.Printf("Storage is set up, with %d changes.\n", st.changes)
+	}
+	log.Print("The server's credentials need this IAM policy:\n")
+	printServerPolicy(c, buckets)
+}
+
+// printServerPolicy writes the IAM policy the server needs for buckets to
+// stdout
+func printServerPolicy(c *config, buckets map[string]bool) {
+	out, _ := json.MarshalIndent(serverPolicy(c, buckets), "", "  ")
+	// The policy is the command's output, for piping to a file, while
+	// everything else it says goes to the log
+	fmt.Fprintln(os.Stdout, string(out))
+}
+
+// serverPolicy is the IAM policy for the server's credentials: reading,
+// writing, and deleting objects in its buckets, listing them, and reading
+// the settings checked on startup
+func serverPolicy(c *config, buckets map[string]bool) policyDocument {
+	objectActions := []string{
+		"s3:PutObject", "s3:GetObject", "s3:DeleteObject",
+		"s3:AbortMultipartUpload", "s3:ListMultipartUploadParts",
+	}
+	var bucketARNs, objectARNs []string
+	acls := false
+	for bucketName := range buckets {
+		bucketARNs = append(bucketARNs, "arn:aws:s3:::"+bucketName)
+		objectARNs = append(objectARNs, "arn:aws:s3:::"+bucketName+"/*")
+		if objectACL(c, bucketName) != nil {
+			acls = true
+		}
+	}
+	sort.Strings(bucketARNs)
+	sort.Strings(objectARNs)
+	// Putting an object with an ACL needs permission to set it
+	if acls {
+		objectActions = append(objectActions, "s3:PutObjectAcl")
+	}
+	return policyDocument{
+		Version: "2012-10-17",
+		Statement: []policyStatement{
+			{
+				Sid:      "PotteryLogObjects",
+				Effect:   "Allow",
+				Action:   objectActions,
+				Resource: objectARNs,
+			},
+			{
+				Sid:      "PotteryLogBuckets",
+				Effect:   "Allow",
+				Action:   []string{"s3:ListBucket", "s3:GetBucketOwnershipControls", "s3:GetBucketPolicyStatus"},
+				Resource: bucketARNs,
+			},
+		},
+	}
+}
+
+type storageSetup struct {
+	server  *Server
+	svc     *s3.S3
+	region  string
+	check   bool
+	origins []string
+	// changes counts what was changed, or with -check what would be
+	changes int
+	errors  int
+}
+
+func (st *storageSetup) errorf(format string, args ...interface{}) {
+	st.errors++
+	log.Printf("Error: "+format+"\n", args...)
+}
+
+// change logs a change to make, and returns whether to make it
+func (st *storageSetup) change(format string, args ...interface{}) bool {
+	st.changes++
+	if st.check {
+		log.Printf("Needed: "+format+"\n", args...)
+		return false
+	}
+	log.Printf(format+"\n", args...)
+	return true
+}
+
+func awsErrorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return ""
+}
+
+// setUp brings one bucket in line, stopping at the first step that fails
+func (st *storageSetup) setUp(bucketName string, image bool) {
+	acl := "none"
+	if a := st.server.objectACL(bucketName); a != nil {
+		acl = *a
+	}
+	// Image buckets are public by ACL or else by policy
+	publicPolicy := image && acl != "public-read"
+	steps := []func() error{
+		func() error { return st.createBucket(bucketName) },
+		func() error { return st.setOwnership(bucketName, acl) },
+		func() error { return st.setPublicAccess(bucketName, acl == "public-read", publicPolicy) },
+		func() error {
+			if !publicPolicy {
+				return nil
+			}
+			return st.setPublicPolicy(bucketName)
+		},
+		func() error { return st.setCORS(bucketName) },
+		func() error { return st.setLifecycle(bucketName) },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			st.errorf("bucket %s: %v", bucketName, err)
+			return
+		}
+	}
+}
+
+func (st *storageSetup) createBucket(bucketName string) error {
+	_, err := st.svc.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(bucketName)})
+	if err == nil {
+		return nil
+	}
+	switch awsErrorCode(err) {
+	case "NotFound", s3.ErrCodeNoSuchBucket:
+	case "Forbidden":
+		return fmt.Errorf("it belongs to another account, or these credentials can't see it")
+	default:
+		return err
+	}
+	if !st.change("bucket %s: creating it in %s", bucketName, st.region) {
+		// Nothing else can be checked
+		return nil
+	}
+	in := &s3.CreateBucketInput{Bucket: aws.String(bucketName)}
+	// us-east-1 is the default, and can't be given as a constraint
+	if st.region != "us-east-1" {
+		in.CreateBucketConfiguration = &s3.CreateBucketConfiguration{LocationConstraint: aws.String(st.region)}
+	}
+	if _, err := st.svc.CreateBucket(in); err != nil && awsErrorCode(err) != s3.ErrCodeBucketAlreadyOwnedByYou {
+		return err
+	}
+	return st.svc.WaitUntilBucketExists(&s3.HeadBucketInput{Bucket: aws.String(bucketName)})
+}
+
+// setOwnership turns ACLs off for a bucket whose objects are put without
+// one, and makes sure a bucket whose objects have an ACL accepts them
+func (st *storageSetup) setOwnership(bucketName, acl string) error {
+	ownership := s3.ObjectOwnershipObjectWriter
+	out, err := st.svc.GetBucketOwnershipControls(&s3.GetBucketOwnershipControlsInput{Bucket: aws.String(bucketName)})
+	switch {
+	case awsErrorCode(err) == "OwnershipControlsNotFoundError", awsErrorCode(err) == s3.ErrCodeNoSuchBucket:
+	case err != nil:
+		return err
+	case out.OwnershipControls != nil && len(out.OwnershipControls.Rules) > 0:
+		ownership = aws.StringValue(out.OwnershipControls.Rules[0].ObjectOwnership)
+	}
+	want := ownership
+	if acl == "none" {
+		want = objectOwnershipBucketOwnerEnforced
+	} else if ownership == objectOwnershipBucketOwnerEnforced {
+		want = s3.ObjectOwnershipBucketOwnerPreferred
+	}
+	if want == ownership || !st.change("bucket %s: setting Object Ownership to %s", bucketName, want) {
+		return nil
+	}
+	_, err = st.svc.PutBucketOwnershipControls(&s3.PutBucketOwnershipControlsInput{
+		Bucket: aws.String(bucketName),
+		OwnershipControls: &s3.OwnershipControls{
+			Rules: []*s3.OwnershipControlsRule{{ObjectOwnership: aws.String(want)}},
+		},
+	})
+	return err
+}
+
+// setPublicAccess blocks public access to the bucket except by the ACL or
+// policy it's meant to be public by
+func (st *storageSetup) setPublicAccess(bucketName string, publicACL, publicPolicy bool) error {
+	want := &s3.PublicAccessBlockConfiguration{
+		BlockPublicAcls:       aws.Bool(!publicACL),
+		IgnorePublicAcls:      aws.Bool(!publicACL),
+		BlockPublicPolicy:     aws.Bool(!publicPolicy),
+		RestrictPublicBuckets: aws.Bool(!publicPolicy),
+	}
+	// Nothing is blocked without a configuration
+	have := &s3.PublicAccessBlockConfiguration{
+		BlockPublicAcls:       aws.Bool(false),
+		IgnorePublicAcls:      aws.Bool(false),
+		BlockPublicPolicy:     aws.Bool(false),
+		RestrictPublicBuckets: aws.Bool(false),
+	}
+	out, err := st.svc.GetPublicAccessBlock(&s3.GetPublicAccessBlockInput{Bucket: aws.String(bucketName)})
+	switch {
+	case awsErrorCode(err) == "NoSuchPublicAccessBlockConfiguration", awsErrorCode(err) == s3.ErrCodeNoSuchBucket:
+	case err != nil:
+		return err
+	case out.PublicAccessBlockConfiguration != nil:
+		have = out.PublicAccessBlockConfiguration
+	}
+	if reflect.DeepEqual(have, want) || !st.change("bucket %s: blocking public access except by %s", bucketName, publicAccessBy(publicACL, publicPolicy)) {
+		return nil
+	}
+	_, err = st.svc.PutPublicAccessBlock(&s3.PutPublicAccessBlockInput{
+		Bucket:                         aws.String(bucketName),
+		PublicAccessBlockConfiguration: want,
+	})
+	return err
+}
+
+func publicAccessBy(publicACL, publicPolicy bool) string {
+	switch {
+	case publicACL && publicPolicy:
+		return "ACL or policy"
+	case publicACL:
+		return "ACL"
+	case publicPolicy:
+		return "policy"
+	}
+	return "anything"
+}
+
+// setPublicPolicy adds a statement granting public reads to the bucket's
+// policy, keeping the statements already there
+func (st *storageSetup) setPublicPolicy(bucketName string) error {
+	statement := policyStatement{
+		Sid:       publicReadSid,
+		Effect:    "Allow",
+		Principal: "*",
+		Action:    "s3:GetObject",
+		Resource:  "arn:aws:s3:::" + bucketName + "/*",
+	}
+	doc := map[string]interface{}{"Version": "2012-10-17"}
+	var statements []interface{}
+	out, err := st.svc.GetBucketPolicy(&s3.GetBucketPolicyInput{Bucket: aws.String(bucketName)})
+	switch {
+	case awsErrorCode(err) == "NoSuchBucketPolicy", awsErrorCode(err) == s3.ErrCodeNoSuchBucket:
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal([]byte(aws.StringValue(out.Policy)), &doc); err != nil {
+			return fmt.Errorf("reading its policy: %w", err)
+		}
+		switch s := doc["Statement"].(type) {
+		case []interface{}:
+			statements = s
+		case map[string]interface{}:
+			statements = []interface{}{s}
+		}
+	}
+
+	// Compare as JSON values, the way the policy comes back
+	var want map[string]interface{}
+	data, _ := json.Marshal(statement)
+	json.Unmarshal(data, &want)
+	kept := []interface{}{}
+	for _, s := range statements {
+		if m, ok := s.(map[string]interface{}); ok && m["Sid"] == publicReadSid {
+			if reflect.DeepEqual(m, want) {
+				return nil
+			}
+			continue
+		}
+		kept = append(kept, s)
+	}
+	if !st.change("bucket %s: granting public reads in its policy", bucketName) {
+		return nil
+	}
+	doc["Statement"] = append(kept, want)
+	policy, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = st.svc.PutBucketPolicy(&s3.PutBucketPolicyInput{
+		Bucket: aws.String(bucketName),
+		Policy: aws.String(string(policy)),
+	})
+	return err
+}
+
+// setCORS lets the configured origins read objects from a browser
+func (st *storageSetup) setCORS(bucketName string) error {
+	want := &s3.CORSRule{
+		ID:             aws.String(storageRuleID),
+		AllowedMethods: aws.StringSlice([]string{"GET", "HEAD"}),
+		AllowedOrigins: aws.StringSlice(st.origins),
+		AllowedHeaders: aws.StringSlice([]string{"*"}),
+		ExposeHeaders:  aws.StringSlice([]string{"ETag", "Content-Length"}),
+		MaxAgeSeconds:  aws.Int64(3600),
+	}
+	var rules []*s3.CORSRule
+	out, err := st.svc.GetBucketCors(&s3.GetBucketCorsInput{Bucket: aws.String(bucketName)})
+	switch {
+	case awsErrorCode(err) == "NoSuchCORSConfiguration", awsErrorCode(err) == s3.ErrCodeNoSuchBucket:
+	case err != nil:
+		return err
+	default:
+		rules = out.CORSRules
+	}
+	kept := []*s3.CORSRule{}
+	for _, rule := range rules {
+		if aws.StringValue(rule.ID) == storageRuleID {
+			if reflect.DeepEqual(rule, want) {
+				return nil
+			}
+			continue
+		}
+		kept = append(kept, rule)
+	}
+	if !st.change("bucket %s: allowing GET from %s with CORS", bucketName, strings.Join(st.origins, ", ")) {
+		return nil
+	}
+	_, err = st.svc.PutBucketCors(&s3.PutBucketCorsInput{
+		Bucket:            aws.String(bucketName),
+		CORSConfiguration: &s3.CORSConfiguration{CORSRules: append(kept, want)},
+	})
+	return err
+}
+
+// setLifecycle has S3 delete the parts of abandoned multipart uploads
+func (st *storageSetup) setLifecycle(bucketName string) error {
+	want := &s3.LifecycleRule{
+		ID:     aws.String(storageRuleID),
+		Status: aws.String(s3.ExpirationStatusEnabled),
+		Filter: &s3.LifecycleRuleFilter{Prefix: aws.String("")},
+		AbortIncompleteMultipartUpload: &s3.AbortIncompleteMultipartUpload{
+			DaysAfterInitiation: aws.Int64(abortMultipartDays),
+		},
+	}
+	var rules []*s3.LifecycleRule
+	out, err := st.svc.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(bucketName)})
+	switch {
+	case awsErrorCode(err) == "NoSuchLifecycleConfiguration", awsErrorCode(err) == s3.ErrCodeNoSuchBucket:
+	case err != nil:
+		return err
+	default:
+		rules = out.Rules
+	}
+	kept := []*s3.LifecycleRule{}
+	for _, rule := range rules {
+		if aws.StringValue(rule.ID) == storageRuleID {
+			if aws.StringValue(rule.Status) == s3.ExpirationStatusEnabled && rule.AbortIncompleteMultipartUpload != nil &&
+				aws.Int64Value(rule.AbortIncompleteMultipartUpload.DaysAfterInitiation) == abortMultipartDays {
+				return nil
+			}
+			continue
+		}
+		kept = append(kept, rule)
+	}
+	if !st.change("bucket %s: aborting multipart uploads after %d day", bucketName, abortMultipartDays) {
+		return nil
+	}
+	_, err = st.svc.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(bucketName),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: append(kept, want)},
+	})
+	return err
+}
@@ -0,0 +1,110 @@
+package potterylog
+
+import (
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Key escrow keeps a copy of the key an encrypted export was made with, so
+// a user who forgets the backup passphrase before their phone dies can
+// still get it back. The app derives the key from the account, wraps it
+// with the user's passphrase, and sends only the wrapped key, the salt, and
+// a description of how the wrapping key was derived. The server never sees
+// the passphrase or the key itself. Escrow is optional; an app that doesn't
+// use it loses nothing.
+
+var errNoSuchKey = newAPIError("no_such_key", "There is no escrowed key with that id")
+
+var base64Pattern = regexp.MustCompile(`^[A-Za-z0-9+/_=-]+$`)
+
+var (
+	keyIDField = field{Name: "keyId", Required: true, MaxLen: 128, Pattern: validIDPattern}
+	// A wrapped 256-bit key with its nonce and tag is well under 1KB
+	wrappedKeyField = field{Name: "wrappedKey", Required: true, MaxLen: 1024, Pattern: base64Pattern}
+	saltField       = field{Name: "salt", Required: true, MaxLen: 256, Pattern: base64Pattern}
+	// kdf is the app's own description, like argon2id$m=65536,t=3,p=4
+	kdfField = field{Name: "kdf", Required: true, MaxLen: 256, Pattern: uriPattern}
+)
+
+type escrowedKey struct {
+	KeyID      string    `json:"keyId"`
+	WrappedKey string    `json:"wrappedKey"`
+	Salt       string    `json:"salt"`
+	KDF        string    `json:"kdf"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// KeyEscrow lists the device's escrowed keys on GET (or just keyId's),
+// stores one on POST, and deletes keyId on DELETE
+func (s *Server) KeyEscrow(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	if !s.requireDevice(w, req, deviceID) {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		if !s.validateForm(w, req, field{Name: "keyId", MaxLen: 128, Pattern: validIDPattern}) {
+			return
+		}
+		keys, err := s.ops.EscrowedKeys(deviceID)
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		if keyID := req.FormValue("keyId"); keyID != "" {
+			var found []escrowedKey
+			for _, k := range keys {
+				if k.KeyID == keyID {
+					found = append(found, k)
+				}
+			}
+			if len(found) == 0 {
+				s.handleErrCode(errNoSuchKey, http.StatusNotFound, deviceID, w)
+				return
+			}
+			keys = found
+			s.logEvent(deviceID, RecoverKeyEvent)
+		}
+		writeJSON(w, struct {
+			Status string        `json:"status"`
+			Keys   []escrowedKey `json:"keys"`
+		}{
+			Status: "ok",
+			Keys:   keys,
+		})
+	case http.MethodPost:
+		if !s.validateForm(w, req, keyIDField, wrappedKeyField, saltField, kdfField) {
+			return
+		}
+		err := s.ops.EscrowKey(deviceID, escrowedKey{
+			KeyID:      req.FormValue("keyId"),
+			WrappedKey: req.FormValue("wrappedKey"),
+			Salt:       req.FormValue("salt"),
+			KDF:        req.FormValue("kdf"),
+		})
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		s.logEvent(deviceID, EscrowKeyEvent)
+		w.Write(okResponse())
+	case http.MethodDelete:
+		if !s.validateForm(w, req, keyIDField) {
+			return
+		}
+		deleted, err := s.ops.DeleteEscrowedKey(deviceID, req.FormValue("keyId"))
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		if !deleted {
+			s.handleErrCode(errNoSuchKey, http.StatusNotFound, deviceID, w)
+			return
+		}
+		w.Write(okResponse())
+	default:
+		s.handleErrCode(errMethodNotAllowed, http.StatusMethodNotAllowed, deviceID, w)
+	}
+}
@@ -0,0 +1,669 @@
+package potterylog
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Imports with source=csv or source=trello come from another app or a
+// spreadsheet rather than from Pottery Log. The upload is turned into a
+// Pottery Log archive, with a metadata.json in the app's format and the
+// pots' photos, and then imported like any other, so merging and retries
+// work the same. Pot ids are derived from the source, so importing the same
+// file twice gives the same pots.
+//
+// A CSV import is a zip with a .csv file and the photos. Each row is a pot.
+// Columns are matched by name: title (or name), id, notes, photos (names
+// separated by ; or ,), a date column for each status, like thrown or
+// "bisque date", and status with status_date. A pot without photos listed
+// has the ones in a folder named after its id or title.
+//
+// A Trello import is a board's JSON export, or a zip with it and the
+// downloaded attachments. Each card is a pot, its list is its status, and
+// the board's actions date when it reached each one. Trello's export only
+// links to attachments, so any that aren't in the zip are listed as errors.
+
+const (
+	importSourcePotteryLog = "pottery-log"
+	importSourceCSV        = "csv"
+	importSourceTrello     = "trello"
+)
+
+var importSourceField = field{Name: "source", Pattern: regexp.MustCompile(`^(pottery-log|csv|trello)$`)}
+
+// maxLegacyTableBytes caps the CSV or Trello JSON, which is read into
+// memory
+const maxLegacyTableBytes = 20 << 20
+
+var errLegacyNoPhoto = newAPIError("legacy_photo_missing", "The photo isn't in the upload")
+
+var legacySourceNames = map[string]string{
+	importSourceCSV:    "CSV",
+	importSourceTrello: "Trello",
+}
+
+// legacyUnreadable is why the upload can't be converted, with the details
+// for the log
+func legacyUnreadable(source string, err error) error {
+	name := legacySourceNames[source]
+	return fmt.Errorf("%w: %v", newAPIError("legacy_import_unreadable", "The "+name+" export can't be read", name), err)
+}
+
+func legacyNoPots(source string) error {
+	name := legacySourceNames[source]
+	return newAPIError("legacy_import_empty", "There are no pots in the "+name+" export", name)
+}
+
+// legacyImportStatus is 400 for an upload that can't be converted, and 500
+// for anything else
+func legacyImportStatus(err error) int {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// legacyPot is a pot from another app, before it's written as app metadata
+type legacyPot struct {
+	// key identifies the pot in its source, like a Trello card id
+	key   string
+	Title string
+	Dates map[string]time.Time
+	Notes string
+	// Photos are the upload's entries, in order
+	Photos []*zip.File
+}
+
+// legacyStatuses maps what other apps call a stage, lowercased with only
+// its letters, to the app's status
+var legacyStatuses = map[string]string{
+	"notstarted": "notstarted", "planned": "notstarted", "idea": "notstarted", "todo": "notstarted",
+	"thrown": "thrown", "throw": "thrown", "made": "thrown", "created": "thrown", "built": "thrown", "handbuilt": "thrown", "formed": "thrown",
+	"trimmed": "trimmed", "trim": "trimmed", "trimming": "trimmed",
+	"bisqued": "bisqued", "bisque": "bisqued", "bisquefired": "bisqued", "bisquefiring": "bisqued",
+	"glazed": "glazed", "glaze": "glazed", "glazing": "glazed", "glazefired": "glazed", "glazefiring": "glazed", "fired": "glazed",
+	"pickedup": "pickedup", "pickup": "pickedup", "done": "pickedup", "finished": "pickedup", "complete": "pickedup", "completed": "pickedup",
+}
+
+func legacyStatus(name string) (string, bool) {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) {
+			b.WriteRune(r)
+		}
+	}
+	status, ok := legacyStatuses[b.String()]
+	return status, ok
+}
+
+// legacyDateLayouts are tried in order. Slashed dates are read month
+// first, like most spreadsheets in the US, unless that can't be right.
+var legacyDateLayouts = []string{
+	time.RFC3339, "2006-01-02", "2006-01-02 15:04:05", "2006-01-02 15:04", "2006/01/02",
+	"1/2/2006", "1/2/06", "2/1/2006", "2/1/06", "1/2/2006 15:04", "1/2/2006 15:04:05",
+	"Jan 2, 2006", "January 2, 2006", "2 Jan 2006", "2 January 2006",
+}
+
+func legacyDate(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range legacyDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// convertLegacyImport turns an upload from source into a Pottery Log
+// archive in the export temp directory, which the caller removes. Photos that
+// couldn't be found are returned as errors, and the rest is converted.
+func (s *Server) convertLegacyImport(source string, upload io.ReaderAt, size int64) (*os.File, []importFileError, error) {
+	var pots []legacyPot
+	var missing []importFileError
+	var err error
+	switch source {
+	case importSourceCSV:
+		pots, missing, err = s.csvLegacyPots(upload, size)
+	case importSourceTrello:
+		pots, missing, err = s.trelloLegacyPots(upload, size)
+	default:
+		return nil, nil, fmt.Errorf("unknown import source %q", source)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(pots) == 0 {
+		return nil, nil, legacyNoPots(source)
+	}
+	f, err := s.writeLegacyArchive(source, pots)
+	return f, missing, err
+}
+
+// readLegacyTable reads the CSV or JSON, against the memory budget
+func (s *Server) readLegacyTable(source string, r io.Reader, size int64) ([]byte, error) {
+	if size > maxLegacyTableBytes {
+		return nil, legacyUnreadable(source, fmt.Errorf("it's bigger than %s", formatBytes(maxLegacyTableBytes)))
+	}
+	release, err := s.memory.Reserve(size, memoryWait)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return ioutil.ReadAll(io.LimitReader(r, maxLegacyTableBytes))
+}
+
+// legacyEntries are the upload's files, skipping folders and what macOS
+// adds to zips
+func legacyEntries(r *zip.Reader) []*zip.File {
+	files := []*zip.File{}
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() || strings.HasPrefix(f.Name, "__MACOSX/") || strings.HasPrefix(path.Base(f.Name), ".") {
+			continue
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+// findLegacyFile is the least nested entry with the extension
+func findLegacyFile(files []*zip.File, ext string) *zip.File {
+	var found *zip.File
+	for _, f := range files {
+		if strings.ToLower(path.Ext(f.Name)) != ext {
+			continue
+		}
+		if found == nil || strings.Count(f.Name, "/") < strings.Count(found.Name, "/") {
+			found = f
+		}
+	}
+	return found
+}
+
+// legacyPhotos finds photos by their path in the upload or, failing that,
+// by their file name anywhere in it
+type legacyPhotos struct {
+	byPath map[string]*zip.File
+	byName map[string]*zip.File
+}
+
+func newLegacyPhotos(files []*zip.File) *legacyPhotos {
+	p := &legacyPhotos{byPath: make(map[string]*zip.File), byName: make(map[string]*zip.File)}
+	for _, f := range files {
+		if imageTypeByExtension(f.Name) == "" {
+			continue
+		}
+		p.byPath[strings.ToLower(f.Name)] = f
+		if _, ok := p.byName[strings.ToLower(path.Base(f.Name))]; !ok {
+			p.byName[strings.ToLower(path.Base(f.Name))] = f
+		}
+	}
+	return p
+}
+
+func (p *legacyPhotos) find(dir, name string) *zip.File {
+	name = strings.TrimSpace(strings.ReplaceAll(name, "\\", "/"))
+	if f, ok := p.byPath[strings.ToLower(path.Join(dir, name))]; ok {
+		return f
+	}
+	return p.byName[strings.ToLower(path.Base(name))]
+}
+
+// inFolder is the photos in a folder called name, in name order
+func (p *legacyPhotos) inFolder(name string) []*zip.File {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return nil
+	}
+	photos := []*zip.File{}
+	for key, f := range p.byPath {
+		if path.Base(path.Dir(key)) == name {
+			photos = append(photos, f)
+		}
+	}
+	sort.Slice(photos, func(i, j int) bool { return photos[i].Name < photos[j].Name })
+	return photos
+}
+
+func missingPhoto(name string) importFileError {
+	return importFileError{Name: name, Code: errLegacyNoPhoto.Code, Message: errLegacyNoPhoto.Message}
+}
+
+// csvColumns are the columns of a CSV import by what they hold
+type csvColumns struct {
+	id, title, notes, photos, status, statusDate int
+	// dates are the status date columns by status
+	dates map[string]int
+}
+
+func csvHeader(header []string) csvColumns {
+	cols := csvColumns{id: -1, title: -1, notes: -1, photos: -1, status: -1, statusDate: -1, dates: make(map[string]int)}
+	set := func(col *int, i int) {
+		if *col < 0 {
+			*col = i
+		}
+	}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		switch strings.NewReplacer(" ", "_", "-", "_").Replace(name) {
+		case "id", "uuid":
+			set(&cols.id, i)
+		case "title", "name", "piece", "pot":
+			set(&cols.title, i)
+		case "notes", "note", "comments", "comment", "description":
+			set(&cols.notes, i)
+		case "photos", "photo", "images", "image", "pictures", "picture", "files":
+			set(&cols.photos, i)
+		case "status", "stage":
+			set(&cols.status, i)
+		case "status_date", "date":
+			set(&cols.statusDate, i)
+		default:
+			for _, suffix := range []string{"_date", " date", " on"} {
+				name = strings.TrimSuffix(name, suffix)
+			}
+			if status, ok := legacyStatus(name); ok {
+				if _, ok := cols.dates[status]; !ok {
+					cols.dates[status] = i
+				}
+			}
+		}
+	}
+	return cols
+}
+
+var photoSeparators = regexp.MustCompile(`[;,|\n]+`)
+
+func (s *Server) csvLegacyPots(upload io.ReaderAt, size int64) ([]legacyPot, []importFileError, error) {
+	r, err := zip.NewReader(upload, size)
+	if err != nil {
+		return nil, nil, legacyUnreadable(importSourceCSV, err)
+	}
+	files := legacyEntries(r)
+	table := findLegacyFile(files, ".csv")
+	if table == nil {
+		return nil, nil, legacyUnreadable(importSourceCSV, fmt.Errorf("there's no .csv file"))
+	}
+	rc, err := table.Open()
+	if err != nil {
+		return nil, nil, legacyUnreadable(importSourceCSV, err)
+	}
+	defer rc.Close()
+	data, err := s.readLegacyTable(importSourceCSV, rc, int64(table.UncompressedSize64))
+	if err != nil {
+		return nil, nil, err
+	}
+	cr := csv.NewReader(bytes.NewReader(data))
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, nil, legacyUnreadable(importSourceCSV, err)
+	}
+	if len(rows) < 2 {
+		return nil, nil, legacyNoPots(importSourceCSV)
+	}
+	cols := csvHeader(rows[0])
+	if cols.title < 0 && cols.id < 0 {
+		return nil, nil, legacyUnreadable(importSourceCSV, fmt.Errorf("there's no title or id column"))
+	}
+
+	photos := newLegacyPhotos(files)
+	dir := path.Dir(table.Name)
+	pots := []legacyPot{}
+	missing := []importFileError{}
+	for n, row := range rows[1:] {
+		cell := func(i int) string {
+			if i < 0 || i >= len(row) {
+				return ""
+			}
+			// Undo csvCell's guard against formulas
+			return strings.TrimPrefix(strings.TrimSpace(row[i]), "'")
+		}
+		id, title := cell(cols.id), cell(cols.title)
+		if id == "" && title == "" {
+			continue
+		}
+		if title == "" {
+			title = id
+		}
+		key := id
+		if key == "" {
+			key = fmt.Sprintf("row %d: %s", n+2, title)
+		}
+		p := legacyPot{key: key, Title: title, Dates: make(map[string]time.Time), Notes: cell(cols.notes)}
+		for status, i := range cols.dates {
+			if date, ok := legacyDate(cell(i)); ok {
+				p.Dates[status] = date
+			}
+		}
+		if status, ok := legacyStatus(cell(cols.status)); ok {
+			if date, ok := legacyDate(cell(cols.statusDate)); ok {
+				if _, ok := p.Dates[status]; !ok {
+					p.Dates[status] = date
+				}
+			}
+		}
+		if names := cell(cols.photos); names != "" {
+			for _, name := range photoSeparators.Split(names, -1) {
+				// The table export only counts photos
+				if name = strings.TrimSpace(name); name == "" || isDigits(name) {
+					continue
+				}
+				if f := photos.find(dir, name); f != nil {
+					p.Photos = append(p.Photos, f)
+				} else {
+					missing = append(missing, missingPhoto(name))
+				}
+			}
+		} else if p.Photos = photos.inFolder(id); len(p.Photos) == 0 {
+			p.Photos = photos.inFolder(title)
+		}
+		pots = append(pots, p)
+	}
+	return pots, missing, nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// trelloBoard is what's read of a Trello board's JSON export
+type trelloBoard struct {
+	Lists []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"lists"`
+	Cards []struct {
+		ID               string    `json:"id"`
+		Name             string    `json:"name"`
+		Desc             string    `json:"desc"`
+		IDList           string    `json:"idList"`
+		DateLastActivity time.Time `json:"dateLastActivity"`
+		Labels           []struct {
+			Name string `json:"name"`
+		} `json:"labels"`
+		Attachments []struct {
+			Name     string `json:"name"`
+			FileName string `json:"fileName"`
+			URL      string `json:"url"`
+			MimeType string `json:"mimeType"`
+		} `json:"attachments"`
+	} `json:"cards"`
+	// Actions are newest first
+	Actions []struct {
+		Type string    `json:"type"`
+		Date time.Time `json:"date"`
+		Data struct {
+			Card struct {
+				ID string `json:"id"`
+			} `json:"card"`
+			List struct {
+				ID string `json:"id"`
+			} `json:"list"`
+			ListAfter struct {
+				ID string `json:"id"`
+			} `json:"listAfter"`
+		} `json:"data"`
+	} `json:"actions"`
+}
+
+func (s *Server) trelloLegacyPots(upload io.ReaderAt, size int64) ([]legacyPot, []importFileError, error) {
+	var data []byte
+	var files []*zip.File
+	var err error
+	if r, zipErr := zip.NewReader(upload, size); zipErr == nil {
+		files = legacyEntries(r)
+		board := findLegacyFile(files, ".json")
+		if board == nil {
+			return nil, nil, legacyUnreadable(importSourceTrello, fmt.Errorf("there's no .json file"))
+		}
+		rc, err := board.Open()
+		if err != nil {
+			return nil, nil, legacyUnreadable(importSourceTrello, err)
+		}
+		defer rc.Close()
+		data, err = s.readLegacyTable(importSourceTrello, rc, int64(board.UncompressedSize64))
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		data, err = s.readLegacyTable(importSourceTrello, io.NewSectionReader(upload, 0, size), size)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	var board trelloBoard
+	if err := json.Unmarshal(data, &board); err != nil {
+		return nil, nil, legacyUnreadable(importSourceTrello, err)
+	}
+
+	listStatus := make(map[string]string)
+	for _, l := range board.Lists {
+		if status, ok := legacyStatus(l.Name); ok {
+			listStatus[l.ID] = status
+		}
+	}
+	// Each card's earliest arrival in each status, from the oldest action
+	arrived := make(map[string]map[string]time.Time)
+	for i := len(board.Actions) - 1; i >= 0; i-- {
+		a := board.Actions[i]
+		listID := a.Data.ListAfter.ID
+		if a.Type == "createCard" || a.Type == "copyCard" || a.Type == "moveCardToBoard" {
+			listID = a.Data.List.ID
+		}
+		status, ok := listStatus[listID]
+		if !ok || a.Data.Card.ID == "" || a.Date.IsZero() {
+			continue
+		}
+		if arrived[a.Data.Card.ID] == nil {
+			arrived[a.Data.Card.ID] = make(map[string]time.Time)
+		}
+		if d, ok := arrived[a.Data.Card.ID][status]; !ok || a.Date.Before(d) {
+			arrived[a.Data.Card.ID][status] = a.Date.UTC()
+		}
+	}
+
+	photos := newLegacyPhotos(files)
+	pots := []legacyPot{}
+	missing := []importFileError{}
+	for _, c := range board.Cards {
+		if strings.TrimSpace(c.Name) == "" {
+			continue
+		}
+		p := legacyPot{key: c.ID, Title: strings.TrimSpace(c.Name), Dates: make(map[string]time.Time), Notes: strings.TrimSpace(c.Desc)}
+		for status, date := range arrived[c.ID] {
+			p.Dates[status] = date
+		}
+		if status, ok := listStatus[c.IDList]; ok && !c.DateLastActivity.IsZero() {
+			if _, ok := p.Dates[status]; !ok {
+				p.Dates[status] = c.DateLastActivity.UTC()
+			}
+		}
+		labels := []string{}
+		for _, l := range c.Labels {
+			if l.Name != "" {
+				labels = append(labels, l.Name)
+			}
+		}
+		if len(labels) > 0 {
+			p.Notes = strings.TrimSpace(p.Notes + "\n\nLabels: " + strings.Join(labels, ", "))
+		}
+		for _, a := range c.Attachments {
+			name := a.FileName
+			if name == "" {
+				name = a.Name
+			}
+			if !isImageType(a.MimeType) && imageTypeByExtension(name) == "" {
+				continue
+			}
+			if f := photos.find("", name); f != nil {
+				p.Photos = append(p.Photos, f)
+			} else {
+				missing = append(missing, missingPhoto(name))
+			}
+		}
+		pots = append(pots, p)
+	}
+	return pots, missing, nil
+}
+
+// legacyAppPot is a pot as the app stores it
+type legacyAppPot struct {
+	UUID   string            `json:"uuid"`
+	Title  string            `json:"title"`
+	Status map[string]string `json:"status"`
+	Notes2 struct {
+		Notes map[string]string `json:"notes"`
+	} `json:"notes2"`
+	Images3 []struct {
+		Name string `json:"name"`
+	} `json:"images3"`
+	EditTime int64 `json:"editTime,omitempty"`
+}
+
+// legacyPotID is a UUID-shaped id for the pot, the same every time its
+// source is imported
+func legacyPotID(source, key string) string {
+	sum := sha256.Sum256([]byte(source + "\x00" + key))
+	h := hex.EncodeToString(sum[:16])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// writeLegacyArchive writes the pots as a Pottery Log archive. Photos are
+// copied without being decompressed, under names that are safe to store
+// and unique in the archive.
+func (s *Server) writeLegacyArchive(source string, pots []legacyPot) (*os.File, error) {
+	f, err := ioutil.TempFile(s.Exports.tempDir, "legacy-")
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*os.File, error) {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	metadata := make(map[string]string)
+	potIDs := []string{}
+	names := make(map[string]bool)
+	photoNames := make(map[*zip.File]string)
+	photoOrder := []*zip.File{}
+	for _, p := range pots {
+		id := legacyPotID(source, p.key)
+		if _, ok := metadata[appPotKeyPrefix+id]; ok {
+			// A repeated id in the source
+			continue
+		}
+		pot := legacyAppPot{UUID: id, Title: p.Title, Status: make(map[string]string)}
+		pot.Notes2.Notes = make(map[string]string)
+		pot.Images3 = []struct {
+			Name string `json:"name"`
+		}{}
+		var latest time.Time
+		latestStatus := "notstarted"
+		for _, status := range orderStatuses(p.Dates) {
+			date := p.Dates[status]
+			pot.Status[status] = date.Format(time.RFC3339)
+			if !date.Before(latest) {
+				latest, latestStatus = date, status
+			}
+		}
+		if !latest.IsZero() {
+			pot.EditTime = latest.UnixNano() / int64(time.Millisecond)
+		}
+		if p.Notes != "" {
+			pot.Notes2.Notes[latestStatus] = p.Notes
+		}
+		for _, photo := range p.Photos {
+			name, ok := photoNames[photo]
+			if !ok {
+				base := unsafeNameChars.ReplaceAllString(path.Base(photo.Name), "_")
+				name = base
+				for n := 2; names[strings.ToLower(name)] || name == metadataFileName; n++ {
+					name = suffixedName(base, n)
+				}
+				names[strings.ToLower(name)] = true
+				photoNames[photo] = name
+				photoOrder = append(photoOrder, photo)
+			}
+			pot.Images3 = append(pot.Images3, struct {
+				Name string `json:"name"`
+			}{name})
+		}
+		potJSON, err := json.Marshal(pot)
+		if err != nil {
+			return fail(err)
+		}
+		metadata[appPotKeyPrefix+id] = string(potJSON)
+		potIDs = append(potIDs, id)
+	}
+	// The app's list of pots
+	list, _ := json.Marshal(struct {
+		PotIDs []string `json:"potIds"`
+	}{potIDs})
+	metadata["@Pots"] = string(list)
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return fail(err)
+	}
+
+	w := zip.NewWriter(f)
+	mw, err := w.CreateHeader(&zip.FileHeader{Name: metadataFileName, Method: zip.Deflate})
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := mw.Write(metadataJSON); err != nil {
+		return fail(err)
+	}
+	for _, photo := range photoOrder {
+		header := photo.FileHeader
+		header.Name = photoNames[photo]
+		header.Comment = imageTypeByExtension(header.Name)
+		header.Extra = nil
+		raw, err := photo.OpenRaw()
+		if err != nil {
+			return fail(err)
+		}
+		pw, err := w.CreateRaw(&header)
+		if err != nil {
+			return fail(err)
+		}
+		if _, err := io.Copy(pw, raw); err != nil {
+			return fail(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return fail(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	return f, nil
+}
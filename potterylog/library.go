@@ -0,0 +1,129 @@
+package potterylog
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Options set up a server mounted in another Go program with NewHandler.
+// The zero value keeps its data in ~/.local/state/pottery-log (or under
+// $XDG_STATE_HOME) and its images in S3, with the AWS credentials from the
+// environment.
+type Options struct {
+	// DataDir holds the stores, and the SQLite database unless Database
+	// is set
+	DataDir string
+	// Database is a SQLite path or a postgres:// URL
+	Database string
+	// ConfigPath is a JSON config file, as for -config. It's reread on
+	// SIGHUP.
+	ConfigPath string
+	// LocalStorage keeps images and exports under DataDir instead of S3,
+	// served at /fake-storage/ under BaseURL
+	LocalStorage bool
+	// BaseURL is where the handler is reachable, like
+	// https://example.com, for share links and local storage URLs. It's
+	// required with LocalStorage. Without it, share links use the
+	// request's Host.
+	BaseURL string
+	// AmplitudeAPIKey sends analytics events to Amplitude. Without it
+	// they're only counted.
+	AmplitudeAPIKey string
+}
+
+// openDataDirs are the data directories of the handlers made so far, since
+// two servers can't share their stores
+var openDataDirs = struct {
+	mu   sync.Mutex
+	dirs map[string]bool
+}{
+	dirs: make(map[string]bool),
+}
+
+// claimDataDir reserves dir for one handler, returning the function that
+// gives it back
+func claimDataDir(dir string) (func(), error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	openDataDirs.mu.Lock()
+	defer openDataDirs.mu.Unlock()
+	if openDataDirs.dirs[dir] {
+		return nil, fmt.Errorf("another handler in this process already uses %s", dir)
+	}
+	openDataDirs.dirs[dir] = true
+	return func() {
+		openDataDirs.mu.Lock()
+		defer openDataDirs.mu.Unlock()
+		delete(openDataDirs.dirs, dir)
+	}, nil
+}
+
+// NewHandler opens the stores, starts the background jobs, and returns the
+// public API, with access logging. Its routes start with /pottery-log,
+// /pottery-log-images, and /v2, so it can share a mux with other routes or
+// sit behind http.StripPrefix. Each handler has its own stores, limits,
+// and counters, so a process can run several as long as each has its own
+// DataDir. Only the log level is the process's, from whichever config was
+// loaded last.
+func NewHandler(opts Options) (http.Handler, error) {
+	if opts.LocalStorage && opts.BaseURL == "" {
+		return nil, errors.New("LocalStorage needs a BaseURL to serve images at")
+	}
+	c, err := loadConfig(opts.ConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	srv := NewServer()
+	srv.Settings = c
+	if opts.DataDir != "" {
+		srv.dataDir = opts.DataDir
+	}
+	if srv.dataDir == "" {
+		return nil, errors.New("there's no home directory to keep data in, so DataDir is required")
+	}
+	release, err := claimDataDir(srv.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			release()
+		}
+	}()
+	srv.publicURL = strings.TrimSuffix(opts.BaseURL, "/")
+	srv.configPath = opts.ConfigPath
+	if opts.Database == "" {
+		opts.Database = filepath.Join(srv.dataDir, "pottery-log.db")
+	}
+	if err := srv.openStores(opts.Database); err != nil {
+		return nil, err
+	}
+	if err := srv.setFormSpillDir(); err != nil {
+		return nil, fmt.Errorf("setting up %s: %w", filepath.Join(srv.dataDir, "upload-tmp"), err)
+	}
+	loadGalleryTemplate()
+
+	if opts.LocalStorage {
+		srv.Storage = newFakeStore(filepath.Join(srv.dataDir, "fake-storage"), srv.publicURL)
+	}
+	go srv.sendToAmplitude(opts.AmplitudeAPIKey)
+	if srv.configPath != "" {
+		go srv.reloadConfigOnSignal()
+	}
+
+	handler := srv.Handler()
+	if err := srv.runSelfCheck(opts.AmplitudeAPIKey); err != nil {
+		return nil, err
+	}
+	srv.registerJobs()
+	srv.jobs.Start()
+	ok = true
+	return logRequests(handler), nil
+}
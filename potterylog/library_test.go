@@ -0,0 +1,65 @@
+package potterylog
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func newLibraryHandler(t *testing.T, dir string) *httptest.Server {
+	t.Helper()
+	handler, err := NewHandler(Options{DataDir: dir, LocalStorage: true, BaseURL: "http://pottery.invalid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func metadataVersionCount(t *testing.T, server *httptest.Server, deviceID string) int {
+	t.Helper()
+	resp, err := http.PostForm(server.URL+"/pottery-log/metadata-versions", url.Values{"deviceId": {deviceID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var listed struct {
+		Versions []metadataVersion `json:"versions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	return len(listed.Versions)
+}
+
+func TestHandlersKeepSeparateStores(t *testing.T) {
+	first := newLibraryHandler(t, t.TempDir())
+	second := newLibraryHandler(t, t.TempDir())
+
+	resp, err := http.PostForm(first.URL+"/pottery-log/backup-metadata", url.Values{"deviceId": {"device1"}, "metadata": {`{"pots":[]}`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("backup-metadata: got %s", resp.Status)
+	}
+
+	if n := metadataVersionCount(t, first, "device1"); n != 1 {
+		t.Errorf("the first handler has %d versions, want 1", n)
+	}
+	if n := metadataVersionCount(t, second, "device1"); n != 0 {
+		t.Errorf("the second handler sees %d of the first's versions", n)
+	}
+}
+
+func TestHandlersCantShareDataDir(t *testing.T) {
+	dir := t.TempDir()
+	newLibraryHandler(t, dir)
+	if _, err := NewHandler(Options{DataDir: dir, LocalStorage: true, BaseURL: "http://pottery.invalid"}); err == nil {
+		t.Error("a second handler opened the same data dir")
+	}
+}
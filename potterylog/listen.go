@@ -0,0 +1,48 @@
+package potterylog
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+const unixSocketPrefix = "unix://"
+
+// listen opens the -listen address: host:port for TCP, like 127.0.0.1:9292
+// or a VPN interface's address, or unix:///path/to/socket for a reverse
+// proxy on the same host.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixSocketPrefix) {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, unixSocketPrefix)
+	// A socket left behind by a previous run would make Listen fail
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Let the proxy's group connect
+	if err := os.Chmod(path, 0660); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// localBaseURL is how the server reaches itself, for fake storage links
+func localBaseURL(addr string) string {
+	if strings.HasPrefix(addr, unixSocketPrefix) {
+		return "http://localhost"
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "http://localhost"
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
@@ -0,0 +1,146 @@
+package potterylog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With -log-file the server writes its logs to a file instead of stderr, for
+// home servers where nothing keeps stdout across a reboot. The file is
+// rotated when it gets bigger than -log-max-size or a -log-rotate period
+// starts, by renaming it with the time, like pottery-log-20261016-200922.log,
+// and rotated files older than -log-retention are deleted.
+
+// rotatedTimeFormat is the time in a rotated file's name
+const rotatedTimeFormat = "20060102-150405"
+
+// rotatingFile is an io.Writer for the log package that rotates the file at
+// path
+type rotatingFile struct {
+	path string
+	// maxBytes and interval are when to rotate, and retention when to
+	// delete a rotated file. Zero turns each off.
+	maxBytes  int64
+	interval  time.Duration
+	retention time.Duration
+
+	// clock is when lines are written, for rotating by interval
+	clock Clock
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	// period is the start of the interval the file's lines are from
+	period time.Time
+}
+
+func openLogFile(path string, maxBytes int64, interval, retention time.Duration) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxBytes: maxBytes, interval: interval, retention: retention, clock: systemClock{}}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	f.removeExpired()
+	return f, nil
+}
+
+// open appends to the file, which may be left from an earlier run
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.period = f.periodOf(f.clock.Now())
+	if f.size > 0 {
+		f.period = f.periodOf(info.ModTime())
+	}
+	return nil
+}
+
+func (f *rotatingFile) periodOf(t time.Time) time.Time {
+	if f.interval <= 0 {
+		return time.Time{}
+	}
+	return t.Truncate(f.interval)
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.clock.Now()
+	full := f.maxBytes > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxBytes
+	if full || f.periodOf(now) != f.period {
+		if err := f.rotate(now); err != nil {
+			// Keep logging to the old file rather than lose lines
+			os.Stderr.WriteString("Error rotating " + f.path + ": " + err.Error() + "\n")
+			f.period = f.periodOf(now)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file and starts a new one
+func (f *rotatingFile) rotate(now time.Time) error {
+	if f.size == 0 {
+		f.period = f.periodOf(now)
+		return nil
+	}
+	rotated := f.rotatedName(now)
+	// Two rotations in a second, when lines are bigger than -log-max-size
+	for n := 2; fileExists(rotated); n++ {
+		rotated = suffixedName(f.rotatedName(now), n)
+	}
+	if err := os.Rename(f.path, rotated); err != nil {
+		return err
+	}
+	old := f.file
+	if err := f.open(); err != nil {
+		// The old file is still open at its new name
+		return err
+	}
+	old.Close()
+	go f.removeExpired()
+	return nil
+}
+
+func (f *rotatingFile) rotatedName(now time.Time) string {
+	ext := filepath.Ext(f.path)
+	return strings.TrimSuffix(f.path, ext) + "-" + now.Format(rotatedTimeFormat) + ext
+}
+
+// removeExpired deletes rotated files last written more than retention ago
+func (f *rotatingFile) removeExpired() {
+	if f.retention <= 0 {
+		return
+	}
+	ext := filepath.Ext(f.path)
+	rotated, err := filepath.Glob(strings.TrimSuffix(f.path, ext) + "-*" + ext)
+	if err != nil {
+		return
+	}
+	cutoff := f.clock.Now().Add(-f.retention)
+	for _, name := range rotated {
+		if info, err := os.Stat(name); err == nil && info.ModTime().Before(cutoff) {
+			os.Remove(name)
+		}
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
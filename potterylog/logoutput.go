@@ -0,0 +1,179 @@
+package potterylog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// The config's log_output sends logs to syslog or to the systemd journal
+// instead of stderr or -log-file. Either way each line gets a priority: debug
+// for debugf's, err for errors, warning for warnings, and info for the rest,
+// like access log lines. syslog_address, like udp://logs.local:514, sends
+// them to a remote syslog instead of the local one. For journald, lines go
+// to stderr with sd-daemon's <N> priority prefixes, which the journal reads
+// when the server runs as a systemd service.
+
+const (
+	logOutputStderr   = "stderr"
+	logOutputSyslog   = "syslog"
+	logOutputJournald = "journald"
+)
+
+// syslogTag is the program name syslog and the journal show
+const syslogTag = "pottery-log"
+
+// logSink is a log output that takes each line's priority
+type logSink interface {
+	writeLevel(priority syslog.Priority, line []byte) error
+}
+
+var (
+	logOutputMu sync.Mutex
+	// defaultLogOutput is stderr or -log-file
+	defaultLogOutput io.Writer = os.Stderr
+	// logOutputKey is the log_output and syslog_address in use
+	logOutputKey = logOutputStderr
+	currentSink  logSink
+	closeSink    func() error
+)
+
+// applyLogOutput switches logs to c's log_output, if it changed
+func applyLogOutput(c *config) error {
+	output := c.LogOutput
+	if output == "" {
+		output = logOutputStderr
+	}
+	key := output
+	if output == logOutputSyslog {
+		key += " " + c.SyslogAddress
+	}
+	logOutputMu.Lock()
+	defer logOutputMu.Unlock()
+	if key == logOutputKey {
+		return nil
+	}
+
+	var sink logSink
+	var closer func() error
+	switch output {
+	case logOutputStderr:
+	case logOutputSyslog:
+		w, err := dialSyslog(c.SyslogAddress)
+		if err != nil {
+			return fmt.Errorf("Error connecting to syslog: %v", err)
+		}
+		sink, closer = syslogSink{w}, w.Close
+	case logOutputJournald:
+		sink = journaldSink{os.Stderr}
+	default:
+		return fmt.Errorf("Unknown log_output %q: it can be %q, %q, or %q",
+			c.LogOutput, logOutputStderr, logOutputSyslog, logOutputJournald)
+	}
+
+	if closeSink != nil {
+		defer closeSink()
+	}
+	currentSink, closeSink, logOutputKey = sink, closer, key
+	if sink == nil {
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(defaultLogOutput)
+	} else {
+		// Syslog and the journal add their own timestamps
+		log.SetFlags(0)
+		log.SetOutput(leveledWriter{sink})
+	}
+	return nil
+}
+
+// dialSyslog connects to the syslog at address, a URL like
+// udp://logs.local:514, or the local one if it's empty
+func dialSyslog(address string) (*syslog.Writer, error) {
+	priority := syslog.LOG_INFO | syslog.LOG_DAEMON
+	if address == "" {
+		return syslog.New(priority, syslogTag)
+	}
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("syslog_address %q should be like udp://host:514", address)
+	}
+	return syslog.Dial(u.Scheme, u.Host, priority, syslogTag)
+}
+
+// logAt logs a line at priority, for lines whose priority can't be told
+// from their text
+func logAt(priority syslog.Priority, format string, v ...interface{}) {
+	logOutputMu.Lock()
+	sink := currentSink
+	logOutputMu.Unlock()
+	if sink == nil {
+		log.Printf(format, v...)
+		return
+	}
+	sink.writeLevel(priority, []byte(fmt.Sprintf(format, v...)))
+}
+
+// linePriority is a log line's priority from how the server words its
+// messages
+func linePriority(line []byte) syslog.Priority {
+	switch {
+	case bytes.HasPrefix(line, []byte("Error")), bytes.HasPrefix(line, []byte("Config error")),
+		bytes.HasPrefix(line, []byte("Not starting")), bytes.HasPrefix(line, []byte("panic")):
+		return syslog.LOG_ERR
+	case bytes.HasPrefix(line, []byte("Warning")), bytes.HasPrefix(line, []byte("Config warning")):
+		return syslog.LOG_WARNING
+	}
+	return syslog.LOG_INFO
+}
+
+// leveledWriter is the log package's output for a sink
+type leveledWriter struct {
+	sink logSink
+}
+
+func (w leveledWriter) Write(p []byte) (int, error) {
+	if err := w.sink.writeLevel(linePriority(p), p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func (s syslogSink) writeLevel(priority syslog.Priority, line []byte) error {
+	m := string(bytes.TrimRight(line, "\n"))
+	switch priority {
+	case syslog.LOG_DEBUG:
+		return s.w.Debug(m)
+	case syslog.LOG_WARNING:
+		return s.w.Warning(m)
+	case syslog.LOG_ERR:
+		return s.w.Err(m)
+	}
+	return s.w.Info(m)
+}
+
+// journaldSink prefixes every line of a message with its priority, since the
+// journal reads each line of stderr on its own
+type journaldSink struct {
+	w io.Writer
+}
+
+func (s journaldSink) writeLevel(priority syslog.Priority, line []byte) error {
+	prefix := []byte(fmt.Sprintf("<%d>", priority))
+	var b bytes.Buffer
+	for _, l := range bytes.Split(bytes.TrimRight(line, "\n"), []byte("\n")) {
+		b.Write(prefix)
+		b.Write(l)
+		b.WriteByte('\n')
+	}
+	_, err := s.w.Write(b.Bytes())
+	return err
+}
@@ -0,0 +1,83 @@
+package potterylog
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const maintenanceRetryAfter = 10 * time.Minute
+
+const defaultMaintenanceMessage = "Pottery Log is down for maintenance. Please try again in a few minutes."
+
+// inMaintenance is whether mutating endpoints are turned away. Exports that
+// were already started may still add images and finish.
+func (s *Server) inMaintenance() bool {
+	return atomic.LoadInt32(&s.maintenanceMode) == 1
+}
+
+func (s *Server) setMaintenance(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&s.maintenanceMode, v)
+	log.Printf("Maintenance mode: %v\n", on)
+}
+
+// toggleMaintenanceOnSignal flips maintenance mode every time the process
+// receives SIGUSR1, e.g. `kill -USR1 $(pidof pottery-log-server)`.
+func (s *Server) toggleMaintenanceOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	for range sigs {
+		s.setMaintenance(!s.inMaintenance())
+	}
+}
+
+// mutating wraps a handler that changes stored data so that it is refused
+// during maintenance.
+func (s *Server) mutating(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if s.inMaintenance() {
+			s.logEvent(preFormValue(req, "deviceId"), MaintenanceRejectEvent{Path: req.URL.Path})
+			w.Header().Set("Retry-After", strconv.Itoa(int(maintenanceRetryAfter.Seconds())))
+			message := s.config().MaintenanceMessage
+			if message == "" {
+				message = s.maintenanceMessage
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			writeJSON(w, struct {
+				Status      string `json:"status"`
+				Code        string `json:"code"`
+				Message     string `json:"message"`
+				Maintenance bool   `json:"maintenance"`
+			}{
+				Status:      "error",
+				Code:        "maintenance",
+				Message:     message,
+				Maintenance: true,
+			})
+			return
+		}
+		handler(w, req)
+	}
+}
+
+// mutatingMethods is mutating for handlers that also serve reads, which
+// keep working during maintenance.
+func (s *Server) mutatingMethods(handler http.HandlerFunc) http.HandlerFunc {
+	guarded := s.mutating(handler)
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			handler(w, req)
+			return
+		}
+		guarded(w, req)
+	}
+}
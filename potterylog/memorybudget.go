@@ -0,0 +1,130 @@
+package potterylog
+
+import (
+	"mime"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The config's memory_budget_mb caps the memory that requests hold in
+// buffers at once: parsed forms, images read into memory to be imported,
+// recompressed, or uploaded from a URL, and the tables of other apps'
+// exports. Each is reserved against the budget before it's allocated, and
+// released when it's done with. A request that can't get its reservation
+// within a few seconds is turned away with a 429 rather than risk the
+// process being killed for running out of memory. Recompression is skipped
+// instead, since the original image can be stored as is.
+
+// memoryWait is how long a reservation waits for others to be released
+const memoryWait = 5 * time.Second
+
+// Multipart forms keep up to form_memory_mb in memory and spill the rest
+// to disk (see formspill.go), and url-encoded forms are at most net/http's
+// 10 MB.
+const urlEncodedFormMemory = 10 << 20
+
+var errMemoryBusy = newAPIError("memory_busy", "The server is busy with other large requests. Please try again shortly.")
+
+type memoryBudget struct {
+	// limit is the budget in bytes, or 0 for none
+	limit    atomic.Int64
+	mu       sync.Mutex
+	reserved int64
+	// freed is closed (and replaced) whenever memory is released
+	freed    chan struct{}
+	counters *counterSet
+}
+
+func newMemoryBudget(counters *counterSet) *memoryBudget {
+	return &memoryBudget{
+		mu:       sync.Mutex{},
+		freed:    make(chan struct{}),
+		counters: counters,
+	}
+}
+
+// Reserve takes n bytes of the budget, waiting up to wait for them, and
+// returns the function that releases them. With nothing else reserved, a
+// reservation bigger than the whole budget is let through, so a large
+// request can still run on its own.
+func (b *memoryBudget) Reserve(n int64, wait time.Duration) (func(), error) {
+	if n <= 0 {
+		return func() {}, nil
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	for {
+		budget := b.limit.Load()
+		b.mu.Lock()
+		if budget <= 0 || b.reserved == 0 || b.reserved+n <= budget {
+			b.reserved += n
+			b.mu.Unlock()
+			var once sync.Once
+			return func() { once.Do(func() { b.release(n) }) }, nil
+		}
+		freed := b.freed
+		b.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-timeout.C:
+			b.counters.Incr("memory-busy")
+			return nil, errMemoryBusy
+		}
+	}
+}
+
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reserved -= n
+	close(b.freed)
+	b.freed = make(chan struct{})
+}
+
+// SetLimit sets the budget to limit bytes, or none for 0. Reservations
+// already made are kept.
+func (b *memoryBudget) SetLimit(limit int64) {
+	b.limit.Store(limit)
+}
+
+func (b *memoryBudget) Reserved() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.reserved
+}
+
+// formMemory is about how much memory parsing req's form takes
+func (s *Server) formMemory(req *http.Request) int64 {
+	if req.Body == nil || req.Body == http.NoBody {
+		return 0
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	limit := int64(0)
+	switch mediaType {
+	case "multipart/form-data":
+		limit = s.formMemoryLimit()
+	case "application/x-www-form-urlencoded":
+		limit = urlEncodedFormMemory
+	}
+	if req.ContentLength >= 0 && req.ContentLength < limit {
+		return req.ContentLength
+	}
+	return limit
+}
+
+// budgetForms reserves memory for the request's form while the request
+// runs. It has to come before anything reads the form.
+func (s *Server) budgetForms(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		release, err := s.memory.Reserve(s.formMemory(req), memoryWait)
+		if err != nil {
+			s.tooBusy(w, err, req.URL.Query().Get("deviceId"), 30*time.Second)
+			return
+		}
+		defer release()
+		handler.ServeHTTP(w, req)
+	})
+}
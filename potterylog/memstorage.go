@@ -0,0 +1,185 @@
+package potterylog
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memStoreScheme starts the URLs of objects in a memStore
+const memStoreScheme = "mem://"
+
+// memStore keeps objects in memory, for a test harness that shouldn't touch
+// S3 or the disk. Its URLs aren't served; Key turns them back into keys.
+type memStore struct {
+	// clock is when objects are modified
+	clock   Clock
+	mu      sync.Mutex
+	objects map[string]memObject
+}
+
+type memObject struct {
+	data        []byte
+	contentType string
+	modified    time.Time
+}
+
+func newMemStore(clock Clock) *memStore {
+	return &memStore{
+		clock:   clock,
+		mu:      sync.Mutex{},
+		objects: make(map[string]memObject),
+	}
+}
+
+func (s *memStore) get(bucketName, key string) (memObject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[bucketName+"/"+key]
+	if !ok {
+		return memObject{}, &os.PathError{Op: "open", Path: bucketName + "/" + key, Err: os.ErrNotExist}
+	}
+	return obj, nil
+}
+
+func (s *memStore) Put(bucketName, key string, body io.ReadSeeker, contentType string) error {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[bucketName+"/"+key] = memObject{data: data, contentType: contentType, modified: s.clock.Now()}
+	return nil
+}
+
+func (s *memStore) PutFile(bucketName, key string, file *os.File, contentType string, progress func(stored int64)) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := s.Put(bucketName, key, file, contentType); err != nil {
+		return err
+	}
+	if progress != nil {
+		if info, err := file.Stat(); err == nil {
+			progress(info.Size())
+		}
+	}
+	return nil
+}
+
+func (s *memStore) Get(bucketName, key string) (io.ReadCloser, string, error) {
+	obj, err := s.get(bucketName, key)
+	if err != nil {
+		return nil, "", err
+	}
+	return ioutil.NopCloser(bytes.NewReader(obj.data)), obj.contentType, nil
+}
+
+// Fetch does what S3 would with the conditions, for a single byte range
+func (s *memStore) Fetch(bucketName, key string, cond FetchConditions) (*FetchedObject, error) {
+	obj, err := s.get(bucketName, key)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(len(obj.data))
+	etag := `"` + md5Hex(obj.data) + `"`
+	modified := obj.modified.Truncate(time.Second)
+	if cond.IfNoneMatch != "" {
+		if cond.IfNoneMatch == "*" || strings.Contains(cond.IfNoneMatch, etag) {
+			return &FetchedObject{Status: http.StatusNotModified, ETag: etag}, nil
+		}
+	} else if !cond.IfModifiedSince.IsZero() && !modified.After(cond.IfModifiedSince) {
+		return &FetchedObject{Status: http.StatusNotModified, ETag: etag}, nil
+	}
+
+	fetched := &FetchedObject{
+		Status:       http.StatusOK,
+		Body:         ioutil.NopCloser(bytes.NewReader(obj.data)),
+		ContentType:  obj.contentType,
+		Size:         size,
+		ETag:         etag,
+		LastModified: modified,
+	}
+	if cond.Range == "" {
+		return fetched, nil
+	}
+	start, end, ok := parseByteRange(cond.Range, size)
+	if !ok {
+		return &FetchedObject{Status: http.StatusRequestedRangeNotSatisfiable}, nil
+	}
+	fetched.Status = http.StatusPartialContent
+	fetched.Body = ioutil.NopCloser(bytes.NewReader(obj.data[start : end+1]))
+	fetched.Size = end - start + 1
+	fetched.ContentRange = fmt.Sprintf("bytes %d-%d/%d", start, end, size)
+	return fetched, nil
+}
+
+func (s *memStore) Download(ctx context.Context, bucketName, key string, file *os.File) error {
+	obj, err := s.get(bucketName, key)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, contextReader{ctx, bytes.NewReader(obj.data)})
+	return err
+}
+
+func (s *memStore) Exists(bucketName, key string) bool {
+	_, err := s.get(bucketName, key)
+	return err == nil
+}
+
+func (s *memStore) Head(bucketName, key string) (ObjectInfo, error) {
+	obj, err := s.get(bucketName, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: int64(len(obj.data)), ETag: md5Hex(obj.data), ContentType: obj.contentType}, nil
+}
+
+func (s *memStore) Delete(bucketName, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, bucketName+"/"+key)
+	return nil
+}
+
+func (s *memStore) List(bucketName, prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for name := range s.objects {
+		if key := strings.TrimPrefix(name, bucketName+"/"); key != name && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *memStore) URL(bucketName, key string) string {
+	return memStoreScheme + bucketName + "/" + key
+}
+
+func (s *memStore) Key(bucketName, url string) (string, bool) {
+	prefix := memStoreScheme + bucketName + "/"
+	if !strings.HasPrefix(url, prefix) || url == prefix {
+		return "", false
+	}
+	return strings.TrimPrefix(url, prefix), true
+}
+
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,432 @@
+package potterylog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Versions older than the newest metadataVersionsKept are pruned on save
+const metadataVersionsKept = 100
+
+const metadataVersionFormat = "20060102T150405.000000000Z"
+
+var errNoMetadataVersion = newAPIError("no_metadata_version", "There is no metadata version with that id")
+
+// errMetadataEncrypted is for things that need to read metadata the server
+// only has ciphertext for
+var errMetadataEncrypted = newAPIError("metadata_encrypted", "This metadata is encrypted, so the server can't read it")
+
+var (
+	metadataField = field{Name: "metadata", Required: true}
+	// A stored version's id, which names its file
+	metadataVersionField = field{Name: "version", Required: true, MaxLen: 128, Pattern: validIDPattern}
+	// The versions MetadataDiff compares
+	metadataFromField = field{Name: "from", MaxLen: 128, Pattern: validIDPattern}
+	metadataToField   = field{Name: "to", MaxLen: 128, Pattern: validIDPattern}
+	encryptedField    = field{Name: "encrypted", Pattern: boolPattern}
+)
+
+// An encrypted version's index is a few plain fields the app chooses to
+// share, like a pot count, so versions can be told apart without the key
+const (
+	maxMetadataIndexFields = 16
+	maxMetadataIndexBytes  = 4096
+)
+
+type metadataVersion struct {
+	ID        string            `json:"id"`
+	Created   time.Time         `json:"created"`
+	Bytes     int64             `json:"bytes"`
+	Encrypted bool              `json:"encrypted,omitempty"`
+	Index     map[string]string `json:"index,omitempty"`
+}
+
+// metadataStore keeps every metadata snapshot a device sends, as
+// dir/<deviceId>/<version>.json, where the version is the UTC save time.
+// Metadata the app encrypted is kept as <version>.enc, with its index in
+// <version>.index.json.
+type metadataStore struct {
+	dir string
+	// clock names the versions
+	clock Clock
+}
+
+// NewMetadataStore sets up a metadata history in the given directory
+func NewMetadataStore(dir string, clock Clock) *metadataStore {
+	os.MkdirAll(dir, 0777)
+	return &metadataStore{dir: dir, clock: clock}
+}
+
+func (s *metadataStore) Save(deviceID, metadata string) (string, error) {
+	return s.save(deviceID, metadata, nil)
+}
+
+// SaveEncrypted stores ciphertext the server can't read, with the app's
+// plain index fields
+func (s *metadataStore) SaveEncrypted(deviceID, ciphertext string, index map[string]string) (string, error) {
+	if index == nil {
+		index = map[string]string{}
+	}
+	return s.save(deviceID, ciphertext, index)
+}
+
+// save writes a plain version if index is nil, and an encrypted one if not
+func (s *metadataStore) save(deviceID, data string, index map[string]string) (string, error) {
+	deviceDir := filepath.Join(s.dir, deviceID)
+	if err := os.MkdirAll(deviceDir, 0777); err != nil {
+		return "", err
+	}
+	versionID := s.clock.Now().UTC().Format(metadataVersionFormat)
+	name := versionID + ".json"
+	if index != nil {
+		indexData, err := json.Marshal(index)
+		if err != nil {
+			return "", err
+		}
+		if err := ioutil.WriteFile(filepath.Join(deviceDir, versionID+".index.json"), indexData, 0666); err != nil {
+			return "", err
+		}
+		name = versionID + ".enc"
+	}
+	if err := ioutil.WriteFile(filepath.Join(deviceDir, name), []byte(data), 0666); err != nil {
+		return "", err
+	}
+	s.prune(deviceID)
+	return versionID, nil
+}
+
+// List returns the device's versions, newest first
+func (s *metadataStore) List(deviceID string) ([]metadataVersion, error) {
+	files, err := ioutil.ReadDir(filepath.Join(s.dir, deviceID))
+	if os.IsNotExist(err) {
+		return []metadataVersion{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	versions := []metadataVersion{}
+	for _, f := range files {
+		versionID := strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))
+		created, err := time.Parse(metadataVersionFormat, versionID)
+		if err != nil {
+			continue
+		}
+		version := metadataVersion{
+			ID:      versionID,
+			Created: created,
+			Bytes:   f.Size(),
+		}
+		if strings.HasSuffix(f.Name(), ".enc") {
+			version.Encrypted = true
+			version.Index = s.index(deviceID, versionID)
+		}
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Created.After(versions[j].Created)
+	})
+	return versions, nil
+}
+
+func (s *metadataStore) index(deviceID, versionID string) map[string]string {
+	index := map[string]string{}
+	if data, err := ioutil.ReadFile(filepath.Join(s.dir, deviceID, versionID+".index.json")); err == nil {
+		json.Unmarshal(data, &index)
+	}
+	return index
+}
+
+// Encrypted reports whether a version is ciphertext
+func (s *metadataStore) Encrypted(deviceID, versionID string) bool {
+	_, err := os.Stat(filepath.Join(s.dir, deviceID, versionID+".enc"))
+	return err == nil
+}
+
+// Get returns a version's metadata, or its ciphertext if it's encrypted
+func (s *metadataStore) Get(deviceID, versionID string) ([]byte, error) {
+	if _, err := time.Parse(metadataVersionFormat, versionID); err != nil {
+		return nil, errNoMetadataVersion
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, deviceID, versionID+".json"))
+	if os.IsNotExist(err) {
+		data, err = ioutil.ReadFile(filepath.Join(s.dir, deviceID, versionID+".enc"))
+	}
+	if os.IsNotExist(err) {
+		return nil, errNoMetadataVersion
+	}
+	return data, err
+}
+
+// getPlain is Get for callers that need to read the metadata
+func (s *metadataStore) getPlain(deviceID, versionID string) ([]byte, error) {
+	if s.Encrypted(deviceID, versionID) {
+		return nil, errMetadataEncrypted
+	}
+	return s.Get(deviceID, versionID)
+}
+
+// Latest returns the newest version, or errNoMetadataVersion
+func (s *metadataStore) Latest(deviceID string) (metadataVersion, []byte, error) {
+	versions, err := s.List(deviceID)
+	if err != nil {
+		return metadataVersion{}, nil, err
+	}
+	if len(versions) == 0 {
+		return metadataVersion{}, nil, errNoMetadataVersion
+	}
+	data, err := s.Get(deviceID, versions[0].ID)
+	return versions[0], data, err
+}
+
+func (s *metadataStore) prune(deviceID string) {
+	versions, err := s.List(deviceID)
+	if err != nil {
+		return
+	}
+	for i := metadataVersionsKept; i < len(versions); i++ {
+		for _, ext := range []string{".json", ".enc", ".index.json"} {
+			os.Remove(filepath.Join(s.dir, deviceID, versions[i].ID+ext))
+		}
+	}
+}
+
+func (s *Server) handleMetadataErr(err error, deviceID string, w http.ResponseWriter) bool {
+	if err == errNoMetadataVersion {
+		return s.handleErrCode(err, http.StatusNotFound, deviceID, w)
+	}
+	if err == errMetadataEncrypted {
+		return s.handleErrCode(err, http.StatusConflict, deviceID, w)
+	}
+	return s.handleErr(err, deviceID, w)
+}
+
+func (s *Server) MetadataVersions(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	key := requestTenant(req).dataKey(deviceID)
+	if !s.requireDevice(w, req, deviceID) {
+		return
+	}
+
+	versions, err := s.metadataHistory.List(key)
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+	writeJSON(w, struct {
+		Status   string            `json:"status"`
+		Versions []metadataVersion `json:"versions"`
+	}{
+		Status:   "ok",
+		Versions: versions,
+	})
+}
+
+// ImportVersion restores a stored metadata version. The response has the
+// same shape as Import's so the app can apply it the same way; the images
+// are already in the image bucket, so the image map is empty.
+func (s *Server) ImportVersion(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField, metadataVersionField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	key := requestTenant(req).dataKey(deviceID)
+	versionID := req.FormValue("version")
+	if !s.requireDevice(w, req, deviceID) {
+		return
+	}
+
+	metadata, err := s.metadataHistory.Get(key, versionID)
+	if s.handleMetadataErr(err, deviceID, w) {
+		return
+	}
+	writeJSON(w, struct {
+		Status    string            `json:"status"`
+		Metadata  string            `json:"metadata"`
+		Encrypted bool              `json:"encrypted,omitempty"`
+		ImageMap  map[string]string `json:"image_map"`
+	}{
+		Status:    "ok",
+		Metadata:  string(metadata),
+		Encrypted: s.metadataHistory.Encrypted(key, versionID),
+		ImageMap:  map[string]string{},
+	})
+	s.logEvent(deviceID, ImportVersionEvent)
+}
+
+// BackupMetadata stores just the metadata JSON, for cheap scheduled
+// snapshots. Sending the same metadata as the latest version is a no-op.
+// With encrypted=true, metadata is base64 ciphertext, and index is a JSON
+// object of plain string fields to keep beside it.
+func (s *Server) BackupMetadata(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField, metadataField, encryptedField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	key := requestTenant(req).dataKey(deviceID)
+	metadata := req.FormValue("metadata")
+	encrypted := req.FormValue("encrypted") == "true"
+	var index map[string]string
+	if encrypted {
+		var ok bool
+		if index, ok = s.metadataIndex(w, req, deviceID); !ok {
+			return
+		}
+		if !base64Pattern.MatchString(metadata) {
+			s.handleErrCode(errInvalidField("metadata"), http.StatusBadRequest, deviceID, w)
+			return
+		}
+	}
+
+	latest, latestData, err := s.metadataHistory.Latest(key)
+	if err != nil && err != errNoMetadataVersion {
+		s.handleErr(err, deviceID, w)
+		return
+	}
+	versionID := latest.ID
+	unchanged := err == nil && latest.Encrypted == encrypted && string(latestData) == metadata
+	if !unchanged {
+		if encrypted {
+			versionID, err = s.metadataHistory.SaveEncrypted(key, metadata, index)
+		} else {
+			versionID, err = s.metadataHistory.Save(key, metadata)
+		}
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+	}
+
+	writeJSON(w, struct {
+		Status    string `json:"status"`
+		Version   string `json:"version"`
+		Unchanged bool   `json:"unchanged"`
+	}{
+		Status:    "ok",
+		Version:   versionID,
+		Unchanged: unchanged,
+	})
+	s.logEvent(deviceID, BackupMetadataEvent{Bytes: len(metadata), Unchanged: unchanged, Encrypted: encrypted})
+}
+
+// metadataIndex reads the index field of an encrypted backup, handling the
+// error if it's too big or not an object of strings
+func (s *Server) metadataIndex(w http.ResponseWriter, req *http.Request, deviceID string) (map[string]string, bool) {
+	index := map[string]string{}
+	value := req.FormValue("index")
+	if value == "" {
+		return index, true
+	}
+	if len(value) > maxMetadataIndexBytes {
+		s.handleErrCode(errFieldTooLong("index"), http.StatusBadRequest, deviceID, w)
+		return nil, false
+	}
+	if err := json.Unmarshal([]byte(value), &index); err != nil || len(index) > maxMetadataIndexFields {
+		s.handleErrCode(errInvalidField("index"), http.StatusBadRequest, deviceID, w)
+		return nil, false
+	}
+	return index, true
+}
+
+// RestoreMetadata returns the latest metadata, or a specific version
+func (s *Server) RestoreMetadata(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField, optional(metadataVersionField)) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	key := requestTenant(req).dataKey(deviceID)
+	versionID := req.FormValue("version")
+	if !s.requireDevice(w, req, deviceID) {
+		return
+	}
+
+	var metadata []byte
+	var err error
+	if versionID == "" {
+		var latest metadataVersion
+		latest, metadata, err = s.metadataHistory.Latest(key)
+		versionID = latest.ID
+	} else {
+		metadata, err = s.metadataHistory.Get(key, versionID)
+	}
+	if s.handleMetadataErr(err, deviceID, w) {
+		return
+	}
+
+	writeJSON(w, struct {
+		Status    string `json:"status"`
+		Version   string `json:"version"`
+		Metadata  string `json:"metadata"`
+		Encrypted bool   `json:"encrypted,omitempty"`
+	}{
+		Status:    "ok",
+		Version:   versionID,
+		Metadata:  string(metadata),
+		Encrypted: s.metadataHistory.Encrypted(key, versionID),
+	})
+	s.logEvent(deviceID, RestoreMetadataEvent)
+}
+
+// MetadataDiff shows what restoring a version would change. The base is
+// either the client's current `metadata` or the stored version `from`; the
+// target is the stored version `to`, or the latest one.
+func (s *Server) MetadataDiff(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField, optional(metadataField), metadataFromField, metadataToField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	key := requestTenant(req).dataKey(deviceID)
+	if !s.requireDevice(w, req, deviceID) {
+		return
+	}
+
+	var from []byte
+	var err error
+	if metadata := req.FormValue("metadata"); metadata != "" {
+		from = []byte(metadata)
+	} else if fromID := req.FormValue("from"); fromID != "" {
+		from, err = s.metadataHistory.getPlain(key, fromID)
+		if s.handleMetadataErr(err, deviceID, w) {
+			return
+		}
+	} else {
+		s.handleErrCode(errMissingField("metadata", "from"), http.StatusBadRequest, deviceID, w)
+		return
+	}
+
+	var to []byte
+	toID := req.FormValue("to")
+	if toID == "" {
+		var latest metadataVersion
+		latest, to, err = s.metadataHistory.Latest(key)
+		toID = latest.ID
+		if latest.Encrypted {
+			err = errMetadataEncrypted
+		}
+	} else {
+		to, err = s.metadataHistory.getPlain(key, toID)
+	}
+	if s.handleMetadataErr(err, deviceID, w) {
+		return
+	}
+
+	diff, err := diffAppMetadata(from, to)
+	if s.handleErrCode(err, http.StatusBadRequest, deviceID, w) {
+		return
+	}
+	writeJSON(w, struct {
+		Status string `json:"status"`
+		To     string `json:"to"`
+		*metadataDiff
+	}{
+		Status:       "ok",
+		To:           toID,
+		metadataDiff: diff,
+	})
+}
@@ -0,0 +1,89 @@
+package potterylog
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestMetadataVersionsAreNamedByServerClock(t *testing.T) {
+	h, err := newTestHarness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	first := h.Clock.Now()
+	var backup struct {
+		Version string `json:"version"`
+	}
+	postForm(t, h, "/pottery-log/backup-metadata", map[string]string{"deviceId": "device1", "metadata": `{"pots":[]}`}, "", "", nil, &backup)
+	if want := first.UTC().Format(metadataVersionFormat); backup.Version != want {
+		t.Fatalf("first version is %s, want %s", backup.Version, want)
+	}
+
+	h.Clock.Advance(time.Hour)
+	postForm(t, h, "/pottery-log/backup-metadata", map[string]string{"deviceId": "device1", "metadata": `{"pots":[{"id":"1"}]}`}, "", "", nil, &backup)
+
+	var listed struct {
+		Versions []metadataVersion `json:"versions"`
+	}
+	postForm(t, h, "/pottery-log/metadata-versions", map[string]string{"deviceId": "device1"}, "", "", nil, &listed)
+	if len(listed.Versions) != 2 {
+		t.Fatalf("got %d versions, want 2", len(listed.Versions))
+	}
+	var created []time.Time
+	for _, v := range listed.Versions {
+		created = append(created, v.Created)
+	}
+	gap := created[0].Sub(created[1])
+	if gap < 0 {
+		gap = -gap
+	}
+	if gap != time.Hour {
+		t.Errorf("versions are %v apart, want the hour the clock advanced", gap)
+	}
+}
+
+func TestMetadataHandlersValidateTheirFields(t *testing.T) {
+	h, err := newTestHarness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	for _, c := range []struct {
+		path    string
+		form    url.Values
+		code    string
+		message string
+	}{
+		{"/pottery-log/metadata-versions", url.Values{}, "missing_field", "Missing required field deviceId"},
+		{"/pottery-log/metadata-versions", url.Values{"deviceId": {"../device1"}}, "invalid_device_id", "Invalid deviceId"},
+		{"/pottery-log/import-version", url.Values{"deviceId": {"device1"}}, "missing_field", "Missing required field version"},
+		{"/pottery-log/import-version", url.Values{"deviceId": {"device1"}, "version": {"../latest"}}, "invalid_field", "Invalid version"},
+		{"/pottery-log/backup-metadata", url.Values{"deviceId": {"device1"}}, "missing_field", "Missing required field metadata"},
+		{"/pottery-log/restore-metadata", url.Values{"deviceId": {"device1"}, "version": {"a/b"}}, "invalid_field", "Invalid version"},
+		{"/pottery-log/metadata-diff", url.Values{"deviceId": {"device1"}, "from": {"../x"}}, "invalid_field", "Invalid from"},
+		{"/v2/search", url.Values{"deviceId": {"device1"}}, "missing_field", "Missing required field q"},
+	} {
+		resp, err := http.PostForm(h.Server.URL+c.path, c.form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", c.path, err)
+		}
+		if resp.StatusCode != http.StatusBadRequest || body.Code != c.code || body.Message != c.message {
+			t.Errorf("%s with %v: got %s %s %q, want 400 %s %q", c.path, c.form, resp.Status, body.Code, body.Message, c.code, c.message)
+		}
+	}
+}
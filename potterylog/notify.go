@@ -0,0 +1,434 @@
+package potterylog
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/smtp"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notifications tell a device's user or the operator that something
+// happened, like a finished export or a run of server errors. Each
+// deployment lists its notifiers in the config, and every notification goes
+// to each notifier whose kinds include it. Push notifiers only deliver to
+// devices that registered a push token; the others are for the operator.
+const (
+	notifyExportFinished = "export-finished"
+	notifyBackupReminder = "backup-reminder"
+	notifyQuotaWarning   = "quota-warning"
+	notifyErrorAlert     = "error-alert"
+	notifyImportAbuse    = "import-abuse"
+)
+
+type notification struct {
+	Kind string `json:"kind"`
+	// DeviceID is empty for notifications about the server itself
+	DeviceID string                 `json:"device_id,omitempty"`
+	Tenant   string                 `json:"tenant"`
+	Title    string                 `json:"title"`
+	Body     string                 `json:"body"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+}
+
+// notifier delivers notifications one way
+type notifier interface {
+	Notify(n notification) error
+}
+
+type notifierConfig struct {
+	// "webhook", "email", "fcm", "apns", or "noop"
+	Type string `json:"type"`
+	// Kinds limits the notifier to some kinds of notifications; empty
+	// means all of them
+	Kinds []string `json:"kinds"`
+
+	// webhook: gets each notification as a JSON POST
+	WebhookURL string `json:"webhook_url"`
+
+	// email
+	smtpConfig
+
+	// fcm: a Google service account key file with access to Firebase
+	// Cloud Messaging in the project
+	GoogleServiceAccount string `json:"google_service_account"`
+	FirebaseProject      string `json:"firebase_project"`
+
+	// apns: the team and key ids and .p8 key file from Apple, and the
+	// app's bundle id
+	AppleTeamID      string `json:"apple_team_id"`
+	AppleKeyID       string `json:"apple_key_id"`
+	ApplePrivateKey  string `json:"apple_private_key"`
+	AppleBundleID    string `json:"apple_bundle_id"`
+	AppleDevelopment bool   `json:"apple_development"`
+}
+
+func (c notifierConfig) wants(kind string) bool {
+	if len(c.Kinds) == 0 {
+		return true
+	}
+	for _, k := range c.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func newNotifier(c notifierConfig, db *opsDB) (notifier, error) {
+	switch c.Type {
+	case "webhook":
+		return webhookNotifier{url: c.WebhookURL}, nil
+	case "email":
+		return emailNotifier{c.smtpConfig}, nil
+	case "fcm":
+		return fcmNotifier{serviceAccount: c.GoogleServiceAccount, project: c.FirebaseProject, db: db}, nil
+	case "apns":
+		return apnsNotifier{notifierConfig: c, db: db}, nil
+	case "noop", "":
+		return noopNotifier{}, nil
+	}
+	return nil, fmt.Errorf("unknown notifier type %q", c.Type)
+}
+
+// notifiersFor is the tenant's notifiers, or the top-level ones for the
+// default tenant and tenants that don't list any
+func (s *Server) notifiersFor(t *tenant) []notifierConfig {
+	if t != defaultTenant && t.Notifiers != nil {
+		return t.Notifiers
+	}
+	return s.config().Notifiers
+}
+
+// notify sends n to every notifier of the device's tenant that wants it.
+// Failures are logged, and the last one is returned.
+func (s *Server) notify(n notification) error {
+	t := s.tenantOf(n.DeviceID)
+	n.Tenant = t.Name
+	var lastErr error
+	for _, c := range s.notifiersFor(t) {
+		if !c.wants(n.Kind) {
+			continue
+		}
+		nr, err := newNotifier(c, s.ops)
+		if err == nil {
+			err = nr.Notify(n)
+		}
+		if err != nil {
+			log.Printf("Error sending %s notification with %s: %v\n", n.Kind, c.Type, err)
+			s.counters.Incr("notify-errors." + c.Type)
+			lastErr = err
+			continue
+		}
+		s.counters.Incr("notify." + c.Type)
+	}
+	return lastErr
+}
+
+type noopNotifier struct{}
+
+func (noopNotifier) Notify(n notification) error { return nil }
+
+type webhookNotifier struct {
+	url string
+}
+
+func (w webhookNotifier) Notify(n notification) error {
+	return postWebhook(w.url, n)
+}
+
+// smtpConfig is where to send email. Mail goes through SMTPAddr
+// ("host:port"), logging in with SMTPUsername and SMTPPassword if they're
+// set.
+type smtpConfig struct {
+	EmailTo      []string `json:"email_to"`
+	EmailFrom    string   `json:"email_from"`
+	SMTPAddr     string   `json:"smtp_addr"`
+	SMTPUsername string   `json:"smtp_username"`
+	SMTPPassword string   `json:"smtp_password"`
+}
+
+func (c smtpConfig) configured() bool {
+	return len(c.EmailTo) > 0 && c.SMTPAddr != ""
+}
+
+// send emails a plain text message to EmailTo
+func (c smtpConfig) send(subject, body string) error {
+	if !c.configured() {
+		return errors.New("email needs email_to and smtp_addr")
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", c.EmailFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(c.EmailTo, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if c.SMTPUsername != "" {
+		host := strings.Split(c.SMTPAddr, ":")[0]
+		auth = smtp.PlainAuth("", c.SMTPUsername, c.SMTPPassword, host)
+	}
+	return smtp.SendMail(c.SMTPAddr, auth, c.EmailFrom, c.EmailTo, msg.Bytes())
+}
+
+// emailNotifier emails the operator
+type emailNotifier struct {
+	smtpConfig
+}
+
+func (e emailNotifier) Notify(n notification) error {
+	body := n.Body + "\n"
+	if n.DeviceID != "" {
+		body += "\nDevice: " + n.DeviceID
+	}
+	if n.Tenant != "" {
+		body += "\nTenant: " + n.Tenant
+	}
+	for key, value := range n.Data {
+		body += fmt.Sprintf("\n%s: %v", key, value)
+	}
+	return e.send("Pottery Log: "+n.Title, body+"\n")
+}
+
+// Devices register for push notifications with /pottery-log/push-token
+const (
+	pushTokenSetting    = "push-token"
+	pushPlatformSetting = "push-platform"
+)
+
+// pushToken returns the device's push token in db if it registered one
+// for platform
+func pushToken(db *opsDB, deviceID, platform string) string {
+	if deviceID == "" || db.DeviceSetting(deviceID, pushPlatformSetting) != platform {
+		return ""
+	}
+	return db.DeviceSetting(deviceID, pushTokenSetting)
+}
+
+// pushData stringifies n.Data, since push payloads only carry strings
+func pushData(n notification) map[string]string {
+	data := map[string]string{"kind": n.Kind}
+	for key, value := range n.Data {
+		data[key] = fmt.Sprint(value)
+	}
+	return data
+}
+
+type fcmNotifier struct {
+	serviceAccount string
+	project        string
+	// db has the devices' push tokens
+	db *opsDB
+}
+
+func (f fcmNotifier) Notify(n notification) error {
+	token := pushToken(f.db, n.DeviceID, "android")
+	if token == "" {
+		return nil
+	}
+	accessToken, err := googleAccessToken(f.serviceAccount, "https://www.googleapis.com/auth/firebase.messaging")
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"token":        token,
+			"notification": map[string]string{"title": n.Title, "body": n.Body},
+			"data":         pushData(n),
+		},
+	})
+	req, err := http.NewRequest(http.MethodPost, "https://fcm.googleapis.com/v1/projects/"+f.project+"/messages:send", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+	return doJSON(req, nil)
+}
+
+type apnsNotifier struct {
+	notifierConfig
+	// db has the devices' push tokens
+	db *opsDB
+}
+
+// apnsTokens caches provider tokens by key id. Apple rejects tokens older
+// than an hour, and refreshing more than every 20 minutes.
+var apnsTokens = struct {
+	mu     sync.Mutex
+	tokens map[string]cachedToken
+}{
+	tokens: make(map[string]cachedToken),
+}
+
+func (a apnsNotifier) providerToken() (string, error) {
+	apnsTokens.mu.Lock()
+	defer apnsTokens.mu.Unlock()
+	if cached := apnsTokens.tokens[a.AppleKeyID]; cached.token != "" && time.Now().Before(cached.expires) {
+		return cached.token, nil
+	}
+	keyPEM, err := ioutil.ReadFile(a.ApplePrivateKey)
+	if err != nil {
+		return "", err
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return "", err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return "", errors.New("the Apple private key must be an EC key")
+	}
+	jwt, err := signJWT(map[string]interface{}{"alg": "ES256", "kid": a.AppleKeyID},
+		map[string]interface{}{"iss": a.AppleTeamID, "iat": time.Now().Unix()}, ecKey)
+	if err != nil {
+		return "", err
+	}
+	apnsTokens.tokens[a.AppleKeyID] = cachedToken{token: jwt, expires: time.Now().Add(40 * time.Minute)}
+	return jwt, nil
+}
+
+func (a apnsNotifier) Notify(n notification) error {
+	token := pushToken(a.db, n.DeviceID, "ios")
+	if token == "" {
+		return nil
+	}
+	jwt, err := a.providerToken()
+	if err != nil {
+		return err
+	}
+	payload := map[string]interface{}{
+		"aps": map[string]interface{}{
+			"alert": map[string]string{"title": n.Title, "body": n.Body},
+		},
+	}
+	for key, value := range pushData(n) {
+		payload[key] = value
+	}
+	body, _ := json.Marshal(payload)
+
+	host := "api.push.apple.com"
+	if a.AppleDevelopment {
+		host = "api.sandbox.push.apple.com"
+	}
+	req, err := http.NewRequest(http.MethodPost, "https://"+host+"/3/device/"+token, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("apns-topic", a.AppleBundleID)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("Content-Type", "application/json")
+	return doJSON(req, nil)
+}
+
+var (
+	pushTokenField    = field{Name: "token", Required: true, MaxLen: 4096, Pattern: uriPattern}
+	pushPlatformField = field{Name: "platform", Required: true, Pattern: regexp.MustCompile(`^(android|ios)$`)}
+)
+
+// PushToken registers the device for push notifications. The platform is
+// "android" for FCM or "ios" for APNs.
+func (s *Server) PushToken(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField, pushTokenField, pushPlatformField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	if !s.requireDevice(w, req, deviceID) {
+		return
+	}
+	if err := s.ops.SetDeviceSetting(deviceID, pushTokenSetting, req.FormValue("token")); s.handleErr(err, deviceID, w) {
+		return
+	}
+	if err := s.ops.SetDeviceSetting(deviceID, pushPlatformSetting, req.FormValue("platform")); s.handleErr(err, deviceID, w) {
+		return
+	}
+	w.Write(okResponse())
+}
+
+func exportFinishedNotification(deviceID, kind, uri string, size int64) notification {
+	return notification{
+		Kind:     notifyExportFinished,
+		DeviceID: deviceID,
+		Title:    "Backup finished",
+		Body:     fmt.Sprintf("Your pots were backed up (%s).", formatBytes(size)),
+		Data:     map[string]interface{}{"export_kind": kind, "uri": uri, "bytes": size},
+	}
+}
+
+// errorAlertLimit limits error-alert notifications to one per errorAlertInterval
+type errorAlertLimit struct {
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+const errorAlertInterval = 10 * time.Minute
+
+// alertError tells the operator about a server error, unless it told them
+// about one recently
+func (s *Server) alertError(err error, requestID string) {
+	s.errorAlerts.mu.Lock()
+	if s.Clock.Now().Sub(s.errorAlerts.last) < errorAlertInterval {
+		s.errorAlerts.suppressed++
+		s.errorAlerts.mu.Unlock()
+		return
+	}
+	suppressed := s.errorAlerts.suppressed
+	s.errorAlerts.last = s.Clock.Now()
+	s.errorAlerts.suppressed = 0
+	s.errorAlerts.mu.Unlock()
+
+	go s.notify(notification{
+		Kind:  notifyErrorAlert,
+		Title: "Server error",
+		Body:  err.Error(),
+		Data: map[string]interface{}{
+			"request_id":         requestID,
+			"errors_since_alert": suppressed,
+		},
+	})
+}
+
+// quotaWindow is how far back warnQuota adds up a device's uploads
+const quotaWindow = 30 * 24 * time.Hour
+
+// The device setting that records when a device was last warned
+const quotaWarnedSetting = "quota-warned"
+
+// warnQuota notifies a device whose uploads to t over the last 30 days
+// passed quota_warning_bytes, at most once per 30 days
+func (s *Server) warnQuota(t *tenant, deviceID string) {
+	limit := s.config().QuotaWarningBytes
+	if limit <= 0 {
+		return
+	}
+	used, err := s.ops.Usage(t, deviceID, "upload_bytes", s.Clock.Now().Add(-quotaWindow))
+	if err != nil || used < limit {
+		return
+	}
+	key := t.dataKey(deviceID)
+	if warned, err := time.Parse(time.RFC3339, s.ops.DeviceSetting(key, quotaWarnedSetting)); err == nil && s.Clock.Now().Sub(warned) < quotaWindow {
+		return
+	}
+	if err := s.ops.SetDeviceSetting(key, quotaWarnedSetting, s.Clock.Now().UTC().Format(time.RFC3339)); err != nil {
+		log.Printf("Error saving quota warning for %s: %v\n", deviceID, err)
+		return
+	}
+	go s.notify(notification{
+		Kind:     notifyQuotaWarning,
+		DeviceID: deviceID,
+		Title:    "You're using a lot of storage",
+		Body:     fmt.Sprintf("You've uploaded %s of photos in the last 30 days.", formatBytes(used)),
+		Data:     map[string]interface{}{"bytes": used, "limit": limit},
+	})
+}
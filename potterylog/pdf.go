@@ -0,0 +1,235 @@
+package potterylog
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// pdfDoc writes just enough PDF for the portfolio: pages of Helvetica text
+// and JPEG images. Text is encoded as WinAnsi, so characters outside it
+// come out as "?". Coordinates are in points from the bottom left.
+type pdfDoc struct {
+	width, height float64
+	pages         []*pdfPage
+	images        [][]byte
+	imageSizes    [][2]int
+}
+
+type pdfPage struct {
+	content bytes.Buffer
+	images  []int
+}
+
+const (
+	pdfFontRegular = "F1"
+	pdfFontBold    = "F2"
+)
+
+// Paper sizes in points
+var pdfPaperSizes = map[string][2]float64{
+	"letter": {612, 792},
+	"a4":     {595.28, 841.89},
+}
+
+func newPDF(paper string) *pdfDoc {
+	size := pdfPaperSizes[paper]
+	return &pdfDoc{width: size[0], height: size[1]}
+}
+
+func (d *pdfDoc) AddPage() *pdfPage {
+	p := &pdfPage{}
+	d.pages = append(d.pages, p)
+	return p
+}
+
+// Text draws a line of text with its baseline at y
+func (p *pdfPage) Text(font string, size, x, y float64, text string) {
+	fmt.Fprintf(&p.content, "BT /%s %.2f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, y, pdfString(text))
+}
+
+// Line draws a thin gray rule
+func (p *pdfPage) Line(x0, y0, x1, y1 float64) {
+	fmt.Fprintf(&p.content, "q 0.75 G 0.5 w %.2f %.2f m %.2f %.2f l S Q\n", x0, y0, x1, y1)
+}
+
+// AddImage adds a JPEG of the given pixel size to the document and returns
+// its number for Image
+func (d *pdfDoc) AddImage(jpegData []byte, width, height int) int {
+	d.images = append(d.images, jpegData)
+	d.imageSizes = append(d.imageSizes, [2]int{width, height})
+	return len(d.images) - 1
+}
+
+// Image draws an added image in the box with its bottom left at x, y
+func (p *pdfPage) Image(image int, x, y, w, h float64) {
+	p.images = append(p.images, image)
+	fmt.Fprintf(&p.content, "q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n", w, h, x, y, image)
+}
+
+// Bytes lays out the objects: the catalog, the page tree, the two fonts,
+// the images, and then each page and its content stream
+func (d *pdfDoc) Bytes() []byte {
+	var out bytes.Buffer
+	offsets := []int{}
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	const firstImage = 5
+	firstPage := firstImage + len(d.images)
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, data := range d.images {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB "+
+			"/BitsPerComponent 8 /Filter /DCTDecode /Length %d >>\nstream\n", len(offsets), d.imageSizes[i][0], d.imageSizes[i][1], len(data))
+		out.Write(data)
+		out.WriteString("\nendstream\nendobj\n")
+	}
+	for i, p := range d.pages {
+		var xobjects strings.Builder
+		for _, image := range p.images {
+			fmt.Fprintf(&xobjects, "/Im%d %d 0 R ", image, firstImage+image)
+		}
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Contents %d 0 R "+
+			"/Resources << /Font << /%s 3 0 R /%s 4 0 R >> /XObject << %s>> >> >>",
+			d.width, d.height, firstPage+2*i+1, pdfFontRegular, pdfFontBold, xobjects.String()))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", p.content.Len(), p.content.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+// WinAnsi's characters from 0x80 to 0x9F; the rest match Latin-1
+var winAnsiExtras = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87, 'ˆ': 0x88,
+	'‰': 0x89, 'Š': 0x8A, '‹': 0x8B, 'Œ': 0x8C, 'Ž': 0x8E, '‘': 0x91, '’': 0x92, '“': 0x93,
+	'”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '˜': 0x98, '™': 0x99, 'š': 0x9A, '›': 0x9B,
+	'œ': 0x9C, 'ž': 0x9E, 'Ÿ': 0x9F,
+}
+
+// pdfString encodes text as WinAnsi and escapes it for a PDF string
+func pdfString(text string) string {
+	var out strings.Builder
+	for _, r := range text {
+		var b byte
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			out.WriteByte('\\')
+			b = byte(r)
+		case r == '\n' || r == '\t':
+			b = ' '
+		case r >= 0x20 && r < 0x7F, r >= 0xA0 && r <= 0xFF:
+			b = byte(r)
+		default:
+			if extra, ok := winAnsiExtras[r]; ok {
+				b = extra
+			} else {
+				b = '?'
+			}
+		}
+		if b >= 0x80 {
+			fmt.Fprintf(&out, "\\%03o", b)
+		} else {
+			out.WriteByte(b)
+		}
+	}
+	return out.String()
+}
+
+// Helvetica's widths for ASCII 32 to 126, in thousandths of the font size.
+// Anything else is measured as a digit's width.
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+// textWidth estimates how wide text is in Helvetica at size. Bold is about
+// 5% wider.
+func textWidth(text string, size float64, bold bool) float64 {
+	total := 0
+	for _, r := range text {
+		if r >= 32 && r <= 126 {
+			total += helveticaWidths[r-32]
+		} else {
+			total += 556
+		}
+	}
+	width := float64(total) * size / 1000
+	if bold {
+		width *= 1.05
+	}
+	return width
+}
+
+// wrapText breaks text into lines no wider than width, breaking long words
+// if it must
+func wrapText(text string, size, width float64) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			for textWidth(word, size, false) > width && utf8.RuneCountInString(word) > 1 {
+				if line != "" {
+					lines = append(lines, line)
+					line = ""
+				}
+				fits := 0
+				for n := range word {
+					if n > 0 && textWidth(word[:n], size, false) > width {
+						break
+					}
+					fits = n
+				}
+				if fits == 0 {
+					_, fits = utf8.DecodeRuneInString(word)
+				}
+				lines = append(lines, word[:fits])
+				word = word[fits:]
+			}
+			candidate := word
+			if line != "" {
+				candidate = line + " " + word
+			}
+			if line != "" && textWidth(candidate, size, false) > width {
+				lines = append(lines, line)
+				candidate = word
+			}
+			line = candidate
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// truncateText shortens text with an ellipsis to fit in width
+func truncateText(text string, size, width float64, bold bool) string {
+	if textWidth(text, size, bold) <= width {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 && textWidth(string(runes)+"…", size, bold) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "…"
+}
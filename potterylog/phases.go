@@ -0,0 +1,71 @@
+package potterylog
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// phaseTimes adds up how long each phase of an export or import takes, like
+// writing the zip or uploading it to S3, so a slow backup can be pinned on
+// the network, the CPU, or S3.
+type phaseTimes struct {
+	mu    sync.Mutex
+	times map[string]time.Duration
+}
+
+func newPhaseTimes() *phaseTimes {
+	return &phaseTimes{
+		mu:    sync.Mutex{},
+		times: make(map[string]time.Duration),
+	}
+}
+
+func (p *phaseTimes) Add(phase string, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.times[phase] += d
+}
+
+// Time runs f and counts how long it took toward phase
+func (p *phaseTimes) Time(phase string, f func() error) error {
+	start := time.Now()
+	err := f()
+	p.Add(phase, time.Since(start))
+	return err
+}
+
+// Millis returns the milliseconds spent in each phase, for events
+func (p *phaseTimes) Millis() map[string]int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ms := make(map[string]int64, len(p.times))
+	for phase, d := range p.times {
+		ms[phase] = d.Milliseconds()
+	}
+	return ms
+}
+
+// Record adds the times to counters as "<name>-<phase>-ms", so /stats
+// shows where the time goes across all exports or imports
+func (p *phaseTimes) Record(counters *counterSet, name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for phase, d := range p.times {
+		counters.Add(name+"-"+phase+"-ms", d.Milliseconds())
+	}
+}
+
+// timedReader counts how long its reads take, to separate a slow source
+// from slow processing of what's read
+type timedReader struct {
+	r       io.Reader
+	elapsed time.Duration
+}
+
+func (t *timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.r.Read(p)
+	t.elapsed += time.Since(start)
+	return n, err
+}
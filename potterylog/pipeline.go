@@ -0,0 +1,264 @@
+package potterylog
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every image that's uploaded or imported goes through the upload
+// pipeline: validate, then transform, then store, then post-process.
+// Features that look at or change images register a stage instead of
+// adding to the upload code. A validate or transform stage can stop the
+// upload by returning an error; post-process stages run after the image is
+// stored, so their errors are only logged.
+type uploadItem struct {
+	DeviceID    string
+	Bucket      string
+	FileName    string
+	ContentType string
+	// Body is the image as it stands after the stages so far. Transforms
+	// replace it and update Size.
+	Body io.ReadSeeker
+	Size int64
+	// Imported is true for images restored from an export
+	Imported bool
+	// FailOnConflict refuses the upload if a different image has its name,
+	// instead of storing it under a suffixed name
+	FailOnConflict bool
+	// Replace stores the image under its name even if a different image
+	// has it, as a conditional upload does
+	Replace bool
+	// The pot the app is adding the image to and when the photo was taken,
+	// if the app said (see imagemeta.go)
+	PotID      string
+	CapturedAt time.Time
+
+	// OriginalFileName is the name the image was sent with, before the
+	// stages changed it
+	OriginalFileName string
+	// Set by recompress: the image as it was sent, and its type, kept
+	// under originals/ once the WebP is stored
+	Original            []byte
+	OriginalContentType string
+
+	// Set by the store stage. ETag is the hex MD5 of what's stored.
+	Key  string
+	URI  string
+	ETag string
+	// Set by the measure stage, or 0 if the image couldn't be decoded
+	Width  int
+	Height int
+}
+
+// A stage runs for the server the image was sent to
+type uploadStage struct {
+	name string
+	run  func(s *Server, item *uploadItem) error
+}
+
+type uploadPipeline struct {
+	mu          sync.Mutex
+	validate    []uploadStage
+	transform   []uploadStage
+	store       func(s *Server, item *uploadItem) error
+	postProcess []uploadStage
+}
+
+// newUploadPipeline is the pipeline with every stage, in the order they run
+func newUploadPipeline() *uploadPipeline {
+	p := &uploadPipeline{store: storeUpload}
+	// Before recompression, which drops the EXIF
+	p.Validate("capture-time", readCaptureTime)
+	p.Transform("detect-content-type", detectContentType)
+	p.Transform("recompress", recompress)
+	p.PostProcess("keep-original", storeOriginal)
+	p.PostProcess("measure", measureImage)
+	// After measure, so the sidecar has the dimensions
+	p.PostProcess("sidecar", writeImageMeta)
+	p.PostProcess("webhooks", imageUploaded)
+	return p
+}
+
+// Validate adds a stage that checks an image before anything else happens
+func (p *uploadPipeline) Validate(name string, run func(s *Server, item *uploadItem) error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.validate = append(p.validate, uploadStage{name, run})
+}
+
+// Transform adds a stage that can rewrite the image before it's stored
+func (p *uploadPipeline) Transform(name string, run func(s *Server, item *uploadItem) error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.transform = append(p.transform, uploadStage{name, run})
+}
+
+// PostProcess adds a stage that runs after the image is stored
+func (p *uploadPipeline) PostProcess(name string, run func(s *Server, item *uploadItem) error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.postProcess = append(p.postProcess, uploadStage{name, run})
+}
+
+// Run sends an item for s through every stage and returns its URI
+func (p *uploadPipeline) Run(s *Server, item *uploadItem) (string, error) {
+	p.mu.Lock()
+	validate := append([]uploadStage{}, p.validate...)
+	transform := append([]uploadStage{}, p.transform...)
+	store := p.store
+	postProcess := append([]uploadStage{}, p.postProcess...)
+	p.mu.Unlock()
+
+	if item.OriginalFileName == "" {
+		item.OriginalFileName = item.FileName
+	}
+	for _, stages := range [][]uploadStage{validate, transform} {
+		for _, stage := range stages {
+			if err := stage.run(s, item); err != nil {
+				debugf("Upload stage %s rejected %s: %v\n", stage.name, item.FileName, err)
+				return "", err
+			}
+			if _, err := item.Body.Seek(0, io.SeekStart); err != nil {
+				return "", err
+			}
+		}
+	}
+	if err := store(s, item); err != nil {
+		return "", err
+	}
+	for _, stage := range postProcess {
+		if _, err := item.Body.Seek(0, io.SeekStart); err != nil {
+			break
+		}
+		if err := stage.run(s, item); err != nil {
+			debugf("Upload stage %s failed for %s: %v\n", stage.name, item.Key, err)
+		}
+	}
+	return item.URI, nil
+}
+
+// seekable returns r as an io.ReadSeeker, reading it into memory if needed,
+// and its size
+func seekable(r io.Reader) (io.ReadSeeker, int64, error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		size, err := rs.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, 0, err
+		}
+		_, err = rs.Seek(0, io.SeekStart)
+		return rs, size, err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(data), int64(len(data)), nil
+}
+
+func isImageType(contentType string) bool {
+	return strings.HasPrefix(contentType, "image/")
+}
+
+// detectContentType sniffs the type when the client didn't say it's an
+// image, as with exports from older apps, whose entries have no type.
+// Images the standard sniffer doesn't know, like HEIC, are recognized by
+// their header or else their file extension.
+func detectContentType(s *Server, item *uploadItem) error {
+	if isImageType(item.ContentType) {
+		return nil
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(item.Body, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	contentType := http.DetectContentType(head[:n])
+	if !isImageType(contentType) {
+		if t := sniffHEIF(head[:n]); t != "" {
+			contentType = t
+		} else if t := imageTypeByExtension(item.FileName); t != "" {
+			contentType = t
+		}
+	}
+	item.ContentType = contentType
+	return nil
+}
+
+// sniffHEIF recognizes HEIC and HEIF images by the brand in their ftyp box
+func sniffHEIF(head []byte) string {
+	if len(head) < 12 || string(head[4:8]) != "ftyp" {
+		return ""
+	}
+	switch string(head[8:12]) {
+	case "heic", "heix", "heim", "heis":
+		return "image/heic"
+	case "mif1", "msf1", "heif":
+		return "image/heif"
+	}
+	return ""
+}
+
+// imageTypeByExtension is the image type for the file name's extension,
+// or "" if it isn't an image extension
+func imageTypeByExtension(fileName string) string {
+	ext := strings.ToLower(path.Ext(fileName))
+	switch ext {
+	case ".heic":
+		return "image/heic"
+	case ".heif":
+		return "image/heif"
+	}
+	if t := mime.TypeByExtension(ext); isImageType(t) {
+		return t
+	}
+	return ""
+}
+
+// storeUpload is the store stage: content-addressed when that's on for
+// images, uploaded or imported, otherwise at <deviceId>/<fileName>, with the
+// name suffixed if a different image already has it (or replacing it, for
+// Replace)
+func storeUpload(s *Server, item *uploadItem) error {
+	if s.config().ContentAddressedImages {
+		return storeBlob(s, item)
+	}
+	fileName, exists, unlockName, err := freeName(item, func(fileName string) (bool, bool, error) {
+		info, err := s.Storage.Head(item.Bucket, item.DeviceID+"/"+fileName)
+		if isNotFound(err) {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+		if item.Imported && !isImageType(info.ContentType) {
+			// Restores from before types were sniffed stored some images
+			// as binary, which browsers won't show, so replace those
+			return false, false, nil
+		}
+		same, err := sameObject(s, item, info)
+		return same, true, err
+	})
+	if err != nil {
+		return err
+	}
+	defer unlockName()
+	item.FileName = fileName
+	item.Key = item.DeviceID + "/" + fileName
+	if item.ETag, err = bodyMD5(item); err != nil {
+		return err
+	}
+	if exists {
+		debugf("Image %s already in s3\n", item.Key)
+	} else if err := s.Storage.Put(item.Bucket, item.Key, item.Body, item.ContentType); err != nil {
+		return err
+	}
+	item.URI = s.objectUrl(item.Bucket, item.Key)
+	return nil
+}
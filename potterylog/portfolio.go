@@ -0,0 +1,371 @@
+package potterylog
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A portfolio is a PDF of the device's pots for a gallery application or a
+// teaching portfolio: a cover page, then a page per pot with its photos,
+// dates, and notes. It's built from app metadata like the table export and
+// uploaded next to the device's exports. Decoding and scaling every photo
+// is slow, so only a couple are built at once.
+
+const (
+	maxPortfolioPots      = 100
+	portfolioImagesPerPot = 4
+	// Photos are scaled to this many pixels square, enough for print
+	portfolioOnePhotoPixels  = 1200
+	portfolioGridPhotoPixels = 800
+	portfolioMargin          = 54
+	maxPortfolioBuilds       = 2
+)
+
+var (
+	errPortfoliosBusy = newAPIError("portfolios_busy", "The server is busy making other portfolios. Please try again in a minute.")
+	errTooManyPots    = newAPIError("too_many_pots", fmt.Sprintf("A portfolio can have at most %d pots", maxPortfolioPots), maxPortfolioPots)
+)
+
+var paperPattern = regexp.MustCompile(`^(letter|a4)$`)
+
+var (
+	// pots is a comma-separated list of pot ids, in the order to show them
+	portfolioPotsField  = field{Name: "pots", MaxLen: 16 << 10, Pattern: uriPattern}
+	portfolioTitleField = field{Name: "title", MaxLen: 200}
+	portfolioNameField  = field{Name: "name", MaxLen: 200}
+	paperField          = field{Name: "paper", Pattern: paperPattern}
+)
+
+// Names for the app's statuses
+var statusLabels = map[string]string{
+	"notstarted": "Not started",
+	"thrown":     "Thrown",
+	"trimmed":    "Trimmed",
+	"bisqued":    "Bisqued",
+	"glazed":     "Glazed",
+	"pickedup":   "Picked up",
+}
+
+func statusLabel(status string) string {
+	if label, ok := statusLabels[status]; ok {
+		return label
+	}
+	return status
+}
+
+const portfolioDateFormat = "Jan 2, 2006"
+
+type portfolioResult struct {
+	PDF           []byte
+	Pages         int
+	Images        int
+	MissingImages int
+}
+
+// portfolioLayout tracks where the next line goes, starting new pages as
+// they fill up
+type portfolioLayout struct {
+	doc  *pdfDoc
+	page *pdfPage
+	y    float64
+}
+
+func (l *portfolioLayout) newPage() {
+	l.page = l.doc.AddPage()
+	l.y = l.doc.height - portfolioMargin
+}
+
+// need starts a new page unless there are height points left on this one
+func (l *portfolioLayout) need(height float64) {
+	if l.y-height < portfolioMargin+20 {
+		l.newPage()
+	}
+}
+
+func (l *portfolioLayout) text(font string, size, lineHeight float64, text string) {
+	l.need(lineHeight)
+	l.y -= lineHeight
+	l.page.Text(font, size, portfolioMargin, l.y, text)
+}
+
+func (l *portfolioLayout) wrapped(size, lineHeight float64, text string) {
+	for _, line := range wrapText(text, size, l.contentWidth()) {
+		l.text(pdfFontRegular, size, lineHeight, line)
+	}
+}
+
+func (l *portfolioLayout) contentWidth() float64 {
+	return l.doc.width - 2*portfolioMargin
+}
+
+// buildPortfolio lays out the pots, with photos looked up by their app
+// names in images, which are in the bucket
+func (s *Server) buildPortfolio(bucketName, deviceID string, list []appPot, images map[string]string, title, name, paper string) *portfolioResult {
+	l := &portfolioLayout{doc: newPDF(paper)}
+	result := &portfolioResult{}
+
+	l.newPage()
+	l.y -= 180
+	l.text(pdfFontBold, 30, 36, truncateText(title, 30, l.contentWidth(), true))
+	if name != "" {
+		l.text(pdfFontRegular, 16, 24, truncateText(name, 16, l.contentWidth(), false))
+	}
+	l.y -= 12
+	summary := fmt.Sprintf("%d pots", len(list))
+	if len(list) == 1 {
+		summary = "1 pot"
+	}
+	if first, last := workSpan(list); !first.IsZero() {
+		summary += ", " + first.Format("January 2006")
+		if last.Format("January 2006") != first.Format("January 2006") {
+			summary += " to " + last.Format("January 2006")
+		}
+	}
+	l.text(pdfFontRegular, 12, 18, summary)
+
+	for _, p := range list {
+		l.newPage()
+		potTitle := p.Title
+		if potTitle == "" {
+			potTitle = "Untitled"
+		}
+		l.text(pdfFontBold, 22, 26, truncateText(potTitle, 22, l.contentWidth(), true))
+		if status, date := p.Status(); status != "" {
+			l.text(pdfFontRegular, 12, 18, statusLabel(status)+" "+date.Format(portfolioDateFormat))
+		}
+		dates := []string{}
+		for _, s := range p.statuses() {
+			dates = append(dates, statusLabel(s)+" "+p.Dates[s].Format(portfolioDateFormat))
+		}
+		if len(dates) > 1 {
+			l.wrapped(10, 14, strings.Join(dates, "  ·  "))
+		}
+		l.y -= 10
+		l.page.Line(portfolioMargin, l.y, l.doc.width-portfolioMargin, l.y)
+		l.y -= 14
+
+		keys := []string{}
+		for _, imageName := range p.Images {
+			key, ok := images[imageName]
+			if !ok {
+				result.MissingImages++
+				continue
+			}
+			if len(keys) < portfolioImagesPerPot {
+				keys = append(keys, key)
+			}
+		}
+		l.photos(s, bucketName, keys, result)
+
+		if len(p.Notes) > 0 {
+			l.y -= 6
+			l.text(pdfFontBold, 12, 18, "Notes")
+			for _, s := range orderStatuses(noteStatuses(p.Notes)) {
+				label := statusLabel(s)
+				if s == "general" {
+					label = ""
+				}
+				note := p.Notes[s]
+				if label != "" {
+					note = label + ": " + note
+				}
+				l.wrapped(10.5, 14, note)
+				l.y -= 4
+			}
+		}
+	}
+
+	for i, page := range l.doc.pages {
+		footer := fmt.Sprintf("%d / %d", i+1, len(l.doc.pages))
+		page.Text(pdfFontRegular, 9, (l.doc.width-textWidth(footer, 9, false))/2, portfolioMargin/2, footer)
+	}
+	result.Pages = len(l.doc.pages)
+	result.PDF = l.doc.Bytes()
+	return result
+}
+
+// photos draws one large photo from s's storage, or up to four in a grid,
+// below the cursor
+func (l *portfolioLayout) photos(s *Server, bucketName string, keys []string, result *portfolioResult) {
+	if len(keys) == 0 {
+		return
+	}
+	width := l.contentWidth()
+	const gap = 12
+	cols, side, pixels := 1, width*0.75, portfolioOnePhotoPixels
+	if len(keys) > 1 {
+		cols, side, pixels = 2, (width-gap)/2, portfolioGridPhotoPixels
+	}
+	rows := (len(keys) + cols - 1) / cols
+	l.need(float64(rows)*(side+gap) - gap)
+	left := portfolioMargin + (width-float64(cols)*side-float64(cols-1)*gap)/2
+
+	for i, key := range keys {
+		data, err := s.portfolioPhoto(bucketName, key, pixels)
+		if err != nil {
+			debugf("Leaving %s out of a portfolio: %v\n", key, err)
+			result.MissingImages++
+			continue
+		}
+		image := l.doc.AddImage(data, pixels, pixels)
+		x := left + float64(i%cols)*(side+gap)
+		y := l.y - float64(i/cols+1)*side - float64(i/cols)*gap
+		l.page.Image(image, x, y, side, side)
+		result.Images++
+	}
+	l.y -= float64(rows)*(side+gap) - gap + 16
+}
+
+// portfolioPhoto fetches a photo, turns it upright, and crops and scales it
+// to a square JPEG
+func (s *Server) portfolioPhoto(bucketName, key string, pixels int) ([]byte, error) {
+	body, _, err := s.Storage.Get(bucketName, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if format == "jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, fitSquare(img, pixels), &jpeg.Options{Quality: 82}); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func noteStatuses(notes map[string]string) map[string]time.Time {
+	statuses := make(map[string]time.Time, len(notes))
+	for s := range notes {
+		statuses[s] = time.Time{}
+	}
+	return statuses
+}
+
+// workSpan is the earliest and latest dates of any of the pots
+func workSpan(list []appPot) (time.Time, time.Time) {
+	var first, last time.Time
+	for _, p := range list {
+		for _, d := range p.Dates {
+			if first.IsZero() || d.Before(first) {
+				first = d
+			}
+			if d.After(last) {
+				last = d
+			}
+		}
+	}
+	return first, last
+}
+
+// selectPots picks the pots with the given ids, in that order
+func selectPots(list []appPot, ids []string) ([]appPot, error) {
+	byID := make(map[string]appPot, len(list))
+	for _, p := range list {
+		byID[p.ID] = p
+	}
+	selected := make([]appPot, 0, len(ids))
+	for _, id := range ids {
+		p, ok := byID[id]
+		if !ok {
+			return nil, errPotNotFound
+		}
+		selected = append(selected, p)
+	}
+	return selected, nil
+}
+
+// Portfolio makes a PDF of the device's pots, or just those in pots, and
+// returns its URI
+func (s *Server) Portfolio(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField, portfolioPotsField, portfolioTitleField, portfolioNameField, paperField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	if !s.requireDevice(w, req, deviceID) {
+		return
+	}
+	metadata, _, ok := s.requestMetadata(w, req, deviceID)
+	if !ok {
+		return
+	}
+	list, err := appPots(metadata)
+	if s.handleErrCode(err, http.StatusBadRequest, deviceID, w) {
+		return
+	}
+	if ids := req.FormValue("pots"); ids != "" {
+		list, err = selectPots(list, strings.Split(ids, ","))
+		if s.handlePotErr(err, deviceID, w) {
+			return
+		}
+	}
+	if len(list) > maxPortfolioPots {
+		s.handleErrCode(errTooManyPots, http.StatusBadRequest, deviceID, w)
+		return
+	}
+	title := req.FormValue("title")
+	if title == "" {
+		title = "Portfolio"
+	}
+	paper := req.FormValue("paper")
+	if paper == "" {
+		paper = "letter"
+	}
+
+	if !s.portfolioBuilds.Acquire(maxPortfolioBuilds, 10*time.Second) {
+		s.tooBusy(w, errPortfoliosBusy, deviceID, time.Minute)
+		return
+	}
+	defer s.portfolioBuilds.Release()
+	started := s.Clock.Now()
+	imageBucket := requestTenant(req).imageBucket()
+	images, err := s.deviceImages(imageBucket, deviceID)
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+	result := s.buildPortfolio(imageBucket, deviceID, list, images, title, req.FormValue("name"), paper)
+
+	bucketName := requestTenant(req).importBucket()
+	key := deviceID + "/pottery_log_portfolio_" + s.Clock.Now().Format("2006_01_02_150405") + ".pdf"
+	if s.handleErr(s.Storage.Put(bucketName, key, bytes.NewReader(result.PDF), "application/pdf"), deviceID, w) {
+		return
+	}
+	s.logEvent(deviceID, PortfolioEvent{
+		Pots:     len(list),
+		Images:   result.Images,
+		Bytes:    len(result.PDF),
+		Duration: millis(s.Clock.Now().Sub(started)),
+	})
+	writeJSON(w, struct {
+		Status        string `json:"status"`
+		URI           string `json:"uri"`
+		Pots          int    `json:"pots"`
+		Pages         int    `json:"pages"`
+		Images        int    `json:"images"`
+		MissingImages int    `json:"missing_images"`
+		Bytes         int    `json:"bytes"`
+	}{
+		Status:        "ok",
+		URI:           s.objectUrl(bucketName, key),
+		Pots:          len(list),
+		Pages:         result.Pages,
+		Images:        result.Images,
+		MissingImages: result.MissingImages,
+		Bytes:         len(result.PDF),
+	})
+}
@@ -0,0 +1,202 @@
+package potterylog
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+var errImageNotOnPot = newAPIError("image_not_on_pot", "That image is not attached to the pot")
+
+// PotImages serves /v2/pots/<id>/images:
+//
+//	POST with `key` attaches an uploaded image to the end of the pot's list
+//	DELETE with `key` detaches it (the image itself is not deleted)
+//	PUT with a JSON body {"images": [...]} reorders the attached images
+func (s *Server) PotImages(w http.ResponseWriter, req *http.Request, deviceID, library, potID string) {
+	var update func(p *pot) error
+	var change string
+
+	switch req.Method {
+	case http.MethodGet:
+		p, err := s.pots.Get(library, potID)
+		if s.handlePotErr(err, deviceID, w) {
+			return
+		}
+		writePotImages(w, p)
+		return
+
+	case http.MethodPost:
+		key, err := s.imageKey(requestTenant(req).imageBucket(), req.FormValue("key"), deviceID)
+		if s.handleErrCode(err, http.StatusBadRequest, deviceID, w) {
+			return
+		}
+		change = "attach"
+		update = func(p *pot) error {
+			for _, existing := range p.Images {
+				if existing == key {
+					return nil
+				}
+			}
+			p.Images = append(p.Images, key)
+			return nil
+		}
+
+	case http.MethodDelete:
+		key, err := s.imageKey(requestTenant(req).imageBucket(), req.FormValue("key"), deviceID)
+		if s.handleErrCode(err, http.StatusBadRequest, deviceID, w) {
+			return
+		}
+		change = "detach"
+		update = func(p *pot) error {
+			for i, existing := range p.Images {
+				if existing == key {
+					p.Images = append(p.Images[:i], p.Images[i+1:]...)
+					if p.Cover == key {
+						p.Cover = ""
+					}
+					return nil
+				}
+			}
+			return errImageNotOnPot
+		}
+
+	case http.MethodPut:
+		var body struct {
+			Images []string `json:"images"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); s.handleErrCode(err, http.StatusBadRequest, deviceID, w) {
+			return
+		}
+		change = "reorder"
+		update = func(p *pot) error {
+			if !sameImages(p.Images, body.Images) {
+				return newAPIError("invalid_image_order", "The new order must contain exactly the pot's current images")
+			}
+			p.Images = body.Images
+			return nil
+		}
+
+	default:
+		s.handleErrCode(errMethodNotAllowed, http.StatusMethodNotAllowed, deviceID, w)
+		return
+	}
+
+	p, err := s.pots.Update(library, potID, update)
+	if err != nil && err != errPotNotFound {
+		s.handleErrCode(err, http.StatusBadRequest, deviceID, w)
+		return
+	}
+	if s.handlePotErr(err, deviceID, w) {
+		return
+	}
+	s.logEvent(deviceID, PotImagesEvent{Change: change, Images: len(p.Images)})
+	writePotImages(w, p)
+}
+
+// PotCover serves /v2/pots/<id>/cover, the image share pages, feeds,
+// static sites, and collages lead with:
+//
+//	GET returns the pot's images and cover
+//	PUT or POST with `key` makes an attached image the cover
+//	DELETE goes back to the first image
+func (s *Server) PotCover(w http.ResponseWriter, req *http.Request, deviceID, library, potID string) {
+	var update func(p *pot) error
+	switch req.Method {
+	case http.MethodGet:
+		p, err := s.pots.Get(library, potID)
+		if s.handlePotErr(err, deviceID, w) {
+			return
+		}
+		writePotImages(w, p)
+		return
+
+	case http.MethodPut, http.MethodPost:
+		key, err := s.imageKey(requestTenant(req).imageBucket(), req.FormValue("key"), deviceID)
+		if s.handleErrCode(err, http.StatusBadRequest, deviceID, w) {
+			return
+		}
+		update = func(p *pot) error {
+			for _, existing := range p.Images {
+				if existing == key {
+					p.Cover = key
+					return nil
+				}
+			}
+			return errImageNotOnPot
+		}
+
+	case http.MethodDelete:
+		update = func(p *pot) error {
+			p.Cover = ""
+			return nil
+		}
+
+	default:
+		s.handleErrCode(errMethodNotAllowed, http.StatusMethodNotAllowed, deviceID, w)
+		return
+	}
+
+	p, err := s.pots.Update(library, potID, update)
+	if err != nil && err != errPotNotFound {
+		s.handleErrCode(err, http.StatusBadRequest, deviceID, w)
+		return
+	}
+	if s.handlePotErr(err, deviceID, w) {
+		return
+	}
+	s.logEvent(deviceID, PotImagesEvent{Change: "cover", Images: len(p.Images)})
+	writePotImages(w, p)
+}
+
+// imageKey accepts either a key in the bucket or an image URI as returned
+// by Upload, and checks that it belongs to the device
+func (s *Server) imageKey(bucketName, keyOrURI, deviceID string) (string, error) {
+	if keyOrURI == "" {
+		return "", errMissingField("key")
+	}
+	key := keyOrURI
+	if k, ok := s.objectKey(bucketName, keyOrURI); ok {
+		key = k
+	}
+	if !strings.HasPrefix(key, deviceID+"/") && !s.ownsBlob(bucketName, deviceID, key) {
+		return "", newAPIError("image_not_owned", "The image does not belong to this device")
+	}
+	return key, nil
+}
+
+func sameImages(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int)
+	for _, key := range a {
+		counts[key]++
+	}
+	for _, key := range b {
+		counts[key]--
+		if counts[key] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func writePotImages(w http.ResponseWriter, p *pot) {
+	images := p.Images
+	if images == nil {
+		images = []string{}
+	}
+	writeJSON(w, struct {
+		Status string   `json:"status"`
+		PotID  string   `json:"pot_id"`
+		Images []string `json:"images"`
+		// Cover is the cover image, chosen or not
+		Cover string `json:"cover"`
+	}{
+		Status: "ok",
+		PotID:  p.ID,
+		Images: images,
+		Cover:  p.coverImage(),
+	})
+}
@@ -0,0 +1,420 @@
+package potterylog
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errPotNotFound = newAPIError("pot_not_found", "There is no pot with that id")
+
+type potNote struct {
+	Date time.Time `json:"date"`
+	Text string    `json:"text"`
+}
+
+type pot struct {
+	ID     string `json:"id"`
+	Title  string `json:"title"`
+	Status string `json:"status"`
+	Clay   string `json:"clay"`
+	Glaze  string `json:"glaze"`
+	// Dates is keyed by status, e.g. "thrown", "bisqued", "glazed", "fired"
+	Dates map[string]time.Time `json:"dates"`
+	Notes []potNote            `json:"notes"`
+	// Images are keys in the image bucket, in display order
+	Images []string `json:"images"`
+	// Cover is the image chosen to represent the pot, if one was
+	Cover string `json:"cover,omitempty"`
+	// ShareID is set while the pot has a public share link
+	ShareID string    `json:"share_id,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// potStore keeps each library's pots as one JSON file in dir. A library is
+// a device's own pots (named by its deviceId) or a studio's shared pots.
+type potStore struct {
+	mu    sync.Mutex
+	dir   string
+	clock Clock
+	// index is the search index (see search.go), kept up to date as pots
+	// are saved, if it's set
+	index *opsDB
+}
+
+// NewPotStore sets up a pot store in the given directory
+func NewPotStore(dir string, clock Clock) *potStore {
+	os.MkdirAll(dir, 0777)
+	return &potStore{
+		mu:    sync.Mutex{},
+		dir:   dir,
+		clock: clock,
+	}
+}
+
+func (s *potStore) load(library string) (map[string]*pot, error) {
+	libraryPots := make(map[string]*pot)
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, library+".json"))
+	if os.IsNotExist(err) {
+		return libraryPots, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &libraryPots)
+	return libraryPots, err
+}
+
+// indexed updates the search index for a saved pot. The pot is already
+// saved, so a failure is logged rather than returned.
+func (s *potStore) indexed(library string, p *pot) {
+	if s.index == nil {
+		return
+	}
+	if err := s.index.IndexPot(library, newPotDocument(p)); err != nil {
+		log.Printf("Error indexing pot %s/%s: %v\n", library, p.ID, err)
+	}
+}
+
+// Reindex adds every library's pots to the search index, for an index
+// that's new
+func (s *potStore) Reindex() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, file := range files {
+		library := strings.TrimSuffix(filepath.Base(file), ".json")
+		libraryPots, err := s.load(library)
+		if err != nil {
+			return err
+		}
+		for _, p := range libraryPots {
+			if err := s.index.IndexPot(library, newPotDocument(p)); err != nil {
+				return err
+			}
+			n++
+		}
+	}
+	if n > 0 {
+		log.Printf("Indexed %d pots for search\n", n)
+	}
+	return nil
+}
+
+func (s *potStore) save(library string, libraryPots map[string]*pot) error {
+	data, err := json.Marshal(libraryPots)
+	if err != nil {
+		return err
+	}
+	// Write then rename so a crash never leaves a half-written file
+	location := filepath.Join(s.dir, library+".json")
+	if err := ioutil.WriteFile(location+".tmp", data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(location+".tmp", location)
+}
+
+func (s *potStore) List(library string) ([]*pot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	libraryPots, err := s.load(library)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*pot, 0, len(libraryPots))
+	for _, p := range libraryPots {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list, nil
+}
+
+func (s *potStore) Get(library, potID string) (*pot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	libraryPots, err := s.load(library)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := libraryPots[potID]
+	if !ok {
+		return nil, errPotNotFound
+	}
+	return p, nil
+}
+
+// Put creates or replaces a pot, keeping its original creation time and share
+// link. Images are managed separately, so a pot without an image list keeps
+// its images. It returns the status the pot had before, or "" for a new pot.
+func (s *potStore) Put(library string, p *pot) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	libraryPots, err := s.load(library)
+	if err != nil {
+		return "", err
+	}
+	now := s.clock.Now()
+	previousStatus := ""
+	if existing, ok := libraryPots[p.ID]; ok {
+		previousStatus = existing.Status
+		p.Created = existing.Created
+		p.ShareID = existing.ShareID
+		if p.Images == nil {
+			p.Images = existing.Images
+		}
+		if p.Cover == "" {
+			p.Cover = existing.Cover
+		}
+	} else {
+		p.Created = now
+	}
+	p.Updated = now
+	libraryPots[p.ID] = p
+	if err := s.save(library, libraryPots); err != nil {
+		return "", err
+	}
+	s.indexed(library, p)
+	return previousStatus, nil
+}
+
+// Update applies fn to a stored pot and saves it if fn succeeds
+func (s *potStore) Update(library, potID string, fn func(p *pot) error) (*pot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	libraryPots, err := s.load(library)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := libraryPots[potID]
+	if !ok {
+		return nil, errPotNotFound
+	}
+	if err := fn(p); err != nil {
+		return nil, err
+	}
+	p.Updated = s.clock.Now()
+	if err := s.save(library, libraryPots); err != nil {
+		return nil, err
+	}
+	s.indexed(library, p)
+	return p, nil
+}
+
+func (s *potStore) Delete(library, potID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	libraryPots, err := s.load(library)
+	if err != nil {
+		return err
+	}
+	if _, ok := libraryPots[potID]; !ok {
+		return errPotNotFound
+	}
+	delete(libraryPots, potID)
+	if err := s.save(library, libraryPots); err != nil {
+		return err
+	}
+	if s.index != nil {
+		if err := s.index.UnindexPot(library, potID); err != nil {
+			log.Printf("Error unindexing pot %s/%s: %v\n", library, potID, err)
+		}
+	}
+	return nil
+}
+
+// coverImage is the pot's cover if it's still attached, or else its first
+// image, or "" if it has none
+func (p *pot) coverImage() string {
+	for _, key := range p.Images {
+		if key == p.Cover {
+			return key
+		}
+	}
+	if len(p.Images) > 0 {
+		return p.Images[0]
+	}
+	return ""
+}
+
+// imagesCoverFirst is the pot's images with the cover moved to the front
+func (p *pot) imagesCoverFirst() []string {
+	cover := p.coverImage()
+	if cover == "" {
+		return []string{}
+	}
+	images := []string{cover}
+	for _, key := range p.Images {
+		if key != cover {
+			images = append(images, key)
+		}
+	}
+	return images
+}
+
+var validIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]{0,127}$`)
+
+// validID reports whether an id is safe to use as a file or key name
+func validID(id string) bool {
+	return validIDPattern.MatchString(id)
+}
+
+func newID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Pots serves /v2/pots and /v2/pots/<id>, for the device's own pots or,
+// with studioId, a studio's
+func (s *Server) Pots(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	if !s.requireDevice(w, req, deviceID) {
+		return
+	}
+	library, ok := s.potLibrary(w, req, deviceID)
+	if !ok {
+		return
+	}
+
+	parts := strings.SplitN(strings.Trim(strings.TrimPrefix(req.URL.Path, "/v2/pots"), "/"), "/", 2)
+	potID := parts[0]
+	if potID != "" && !validID(potID) {
+		s.handleErrCode(errPotNotFound, http.StatusNotFound, deviceID, w)
+		return
+	}
+	if len(parts) == 2 {
+		switch parts[1] {
+		case "images":
+			s.PotImages(w, req, deviceID, library, potID)
+		case "share":
+			s.SharePot(w, req, deviceID, library, potID)
+		case "cover":
+			s.PotCover(w, req, deviceID, library, potID)
+		case "collage":
+			s.Collage(w, req, deviceID, library, potID)
+		default:
+			s.handleErrCode(errNotFound, http.StatusNotFound, deviceID, w)
+		}
+		return
+	}
+
+	switch {
+	case potID == "" && req.Method == http.MethodGet:
+		list, err := s.pots.List(library)
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		writeJSON(w, struct {
+			Status string `json:"status"`
+			Pots   []*pot `json:"pots"`
+		}{
+			Status: "ok",
+			Pots:   list,
+		})
+
+	case potID == "" && req.Method == http.MethodPost:
+		p, err := decodePot(req)
+		if s.handleErrCode(err, http.StatusBadRequest, deviceID, w) {
+			return
+		}
+		p.ID = newID()
+		if _, err := s.pots.Put(library, p); s.handleErr(err, deviceID, w) {
+			return
+		}
+		s.potStatusChanged(library, "", p)
+		s.logEvent(deviceID, CreatePotEvent)
+		writePot(w, p)
+
+	case potID != "" && req.Method == http.MethodGet:
+		p, err := s.pots.Get(library, potID)
+		if s.handlePotErr(err, deviceID, w) {
+			return
+		}
+		writePot(w, p)
+
+	case potID != "" && req.Method == http.MethodPut:
+		p, err := decodePot(req)
+		if s.handleErrCode(err, http.StatusBadRequest, deviceID, w) {
+			return
+		}
+		p.ID = potID
+		previousStatus, err := s.pots.Put(library, p)
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		s.potStatusChanged(library, previousStatus, p)
+		s.logEvent(deviceID, UpdatePotEvent)
+		writePot(w, p)
+
+	case potID != "" && req.Method == http.MethodDelete:
+		p, err := s.pots.Get(library, potID)
+		if s.handlePotErr(err, deviceID, w) {
+			return
+		}
+		if p.ShareID != "" && s.handleErr(s.shares.Remove(p.ShareID), deviceID, w) {
+			return
+		}
+		if s.handlePotErr(s.pots.Delete(library, potID), deviceID, w) {
+			return
+		}
+		s.logEvent(deviceID, DeletePotEvent)
+		w.Write(okResponse())
+
+	default:
+		s.handleErrCode(errMethodNotAllowed, http.StatusMethodNotAllowed, deviceID, w)
+	}
+}
+
+func decodePot(req *http.Request) (*pot, error) {
+	p := &pot{}
+	if err := json.NewDecoder(req.Body).Decode(p); err != nil {
+		return nil, err
+	}
+	if p.Dates == nil {
+		p.Dates = make(map[string]time.Time)
+	}
+	return p, nil
+}
+
+func writePot(w http.ResponseWriter, p *pot) {
+	writeJSON(w, struct {
+		Status string `json:"status"`
+		Pot    *pot   `json:"pot"`
+	}{
+		Status: "ok",
+		Pot:    p,
+	})
+}
+
+func (s *Server) handlePotErr(err error, deviceID string, w http.ResponseWriter) bool {
+	if err == errPotNotFound {
+		return s.handleErrCode(err, http.StatusNotFound, deviceID, w)
+	}
+	return s.handleErr(err, deviceID, w)
+}
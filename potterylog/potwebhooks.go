@@ -0,0 +1,346 @@
+package potterylog
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Studio owners can register webhooks for their studio's pots, so tools
+// like kiln booking systems hear when a pot moves to a status they care
+// about, such as "bisque-ready". Each delivery is a JSON POST signed with
+// the webhook's secret, which is only shown when the webhook is created:
+// X-Pottery-Log-Signature is "sha256=" and the hex HMAC-SHA256 of the body.
+type potWebhookConfig struct {
+	// Webhooks per studio (default 10)
+	MaxPerStudio int `json:"max_per_studio"`
+	// Deliver to loopback and private network addresses, which are refused
+	// by default so a webhook can't reach the server's own network
+	AllowPrivateAddresses bool `json:"allow_private_addresses"`
+}
+
+func (c potWebhookConfig) maxPerStudio() int {
+	if c.MaxPerStudio > 0 {
+		return c.MaxPerStudio
+	}
+	return 10
+}
+
+const potStatusChangedEvent = "pot.status_changed"
+
+// Deliveries are retried after these delays
+var potWebhookRetries = []time.Duration{10 * time.Second, time.Minute, 10 * time.Minute}
+
+var (
+	errNoSuchWebhook   = newAPIError("no_such_webhook", "There is no webhook with that id")
+	errTooManyWebhooks = newAPIError("too_many_webhooks", "This studio has as many webhooks as it can have")
+	errPrivateAddress  = errors.New("webhooks can't be delivered to private addresses")
+)
+
+var (
+	webhookURLField = field{Name: "url", Required: true, MaxLen: 2048, Pattern: uriPattern}
+	// statuses is a comma-separated list; without it every change is sent
+	webhookStatusesField = field{Name: "statuses", MaxLen: 1024, Pattern: uriPattern}
+	webhookIDField       = field{Name: "webhookId", Required: true, MaxLen: 128, Pattern: validIDPattern}
+)
+
+type potWebhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Statuses are the pot statuses to send changes to, or all if empty
+	Statuses []string `json:"statuses"`
+	// Secret is only in the response that creates the webhook
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// The latest delivery's time and result: "ok" or what went wrong
+	LastDeliveryAt *time.Time `json:"last_delivery_at"`
+	LastResult     string     `json:"last_result,omitempty"`
+
+	library string
+	secret  string
+}
+
+func (h potWebhook) wants(status string) bool {
+	if len(h.Statuses) == 0 {
+		return true
+	}
+	for _, s := range h.Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+type potStatusChange struct {
+	Event    string    `json:"event"`
+	StudioID string    `json:"studio_id"`
+	PotID    string    `json:"pot_id"`
+	Title    string    `json:"title"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	At       time.Time `json:"at"`
+	Pot      *pot      `json:"pot"`
+}
+
+// potStatusChanged sends the change to the library's webhooks that want
+// it. Only studio libraries have webhooks.
+func (s *Server) potStatusChanged(library, from string, p *pot) {
+	if from == p.Status || !strings.HasPrefix(library, studioLibraryPrefix) {
+		return
+	}
+	hooks, err := s.ops.PotWebhooks(library)
+	if err != nil {
+		log.Printf("Error finding webhooks for %s: %v\n", library, err)
+		return
+	}
+	change := potStatusChange{
+		Event:    potStatusChangedEvent,
+		StudioID: strings.TrimPrefix(library, studioLibraryPrefix),
+		PotID:    p.ID,
+		Title:    p.Title,
+		From:     from,
+		To:       p.Status,
+		At:       p.Updated,
+		Pot:      p,
+	}
+	body, err := json.Marshal(change)
+	if err != nil {
+		log.Printf("Error encoding a status change of pot %s: %v\n", p.ID, err)
+		return
+	}
+	for _, h := range hooks {
+		if h.wants(p.Status) {
+			go s.deliverPotWebhook(h, body)
+		}
+	}
+}
+
+// deliverPotWebhook posts a change, retrying failures, and records how the
+// last attempt went
+func (s *Server) deliverPotWebhook(h potWebhook, body []byte) {
+	delivery := newID()
+	err := s.postPotWebhook(h, delivery, body)
+	for _, delay := range potWebhookRetries {
+		if err == nil || err == errPrivateAddress {
+			break
+		}
+		time.Sleep(delay)
+		err = s.postPotWebhook(h, delivery, body)
+	}
+	result := "ok"
+	if err != nil {
+		log.Printf("Error delivering to webhook %s: %v\n", h.ID, err)
+		s.counters.Incr("pot-webhook-failed")
+		result = err.Error()
+	} else {
+		s.counters.Incr("pot-webhook-delivered")
+	}
+	if err := s.ops.PotWebhookDelivered(h.ID, result); err != nil {
+		log.Printf("Error recording a delivery to webhook %s: %v\n", h.ID, err)
+	}
+}
+
+func (s *Server) postPotWebhook(h potWebhook, delivery string, body []byte) error {
+	return postSignedWebhook(h.URL, h.secret, potStatusChangedEvent, delivery, body, s.config().PotWebhooks.AllowPrivateAddresses)
+}
+
+// postSignedWebhook posts body signed with secret, and expects any 2xx back
+func postSignedWebhook(url, secret, event, delivery string, body []byte, allowPrivate bool) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "pottery-log-server/"+version)
+	req.Header.Set("X-Pottery-Log-Event", event)
+	req.Header.Set("X-Pottery-Log-Delivery", delivery)
+	req.Header.Set("X-Pottery-Log-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	resp, err := webhookClient(allowPrivate).Do(req)
+	if errors.Is(err, errPrivateAddress) {
+		return errPrivateAddress
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// webhookClient refuses to connect to private addresses unless they're
+// allowed. The check is on the address dialed, so a name that resolves to
+// one is refused too.
+func webhookClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !allowPrivate {
+		dialer.Control = refusePrivateAddresses(errPrivateAddress)
+	}
+	return &http.Client{
+		Timeout: 15 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// refusePrivateAddresses is a dialer Control that refuses, with refusal,
+// any address that isn't a public unicast one
+func refusePrivateAddresses(refusal error) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		addrPort, err := netip.ParseAddrPort(address)
+		if err != nil {
+			return err
+		}
+		if !isPublicAddress(addrPort.Addr()) {
+			return refusal
+		}
+		return nil
+	}
+}
+
+// nonPublicPrefixes are the special-purpose ranges that netip.Addr's own
+// checks let through
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this network"
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, and broadcast
+	netip.MustParsePrefix("::/96"),           // IPv4-compatible
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use NAT64
+	netip.MustParsePrefix("100::/64"),        // discard
+	netip.MustParsePrefix("2001::/32"),       // Teredo
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+}
+
+var (
+	nat64Prefix     = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFourPrefix = netip.MustParsePrefix("2002::/16")
+)
+
+// isPublicAddress is whether addr is a global unicast address outside the
+// private and special-purpose ranges. IPv6 addresses that carry an IPv4
+// address, like ::ffff:127.0.0.1 or a NAT64 address, are judged by it.
+func isPublicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, p := range nonPublicPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	b := addr.As16()
+	switch {
+	case nat64Prefix.Contains(addr):
+		return isPublicAddress(netip.AddrFrom4([4]byte{b[12], b[13], b[14], b[15]}))
+	case sixToFourPrefix.Contains(addr):
+		return isPublicAddress(netip.AddrFrom4([4]byte{b[2], b[3], b[4], b[5]}))
+	}
+	return true
+}
+
+// StudioWebhooks serves /v2/studios/<id>/webhooks for the studio's owners:
+// GET lists them, POST with url (and optionally statuses) adds one, and
+// DELETE with webhookId removes one
+func (s *Server) StudioWebhooks(w http.ResponseWriter, req *http.Request, deviceID string, st *studio) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		hooks, err := s.ops.PotWebhooks(st.library())
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		writeJSON(w, struct {
+			Status   string       `json:"status"`
+			Webhooks []potWebhook `json:"webhooks"`
+		}{
+			Status:   "ok",
+			Webhooks: hooks,
+		})
+	case http.MethodPost:
+		if !s.validateForm(w, req, webhookURLField, webhookStatusesField) {
+			return
+		}
+		u, err := url.Parse(req.FormValue("url"))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			s.handleErrCode(errInvalidField("url"), http.StatusBadRequest, deviceID, w)
+			return
+		}
+		statuses := []string{}
+		for _, s := range strings.Split(req.FormValue("statuses"), ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				statuses = append(statuses, s)
+			}
+		}
+		hooks, err := s.ops.PotWebhooks(st.library())
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		if len(hooks) >= s.config().PotWebhooks.maxPerStudio() {
+			s.handleErrCode(errTooManyWebhooks, http.StatusConflict, deviceID, w)
+			return
+		}
+		h := potWebhook{
+			ID:        newID(),
+			URL:       u.String(),
+			Statuses:  statuses,
+			CreatedAt: s.Clock.Now().Truncate(time.Second),
+			library:   st.library(),
+			secret:    newID() + newID(),
+		}
+		if s.handleErr(s.ops.AddPotWebhook(h), deviceID, w) {
+			return
+		}
+		h.Secret = h.secret
+		s.logEvent(deviceID, AddWebhookEvent)
+		writeJSON(w, struct {
+			Status  string     `json:"status"`
+			Webhook potWebhook `json:"webhook"`
+		}{
+			Status:  "ok",
+			Webhook: h,
+		})
+	case http.MethodDelete:
+		if !s.validateForm(w, req, webhookIDField) {
+			return
+		}
+		deleted, err := s.ops.DeletePotWebhook(st.library(), req.FormValue("webhookId"))
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		if !deleted {
+			s.handleErrCode(errNoSuchWebhook, http.StatusNotFound, deviceID, w)
+			return
+		}
+		w.Write(okResponse())
+	default:
+		s.handleErrCode(errMethodNotAllowed, http.StatusMethodNotAllowed, deviceID, w)
+	}
+}
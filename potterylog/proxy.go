@@ -0,0 +1,108 @@
+package potterylog
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The proxy endpoints serve images and export archives through the server,
+// for clients that can't reach the bucket directly. Their URLs are fetched
+// without the app's headers, so the bucket is the device's tenant's. Range and conditional
+// headers are passed on to storage, so resumed downloads and client caches
+// work the same as they do against S3.
+const (
+	imageProxyPath  = "/pottery-log/images/"
+	exportProxyPath = "/pottery-log/exports/"
+)
+
+// ProxyImage serves /pottery-log/images/<deviceId>/<fileName>. Images are
+// public in the bucket, so no device token is needed.
+func (s *Server) ProxyImage(w http.ResponseWriter, req *http.Request) {
+	deviceID, fileName, ok := s.proxyPath(w, req, imageProxyPath)
+	if !ok {
+		return
+	}
+	s.proxyObject(w, req, s.tenantOf(deviceID).imageBucket(), deviceID+"/"+fileName, deviceID)
+}
+
+// ProxyExport serves /pottery-log/exports/<deviceId>/<fileName>
+func (s *Server) ProxyExport(w http.ResponseWriter, req *http.Request) {
+	deviceID, fileName, ok := s.proxyPath(w, req, exportProxyPath)
+	if !ok || !s.requireDevice(w, req, deviceID) {
+		return
+	}
+	s.proxyObject(w, req, s.tenantOf(deviceID).importBucket(), deviceID+"/"+fileName, deviceID)
+}
+
+// proxyPath splits the device and file name out of a proxy URL, handling the
+// error if it can't
+func (s *Server) proxyPath(w http.ResponseWriter, req *http.Request, prefix string) (string, string, bool) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		s.handleErrCode(errMethodNotAllowed, http.StatusMethodNotAllowed, "", w)
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, prefix), "/", 2)
+	if len(parts) != 2 || parts[1] == "" || !validID(parts[0]) || !fileNamePattern.MatchString(parts[1]) {
+		s.handleErrCode(errNotFound, http.StatusNotFound, "", w)
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func (s *Server) proxyObject(w http.ResponseWriter, req *http.Request, bucketName, key, deviceID string) {
+	cond := FetchConditions{
+		Range:       req.Header.Get("Range"),
+		IfNoneMatch: req.Header.Get("If-None-Match"),
+	}
+	if since, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil {
+		cond.IfModifiedSince = since
+	}
+	// If-Range falls back to the whole object when it doesn't match, which is
+	// simplest to do by not asking for a range at all
+	if ifRange := req.Header.Get("If-Range"); ifRange != "" && cond.Range != "" {
+		if info, err := s.Storage.Head(bucketName, key); err != nil || `"`+info.ETag+`"` != ifRange {
+			cond.Range = ""
+		}
+	}
+
+	obj, err := s.Storage.Fetch(bucketName, key, cond)
+	if err != nil && !s.Storage.Exists(bucketName, key) {
+		s.handleErrCode(errNotFound, http.StatusNotFound, deviceID, w)
+		return
+	}
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+
+	header := w.Header()
+	header.Set("Accept-Ranges", "bytes")
+	if obj.ETag != "" {
+		header.Set("ETag", obj.ETag)
+	}
+	if !obj.LastModified.IsZero() {
+		header.Set("Last-Modified", obj.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if obj.Body == nil {
+		w.WriteHeader(obj.Status)
+		return
+	}
+	defer obj.Body.Close()
+
+	if obj.ContentType != "" {
+		header.Set("Content-Type", obj.ContentType)
+	}
+	if obj.ContentRange != "" {
+		header.Set("Content-Range", obj.ContentRange)
+	}
+	header.Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+	header.Set("Cache-Control", "private, max-age=86400")
+	w.WriteHeader(obj.Status)
+	if req.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, obj.Body); err != nil {
+		debugf("Proxying %s/%s stopped: %v\n", bucketName, key, err)
+	}
+}
@@ -0,0 +1,277 @@
+package potterylog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gen2brain/webp"
+)
+
+// With recompression on, large JPEG and PNG uploads are stored as WebP,
+// which is a fraction of the size at a quality nobody notices on a phone.
+// The upload's URI points at the WebP (<name>.webp). Once the WebP is
+// stored, the original is kept under originals/<key of the WebP> for
+// keep_original_days in case something went wrong, then deleted by the
+// expire-originals job. Devices can opt out.
+type recompressConfig struct {
+	Enabled bool `json:"enabled"`
+	// Only images larger than this are recompressed (default 2MB)
+	MinBytes int64 `json:"min_bytes"`
+	// WebP quality from 0 to 100 (default 85)
+	Quality          int `json:"quality"`
+	KeepOriginalDays int `json:"keep_original_days"`
+}
+
+const originalsPrefix = "originals/"
+
+func (c recompressConfig) minBytes() int64 {
+	if c.MinBytes > 0 {
+		return c.MinBytes
+	}
+	return 2_000_000
+}
+
+func (c recompressConfig) quality() int {
+	if c.Quality > 0 {
+		return c.Quality
+	}
+	return 85
+}
+
+func (c recompressConfig) keepOriginal() time.Duration {
+	if c.KeepOriginalDays > 0 {
+		return time.Duration(c.KeepOriginalDays) * 24 * time.Hour
+	}
+	return 30 * 24 * time.Hour
+}
+
+func recompress(s *Server, item *uploadItem) error {
+	c := s.config().Recompress
+	if !c.Enabled || item.Imported || item.Size < c.minBytes() {
+		return nil
+	}
+	if item.ContentType != "image/jpeg" && item.ContentType != "image/png" {
+		return nil
+	}
+	if s.ops.DeviceSetting(item.DeviceID, "recompress") == "off" {
+		return nil
+	}
+
+	// Recompression is optional, so it's what gives when memory is short
+	release, err := s.memory.Reserve(item.Size, 0)
+	if err != nil {
+		debugf("Not recompressing %s/%s: %v\n", item.DeviceID, item.FileName, err)
+		return nil
+	}
+	defer release()
+	original, err := io.ReadAll(item.Body)
+	if err != nil {
+		return err
+	}
+	var img image.Image
+	if item.ContentType == "image/jpeg" {
+		img, err = jpeg.Decode(bytes.NewReader(original))
+		if err == nil {
+			img = applyOrientation(img, jpegOrientation(original))
+		}
+	} else {
+		img, err = png.Decode(bytes.NewReader(original))
+	}
+	if err != nil {
+		// Leave images we can't read alone
+		debugf("Not recompressing %s: %v\n", item.FileName, err)
+		return nil
+	}
+
+	var out bytes.Buffer
+	if err := webp.Encode(&out, img, webp.Options{Quality: c.quality()}); err != nil {
+		return err
+	}
+	if int64(out.Len()) >= item.Size {
+		return nil
+	}
+
+	debugf("Recompressed %s from %d to %d bytes\n", item.FileName, item.Size, out.Len())
+	s.logEvent(item.DeviceID, RecompressEvent{BytesBefore: item.Size, BytesAfter: out.Len()})
+	item.Original = original
+	item.OriginalContentType = item.ContentType
+	item.FileName += ".webp"
+	item.ContentType = "image/webp"
+	item.Body = bytes.NewReader(out.Bytes())
+	item.Size = int64(out.Len())
+	return nil
+}
+
+// storeOriginal keeps the original of a recompressed image. It runs after
+// the store stage, so the key is the WebP's final one, suffixed or
+// content-addressed, and an upload that failed leaves nothing behind.
+func storeOriginal(s *Server, item *uploadItem) error {
+	if item.Original == nil {
+		return nil
+	}
+	originalKey := originalsPrefix + item.Key
+	if err := s.Storage.Put(item.Bucket, originalKey, bytes.NewReader(item.Original), item.OriginalContentType); err != nil {
+		return err
+	}
+	s.ops.OriginalKept(item.Bucket, originalKey, s.Clock.Now().Add(s.config().Recompress.keepOriginal()))
+	return nil
+}
+
+// expireOriginals deletes originals that have been kept long enough, or on
+// a dry run logs their keys
+func (s *Server) expireOriginals(r *jobRun) error {
+	expired, err := s.ops.ExpiredOriginals(s.Clock.Now())
+	if err != nil {
+		return err
+	}
+	if r.DryRun {
+		for _, o := range expired {
+			r.Logf("Would delete %s/%s", o.Bucket, o.Key)
+		}
+		return nil
+	}
+	deleted := 0
+	for _, o := range expired {
+		if err := s.Storage.Delete(o.Bucket, o.Key); err != nil {
+			r.Logf("Error deleting %s/%s: %v", o.Bucket, o.Key, err)
+			continue
+		}
+		s.ops.OriginalDeleted(o.Bucket, o.Key)
+		deleted++
+	}
+	if deleted > 0 {
+		r.Logf("Deleted %d originals", deleted)
+	}
+	return nil
+}
+
+// RecompressSetting lets a device opt out of (or back into) recompression
+func (s *Server) RecompressSetting(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField, field{Name: "enabled", Required: true, Pattern: boolPattern}) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	if !s.requireDevice(w, req, deviceID) {
+		return
+	}
+	value := "on"
+	if req.FormValue("enabled") == "false" {
+		value = "off"
+	}
+	if s.handleErr(s.ops.SetDeviceSetting(deviceID, "recompress", value), deviceID, w) {
+		return
+	}
+	s.logEvent(deviceID, RecompressSettingEvent{Enabled: value == "on"})
+	w.Write(okResponse())
+}
+
+// jpegOrientation reads the EXIF orientation (1-8) from a JPEG, or returns
+// 1 if it doesn't have one. Decoding ignores it, so phone photos would
+// otherwise come out sideways.
+func jpegOrientation(data []byte) int {
+	if tiff := jpegEXIF(data); tiff != nil {
+		return exifOrientation(tiff)
+	}
+	return 1
+}
+
+// jpegEXIF finds a JPEG's EXIF data, or returns nil if it has none
+func jpegEXIF(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return nil
+		}
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xDA || length < 2 || i+2+length > len(data) {
+			return nil
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		i += 2 + length
+	}
+	return nil
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// applyOrientation turns img the right way up for an EXIF orientation
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	outW, outH := w, h
+	if orientation >= 5 {
+		outW, outH = h, w
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, outW, outH))
+	for y := 0; y < outH; y++ {
+		for x := 0; x < outW; x++ {
+			// Where this output pixel comes from in the stored image
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			out.Set(x, y, color.NRGBAModel.Convert(img.At(b.Min.X+sx, b.Min.Y+sy)))
+		}
+	}
+	return out
+}
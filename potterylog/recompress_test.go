@@ -0,0 +1,87 @@
+package potterylog
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// gradientJPEG is a JPEG that WebP stores in fewer bytes, shaded by tone
+// so that two of them are different images
+func gradientJPEG(t *testing.T, tone uint8) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 4), tone, 255})
+		}
+	}
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func newRecompressHarness(t *testing.T) *testHarness {
+	t.Helper()
+	h, err := newTestHarness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Close)
+	c := *h.srv.config()
+	c.Recompress = recompressConfig{Enabled: true, MinBytes: 1}
+	h.srv.setConfig(&c)
+	return h
+}
+
+func TestRecompressKeepsEachOriginal(t *testing.T) {
+	h := newRecompressHarness(t)
+	bucket := defaultTenant.imageBucket()
+
+	photos := [][]byte{gradientJPEG(t, 0), gradientJPEG(t, 200)}
+	for _, photo := range photos {
+		var uploaded struct {
+			Key string `json:"key"`
+		}
+		postForm(t, h, "/pottery-log-images/upload", map[string]string{"deviceId": "device1"}, "image", "pot.jpg", photo, &uploaded)
+		kept, err := h.Storage.get(bucket, originalsPrefix+uploaded.Key)
+		if err != nil {
+			t.Fatalf("no original kept for %s: %v", uploaded.Key, err)
+		}
+		if !bytes.Equal(kept.data, photo) {
+			t.Errorf("the original kept for %s is a different image", uploaded.Key)
+		}
+	}
+	originals, err := h.Storage.List(bucket, originalsPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(originals) != 2 {
+		t.Errorf("got originals %v, want one for each photo", originals)
+	}
+}
+
+func TestRecompressKeepsNoOriginalWhenStoreFails(t *testing.T) {
+	h := newRecompressHarness(t)
+	h.srv.uploads.store = func(s *Server, item *uploadItem) error {
+		return errors.New("storage is down")
+	}
+
+	item := &uploadItem{DeviceID: "device1", Bucket: defaultTenant.imageBucket(), FileName: "pot.jpg", ContentType: "image/jpeg"}
+	item.Body, item.Size, _ = seekable(bytes.NewReader(gradientJPEG(t, 0)))
+	if _, err := h.srv.uploads.Run(h.srv, item); err == nil {
+		t.Fatal("the upload succeeded with the store failing")
+	}
+	originals, err := h.Storage.List(defaultTenant.imageBucket(), originalsPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(originals) != 0 {
+		t.Errorf("a failed upload left originals %v", originals)
+	}
+}
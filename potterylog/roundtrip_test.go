@@ -0,0 +1,119 @@
+package potterylog
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// postForm posts fields to the harness, with a file if fileField isn't
+// empty, and decodes the JSON response into out
+func postForm(t *testing.T, h *testHarness, path string, fields map[string]string, fileField, fileName string, file []byte, out interface{}) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	if fileField != "" {
+		part, err := form.CreateFormFile(fileField, fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(file)
+	}
+	form.Close()
+	resp, err := http.Post(h.Server.URL+path, form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: got %s", path, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+}
+
+func TestUploadExportImportRoundTrip(t *testing.T) {
+	h, err := newTestHarness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	var photo bytes.Buffer
+	if err := jpeg.Encode(&photo, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	var uploaded struct {
+		Key      string `json:"key"`
+		FileName string `json:"fileName"`
+	}
+	postForm(t, h, "/pottery-log-images/upload", map[string]string{"deviceId": "device1"}, "image", "pot.jpg", photo.Bytes(), &uploaded)
+
+	metadata := `{"pots":[{"id":"1","title":"Vase","images3":["pot.jpg"]}]}`
+	keys, _ := json.Marshal([]string{uploaded.Key})
+	var started struct {
+		ExportID     string `json:"export_id"`
+		CopiedImages int    `json:"copied_images"`
+	}
+	postForm(t, h, "/pottery-log/export", map[string]string{
+		"deviceId":  "device1",
+		"metadata":  metadata,
+		"imageKeys": string(keys),
+	}, "", "", nil, &started)
+	if started.CopiedImages != 1 {
+		t.Fatalf("export: copied %d images, want 1", started.CopiedImages)
+	}
+
+	var finished struct {
+		URI    string `json:"uri"`
+		Images int    `json:"images"`
+	}
+	resp, err := http.PostForm(h.Server.URL+"/pottery-log/finish-export", url.Values{
+		"deviceId": {"device1"},
+		"exportId": {started.ExportID},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&finished)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("finish export: got %s, %v", resp.Status, err)
+	}
+	if finished.Images != 1 {
+		t.Fatalf("finish export: %d images, want 1", finished.Images)
+	}
+
+	var imported importResponse
+	postForm(t, h, "/pottery-log/import", map[string]string{
+		"deviceId":  "device2",
+		"importURL": finished.URI,
+	}, "", "", nil, &imported)
+	if imported.Metadata != metadata {
+		t.Errorf("import: got metadata %q, want %q", imported.Metadata, metadata)
+	}
+	if len(imported.ImageMap) != 1 {
+		t.Fatalf("import: got images %v, want 1", imported.ImageMap)
+	}
+	for name, uri := range imported.ImageMap {
+		key, ok := h.Storage.Key(defaultTenant.importBucket(), uri)
+		if !ok {
+			t.Fatalf("import: %s went to %s, outside the import bucket", name, uri)
+		}
+		if got, err := h.Storage.get(defaultTenant.importBucket(), key); err != nil || !bytes.Equal(got.data, photo.Bytes()) {
+			t.Errorf("import: %s isn't the uploaded photo (%v)", name, err)
+		}
+	}
+	if n := len(h.Events.Events("server-import")); n != 1 {
+		t.Errorf("import: logged %d import events, want 1", n)
+	}
+}
@@ -0,0 +1,618 @@
+package potterylog
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const imageBucketName = "pottery-log"
+const importBucketName = "pottery-log-exports"
+
+var errUploadsBusy = newAPIError("uploads_busy", "The server is busy with other uploads. Please try again shortly.")
+
+// activeUploads counts uploads in progress across tenants
+func (s *Server) activeUploads() int {
+	total := 0
+	s.uploadSlots.Each(func(_ string, slots *semaphore) {
+		total += slots.InUse()
+	})
+	return total
+}
+
+// withUploadSlot runs upload once one of t's upload slots is free
+func (s *Server) withUploadSlot(t *tenant, upload func() error) error {
+	slots := s.uploadSlots.Get(t.Name)
+	if !slots.Acquire(t.maxUploads(s.config()), time.Duration(s.config().UploadQueueSeconds)*time.Second) {
+		return errUploadsBusy
+	}
+	defer slots.Release()
+	return upload()
+}
+
+// downloadImport saves the export at urlString, which must be in t's import
+// bucket or an allowed one, to localFile, for a request from ip. It gives up when ctx is done or import_download_seconds pass,
+// and leaves no partial file behind.
+func (s *Server) downloadImport(ctx context.Context, t *tenant, urlString, localFile, deviceID, ip string) error {
+	bucketName, key, err := s.importSource(t, urlString)
+	if err != nil {
+		return err
+	}
+	size, err := s.preflightImport(bucketName, key)
+	if err != nil {
+		return err
+	}
+	if err := s.allowImportDownload(ip, deviceID, urlString, size); err != nil {
+		return err
+	}
+	debugf("Downloading %v to %v\n", urlString, localFile)
+
+	if seconds := s.config().ImportDownloadSeconds; seconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
+		defer cancel()
+	}
+
+	file, err := os.Create(localFile)
+	if err != nil {
+		log.Printf("Error creating %s for an import: %v\n", localFile, err)
+		return err
+	}
+	stopProgress := logDownloadProgress(file, urlString)
+	err = s.Storage.Download(ctx, bucketName, key, file)
+	stopProgress()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(localFile)
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Printf("Timed out downloading %s\n", urlString)
+			return errImportDownloadTimeout
+		}
+		return err
+	}
+	debugf("Finished downloading file\n")
+	return nil
+}
+
+var (
+	errImportDownloadTimeout = newAPIError("import_download_timeout", "Downloading the backup took too long. Please try again.")
+	errImportNoSpace         = newAPIError("import_no_space", "The server doesn't have room for this backup right now. Please try again later.")
+)
+
+func errImportTooLarge(size, limit int64) *apiError {
+	return newAPIError("import_too_large",
+		fmt.Sprintf("The backup is %s, more than the server's limit of %s", formatBytes(size), formatBytes(limit)),
+		formatBytes(size), formatBytes(limit))
+}
+
+// importDiskMargin is left free on the temp disk after an import download,
+// for everything else the server writes there. Exports don't start with
+// less than this free.
+const importDiskMargin = 512 << 20
+
+// preflightImport checks the size of an export before it's downloaded, so
+// one that's over max_import_bytes or won't fit on disk fails right away
+// instead of partway through. It returns the size.
+func (s *Server) preflightImport(bucketName, key string) (int64, error) {
+	info, err := s.Storage.Head(bucketName, key)
+	if isNotFound(err) {
+		return 0, errNoSuchExport
+	}
+	if err != nil {
+		return 0, err
+	}
+	if limit := s.config().MaxImportBytes; limit > 0 && info.Size > limit {
+		return 0, errImportTooLarge(info.Size, limit)
+	}
+	free, err := freeDiskSpace(s.Exports.tempDir)
+	if err != nil {
+		// Let the download find out
+		log.Printf("Error checking free space in %s: %v\n", s.Exports.tempDir, err)
+		return info.Size, nil
+	}
+	if info.Size+importDiskMargin > free {
+		log.Printf("No room to download a %s import, with %s free in %s\n", formatBytes(info.Size), formatBytes(free), s.Exports.tempDir)
+		return 0, errImportNoSpace
+	}
+	return info.Size, nil
+}
+
+func freeDiskSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// downloadImportStatus is the HTTP status for an error from downloadImport
+func downloadImportStatus(err error) int {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		return http.StatusInternalServerError
+	}
+	switch apiErr.Code {
+	case errNoSuchExport.Code:
+		return http.StatusNotFound
+	case "import_too_large":
+		return http.StatusRequestEntityTooLarge
+	case errImportNoSpace.Code:
+		return http.StatusInsufficientStorage
+	case errImportDownloadTimeout.Code:
+		return http.StatusGatewayTimeout
+	case errImportURLLimit.Code:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusBadRequest
+}
+
+// downloadProgressInterval is how often a download in progress is logged
+const downloadProgressInterval = 30 * time.Second
+
+// logDownloadProgress logs how much of a long download has arrived until
+// the returned func is called
+func logDownloadProgress(file *os.File, urlString string) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(downloadProgressInterval)
+		defer ticker.Stop()
+		started := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if stat, err := file.Stat(); err == nil {
+					log.Printf("Downloading %s: %s after %v\n", urlString, formatBytes(stat.Size()), time.Since(started).Round(time.Second))
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// newUploadItem is an uploaded image, ready for the upload pipeline to
+// store in the bucket
+func newUploadItem(imageFile multipart.File, imageFileHeader *multipart.FileHeader, bucketName, deviceID string) *uploadItem {
+	return &uploadItem{
+		DeviceID:    deviceID,
+		Bucket:      bucketName,
+		FileName:    imageFileHeader.Filename,
+		ContentType: imageFileHeader.Header.Get("Content-Type"),
+		Body:        imageFile,
+		Size:        imageFileHeader.Size,
+	}
+}
+
+// importedImageURI returns the URI of an image from an import archive that
+// an earlier import already stored in the bucket, or "" if it still needs
+// uploading.
+// A stored image of the same name is only taken to be the same if its
+// content is, going by its MD5 as sameObject does.
+func (s *Server) importedImageURI(imageFile *zip.File, bucketName, deviceID string) string {
+	key := deviceID + "/" + imageFile.Name
+	info, err := s.Storage.Head(bucketName, key)
+	if err != nil || info.Size < 0 || uint64(info.Size) != imageFile.UncompressedSize64 || !isImageType(info.ContentType) {
+		return ""
+	}
+	sum, err := zipEntryMD5(imageFile)
+	if err != nil {
+		return ""
+	}
+	if same, err := s.objectHasMD5(bucketName, info, sum); err != nil || !same {
+		return ""
+	}
+	return s.objectUrl(bucketName, key)
+}
+
+func zipEntryMD5(f *zip.File) (string, error) {
+	r, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+var errCorruptImage = newAPIError("corrupt_image", "The image is damaged and couldn't be read")
+
+// uploadImportedImage stores an image from an import archive in the bucket,
+// counting the time to decompress it toward "extract" and the rest toward
+// "upload". An entry that can't be decompressed is an errCorruptImage.
+func (s *Server) uploadImportedImage(imageFile *zip.File, bucketName, deviceID string, phases *phaseTimes) (string, error) {
+	// The image is read into memory unless it was stored without
+	// compression
+	release, err := s.memory.Reserve(int64(imageFile.UncompressedSize64), memoryWait)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	var body io.ReadSeeker
+	var size int64
+	err = phases.Time("extract", func() error {
+		imageReader, err := imageFile.Open()
+		if err != nil {
+			log.Print("Error opening image file")
+			return err
+		}
+		defer imageReader.Close()
+		body, size, err = seekable(imageReader)
+		if err != nil {
+			log.Print("Cannot read the file into memory\n")
+		}
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, syscall.ENOSPC) {
+			return "", err
+		}
+		return "", fmt.Errorf("%w: %v", errCorruptImage, err)
+	}
+	var uri string
+	err = phases.Time("upload", func() (err error) {
+		uri, err = s.uploads.Run(s, &uploadItem{
+			DeviceID:    deviceID,
+			Bucket:      bucketName,
+			FileName:    imageFile.Name,
+			ContentType: imageFile.Comment,
+			Body:        body,
+			Size:        size,
+			Imported:    true,
+		})
+		return err
+	})
+	return uri, err
+}
+
+// uploadFile stores a file the server made itself, like a collage, without
+// the upload pipeline
+func (s *Server) uploadFile(bucketName string, file io.ReadSeeker, fileName, contentType, deviceID string) (string, error) {
+	fullFileName := fmt.Sprintf("%v/%v", deviceID, fileName)
+	if s.Storage.Exists(bucketName, fullFileName) {
+		debugf("Image %s already in s3\n", fullFileName)
+		return s.objectUrl(bucketName, fullFileName), nil
+	}
+	if err := s.Storage.Put(bucketName, fullFileName, file, contentType); err != nil {
+		return "", err
+	}
+	return s.objectUrl(bucketName, fullFileName), nil
+}
+
+func (s *Server) uploadMultipart(bucketName string, file *os.File, fileName, contentType, deviceID string) (string, error) {
+	fullFileName := fmt.Sprintf("%v/%v", deviceID, fileName)
+	var size int64
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+	upload := s.largeUploads.Start(bucketName+"/"+fullFileName, size, s.Clock.Now())
+	defer s.largeUploads.Finish(upload)
+	if err := s.Storage.PutFile(bucketName, fullFileName, file, contentType, upload.progress); err != nil {
+		return "", err
+	}
+	log.Printf("Stored %s (%s) in %v\n", upload.Key, formatBytes(size), time.Since(upload.Started).Round(time.Millisecond))
+	return s.objectUrl(bucketName, fullFileName), nil
+}
+
+// largeUpload is a file, like an export archive, that uploadMultipart is
+// storing. The admin port's /debug/vars lists them as large_uploads.
+type largeUpload struct {
+	Key     string    `json:"key"`
+	Bytes   int64     `json:"bytes"`
+	Stored  int64     `json:"stored"`
+	Started time.Time `json:"started"`
+	set     *largeUploadSet
+}
+
+// largeUploadSet is the large uploads in progress
+type largeUploadSet struct {
+	mu      sync.Mutex
+	uploads map[*largeUpload]bool
+}
+
+func newLargeUploadSet() *largeUploadSet {
+	return &largeUploadSet{uploads: make(map[*largeUpload]bool)}
+}
+
+func (l *largeUploadSet) Start(key string, size int64, started time.Time) *largeUpload {
+	upload := &largeUpload{Key: key, Bytes: size, Started: started, set: l}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.uploads[upload] = true
+	return upload
+}
+
+func (l *largeUploadSet) Finish(upload *largeUpload) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.uploads, upload)
+}
+
+func (u *largeUpload) progress(stored int64) {
+	u.set.mu.Lock()
+	defer u.set.mu.Unlock()
+	if stored > u.Stored {
+		u.Stored = stored
+	}
+}
+
+// InProgress is a copy of the uploads in progress, oldest first
+func (l *largeUploadSet) InProgress() []largeUpload {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	uploads := make([]largeUpload, 0, len(l.uploads))
+	for upload := range l.uploads {
+		uploads = append(uploads, *upload)
+	}
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].Started.Before(uploads[j].Started) })
+	return uploads
+}
+
+type s3Store struct {
+	svc *s3.S3
+	// baseURL is set for an S3-compatible server other than AWS, which
+	// serves objects at baseURL/bucket/key
+	baseURL string
+	// acl is the canned ACL objects are put in a bucket with
+	acl func(bucketName string) *string
+}
+
+// awsProfile is the profile in ~/.aws/credentials the server uses
+const awsProfile = "pottery-log-server"
+
+func newS3Store(acl func(bucketName string) *string) *s3Store {
+	return newS3StoreForProfile(awsProfile, acl)
+}
+
+func newS3StoreForProfile(profile string, acl func(bucketName string) *string) *s3Store {
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		Config: aws.Config{
+			Region:                        aws.String("us-east-2"),
+			CredentialsChainVerboseErrors: aws.Bool(true),
+			//Credentials: credentials.NewSharedCredentials()
+		},
+		Profile: profile,
+	}))
+	return &s3Store{svc: s3.New(sess), acl: acl}
+}
+
+func (s *s3Store) Put(bucketName, key string, body io.ReadSeeker, contentType string) error {
+	params := &s3.PutObjectInput{
+		// Params copied to PutFile UploadInput
+		Bucket:       aws.String(bucketName), // Required
+		Key:          aws.String(key),        // Required
+		ACL:          s.acl(bucketName),
+		Body:         body,
+		CacheControl: aws.String("max-age=31556926"), // cachable forever
+		ContentType:  aws.String(contentType),
+		Expires:      aws.Time(time.Now().Add(time.Hour * 24 * 365)),
+	}
+	_, err := s.svc.PutObject(params)
+	if awserr, ok := err.(awserr.Error); err != nil && ok {
+		log.Printf("AWS Error: %+v\n", awserr)
+	}
+	if err != nil {
+		log.Print("Non-AWS error from svc.PutObject\n")
+	}
+	return err
+}
+
+// PutFile's parts: S3 allows 10,000, so this is good for files up to 640 GB
+const (
+	uploadPartSize    = 64 << 20
+	uploadConcurrency = 4
+)
+
+// PutFile streams file to S3 with the upload manager, which reads each part
+// straight from the file instead of copying it into memory, and sends a few
+// parts at once. Files smaller than a part are sent in one request.
+// progress is called with the bytes stored so far as each part finishes.
+func (s *s3Store) PutFile(bucketName, key string, file *os.File, contentType string, progress func(stored int64)) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var stored int64
+	countParts := func(r *request.Request) {
+		r.Handlers.Complete.PushBack(func(r *request.Request) {
+			if r.Error != nil || progress == nil || r.HTTPRequest == nil {
+				return
+			}
+			if r.Operation.Name == "UploadPart" || r.Operation.Name == "PutObject" {
+				progress(atomic.AddInt64(&stored, r.HTTPRequest.ContentLength))
+			}
+		})
+	}
+	uploader := s3manager.NewUploaderWithClient(s.svc, func(u *s3manager.Uploader) {
+		u.PartSize = uploadPartSize
+		u.Concurrency = uploadConcurrency
+	}, s3manager.WithUploaderRequestOptions(countParts))
+	_, err := uploader.Upload(&s3manager.UploadInput{
+		// Params copied from Put PutObjectInput
+		Bucket:       aws.String(bucketName),
+		Key:          aws.String(key),
+		ACL:          s.acl(bucketName),
+		Body:         file,
+		CacheControl: aws.String("max-age=31556926"), // cachable forever
+		ContentType:  aws.String(contentType),
+		Expires:      aws.Time(time.Now().Add(time.Hour * 24 * 365)),
+	})
+	if awserr, ok := err.(awserr.Error); err != nil && ok {
+		log.Printf("Upload: AWS Error: %+v\n", awserr)
+	}
+	return err
+}
+
+func (s *s3Store) Get(bucketName, key string) (io.ReadCloser, string, error) {
+	resp, err := s.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	if awserr, ok := err.(awserr.Error); err != nil && ok {
+		log.Printf("GetObject: AWS Error: %+v\n", awserr)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.Body, aws.StringValue(resp.ContentType), nil
+}
+
+func (s *s3Store) Fetch(bucketName, key string, cond FetchConditions) (*FetchedObject, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	}
+	if cond.Range != "" {
+		input.Range = aws.String(cond.Range)
+	}
+	if cond.IfNoneMatch != "" {
+		input.IfNoneMatch = aws.String(cond.IfNoneMatch)
+	}
+	if !cond.IfModifiedSince.IsZero() {
+		input.IfModifiedSince = aws.Time(cond.IfModifiedSince)
+	}
+	resp, err := s.svc.GetObject(input)
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		// S3 reports a failed condition as an error, but for the client
+		// it's an answer
+		switch reqErr.StatusCode() {
+		case http.StatusNotModified, http.StatusRequestedRangeNotSatisfiable:
+			return &FetchedObject{Status: reqErr.StatusCode()}, nil
+		}
+	}
+	if awserr, ok := err.(awserr.Error); err != nil && ok {
+		log.Printf("GetObject: AWS Error: %+v\n", awserr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	obj := &FetchedObject{
+		Status:       http.StatusOK,
+		Body:         resp.Body,
+		ContentType:  aws.StringValue(resp.ContentType),
+		ContentRange: aws.StringValue(resp.ContentRange),
+		Size:         aws.Int64Value(resp.ContentLength),
+		ETag:         aws.StringValue(resp.ETag),
+		LastModified: aws.TimeValue(resp.LastModified),
+	}
+	if obj.ContentRange != "" {
+		obj.Status = http.StatusPartialContent
+	}
+	return obj, nil
+}
+
+func (s *s3Store) Download(ctx context.Context, bucketName, key string, file *os.File) error {
+	downloader := s3manager.NewDownloaderWithClient(s.svc)
+	_, err := downloader.DownloadWithContext(ctx, file,
+		&s3.GetObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(key),
+		})
+	if awserr, ok := err.(awserr.Error); err != nil && ok {
+		log.Printf("AWS Error: %+v\n", awserr)
+	}
+	return err
+}
+
+func (s *s3Store) Exists(bucketName, key string) bool {
+	params := &s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	}
+	_, err := s.svc.HeadObject(params)
+	return err == nil
+}
+
+func (s *s3Store) Head(bucketName, key string) (ObjectInfo, error) {
+	resp, err := s.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{
+		Key:         key,
+		Size:        aws.Int64Value(resp.ContentLength),
+		ETag:        strings.Trim(aws.StringValue(resp.ETag), `"`),
+		ContentType: aws.StringValue(resp.ContentType),
+	}, nil
+}
+
+func (s *s3Store) Delete(bucketName, key string) error {
+	params := &s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	}
+	_, err := s.svc.DeleteObject(params)
+	if awserr, ok := err.(awserr.Error); err != nil && ok {
+		log.Printf("AWS Error: %+v\n", awserr)
+	}
+	return err
+}
+
+func (s *s3Store) List(bucketName, prefix string) ([]string, error) {
+	var keys []string
+	err := s.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucketName),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.StringValue(obj.Key))
+		}
+		return true
+	})
+	if awserr, ok := err.(awserr.Error); err != nil && ok {
+		log.Printf("ListObjectsV2: AWS Error: %+v\n", awserr)
+	}
+	return keys, err
+}
+
+func (s *s3Store) URL(bucketName, key string) string {
+	if s.baseURL != "" {
+		return s.baseURL + "/" + bucketName + "/" + key
+	}
+	return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", bucketName, key)
+}
+
+func (s *s3Store) Key(bucketName, urlString string) (string, bool) {
+	if s.baseURL != "" {
+		prefix := s.baseURL + "/" + bucketName + "/"
+		if !strings.HasPrefix(urlString, prefix) || urlString == prefix {
+			return "", false
+		}
+		return strings.TrimPrefix(urlString, prefix), true
+	}
+	u, err := url.Parse(urlString)
+	if err != nil || u.Host != fmt.Sprintf("%s.s3.amazonaws.com", bucketName) {
+		return "", false
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	return key, key != ""
+}
@@ -0,0 +1,287 @@
+package potterylog
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The scheduler runs recurring maintenance jobs. Each run's start is
+// jittered by up to a tenth of the interval so that jobs don't all fire at
+// once, and a job that's still running when its next run comes due is
+// skipped rather than run twice. Replicas sharing a Postgres database each
+// schedule every job, so before a scheduled run a replica takes the job's
+// lease in the database, and skips the run if another replica holds it.
+// Every run is recorded in the database with its outcome and log, for
+// /admin/jobs.
+type job struct {
+	server   *Server
+	name     string
+	interval time.Duration
+	run      func(r *jobRun) error
+	// dryRun jobs can be run from /admin/jobs to log what they'd delete
+	// without deleting it
+	dryRun bool
+	// local jobs tidy up after this process alone, like its temp files,
+	// so every replica runs them without a lease
+	local bool
+
+	mu      sync.Mutex
+	running bool
+	last    *jobRun
+	nextRun time.Time
+}
+
+// jobRun is one run of a job
+type jobRun struct {
+	Job        string    `json:"job"`
+	Started    time.Time `json:"started"`
+	DurationMS int64     `json:"duration_ms"`
+	OK         bool      `json:"ok"`
+	Error      string    `json:"error,omitempty"`
+	Log        []string  `json:"log"`
+	// DryRun runs only report what they would delete
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// Logf writes to the server log and to the run's log
+func (r *jobRun) Logf(format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	log.Printf("Job %s: %s\n", r.Job, line)
+	r.Log = append(r.Log, line)
+}
+
+// scheduler is a server's jobs
+type scheduler struct {
+	server *Server
+	mu     sync.Mutex
+	jobs   []*job
+}
+
+var (
+	errJobRunning = newAPIError("job_running", "The job is already running")
+	errNoDryRun   = newAPIError("no_dry_run", "The job can't be dry run")
+)
+
+// Every registers a job. An interval of 0 disables the schedule, but the
+// job can still be run from /admin/jobs.
+func (s *scheduler) Every(name string, interval time.Duration, run func(r *jobRun) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, &job{server: s.server, name: name, interval: interval, run: run})
+}
+
+// EveryLocal registers a job that every replica runs for itself
+func (s *scheduler) EveryLocal(name string, interval time.Duration, run func(r *jobRun) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, &job{server: s.server, name: name, interval: interval, run: run, local: true})
+}
+
+// EveryDryRun registers a job that deletes things and checks r.DryRun, so
+// it can be dry run from /admin/jobs
+func (s *scheduler) EveryDryRun(name string, interval time.Duration, run func(r *jobRun) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, &job{server: s.server, name: name, interval: interval, run: run, dryRun: true})
+}
+
+// Start begins running every scheduled job
+func (s *scheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if j.interval > 0 {
+			go j.loop()
+		}
+	}
+}
+
+func (s *scheduler) find(name string) *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if j.name == name {
+			return j
+		}
+	}
+	return nil
+}
+
+func (j *job) loop() {
+	for {
+		wait := j.interval + time.Duration(rand.Int63n(int64(j.interval)/10+1))
+		j.mu.Lock()
+		j.nextRun = j.server.Clock.Now().Add(wait)
+		j.mu.Unlock()
+		time.Sleep(wait)
+		if !j.claim() {
+			continue
+		}
+		if err := j.start(false); err == errJobRunning {
+			log.Printf("Job %s is still running; skipping this run\n", j.name)
+			continue
+		}
+		// Held for an interval from the end of the run, so that a run
+		// that took a while isn't repeated by another replica
+		j.claim()
+	}
+}
+
+// claim takes the job's lease for an interval, reporting whether this
+// server holds it
+func (j *job) claim() bool {
+	if j.local {
+		return true
+	}
+	ok, err := j.server.ops.TakeJobLease(j.name, j.interval)
+	if err != nil {
+		log.Printf("Error taking the lease for job %s: %v\n", j.name, err)
+		return false
+	}
+	if !ok {
+		debugf("Job %s is leased to another server; skipping this run\n", j.name)
+	}
+	return ok
+}
+
+// start runs the job unless it's already running. Runs from /admin/jobs
+// start it directly, without the lease.
+func (j *job) start(dryRun bool) error {
+	j.mu.Lock()
+	if j.running {
+		j.mu.Unlock()
+		return errJobRunning
+	}
+	j.running = true
+	j.mu.Unlock()
+
+	r := &jobRun{Job: j.name, Started: j.server.Clock.Now(), DryRun: dryRun, Log: []string{}}
+	err := j.runSafely(r)
+	r.DurationMS = j.server.Clock.Now().Sub(r.Started).Milliseconds()
+	r.OK = err == nil
+	if err != nil {
+		r.Error = err.Error()
+		r.Logf("failed: %v", err)
+	}
+
+	j.mu.Lock()
+	j.running = false
+	j.last = r
+	j.mu.Unlock()
+	j.server.ops.JobRan(r)
+	j.server.logEvent("", JobEvent{Job: j.name, MS: r.DurationMS, OK: r.OK})
+	return nil
+}
+
+// runSafely runs the job, turning a panic into the run's error, so the
+// job isn't left marked running and the server keeps going
+func (j *job) runSafely(r *jobRun) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Job %s panicked: %v\n%s", j.name, p, debug.Stack())
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return j.run(r)
+}
+
+type jobStatus struct {
+	Name     string     `json:"name"`
+	Interval string     `json:"interval"`
+	Running  bool       `json:"running"`
+	DryRun   bool       `json:"dry_run"`
+	LastRun  *jobRun    `json:"last_run,omitempty"`
+	NextRun  *time.Time `json:"next_run,omitempty"`
+}
+
+func (j *job) status() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	st := jobStatus{Name: j.name, Interval: j.interval.String(), Running: j.running, DryRun: j.dryRun, LastRun: j.last}
+	if st.LastRun == nil {
+		// From before the last restart
+		if runs, err := j.server.ops.JobRuns(j.name, 1); err == nil && len(runs) > 0 {
+			st.LastRun = &runs[0]
+		}
+	}
+	if !j.nextRun.IsZero() {
+		nextRun := j.nextRun
+		st.NextRun = &nextRun
+	}
+	return st
+}
+
+// Jobs serves the admin view of the jobs:
+//
+//	GET /admin/jobs               every job's status and last run
+//	GET /admin/jobs/<name>        the job's recent runs, with logs
+//	POST /admin/jobs/<name>/run   runs the job now, in the background
+//	                              (with dryRun=true, only logs what it
+//	                              would delete)
+func (s *Server) Jobs(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/admin/jobs"), "/"), "/")
+	if parts[0] == "" {
+		s.jobs.mu.Lock()
+		all := append([]*job{}, s.jobs.jobs...)
+		s.jobs.mu.Unlock()
+		statuses := []jobStatus{}
+		for _, j := range all {
+			statuses = append(statuses, j.status())
+		}
+		writeJSON(w, struct {
+			Status string      `json:"status"`
+			Jobs   []jobStatus `json:"jobs"`
+		}{
+			Status: "ok",
+			Jobs:   statuses,
+		})
+		return
+	}
+
+	j := s.jobs.find(parts[0])
+	if j == nil {
+		s.handleErrCode(errNotFound, http.StatusNotFound, "", w)
+		return
+	}
+	switch {
+	case len(parts) == 1 && req.Method == http.MethodGet:
+		runs, err := j.server.ops.JobRuns(j.name, 20)
+		if s.handleErr(err, "", w) {
+			return
+		}
+		writeJSON(w, struct {
+			Status string    `json:"status"`
+			Job    jobStatus `json:"job"`
+			Runs   []jobRun  `json:"runs"`
+		}{
+			Status: "ok",
+			Job:    j.status(),
+			Runs:   runs,
+		})
+	case len(parts) == 2 && parts[1] == "run" && req.Method == http.MethodPost:
+		if !s.validateForm(w, req, dryRunField) {
+			return
+		}
+		dryRun := req.FormValue("dryRun") == "true"
+		if dryRun && !j.dryRun {
+			s.handleErrCode(errNoDryRun, http.StatusBadRequest, "", w)
+			return
+		}
+		if j.status().Running {
+			s.handleErrCode(errJobRunning, http.StatusConflict, "", w)
+			return
+		}
+		go j.start(dryRun)
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(okResponse())
+	default:
+		s.handleErrCode(errors.New("Use GET /admin/jobs/<name> or POST /admin/jobs/<name>/run"), http.StatusBadRequest, "", w)
+	}
+}
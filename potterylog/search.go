@@ -0,0 +1,110 @@
+package potterylog
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Search uses a full-text index of the pots in the ops database: FTS5 on
+// SQLite, and a weighted tsvector on Postgres. The pot store keeps it up
+// to date as pots are saved and deleted.
+
+// potDocument is what the search index holds for a pot
+type potDocument struct {
+	PotID  string
+	Title  string
+	Glaze  string
+	Clay   string
+	Status string
+	Notes  string
+	Years  string
+}
+
+func newPotDocument(p *pot) potDocument {
+	notes := make([]string, 0, len(p.Notes))
+	for _, note := range p.Notes {
+		notes = append(notes, note.Text)
+	}
+	years := []string{strconv.Itoa(p.Created.Year())}
+	for _, date := range p.Dates {
+		years = append(years, strconv.Itoa(date.Year()))
+	}
+	return potDocument{
+		PotID:  p.ID,
+		Title:  p.Title,
+		Glaze:  p.Glaze,
+		Clay:   p.Clay,
+		Status: p.Status,
+		Notes:  strings.Join(notes, "\n"),
+		Years:  strings.Join(years, " "),
+	}
+}
+
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// searchPots finds the library's pots with a word starting with every
+// word of the query, best match first
+func (s *Server) searchPots(library, query string) ([]*pot, error) {
+	terms := tokenize(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	ids, err := s.ops.SearchPots(library, terms)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	list, err := s.pots.List(library)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*pot, len(list))
+	for _, p := range list {
+		byID[p.ID] = p
+	}
+	results := make([]*pot, 0, len(ids))
+	for _, id := range ids {
+		if p, ok := byID[id]; ok {
+			results = append(results, p)
+		}
+	}
+	return results, nil
+}
+
+func (s *Server) Search(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField, required("q")) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	query := req.FormValue("q")
+	if !s.requireDevice(w, req, deviceID) {
+		return
+	}
+
+	library, ok := s.potLibrary(w, req, deviceID)
+	if !ok {
+		return
+	}
+
+	results, err := s.searchPots(library, query)
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+	if results == nil {
+		results = []*pot{}
+	}
+
+	writeJSON(w, struct {
+		Status string `json:"status"`
+		Pots   []*pot `json:"pots"`
+	}{
+		Status: "ok",
+		Pots:   results,
+	})
+	s.logEvent(deviceID, SearchEvent{Results: len(results)})
+}
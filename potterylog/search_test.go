@@ -0,0 +1,95 @@
+package potterylog
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func searchIDs(t *testing.T, h *testHarness, library, query string) []string {
+	t.Helper()
+	results, err := h.srv.searchPots(library, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, p := range results {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+func sameIDs(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSearchIndexFollowsPotStore(t *testing.T) {
+	h, err := newTestHarness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	for _, p := range []*pot{
+		{ID: "bowl", Title: "Tea bowl", Glaze: "Celadon"},
+		{ID: "vase", Title: "Celadon vase", Clay: "Porcelain"},
+		{ID: "mug", Title: "Mug", Notes: []potNote{{Text: "try celadon next time"}}},
+	} {
+		if _, err := h.srv.pots.Put("device1", p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := h.srv.pots.Put("device2", &pot{ID: "other", Title: "Celadon plate"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A title match ranks above a glaze match, which ranks above a note
+	if got, want := searchIDs(t, h, "device1", "cela"), []string{"vase", "bowl", "mug"}; !sameIDs(got, want) {
+		t.Errorf("search for cela: got %v, want %v", got, want)
+	}
+	if got, want := searchIDs(t, h, "device1", "celadon porc"), []string{"vase"}; !sameIDs(got, want) {
+		t.Errorf("every word has to match: got %v, want %v", got, want)
+	}
+	if got, want := searchIDs(t, h, "device1", h.Clock.Now().Format("2006")), []string{"bowl", "mug", "vase"}; len(got) != len(want) {
+		t.Errorf("search by year: got %v, want all of %v", got, want)
+	}
+
+	if _, err := h.srv.pots.Update("device1", "vase", func(p *pot) error {
+		p.Title = "Tall vase"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.srv.pots.Delete("device1", "mug"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := searchIDs(t, h, "device1", "celadon"), []string{"bowl"}; !sameIDs(got, want) {
+		t.Errorf("after an update and a delete: got %v, want %v", got, want)
+	}
+}
+
+func TestSearchIndexesExistingPots(t *testing.T) {
+	dir := t.TempDir()
+	// Pots saved before the index existed
+	store := NewPotStore(filepath.Join(dir, "pots"), newFakeClock(time.Now()))
+	if _, err := store.Put("device1", &pot{ID: "1", Title: "Shino jar"}); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := newTestHarness(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if got, want := searchIDs(t, h, "device1", "shino"), []string{"1"}; !sameIDs(got, want) {
+		t.Errorf("search after reindexing: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,209 @@
+package potterylog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+)
+
+// runSelfCheck looks for configuration problems on startup, so they show
+// up in the log when the server starts instead of when the first user hits
+// Upload. Problems that would break every request of some kind are errors,
+// and the server won't start with them. The rest are warnings.
+func (s *Server) runSelfCheck(amplitudeAPIKey string) error {
+	c := &selfCheck{server: s}
+	c.checkDirs()
+	c.checkBuckets()
+	c.checkAmplitudeKeys(amplitudeAPIKey)
+	c.checkAttestation(s.config().Attestation)
+	c.checkObjectURLs(s.config().ObjectURLs)
+	for _, t := range s.tenants() {
+		for _, n := range s.notifiersFor(t) {
+			c.checkNotifier(n)
+		}
+	}
+	if c.errors > 0 {
+		return fmt.Errorf("%d configuration errors, listed above", c.errors)
+	}
+	return nil
+}
+
+type selfCheck struct {
+	server *Server
+	errors int
+}
+
+func (c *selfCheck) errorf(format string, args ...interface{}) {
+	c.errors++
+	log.Printf("Config error: "+format+"\n", args...)
+}
+
+func (c *selfCheck) warnf(format string, args ...interface{}) {
+	log.Printf("Config warning: "+format+"\n", args...)
+}
+
+// checkDirs makes sure the server can write where it keeps data and builds
+// exports
+func (c *selfCheck) checkDirs() {
+	for _, dir := range []string{c.server.dataDir, c.server.Exports.tempDir} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			c.errorf("can't create %s: %v", dir, err)
+			continue
+		}
+		f, err := ioutil.TempFile(dir, "self-check-*")
+		if err != nil {
+			c.errorf("can't write to %s: %v", dir, err)
+			continue
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+	if free, err := freeDiskSpace(c.server.Exports.tempDir); err == nil && free < importDiskMargin {
+		c.warnf("only %s free in %s, so exports and imports will fail", formatBytes(free), c.server.Exports.tempDir)
+	}
+	if staticDir != "" {
+		if info, err := os.Stat(staticDir); err != nil || !info.IsDir() {
+			c.errorf("-static_dir %s isn't a directory", staticDir)
+		}
+	}
+}
+
+// selfCheckKey is written and deleted in each bucket
+const selfCheckKey = ".pottery-log-self-check"
+
+// checkBuckets writes, reads, and deletes an object in every bucket, and
+// on AWS checks the buckets' ACL settings
+func (c *selfCheck) checkBuckets() {
+	s := c.server
+	for bucketName := range s.configuredBuckets() {
+		if err := s.Storage.Put(bucketName, selfCheckKey, bytes.NewReader([]byte("ok")), "text/plain"); err != nil {
+			c.errorf("can't upload to bucket %s: %v", bucketName, err)
+			continue
+		}
+		if _, err := s.Storage.Head(bucketName, selfCheckKey); err != nil {
+			c.errorf("can't read from bucket %s: %v", bucketName, err)
+		}
+		if err := s.Storage.Delete(bucketName, selfCheckKey); err != nil {
+			c.warnf("can't delete from bucket %s, so users can't delete images or exports: %v", bucketName, err)
+		}
+	}
+	if store, ok := s.Storage.(*s3Store); ok && store.baseURL == "" {
+		if err := store.checkBucketACLs(s.configuredBuckets()); err != nil {
+			c.errorf("%v", err)
+		}
+	}
+}
+
+// Amplitude API keys are 32 hex digits
+var amplitudeKeyPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+func (c *selfCheck) checkAmplitudeKeys(apiKey string) {
+	if apiKey != "" && !amplitudeKeyPattern.MatchString(apiKey) {
+		c.warnf("-api_key doesn't look like an Amplitude API key, so analytics may be rejected")
+	}
+	for _, t := range c.server.config().Tenants {
+		if t.AmplitudeAPIKey != "" && !amplitudeKeyPattern.MatchString(t.AmplitudeAPIKey) {
+			c.warnf("tenant %s's amplitude_api_key doesn't look like an Amplitude API key", t.Name)
+		}
+	}
+}
+
+func (c *selfCheck) checkAttestation(ac attestationConfig) {
+	switch ac.Mode {
+	case "", "off":
+		return
+	case "log", "enforce":
+	default:
+		c.errorf("attestation mode %q must be off, log, or enforce", ac.Mode)
+		return
+	}
+	if ac.GoogleServiceAccount == "" && ac.ApplePrivateKey == "" {
+		c.warnf("attestation is on, but without google_service_account or apple_private_key it can't check anything")
+	}
+	if ac.GoogleServiceAccount != "" {
+		c.checkServiceAccount("attestation", ac.GoogleServiceAccount)
+	}
+	if ac.ApplePrivateKey != "" {
+		c.checkPrivateKey("attestation", ac.ApplePrivateKey)
+	}
+}
+
+func (c *selfCheck) checkObjectURLs(oc objectURLConfig) {
+	switch oc.Mode {
+	case objectURLsProxy:
+		if c.server.publicURL == "" {
+			c.warnf("object_urls mode proxy without -public_url gives the app URLs relative to the server")
+		}
+	case objectURLsCDN:
+		for bucketName := range c.server.configuredBuckets() {
+			if _, ok := oc.CDNBaseURLs[bucketName]; !ok {
+				c.warnf("object_urls has no cdn_base_urls for bucket %s, so its objects get public URLs", bucketName)
+			}
+		}
+	}
+}
+
+func (c *selfCheck) checkNotifier(n notifierConfig) {
+	if _, err := newNotifier(n, c.server.ops); err != nil {
+		c.errorf("notifiers: %v", err)
+		return
+	}
+	switch n.Type {
+	case "webhook":
+		if u, err := url.Parse(n.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			c.errorf("notifiers: webhook_url %q isn't an http(s) URL", n.WebhookURL)
+		}
+	case "email":
+		if !n.smtpConfig.configured() {
+			c.errorf("notifiers: an email notifier needs email_to and smtp_addr")
+		}
+	case "fcm":
+		if n.FirebaseProject == "" {
+			c.errorf("notifiers: an fcm notifier needs firebase_project")
+		}
+		c.checkServiceAccount("notifiers", n.GoogleServiceAccount)
+	case "apns":
+		if n.AppleTeamID == "" || n.AppleKeyID == "" || n.AppleBundleID == "" {
+			c.errorf("notifiers: an apns notifier needs apple_team_id, apple_key_id, and apple_bundle_id")
+		}
+		c.checkPrivateKey("notifiers", n.ApplePrivateKey)
+	}
+}
+
+// checkServiceAccount makes sure a Google service account key file can be
+// read and has a usable key
+func (c *selfCheck) checkServiceAccount(section, file string) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		c.errorf("%s: can't read the Google service account file: %v", section, err)
+		return
+	}
+	var account struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+	}
+	if err := json.Unmarshal(data, &account); err != nil || account.ClientEmail == "" {
+		c.errorf("%s: %s isn't a Google service account key file", section, file)
+		return
+	}
+	if _, err := parsePrivateKey([]byte(account.PrivateKey)); err != nil {
+		c.errorf("%s: the key in %s can't be used: %v", section, file, err)
+	}
+}
+
+// checkPrivateKey makes sure a .p8 key file can be read and parsed
+func (c *selfCheck) checkPrivateKey(section, file string) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		c.errorf("%s: can't read the Apple private key: %v", section, err)
+		return
+	}
+	if _, err := parsePrivateKey(data); err != nil {
+		c.errorf("%s: the key in %s can't be used: %v", section, file, err)
+	}
+}
@@ -0,0 +1,120 @@
+package potterylog
+
+import (
+	"sync"
+	"time"
+)
+
+// semaphore counts slots in use. The limit is passed on each Acquire so it
+// follows the current config.
+type semaphore struct {
+	mu      sync.Mutex
+	inUse   int
+	waiting int
+	// freed is closed (and replaced) whenever a slot is released
+	freed chan struct{}
+}
+
+func newSemaphore() *semaphore {
+	return &semaphore{
+		mu:    sync.Mutex{},
+		freed: make(chan struct{}),
+	}
+}
+
+// Acquire takes a slot, waiting up to wait for one to free up. A limit of 0
+// or less means unlimited.
+func (s *semaphore) Acquire(limit int, wait time.Duration) bool {
+	return s.AcquireQueued(limit, -1, wait)
+}
+
+// AcquireQueued is Acquire with at most maxWaiting callers waiting for a
+// slot. Past that it fails without waiting. A maxWaiting below 0 means no
+// limit.
+func (s *semaphore) AcquireQueued(limit, maxWaiting int, wait time.Duration) bool {
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	queued := false
+	defer func() {
+		if queued {
+			s.mu.Lock()
+			s.waiting--
+			s.mu.Unlock()
+		}
+	}()
+	for {
+		s.mu.Lock()
+		if limit <= 0 || s.inUse < limit {
+			s.inUse++
+			s.mu.Unlock()
+			return true
+		}
+		if !queued {
+			if maxWaiting >= 0 && s.waiting >= maxWaiting {
+				s.mu.Unlock()
+				return false
+			}
+			s.waiting++
+			queued = true
+		}
+		freed := s.freed
+		s.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-timeout.C:
+			return false
+		}
+	}
+}
+
+func (s *semaphore) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inUse--
+	close(s.freed)
+	s.freed = make(chan struct{})
+}
+
+func (s *semaphore) InUse() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inUse
+}
+
+func (s *semaphore) Waiting() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.waiting
+}
+
+// semaphoreSet is a semaphore for each name, made when it's first used
+type semaphoreSet struct {
+	mu     sync.Mutex
+	byName map[string]*semaphore
+}
+
+func newSemaphoreSet() *semaphoreSet {
+	return &semaphoreSet{byName: make(map[string]*semaphore)}
+}
+
+// Get is name's semaphore
+func (s *semaphoreSet) Get(name string) *semaphore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sem, ok := s.byName[name]
+	if !ok {
+		sem = newSemaphore()
+		s.byName[name] = sem
+	}
+	return sem
+}
+
+// Each calls f with each semaphore made so far
+func (s *semaphoreSet) Each(f func(name string, sem *semaphore)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, sem := range s.byName {
+		f(name, sem)
+	}
+}
@@ -0,0 +1,1077 @@
+package potterylog
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultDataDir is where a server keeps its data unless told otherwise:
+// pottery-log in $XDG_STATE_HOME, or else in ~/.local/state. It's "" when
+// there's no home directory, and then -data_dir has to be given.
+func defaultDataDir() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "pottery-log")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".local", "state", "pottery-log")
+}
+
+// Server is the public and admin APIs, with the state they share. main
+// builds one from flags; a test harness or another program can fill in
+// its fields with something else before calling Handler.
+type Server struct {
+	Storage Storage
+	// Exports are the exports in progress, made by NewExports with Clock
+	Exports *exports
+	// Events receives analytics events, normally queued for Amplitude
+	Events EventSink
+	Clock  Clock
+	// Settings is the starting config, which -config reloads replace
+	Settings *config
+
+	// dataDir holds the stores, and formSpillDir is upload-tmp under it
+	// once setFormSpillDir is called
+	dataDir      string
+	formSpillDir string
+	// publicURL is where the server is reachable, e.g.
+	// https://example.com. If empty, share links use the request's Host and
+	// proxied object URLs are relative.
+	publicURL string
+	// configPath is the config file, reread on SIGHUP or
+	// /admin/reload-config
+	configPath string
+	// adminToken is the -admin_token flag, an admin credential outside the
+	// config
+	adminToken string
+	// maintenanceMode is 1 while mutating endpoints are turned away, with
+	// maintenanceMessage unless the config has one
+	maintenanceMode    int32
+	maintenanceMessage string
+	// ops is the database, and the rest are the stores kept in dataDir,
+	// all opened by openStores
+	ops             *opsDB
+	pots            *potStore
+	metadataHistory *metadataStore
+	deviceTokens    *deviceTokenStore
+	studios         *studioStore
+	shares          *shareStore
+	identities      *identityStore
+	deviceTenants   *deviceTenantStore
+	blocks          *blockStore
+	serverExported  serverExportVersions
+
+	counters *counterSet
+	// amplitude is the queue Events sends to unless it's replaced
+	amplitude *amplitudeQueue
+	memory    *memoryBudget
+	uploads   *uploadPipeline
+	// uploadSlots are by tenant name, and endpointSlots by path
+	uploadSlots   *semaphoreSet
+	endpointSlots *semaphoreSet
+	largeUploads  *largeUploadSet
+	// portfolioBuilds caps the portfolios being made at once, and
+	// imageWebhookSlots the image webhook deliveries, so a large import
+	// doesn't open a connection to the backup for every image
+	portfolioBuilds   *semaphore
+	imageWebhookSlots chan struct{}
+	// These are kept in memory only, like the blocklist's strikes
+	attested      attestationCache
+	importVolume  importVolumes
+	apiKeyLimiter apiKeyBuckets
+	errorAlerts   errorAlertLimit
+	manifests     manifestCache
+	verifier      verifyResults
+	// summaryErrors is the server-error count at the last usage summary
+	summaryErrors struct {
+		mu   sync.Mutex
+		last int64
+	}
+
+	configMu sync.Mutex
+	jobs     *scheduler
+}
+
+// NewServer makes a server that uses S3 and Amplitude, with the default
+// config
+func NewServer() *Server {
+	c, _ := loadConfig("")
+	clock := systemClock{}
+	counters := NewCounters()
+	amplitude := newAmplitudeQueue(counters)
+	s := &Server{
+		Exports:   NewExports(clock),
+		Events:    amplitude,
+		Clock:     clock,
+		Settings:  c,
+		counters:  counters,
+		amplitude: amplitude,
+		dataDir:   defaultDataDir(),
+
+		maintenanceMessage: defaultMaintenanceMessage,
+		memory:             newMemoryBudget(counters),
+		uploads:            newUploadPipeline(),
+		uploadSlots:        newSemaphoreSet(),
+		endpointSlots:      newSemaphoreSet(),
+		largeUploads:       newLargeUploadSet(),
+		portfolioBuilds:    newSemaphore(),
+		imageWebhookSlots:  make(chan struct{}, 4),
+	}
+	s.serverExported.versions = make(map[string]string)
+	s.attested.devices = make(map[string]time.Time)
+	s.importVolume.recent = make(map[string][]importDownload)
+	s.importVolume.alerted = make(map[string]time.Time)
+	s.apiKeyLimiter.buckets = make(map[string]*apiKeyBucket)
+	s.Storage = newS3Store(s.objectACL)
+	s.jobs = &scheduler{server: s}
+	return s
+}
+
+// config is s's current config
+func (s *Server) config() *config {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	return s.Settings
+}
+
+func (s *Server) setConfig(c *config) {
+	s.configMu.Lock()
+	s.Settings = c
+	s.configMu.Unlock()
+	s.applyConfig(c)
+}
+
+func okResponse() []byte {
+	return []byte("{\"status\": \"ok\"}")
+}
+func writeJSON(w http.ResponseWriter, obj interface{}) {
+	respStr, err := json.Marshal(obj)
+	if err != nil {
+		log.Printf("Error during JSON marshal: %v\n", err)
+		return
+	}
+	w.Write([]byte(respStr))
+}
+
+// true if there was an error that we handled
+func (s *Server) handleErr(err error, deviceID string, w http.ResponseWriter) bool {
+	return s.handleErrCode(err, http.StatusInternalServerError, deviceID, w)
+}
+
+// handleErrCode is handleErr with a specific HTTP status
+func (s *Server) handleErrCode(err error, code int, deviceID string, w http.ResponseWriter) bool {
+	if err != nil {
+		requestID := w.Header().Get(requestIDHeader)
+		log.Printf("Error (request %s): %v\n", requestID, err.Error())
+		s.counters.Incr("errors." + errorType(err))
+		s.logEvent(deviceID, ErrorEvent{Message: err.Error(), RequestID: requestID})
+		if code >= 500 {
+			s.alertError(err, requestID)
+		}
+		err = publicError(err, code)
+		w.WriteHeader(code)
+		writeJSON(w, struct {
+			Status       string            `json:"status"`
+			Code         string            `json:"code"`
+			Message      string            `json:"message"`
+			Translations map[string]string `json:"translations,omitempty"`
+			RequestID    string            `json:"request_id,omitempty"`
+			Version      string            `json:"version"`
+		}{
+			Status:       "error",
+			Code:         errorCode(err, code),
+			Message:      err.Error(),
+			Translations: translations(err),
+			RequestID:    requestID,
+			Version:      version,
+		})
+		return true
+	}
+	return false
+}
+
+// tooBusy asks the client to retry later
+func (s *Server) tooBusy(w http.ResponseWriter, err error, deviceID string, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	s.handleErrCode(err, http.StatusTooManyRequests, deviceID, w)
+}
+
+var onConflictField = field{Name: "onConflict", Pattern: onConflictPattern}
+
+func (s *Server) Upload(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField, onConflictField, imagePotIDField, imageCapturedAtField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	conditional := req.Header.Get("If-None-Match") != ""
+	var fileName string
+	if conditional {
+		// The stored image didn't match (see conditional), so this
+		// replaces it
+		var ok bool
+		if deviceID, fileName, ok = s.conditionalTarget(w, req); !ok {
+			return
+		}
+	}
+	t := requestTenant(req)
+	imageFile, imageFileHeader, err := formFile(req, "image")
+	if imageFile == nil {
+		s.handleErrCode(errMissingField("image"), http.StatusBadRequest, deviceID, w)
+		return
+	}
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+
+	item := newUploadItem(imageFile, imageFileHeader, t.imageBucket(), deviceID)
+	item.FailOnConflict = req.FormValue("onConflict") == "error"
+	if conditional {
+		item.FileName = fileName
+		item.Replace = true
+	}
+	if !s.imageItemFields(w, req, item) {
+		return
+	}
+	err = s.withUploadSlot(t, func() error {
+		_, err := s.uploads.Run(s, item)
+		return err
+	})
+	if err == errUploadsBusy {
+		s.logEvent(deviceID, UploadBusyEvent)
+		s.tooBusy(w, err, deviceID, 30*time.Second)
+		return
+	}
+	if err == errFileNameTaken {
+		s.handleErrCode(err, http.StatusConflict, deviceID, w)
+		return
+	}
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+
+	writeUploadedImage(w, item)
+	s.logEvent(deviceID, UploadEvent{Bytes: imageFileHeader.Size, ContentType: imageFileHeader.Header.Get("Content-Type")})
+	s.ops.AddUsage(t, deviceID, "uploads", 1)
+	s.ops.AddUsage(t, deviceID, "upload_bytes", imageFileHeader.Size)
+	s.warnQuota(t, deviceID)
+}
+
+// writeUploadedImage responds with the image as stored. The file name and
+// type can differ from what was sent, for instance after recompression.
+func writeUploadedImage(w http.ResponseWriter, item *uploadItem) {
+	w.Header().Set("ETag", `"`+item.ETag+`"`)
+	writeJSON(w, struct {
+		Status      string `json:"status"`
+		URI         string `json:"uri"`
+		Key         string `json:"key"`
+		FileName    string `json:"fileName"`
+		ContentType string `json:"content_type"`
+		Bytes       int64  `json:"bytes"`
+		Width       int    `json:"width"`
+		Height      int    `json:"height"`
+		ETag        string `json:"etag"`
+	}{
+		Status:      "ok",
+		URI:         item.URI,
+		Key:         item.Key,
+		FileName:    item.FileName,
+		ContentType: item.ContentType,
+		Bytes:       item.Size,
+		Width:       item.Width,
+		Height:      item.Height,
+		ETag:        item.ETag,
+	})
+}
+
+// Delete removes an uploaded image. With dryRun=true it only reports the
+// keys it would delete.
+func (s *Server) Delete(w http.ResponseWriter, req *http.Request) {
+	// Older clients don't send a deviceId
+	if !s.validateForm(w, req, uriField, optional(deviceIDField), imageFileNameField, dryRunField) {
+		return
+	}
+	uri := req.FormValue("uri")
+	deviceID := req.FormValue("deviceId")
+	// A content-addressed image may have several of the device's names,
+	// of which only this one is deleted
+	name := req.FormValue("fileName")
+	t := requestTenant(req)
+	bucketName := t.imageBucket()
+	fileName, ok := s.objectKey(bucketName, uri)
+	if !ok {
+		// Images restored by an import are in the import bucket
+		bucketName = t.importBucket()
+		fileName, ok = s.objectKey(bucketName, uri)
+	}
+	if !ok {
+		s.handleErrCode(newAPIError("invalid_uri", "Can't parse uri "+uri), http.StatusBadRequest, deviceID, w)
+		return
+	}
+
+	dryRun := req.FormValue("dryRun") == "true"
+	deleted := func() {}
+	if !dryRun {
+		deleted = s.imageDeleting(deviceID, bucketName, fileName, name)
+	}
+	keys, err := s.deleteImageRef(bucketName, deviceID, fileName, name, dryRun)
+	if err == errAmbiguousImage {
+		s.handleErrCode(err, http.StatusConflict, deviceID, w)
+		return
+	}
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+	if dryRun {
+		for _, key := range keys {
+			log.Printf("Dry run: would delete %s/%s\n", bucketName, key)
+		}
+		writeJSON(w, struct {
+			Status string   `json:"status"`
+			DryRun bool     `json:"dry_run"`
+			Keys   []string `json:"keys"`
+		}{
+			Status: "ok",
+			DryRun: true,
+			Keys:   keys,
+		})
+		return
+	}
+
+	deleted()
+	s.logEvent(deviceID, DeleteEvent)
+	w.Write(okResponse())
+}
+
+func (s *Server) StartExport(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField, required("metadata")) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	metadata := req.FormValue("metadata")
+	t := requestTenant(req)
+
+	// Images that are already uploaded can be copied into the export
+	// server-side instead of being sent again with ExportImage.
+	var imageKeys []string
+	if keysJSON := req.FormValue("imageKeys"); keysJSON != "" {
+		if err := json.Unmarshal([]byte(keysJSON), &imageKeys); err != nil {
+			s.handleErrCode(errors.New("imageKeys must be a JSON list"), http.StatusBadRequest, deviceID, w)
+			return
+		}
+	}
+	for i, key := range imageKeys {
+		var err error
+		imageKeys[i], err = s.imageKey(t.imageBucket(), key, deviceID)
+		if s.handleErrCode(err, http.StatusBadRequest, deviceID, w) {
+			return
+		}
+	}
+
+	exp, err := s.Exports.Start(s.config(), t, deviceID, metadata)
+	if err == errExportsBusy {
+		s.logEvent(deviceID, ExportBusyEvent)
+		s.tooBusy(w, err, deviceID, 5*time.Minute)
+		return
+	}
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+
+	for _, key := range imageKeys {
+		err := exp.AddObject(s.Storage, t.imageBucket(), key, s.imageName(t.imageBucket(), deviceID, key))
+		if err != nil {
+			// Nothing can finish it, so it shouldn't hold a slot until it's
+			// abandoned
+			s.Exports.Discard(exp, "failed")
+			s.handleErr(err, deviceID, w)
+			return
+		}
+	}
+
+	s.logEvent(deviceID, StartExportEvent{CopiedImages: len(imageKeys)})
+	writeJSON(w, struct {
+		Status       string `json:"status"`
+		ExportID     string `json:"export_id"`
+		CopiedImages int    `json:"copied_images"`
+	}{
+		Status:       "ok",
+		ExportID:     exp.id,
+		CopiedImages: len(imageKeys),
+	})
+}
+
+func (s *Server) FinishExport(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField, exportIDField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	exp := s.Exports.Get(deviceID, req.FormValue("exportId"))
+	if exp == nil {
+		// A direct export's download may be retried or resumed, by the
+		// device whose export it is, as with ExportDownload
+		if d, file := s.Exports.finishedExportDownload(deviceID, req.FormValue("exportId")); d != nil {
+			defer file.Close()
+			if !s.requireDevice(w, req, deviceID) {
+				return
+			}
+			serveExportDownload(w, req, d, file)
+			return
+		}
+		s.handleErr(errNoExport, deviceID, w)
+		return
+	}
+
+	s.Exports.Remove(exp)
+
+	zipFile, err := exp.Finish()
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+	defer zipFile.Close()
+
+	direct := s.config().ExportDelivery == exportDeliveryDirect
+	fileName := s.exportZipName("pottery_log_export_", exp.id)
+	var uri string
+	if direct {
+		uri = s.exportDownloadURI(req, deviceID, exp.id)
+	} else {
+		err = exp.phases.Time("upload", func() (err error) {
+			uri, err = s.uploadMultipart(requestTenant(req).importBucket(), zipFile, fileName, "application/zip", deviceID)
+			return err
+		})
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+	}
+
+	var size int64
+	if fileStat, err := zipFile.Stat(); err == nil {
+		size = fileStat.Size()
+	}
+	var manifestHash string
+	if r, err := zip.NewReader(zipFile, size); err == nil {
+		manifestHash = archiveManifestHash(r)
+	}
+	historyID := s.ops.ExportFinished(requestTenant(req), deviceID, "app", s.storedURL(requestTenant(req).importBucket(), uri), size)
+
+	if direct {
+		d := &exportDownload{
+			HistoryID:      historyID,
+			URI:            uri,
+			Images:         exp.images,
+			SHA256:         exp.SHA256(),
+			ManifestSHA256: manifestHash,
+			FinishedAt:     s.Clock.Now().UTC().Truncate(time.Second),
+		}
+		if s.handleErr(s.Exports.keepExportDownload(exp, d), deviceID, w) {
+			return
+		}
+		serveExportDownload(w, req, d, zipFile)
+	} else {
+		writeJSON(w, struct {
+			Status         string     `json:"status"`
+			URI            string     `json:"uri"`
+			ID             string     `json:"id"`
+			Images         int        `json:"images"`
+			Bytes          int64      `json:"bytes"`
+			SHA256         string     `json:"sha256"`
+			ManifestSHA256 string     `json:"manifest_sha256"`
+			ExpiresAt      *time.Time `json:"expires_at"`
+		}{
+			Status:         "ok",
+			URI:            uri,
+			ID:             historyID,
+			Images:         exp.images,
+			Bytes:          size,
+			SHA256:         exp.SHA256(),
+			ManifestSHA256: manifestHash,
+			ExpiresAt:      s.exportExpiry(s.Clock.Now()),
+		})
+	}
+
+	s.logEvent(deviceID, ExportFinishedEvent{
+		Bytes:    size,
+		Images:   exp.images,
+		Duration: millis(s.Clock.Now().Sub(exp.started)),
+		Phases:   exp.phases.Millis(),
+	})
+	exp.phases.Record(s.counters, "server-finish-export")
+	s.counters.Add("server-finish-export-bytes", size)
+	s.ops.AddUsage(requestTenant(req), deviceID, "exports", 1)
+	go s.notify(exportFinishedNotification(deviceID, "app", uri, size))
+}
+
+func (s *Server) ExportImage(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField, exportIDField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	imageFile, imageFileHeader, err := formFile(req, "image")
+	if imageFile == nil {
+		s.handleErrCode(errMissingField("image"), http.StatusBadRequest, deviceID, w)
+		return
+	}
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+	defer imageFile.Close()
+
+	exp := s.Exports.Get(deviceID, req.FormValue("exportId"))
+	if exp == nil {
+		s.handleErr(errNoExport, deviceID, w)
+		return
+	}
+
+	entry, err := exp.AddImage(imageFile, imageFileHeader)
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+
+	writeJSON(w, struct {
+		Status string `json:"status"`
+		exportEntry
+	}{
+		Status:      "ok",
+		exportEntry: entry,
+	})
+	s.logEvent(deviceID, ExportImageEvent)
+}
+
+// ExportContents lists the images an export in progress has received
+func (s *Server) ExportContents(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField, exportIDField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	exp := s.Exports.Get(deviceID, req.FormValue("exportId"))
+	if exp == nil {
+		s.handleErr(errNoExport, deviceID, w)
+		return
+	}
+	writeJSON(w, struct {
+		Status   string        `json:"status"`
+		ExportID string        `json:"export_id"`
+		Images   []exportEntry `json:"images"`
+	}{
+		Status:   "ok",
+		ExportID: exp.id,
+		Images:   exp.Contents(),
+	})
+}
+
+func (s *Server) Import(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField, importURLField, exportHistoryIDField, importModeField, importSourceField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	t := requestTenant(req)
+	url := req.FormValue("importURL")
+	// Exports from other apps (legacyimport.go) are uploaded
+	source := req.FormValue("source")
+	legacy := source != "" && source != importSourcePotteryLog
+	// keptFile is a direct export to restore from the export temp directory
+	var keptFile string
+	if historyID := req.FormValue("exportHistoryId"); historyID != "" {
+		// Restoring a stored export hands back the device's own data, so it
+		// needs the device's token
+		if !s.requireDevice(w, req, deviceID) {
+			return
+		}
+		var err error
+		url, err = s.exportHistoryURI(deviceID, historyID)
+		if err == errNoSuchExport {
+			s.handleErrCode(err, http.StatusNotFound, deviceID, w)
+			return
+		}
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		keptFile, _ = s.Exports.keptExportDownload(deviceID, url)
+	}
+	zipFile, zipFileHeader, err := formFile(req, "import")
+	if url == "" && zipFile == nil {
+		s.handleErrCode(errMissingField("importURL", "import", "exportHistoryId"), http.StatusBadRequest, deviceID, w)
+		return
+	}
+	if url == "" && s.handleErr(err, deviceID, w) {
+		return
+	}
+	if legacy && zipFile == nil {
+		s.handleErrCode(errMissingField("import"), http.StatusBadRequest, deviceID, w)
+		return
+	}
+	merging := req.FormValue("mode") == importModeMerge
+	var current []byte
+	if merging {
+		var ok bool
+		if current, ok = s.currentImportMetadata(w, req, deviceID); !ok {
+			return
+		}
+	}
+	started := s.Clock.Now()
+	phases := newPhaseTimes()
+	var size int64
+	var r *zip.Reader
+	var fileErrors []importFileError
+	// Both branches assign `r`
+	if url != "" && !legacy {
+		localFile := keptFile
+		if localFile == "" {
+			// Download from URL
+			timeMS := s.Clock.Now().UnixMilli()
+			localFile = filepath.Join(s.Exports.tempDir, fmt.Sprintf("import-%s-%d.zip", deviceID, timeMS))
+			err := phases.Time("download", func() error {
+				return s.downloadImport(req.Context(), t, url, localFile, deviceID, clientIP(req))
+			})
+			if s.handleErrCode(err, downloadImportStatus(err), deviceID, w) {
+				log.Println("Error in downloadImport")
+				return
+			}
+			defer os.Remove(localFile)
+		}
+		rc, err := zip.OpenReader(localFile)
+		if s.handleErr(err, deviceID, w) {
+			log.Println("Error in zip.OpenReader")
+			return
+		}
+		r = &rc.Reader
+		defer rc.Close()
+		if stat, err := os.Stat(localFile); err == nil {
+			size = stat.Size()
+		}
+	} else {
+		// Zip file was uploaded
+		defer zipFile.Close()
+		size = zipFileHeader.Size
+
+		if legacy {
+			converted, missing, err := s.convertLegacyImport(source, zipFile, size)
+			if err == errMemoryBusy {
+				s.tooBusy(w, err, deviceID, 30*time.Second)
+				return
+			}
+			if s.handleErrCode(err, legacyImportStatus(err), deviceID, w) {
+				return
+			}
+			defer os.Remove(converted.Name())
+			defer converted.Close()
+			fileErrors = missing
+			info, err := converted.Stat()
+			if s.handleErr(err, deviceID, w) {
+				return
+			}
+			r, err = zip.NewReader(converted, info.Size())
+		} else {
+			r, err = zip.NewReader(zipFile, zipFileHeader.Size)
+		}
+		if s.handleErr(err, deviceID, w) {
+			log.Println("Error in zip.NewReader")
+			return
+		}
+	}
+
+	// A retry of an import that already finished gets the same result
+	// without uploading every image again
+	archiveHash := archiveManifestHash(r)
+	if cached, ok := s.ops.ImportResult(deviceID, archiveHash); ok {
+		var resp importResponse
+		if err := json.Unmarshal(cached, &resp); err == nil {
+			resp.Cached = true
+			if merging && !resp.merge(s, w, current, deviceID) {
+				return
+			}
+			writeJSON(w, resp)
+			s.logEvent(deviceID, ImportEvent{
+				Bytes:    size,
+				Images:   len(resp.ImageMap),
+				Duration: millis(s.Clock.Now().Sub(started)),
+				Cached:   true,
+			})
+			return
+		}
+	}
+
+	imageMap := make(map[string]string)
+	skipped := 0
+	var metadata []byte
+	for _, f := range r.File {
+		if f.Name == metadataFileName {
+			err := phases.Time("extract", func() error {
+				metadataFile, err := f.Open()
+				if err != nil {
+					log.Println("Error in opening the metadata file")
+					return err
+				}
+				metadata, err = ioutil.ReadAll(metadataFile)
+				return err
+			})
+			if s.handleErr(err, deviceID, w) {
+				log.Println("Error in reading the metadata file")
+				return
+			}
+		} else {
+			// Image file
+			var uri string
+			phases.Time("check", func() error {
+				uri = s.importedImageURI(f, t.importBucket(), deviceID)
+				return nil
+			})
+			if uri != "" {
+				debugf("Skipping image file %v, already stored\n", f.FileHeader.Name)
+				imageMap[f.Name] = uri
+				skipped++
+				continue
+			}
+			debugf("uploading image file %v\n", f.FileHeader.Name)
+			err := s.withUploadSlot(t, func() (err error) {
+				uri, err = s.uploadImportedImage(f, t.importBucket(), deviceID, phases)
+				return err
+			})
+			if err == errUploadsBusy {
+				s.logEvent(deviceID, UploadBusyEvent)
+				s.tooBusy(w, err, deviceID, 30*time.Second)
+				return
+			}
+			if err == errMemoryBusy {
+				s.tooBusy(w, err, deviceID, 30*time.Second)
+				return
+			}
+			if errors.Is(err, errCorruptImage) {
+				// Restore what can be restored
+				log.Printf("Skipping damaged image %v in an import: %v\n", f.FileHeader.Name, err)
+				fileErrors = append(fileErrors, importFileError{
+					Name:    f.Name,
+					Code:    errCorruptImage.Code,
+					Message: errCorruptImage.Message,
+				})
+				continue
+			}
+			if s.handleErr(err, deviceID, w) {
+				log.Printf("Error uploading image %v\n", f.FileHeader.Name)
+				return
+			}
+			imageMap[f.Name] = uri
+		}
+	}
+
+	if metadata == nil {
+		s.handleErr(errNoMetadata, deviceID, w)
+		return
+	}
+
+	resp := importResponse{
+		Status:   "ok",
+		Metadata: string(metadata),
+		ImageMap: imageMap,
+		Skipped:  skipped,
+		Errors:   fileErrors,
+	}
+	// A retry should try the failed images again. The archive's own
+	// metadata is remembered, so a retry can merge it or not.
+	if len(fileErrors) == 0 {
+		if data, err := json.Marshal(resp); err == nil {
+			s.ops.SaveImportResult(deviceID, archiveHash, data)
+		}
+	}
+	if merging && !resp.merge(s, w, current, deviceID) {
+		return
+	}
+	writeJSON(w, resp)
+	s.logEvent(deviceID, ImportEvent{
+		Bytes:    size,
+		Images:   len(imageMap),
+		Skipped:  skipped,
+		Failed:   len(fileErrors),
+		Duration: millis(s.Clock.Now().Sub(started)),
+		Phases:   phases.Millis(),
+	})
+	phases.Record(s.counters, "server-import")
+	s.counters.Add("server-import-bytes", size)
+	s.ops.AddUsage(t, deviceID, "imports", 1)
+}
+
+// Main runs the standalone server, configured by flags
+func Main() {
+	if len(os.Args) > 1 && os.Args[1] == "init-storage" {
+		initStorage(os.Args[2:])
+		return
+	}
+	port := flag.Int("port", 9292, "port to listen on")
+	listenAddr := flag.String("listen", "", "address to listen on, like 127.0.0.1:9292 or unix:///run/pottery-log.sock (default: all interfaces on -port)")
+	amplitudeAPIKey := flag.String("api_key", "", "Amplitude API key")
+	adminPort := flag.Int("admin_port", 9293, "localhost-only port for pprof and diagnostics (0 to disable)")
+	adminToken := flag.String("admin_token", "", "bearer token for full access to the admin port")
+	dataDir := flag.String("data_dir", defaultDataDir(), "directory for server-side data such as pots")
+	publicURL := flag.String("public_url", "", "base URL for share links (default: from the request Host)")
+	serverExportInterval := flag.Duration("server_export_interval", 0, "how often to export devices with changed metadata (0 to disable)")
+	dbPath := flag.String("db", "", "path to the SQLite database (default: pottery-log.db in -data_dir)")
+	configPath := flag.String("config", "", "path to a JSON config file (reloaded on SIGHUP)")
+	fakeStorage := flag.Bool("fake-storage", false, "keep objects under -data_dir instead of S3, and skip Amplitude, for local testing")
+	dev := flag.Bool("dev", false, "run an embedded S3-compatible store under -data_dir and use it instead of AWS, and skip Amplitude, for local development")
+	devS3Port := flag.Int("dev_s3_port", 9294, "localhost port for the -dev object store")
+	faultInjection := flag.Bool("fault_injection", false, "apply the config's fault_injection rules (development only)")
+	verifyInterval := flag.Duration("verify_interval", 0, "how often to verify a sample of stored images (0 to disable)")
+	verifySample := flag.Int("verify_sample", 50, "how many images to verify each time")
+	verifyRepair := flag.Bool("verify_repair", false, "delete corrupt images so the app re-uploads them")
+	maintenance := flag.Bool("maintenance", false, "start in maintenance mode (toggle with SIGUSR1)")
+	flag.StringVar(&staticDir, "static_dir", "", "serve the dashboard, docs, and gallery files from this directory instead of the built-in copies")
+	maintenanceMessage := flag.String("maintenance_message", defaultMaintenanceMessage, "message shown to users during maintenance")
+	checkOnly := flag.Bool("check", false, "check the configuration, storage, and credentials, and exit")
+	logFile := flag.String("log-file", "", "write logs to this file instead of stderr, rotating it")
+	logMaxSize := flag.Int64("log-max-size", 100, "rotate -log-file when it's bigger than this many MB (0 for no limit)")
+	logRotate := flag.Duration("log-rotate", 24*time.Hour, "rotate -log-file this often (0 to only rotate by size)")
+	logRetention := flag.Duration("log-retention", 30*24*time.Hour, "delete rotated log files older than this (0 to keep them)")
+	flag.Parse()
+	if *logFile != "" {
+		f, err := openLogFile(*logFile, *logMaxSize<<20, *logRotate, *logRetention)
+		if err != nil {
+			log.Fatalf("Error opening the log file: %v\n", err)
+		}
+		defaultLogOutput = f
+		log.SetOutput(f)
+	}
+	if *listenAddr == "" {
+		*listenAddr = fmt.Sprintf(":%v", *port)
+	}
+
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Error loading config: %v\n", err)
+	}
+	if err := applyLogOutput(c); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if *dataDir == "" {
+		log.Fatal("There's no home directory to keep data in, so -data_dir is required.\n")
+	}
+	srv := NewServer()
+	srv.dataDir = *dataDir
+	srv.publicURL = *publicURL
+	srv.configPath = *configPath
+	srv.adminToken = *adminToken
+	srv.maintenanceMessage = *maintenanceMessage
+	srv.setConfig(c)
+	loadGalleryTemplate()
+
+	if *dbPath == "" {
+		*dbPath = filepath.Join(*dataDir, "pottery-log.db")
+	}
+	if err := srv.openStores(*dbPath); err != nil {
+		log.Fatalf("Error %v\n", err)
+	}
+	if *fakeStorage {
+		baseURL := *publicURL
+		if baseURL == "" {
+			baseURL = localBaseURL(*listenAddr)
+		}
+		srv.Storage = newFakeStore(filepath.Join(*dataDir, "fake-storage"), baseURL)
+		log.Printf("Using fake storage in %s\n", filepath.Join(*dataDir, "fake-storage"))
+		go srv.discardEvents()
+	} else if *dev {
+		devDir := filepath.Join(*dataDir, "dev-s3")
+		store, err := startDevS3(fmt.Sprintf("127.0.0.1:%d", *devS3Port), devDir, srv.objectACL)
+		if err != nil {
+			log.Fatalf("Error starting the embedded S3: %v\n", err)
+		}
+		srv.Storage = store
+		log.Printf("Using the embedded S3 at %s, keeping objects in %s\n", store.baseURL, devDir)
+		go srv.discardEvents()
+	} else {
+		go srv.sendToAmplitude(*amplitudeAPIKey)
+		srv.jobs.Every("amplitude-identify", 15*time.Minute, srv.identifyDevices(*amplitudeAPIKey))
+	}
+	handler := srv.Handler()
+	if err := srv.runSelfCheck(*amplitudeAPIKey); err != nil {
+		log.Fatalf("Not starting: %v\n", err)
+	}
+	if *checkOnly {
+		log.Print("The configuration looks good.\n")
+		return
+	}
+	// This empties upload-tmp, which a running server may be using
+	if err := srv.setFormSpillDir(); err != nil {
+		log.Fatalf("Error setting up %s: %v\n", filepath.Join(*dataDir, "upload-tmp"), err)
+	}
+	if *faultInjection {
+		handler = srv.injectFaults(handler)
+	}
+
+	if *maintenance || (c.Maintenance != nil && *c.Maintenance) {
+		srv.setMaintenance(true)
+	}
+	go srv.toggleMaintenanceOnSignal()
+	go srv.reloadConfigOnSignal()
+	go srv.serveAdmin(*adminPort, srv.AdminHandler())
+
+	srv.jobs.Every("server-exports", *serverExportInterval, srv.runServerExports)
+	srv.jobs.Every("verify", *verifyInterval, func(r *jobRun) error {
+		checked, corrupt := srv.runVerify(*verifySample, *verifyRepair)
+		r.Logf("Checked %d images, %d corrupt", checked, corrupt)
+		return nil
+	})
+	srv.registerJobs()
+	srv.jobs.Start()
+
+	listener, err := listen(*listenAddr)
+	if err != nil {
+		log.Fatalf("Error listening on %s: %v\n", *listenAddr, err)
+	}
+	log.Printf("Serving version %s (%s) at %v", version, commit, *listenAddr)
+	log.Fatal(http.Serve(listener, logRequests(handler)))
+}
+
+// registerJobs schedules the upkeep every server needs
+func (s *Server) registerJobs() {
+	s.jobs.EveryLocal("export-expiry", 10*time.Minute, s.Exports.ExpireIdle)
+	s.jobs.EveryLocal("temp-cleanup", time.Hour, s.Exports.cleanTempDir)
+	s.jobs.EveryLocal("form-spill-cleanup", time.Hour, s.cleanFormSpillDir)
+	s.jobs.EveryDryRun("expire-originals", 24*time.Hour, s.expireOriginals)
+	s.jobs.EveryDryRun("expire-exports", 24*time.Hour, s.expireExports)
+	s.jobs.Every("backup-reminders", 24*time.Hour, s.sendBackupReminders)
+	s.jobs.Every("usage-summary", 24*time.Hour, s.sendUsageSummary)
+	s.jobs.Every("prune-idempotency-keys", time.Hour, func(r *jobRun) error {
+		return s.ops.PruneIdempotencyKeys(idempotencyKeyTTL)
+	})
+	s.jobs.Every("prune-import-results", time.Hour, func(r *jobRun) error {
+		return s.ops.PruneImportResults(importResultTTL)
+	})
+	s.jobs.EveryLocal("prune-api-key-limits", time.Hour, s.pruneAPIKeyLimiter)
+}
+
+// openStores opens the database at dbPath and the stores kept in s's
+// dataDir
+func (s *Server) openStores(dbPath string) error {
+	dataDir := s.dataDir
+	if dataDir == "" {
+		return errors.New("there's no data directory; set one with -data_dir")
+	}
+	s.Exports.tempDir = filepath.Join(dataDir, "exports")
+	for _, dir := range []string{dataDir, s.Exports.tempDir, s.debugLogDir()} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return err
+		}
+	}
+	var err error
+	s.pots = NewPotStore(filepath.Join(dataDir, "pots"), s.Clock)
+	s.metadataHistory = NewMetadataStore(filepath.Join(dataDir, "metadata"), s.Clock)
+	s.deviceTokens, err = NewDeviceTokenStore(filepath.Join(dataDir, "device-tokens.json"))
+	if err != nil {
+		return fmt.Errorf("loading device tokens: %w", err)
+	}
+	s.studios, err = NewStudioStore(filepath.Join(dataDir, "studios.json"), s.Clock)
+	if err != nil {
+		return fmt.Errorf("loading studios: %w", err)
+	}
+	s.shares, err = NewShareStore(filepath.Join(dataDir, "shares.json"), s.Clock)
+	if err != nil {
+		return fmt.Errorf("loading shares: %w", err)
+	}
+	s.ops, err = OpenOpsDB(dbPath, s.Clock)
+	if err != nil {
+		return fmt.Errorf("opening the database: %w", err)
+	}
+	s.ops.AbandonExports()
+	s.pots.index = s.ops
+	// Pots saved before there was a search index are indexed once
+	empty, err := s.ops.PotIndexEmpty()
+	if err == nil && empty {
+		err = s.pots.Reindex()
+	}
+	if err != nil {
+		return fmt.Errorf("indexing pots for search: %w", err)
+	}
+	s.Exports.db = s.ops
+	s.Exports.history = s.metadataHistory
+	s.identities = NewIdentityStore(s.ops)
+	s.deviceTenants, err = NewDeviceTenantStore(filepath.Join(dataDir, "device-tenants.json"))
+	if err != nil {
+		return fmt.Errorf("loading device tenants: %w", err)
+	}
+	s.blocks, err = NewBlockStore(filepath.Join(dataDir, "blocklist.json"), s.Clock)
+	if err != nil {
+		return fmt.Errorf("loading the blocklist: %w", err)
+	}
+	s.loadServerExported()
+	return nil
+}
+
+// Handler returns the public API, wrapped in the middleware
+// every request goes through. The stores must be open.
+func (s *Server) Handler() http.Handler {
+	s.applyConfig(s.config())
+	// Not http.DefaultServeMux, which net/http/pprof and expvar register on
+	mux := http.NewServeMux()
+	// Every route that reads its form goes through withForm, so that a
+	// multipart body is held to form_memory_mb and spills to formSpillDir
+	// rather than being parsed with net/http's defaults
+	mux.HandleFunc("/pottery-log-images/upload", s.mutating(s.conditional(s.withForm(s.requireAttestation(s.idempotent(s.Upload))))))
+	mux.HandleFunc("/pottery-log-images/upload-from-url", s.mutating(s.withForm(s.requireAttestation(s.idempotent(s.UploadFromURL)))))
+	mux.HandleFunc("/pottery-log-images/list", s.withForm(s.ListImages))
+	mux.HandleFunc("/pottery-log-images/delete", s.mutating(s.withForm(s.idempotent(s.Delete))))
+
+	mux.HandleFunc("/pottery-log/export", s.mutating(s.withForm(s.idempotent(s.StartExport))))
+	mux.HandleFunc("/pottery-log/export-image", s.withForm(s.ExportImage))
+	mux.HandleFunc("/pottery-log/export-contents", s.withForm(s.ExportContents))
+	mux.HandleFunc(imageProxyPath, s.ProxyImage)
+	mux.HandleFunc(exportProxyPath, s.ProxyExport)
+	mux.HandleFunc(exportDownloadPath, s.ExportDownload)
+	mux.HandleFunc("/pottery-log/export-zips", s.mutatingMethods(s.withForm(s.ExportZips)))
+	mux.HandleFunc("/pottery-log/export-history", s.withForm(s.ExportHistory))
+	mux.HandleFunc("/pottery-log/export-manifest", s.withForm(s.ExportManifest))
+	mux.HandleFunc("/pottery-log/key-escrow", s.mutatingMethods(s.withForm(s.KeyEscrow)))
+	mux.HandleFunc("/pottery-log/image-webhooks", s.mutatingMethods(s.withForm(s.ImageWebhooks)))
+	mux.HandleFunc("/pottery-log/finish-export", s.withForm(s.idempotent(s.FinishExport)))
+	mux.HandleFunc("/pottery-log/import", s.mutating(s.withForm(s.requireAttestation(s.idempotent(s.Import)))))
+	mux.HandleFunc(debugPath, s.withForm(s.Debug))
+	mux.HandleFunc("/pottery-log/debug-logs", s.withForm(s.DebugLogs))
+	mux.HandleFunc("/pottery-log/client-event", s.withForm(s.ClientEvent))
+	mux.HandleFunc("/pottery-log/config", s.withForm(s.Config))
+	mux.HandleFunc("/pottery-log/register-device", s.mutating(s.withForm(s.RegisterDevice)))
+	mux.HandleFunc("/pottery-log/push-token", s.mutating(s.withForm(s.PushToken)))
+	mux.HandleFunc("/pottery-log/recompress", s.mutating(s.withForm(s.RecompressSetting)))
+	mux.HandleFunc("/pottery-log/metadata-versions", s.withForm(s.MetadataVersions))
+	mux.HandleFunc("/pottery-log/import-version", s.withForm(s.ImportVersion))
+	mux.HandleFunc("/pottery-log/import-preview", s.withForm(s.ImportPreview))
+	mux.HandleFunc("/pottery-log/backup-metadata", s.mutating(s.withForm(s.BackupMetadata)))
+	mux.HandleFunc("/pottery-log/restore-metadata", s.withForm(s.RestoreMetadata))
+	mux.HandleFunc("/pottery-log/metadata-diff", s.withForm(s.MetadataDiff))
+	mux.HandleFunc("/pottery-log/export-table", s.mutating(s.withForm(s.ExportTable)))
+	mux.HandleFunc("/pottery-log/portfolio", s.mutating(s.withForm(s.Portfolio)))
+	mux.HandleFunc("/pottery-log/calendar", s.mutating(s.withForm(s.CalendarFeed)))
+	mux.HandleFunc(calendarPath, s.Calendar)
+	mux.HandleFunc("/pottery-log/share-feed", s.mutatingMethods(s.withForm(s.ShareFeed)))
+	mux.HandleFunc(shareFeedPath, s.SharedFeed)
+	mux.HandleFunc("/pottery-log/static-site", s.mutating(s.withForm(s.StaticSite)))
+
+	mux.HandleFunc("/v2/pots", s.withAPIKeys(s.mutatingMethods(s.withForm(s.Pots))))
+	mux.HandleFunc("/v2/pots/", s.withAPIKeys(s.mutatingMethods(s.withForm(s.Pots))))
+	mux.HandleFunc("/v2/search", s.withAPIKeys(s.withForm(s.Search)))
+	mux.HandleFunc("/v2/studios", s.withAPIKeys(s.mutatingMethods(s.withForm(s.Studios))))
+	mux.HandleFunc("/v2/studios/", s.withAPIKeys(s.mutatingMethods(s.withForm(s.Studios))))
+	mux.HandleFunc("/v2/api-keys", s.withAPIKeys(s.mutatingMethods(s.withForm(s.APIKeys))))
+	mux.HandleFunc(sharePath, s.Gallery)
+	mux.Handle(publicStaticPath, serveStatic(publicStaticPath, "", "gallery.css"))
+	mux.Handle(docsPath, serveStatic(docsPath, "docs.html", "openapi.json"))
+
+	if fake, ok := s.Storage.(*fakeStore); ok {
+		mux.Handle(fakeStoragePath, fake)
+	}
+
+	mux.HandleFunc("/stats", s.Stats)
+	mux.HandleFunc("/version", s.Version)
+
+	return s.limitEndpoints(s.budgetForms(s.limitDebugBundles(s.withTenant(s.blockAbusers(s.recordDeviceProperties(mux))))))
+}
@@ -0,0 +1,29 @@
+package potterylog
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultDataDirIsPersistent(t *testing.T) {
+	state := t.TempDir()
+	t.Setenv("XDG_STATE_HOME", state)
+	if got, want := defaultDataDir(), filepath.Join(state, "pottery-log"); got != want {
+		t.Errorf("with XDG_STATE_HOME, the data dir is %s, want %s", got, want)
+	}
+
+	home := t.TempDir()
+	t.Setenv("XDG_STATE_HOME", "")
+	t.Setenv("HOME", home)
+	if got, want := defaultDataDir(), filepath.Join(home, ".local", "state", "pottery-log"); got != want {
+		t.Errorf("without XDG_STATE_HOME, the data dir is %s, want %s", got, want)
+	}
+}
+
+func TestOpenStoresNeedsDataDir(t *testing.T) {
+	srv := NewServer()
+	srv.dataDir = ""
+	if err := srv.openStores(filepath.Join(t.TempDir(), "pottery-log.db")); err == nil {
+		t.Error("opened stores without a data dir")
+	}
+}
@@ -0,0 +1,190 @@
+package potterylog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// serverExportVersions remembers which metadata version was last exported for
+// each device, so scheduled exports only run when something changed.
+type serverExportVersions struct {
+	mu       sync.Mutex
+	location string
+	versions map[string]string
+}
+
+// buildServerExport makes a complete export from server-held data in t:
+// the latest stored metadata plus every image the device has uploaded. It
+// counts against the same caps as exports from the app. It returns the
+// export's URI and the metadata version it was built from.
+func (s *Server) buildServerExport(t *tenant, deviceID string) (string, string, error) {
+	version, metadata, err := s.metadataHistory.Latest(t.dataKey(deviceID))
+	if err != nil {
+		return "", "", err
+	}
+	if version.Encrypted {
+		return "", "", errMetadataEncrypted
+	}
+	images, err := s.deviceImages(t.imageBucket(), deviceID)
+	if err != nil {
+		return "", "", err
+	}
+
+	exp, err := s.Exports.begin(s.config(), t, deviceID, string(metadata))
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(exp.f.Name())
+
+	for name, key := range images {
+		if err := exp.AddObject(s.Storage, t.imageBucket(), key, name); err != nil {
+			s.Exports.Discard(exp, "failed")
+			return "", "", err
+		}
+	}
+	s.Exports.Remove(exp)
+	zipFile, err := exp.Finish()
+	if err != nil {
+		return "", "", err
+	}
+	defer zipFile.Close()
+
+	fileName := s.exportZipName("pottery_log_server_export_", newID())
+	var uri string
+	err = exp.phases.Time("upload", func() (err error) {
+		uri, err = s.uploadMultipart(t.importBucket(), zipFile, fileName, "application/zip", deviceID)
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	var size int64
+	if stat, err := zipFile.Stat(); err == nil {
+		size = stat.Size()
+		s.ops.ExportFinished(t, deviceID, "server", s.storedURL(t.importBucket(), uri), size)
+	}
+	go s.notify(exportFinishedNotification(deviceID, "server", uri, size))
+	s.logEvent(deviceID, ServerExportEvent{
+		Bytes:    size,
+		Images:   len(images),
+		Duration: millis(s.Clock.Now().Sub(exp.started)),
+		Phases:   exp.phases.Millis(),
+	})
+	exp.phases.Record(s.counters, "server-server-export")
+	s.counters.Add("server-server-export-bytes", size)
+	return uri, version.ID, nil
+}
+
+// ServerExport builds an export on demand from the server's copy of the
+// device's data, in the default tenant or the one named by tenant, without
+// the app sending anything. It's on the admin port only, since the archive
+// is all of the device's data, and only takes POST, so a viewer credential
+// can't use it.
+func (s *Server) ServerExport(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.validateForm(w, req, deviceIDField, tenantField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	t := s.findTenant(req.FormValue("tenant"))
+	if t == nil {
+		s.handleErrCode(errUnknownTenant(req.FormValue("tenant")), http.StatusBadRequest, deviceID, w)
+		return
+	}
+
+	uri, version, err := s.buildServerExport(t, deviceID)
+	if err == errExportsBusy {
+		s.logEvent(deviceID, ExportBusyEvent)
+		s.tooBusy(w, err, deviceID, 5*time.Minute)
+		return
+	}
+	if s.handleMetadataErr(err, deviceID, w) {
+		return
+	}
+	s.markServerExported(t.dataKey(deviceID), version)
+
+	writeJSON(w, struct {
+		Status  string `json:"status"`
+		URI     string `json:"uri"`
+		Version string `json:"version"`
+	}{
+		Status:  "ok",
+		URI:     uri,
+		Version: version,
+	})
+}
+
+// markServerExported records the version exported for a device's data key
+func (s *Server) markServerExported(key, version string) {
+	s.serverExported.mu.Lock()
+	defer s.serverExported.mu.Unlock()
+
+	s.serverExported.versions[key] = version
+	if s.serverExported.location == "" {
+		return
+	}
+	data, err := json.Marshal(s.serverExported.versions)
+	if err == nil {
+		err = ioutil.WriteFile(s.serverExported.location, data, 0666)
+	}
+	if err != nil {
+		log.Printf("Error saving server export state: %v\n", err)
+	}
+}
+
+func (s *Server) lastServerExported(key string) string {
+	s.serverExported.mu.Lock()
+	defer s.serverExported.mu.Unlock()
+	return s.serverExported.versions[key]
+}
+
+// loadServerExported reads which versions have already been exported, kept
+// in dataDir
+func (s *Server) loadServerExported() {
+	s.serverExported.mu.Lock()
+	defer s.serverExported.mu.Unlock()
+	s.serverExported.location = filepath.Join(s.dataDir, "server-exports.json")
+	if data, err := ioutil.ReadFile(s.serverExported.location); err == nil {
+		json.Unmarshal(data, &s.serverExported.versions)
+	}
+}
+
+// runServerExports exports every device, in every tenant, whose metadata
+// changed since its last server export. It's scheduled by
+// -server_export_interval.
+func (s *Server) runServerExports(r *jobRun) error {
+	devices, err := ioutil.ReadDir(s.metadataHistory.dir)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		key := device.Name()
+		t, deviceID := s.splitDataKey(key)
+		if t == nil {
+			// The tenant was removed from the config
+			continue
+		}
+		latest, _, err := s.metadataHistory.Latest(key)
+		if err != nil || latest.Encrypted || latest.ID == s.lastServerExported(key) {
+			continue
+		}
+		uri, version, err := s.buildServerExport(t, deviceID)
+		if err != nil {
+			r.Logf("Error in server export for %s: %v", key, err)
+			continue
+		}
+		s.markServerExported(key, version)
+		r.Logf("Server export for %s at %s", key, uri)
+	}
+	return nil
+}
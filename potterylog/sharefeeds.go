@@ -0,0 +1,296 @@
+package potterylog
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"html"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A share feed lists a library's newly shared pots as RSS and as a JSON
+// Feed, so followers and personal websites can pick up new work without
+// being sent each link. The feed has its own public id, since the device
+// or studio id behind it isn't something to publish.
+
+const shareFeedPath = "/pottery-log/feeds/"
+
+// maxShareFeedItems is how many of the latest shares a feed lists
+const maxShareFeedItems = 50
+
+var errNoShareFeed = newAPIError("no_share_feed", "There is no feed of shared pots")
+
+var shareFeedTitleField = field{Name: "title", MaxLen: 200}
+
+type shareFeed struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"created_at"`
+
+	library string
+}
+
+// shareFeedItem is a shared pot as it appears in a feed
+type shareFeedItem struct {
+	URL         string
+	Pot         *pot
+	Description string
+	ImageURL    string
+	Shared      time.Time
+}
+
+func (s *Server) shareFeedURL(req *http.Request, feedID, format string) string {
+	return s.publicLink(req, shareFeedPath+feedID+"."+format)
+}
+
+// ShareFeed serves /pottery-log/share-feed for the device's shared pots or,
+// with studioId, a studio's: GET returns the feed's URLs, POST creates the
+// feed (or sets the title of the existing one), and DELETE removes it
+func (s *Server) ShareFeed(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField, shareFeedTitleField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	if !s.requireDevice(w, req, deviceID) {
+		return
+	}
+	library, ok := s.potLibrary(w, req, deviceID)
+	if !ok {
+		return
+	}
+
+	var f shareFeed
+	var err error
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		var found bool
+		f, found, err = s.ops.LibraryShareFeed(library)
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		if !found {
+			s.handleErrCode(errNoShareFeed, http.StatusNotFound, deviceID, w)
+			return
+		}
+	case http.MethodPost:
+		title := req.FormValue("title")
+		if title == "" {
+			title = s.defaultShareFeedTitle(req)
+		}
+		f, err = s.ops.SetShareFeed(library, title)
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		s.logEvent(deviceID, ShareFeedEvent)
+	case http.MethodDelete:
+		deleted, err := s.ops.DeleteShareFeed(library)
+		if s.handleErr(err, deviceID, w) {
+			return
+		}
+		if !deleted {
+			s.handleErrCode(errNoShareFeed, http.StatusNotFound, deviceID, w)
+			return
+		}
+		w.Write(okResponse())
+		return
+	default:
+		s.handleErrCode(errMethodNotAllowed, http.StatusMethodNotAllowed, deviceID, w)
+		return
+	}
+	writeJSON(w, struct {
+		Status   string    `json:"status"`
+		Feed     shareFeed `json:"feed"`
+		RSS      string    `json:"rss"`
+		JSONFeed string    `json:"json_feed"`
+	}{
+		Status:   "ok",
+		Feed:     f,
+		RSS:      s.shareFeedURL(req, f.ID, "rss"),
+		JSONFeed: s.shareFeedURL(req, f.ID, "json"),
+	})
+}
+
+// defaultShareFeedTitle is the studio's name for a studio's feed
+func (s *Server) defaultShareFeedTitle(req *http.Request) string {
+	if st := s.studios.Get(req.FormValue("studioId")); st != nil && st.Name != "" {
+		return st.Name
+	}
+	return "Pottery Log"
+}
+
+// SharedFeed serves a feed publicly, as RSS for .rss and a JSON Feed for
+// .json
+func (s *Server) SharedFeed(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, shareFeedPath)
+	dot := strings.LastIndex(name, ".")
+	if dot < 0 {
+		http.NotFound(w, req)
+		return
+	}
+	feedID, format := name[:dot], name[dot+1:]
+	if !validID(feedID) || (format != "rss" && format != "json") {
+		http.NotFound(w, req)
+		return
+	}
+	f, found, err := s.ops.ShareFeed(feedID)
+	if err != nil {
+		log.Printf("Error looking up share feed %s: %v\n", feedID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.NotFound(w, req)
+		return
+	}
+	items := s.shareFeedItems(req, f.library)
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/feed+json")
+		json.NewEncoder(w).Encode(s.jsonFeed(req, f, items))
+		return
+	}
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(s.rssFeed(req, f, items)); err != nil {
+		log.Printf("Error writing share feed %s: %v\n", feedID, err)
+	}
+}
+
+// shareFeedItems are the library's latest shared pots, newest first
+func (s *Server) shareFeedItems(req *http.Request, library string) []shareFeedItem {
+	bucketName := requestTenant(req).imageBucket()
+	items := []shareFeedItem{}
+	for shareID, ref := range s.shares.Library(library) {
+		p, err := s.pots.Get(library, ref.PotID)
+		if err != nil {
+			// The pot was deleted since it was shared
+			continue
+		}
+		item := shareFeedItem{
+			URL:         s.shareURL(req, shareID),
+			Pot:         p,
+			Description: potDescription(p),
+			Shared:      ref.Created,
+		}
+		if cover := p.coverImage(); cover != "" {
+			item.ImageURL = s.objectUrl(bucketName, cover)
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].Shared.Equal(items[j].Shared) {
+			return items[i].Shared.After(items[j].Shared)
+		}
+		return items[i].URL < items[j].URL
+	})
+	if len(items) > maxShareFeedItems {
+		items = items[:maxShareFeedItems]
+	}
+	return items
+}
+
+type rssDocument struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	Description string  `xml:"description"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+func (s *Server) rssFeed(req *http.Request, f shareFeed, items []shareFeedItem) rssDocument {
+	channel := rssChannel{
+		Title:       f.Title,
+		Link:        s.shareFeedURL(req, f.ID, "rss"),
+		Description: "Newly shared pots",
+		Items:       []rssItem{},
+	}
+	if len(items) > 0 {
+		channel.LastBuildDate = items[0].Shared.UTC().Format(time.RFC1123Z)
+	}
+	for _, item := range items {
+		// The description is HTML, with the cover photo
+		description := html.EscapeString(item.Description)
+		if item.ImageURL != "" {
+			description = `<p><img src="` + html.EscapeString(item.ImageURL) + `" alt=""></p><p>` + description + `</p>`
+		}
+		channel.Items = append(channel.Items, rssItem{
+			Title:       potTitle(item.Pot),
+			Link:        item.URL,
+			GUID:        rssGUID{IsPermaLink: true, Value: item.URL},
+			Description: description,
+			PubDate:     item.Shared.UTC().Format(time.RFC1123Z),
+		})
+	}
+	return rssDocument{Version: "2.0", Channel: channel}
+}
+
+// jsonFeedDocument is a JSON Feed 1.1 (https://jsonfeed.org/version/1.1)
+type jsonFeedDocument struct {
+	Version string         `json:"version"`
+	Title   string         `json:"title"`
+	FeedURL string         `json:"feed_url"`
+	Items   []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	ID            string    `json:"id"`
+	URL           string    `json:"url"`
+	Title         string    `json:"title"`
+	ContentText   string    `json:"content_text"`
+	Image         string    `json:"image,omitempty"`
+	DatePublished time.Time `json:"date_published"`
+	DateModified  time.Time `json:"date_modified"`
+}
+
+func (s *Server) jsonFeed(req *http.Request, f shareFeed, items []shareFeedItem) jsonFeedDocument {
+	doc := jsonFeedDocument{
+		Version: "https://jsonfeed.org/version/1.1",
+		Title:   f.Title,
+		FeedURL: s.shareFeedURL(req, f.ID, "json"),
+		Items:   []jsonFeedItem{},
+	}
+	for _, item := range items {
+		doc.Items = append(doc.Items, jsonFeedItem{
+			ID:            item.URL,
+			URL:           item.URL,
+			Title:         potTitle(item.Pot),
+			ContentText:   item.Description,
+			Image:         item.ImageURL,
+			DatePublished: item.Shared.UTC(),
+			DateModified:  item.Pot.Updated.UTC(),
+		})
+	}
+	return doc
+}
+
+func potTitle(p *pot) string {
+	if p.Title == "" {
+		return "Untitled"
+	}
+	return p.Title
+}
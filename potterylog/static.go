@@ -0,0 +1,66 @@
+package potterylog
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+)
+
+// The admin dashboard, API docs, and gallery page templates are built into
+// the binary, so a home server only needs the one file. -static_dir serves
+// them from disk instead, for editing them without rebuilding.
+//
+//go:embed static
+var embeddedStatic embed.FS
+
+var staticDir = ""
+
+const (
+	publicStaticPath = "/pottery-log/static/"
+	docsPath         = "/docs/"
+	adminUIPath      = "/admin/ui/"
+)
+
+func staticFiles() fs.FS {
+	if staticDir != "" {
+		return os.DirFS(staticDir)
+	}
+	sub, err := fs.Sub(embeddedStatic, "static")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// serveStatic serves the named files from the static files under prefix.
+// index is served for the prefix itself.
+func serveStatic(prefix, index string, names ...string) http.Handler {
+	allowed := map[string]bool{"": true}
+	for _, name := range names {
+		allowed[name] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name := req.URL.Path[len(prefix):]
+		if !allowed[name] {
+			http.NotFound(w, req)
+			return
+		}
+		if name == "" {
+			name = index
+		}
+		http.ServeFileFS(w, req, staticFiles(), name)
+	})
+}
+
+// loadGalleryTemplate parses the share page and static site templates. It
+// runs after flags are parsed, so -static_dir applies.
+func loadGalleryTemplate() {
+	t, err := template.ParseFS(staticFiles(), "gallery.html", "site-index.html")
+	if err != nil {
+		log.Fatalf("Error loading the gallery template: %v\n", err)
+	}
+	galleryTemplate = t
+}
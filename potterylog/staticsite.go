@@ -0,0 +1,237 @@
+package potterylog
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// A static site is the device's (or a studio's) shared pots as a zip of
+// plain HTML that can be hosted anywhere: an index page listing the pots,
+// a page for each made from the share page template, the stylesheet, and
+// the photos themselves, so the site doesn't depend on this server. It's
+// named pottery_site_<date>.zip so it isn't mistaken for an export.
+
+var errNoSharedPots = newAPIError("no_shared_pots", "There are no shared pots to make a site from")
+
+var siteTitleField = field{Name: "title", MaxLen: 200}
+
+// sitePot is a pot on the static site's index page
+type sitePot struct {
+	Title       string
+	Description string
+	Page        string
+	Cover       string
+}
+
+type siteIndex struct {
+	Title string
+	Pots  []sitePot
+}
+
+type staticSiteResult struct {
+	Pots   int
+	Images int
+}
+
+// buildStaticSite writes the site for the library's shared pots to zw
+func (s *Server) buildStaticSite(zw *zip.Writer, req *http.Request, library, title string) (*staticSiteResult, error) {
+	refs := s.shares.Library(library)
+	shareIDs := make([]string, 0, len(refs))
+	for shareID := range refs {
+		shareIDs = append(shareIDs, shareID)
+	}
+	// Newest first, like the share feed
+	sort.Slice(shareIDs, func(i, j int) bool {
+		a, b := refs[shareIDs[i]], refs[shareIDs[j]]
+		if !a.Created.Equal(b.Created) {
+			return a.Created.After(b.Created)
+		}
+		return shareIDs[i] < shareIDs[j]
+	})
+
+	bucketName := requestTenant(req).imageBucket()
+	result := &staticSiteResult{}
+	index := siteIndex{Title: title, Pots: []sitePot{}}
+	// Image file names in the site by key, kept unique across pots
+	imageNames := make(map[string]string)
+	usedNames := make(map[string]bool)
+	imageName := func(key string) string {
+		if name, ok := imageNames[key]; ok {
+			return name
+		}
+		name := path.Base(key)
+		for n := 2; usedNames[name]; n++ {
+			name = suffixedName(path.Base(key), n)
+		}
+		usedNames[name] = true
+		imageNames[key] = name
+		return name
+	}
+
+	for _, shareID := range shareIDs {
+		p, err := s.pots.Get(library, refs[shareID].PotID)
+		if err == errPotNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Leave out photos that were deleted since they were attached
+		stored := *p
+		stored.Images = []string{}
+		for _, key := range p.Images {
+			if s.Storage.Exists(bucketName, key) {
+				stored.Images = append(stored.Images, key)
+			}
+		}
+		p = &stored
+		page := newGalleryPage(p, s.shareURL(req, shareID), func(key string) string {
+			return "../images/" + imageName(key)
+		})
+		page.Stylesheet = "../gallery.css"
+		page.Home = "../index.html"
+		pageName := "pots/" + p.ID + ".html"
+		var html bytes.Buffer
+		if err := galleryTemplate.ExecuteTemplate(&html, "gallery.html", page); err != nil {
+			return nil, err
+		}
+		if err := s.addSiteFile(zw, pageName, zip.Deflate, &html); err != nil {
+			return nil, err
+		}
+
+		item := sitePot{Title: potTitle(p), Description: page.Description, Page: pageName}
+		if cover := p.coverImage(); cover != "" {
+			item.Cover = "images/" + imageName(cover)
+		}
+		index.Pots = append(index.Pots, item)
+		result.Pots++
+	}
+	if result.Pots == 0 {
+		return nil, errNoSharedPots
+	}
+
+	var html bytes.Buffer
+	if err := galleryTemplate.ExecuteTemplate(&html, "site-index.html", index); err != nil {
+		return nil, err
+	}
+	if err := s.addSiteFile(zw, "index.html", zip.Deflate, &html); err != nil {
+		return nil, err
+	}
+	css, err := fs.ReadFile(staticFiles(), "gallery.css")
+	if err != nil {
+		return nil, err
+	}
+	if err := s.addSiteFile(zw, "gallery.css", zip.Deflate, bytes.NewReader(css)); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(imageNames))
+	for key := range imageNames {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		body, _, err := s.Storage.Get(bucketName, key)
+		if err != nil {
+			return nil, err
+		}
+		// Photos are already compressed
+		err = s.addSiteFile(zw, "images/"+imageNames[key], zip.Store, body)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+		result.Images++
+	}
+	return result, nil
+}
+
+func (s *Server) addSiteFile(zw *zip.Writer, name string, method uint16, r io.Reader) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: s.Clock.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// StaticSite makes a static HTML site of the device's shared pots, or with
+// studioId a studio's, and returns the zip's URI
+func (s *Server) StaticSite(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField, siteTitleField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	if !s.requireDevice(w, req, deviceID) {
+		return
+	}
+	library, ok := s.potLibrary(w, req, deviceID)
+	if !ok {
+		return
+	}
+	title := req.FormValue("title")
+	if title == "" {
+		title = s.defaultShareFeedTitle(req)
+	}
+
+	started := s.Clock.Now()
+	location := filepath.Join(s.Exports.tempDir, fmt.Sprintf("site-%s-%d.zip", deviceID, started.UnixNano()))
+	file, err := os.Create(location)
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+	defer os.Remove(location)
+	defer file.Close()
+	zw := zip.NewWriter(file)
+	result, err := s.buildStaticSite(zw, req, library, title)
+	if err == errNoSharedPots {
+		s.handleErrCode(err, http.StatusNotFound, deviceID, w)
+		return
+	}
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+	if s.handleErr(zw.Close(), deviceID, w) {
+		return
+	}
+	size, err := file.Seek(0, io.SeekCurrent)
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); s.handleErr(err, deviceID, w) {
+		return
+	}
+
+	fileName := s.exportZipName("pottery_site_", newID())
+	uri, err := s.uploadMultipart(requestTenant(req).importBucket(), file, fileName, "application/zip", deviceID)
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+	s.logEvent(deviceID, StaticSiteEvent{
+		Pots:     result.Pots,
+		Images:   result.Images,
+		Bytes:    size,
+		Duration: millis(s.Clock.Now().Sub(started)),
+	})
+	writeJSON(w, struct {
+		Status string `json:"status"`
+		URI    string `json:"uri"`
+		Pots   int    `json:"pots"`
+		Images int    `json:"images"`
+		Bytes  int64  `json:"bytes"`
+	}{
+		Status: "ok",
+		URI:    uri,
+		Pots:   result.Pots,
+		Images: result.Images,
+		Bytes:  size,
+	})
+}
@@ -0,0 +1,251 @@
+package potterylog
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// amplitudeQueue holds events for sendToAmplitude, with how sending them is
+// going
+type amplitudeQueue struct {
+	events   chan queuedEvent
+	stats    deliveryStats
+	counters *counterSet
+}
+
+func newAmplitudeQueue(counters *counterSet) *amplitudeQueue {
+	return &amplitudeQueue{
+		events:   make(chan queuedEvent, 1000),
+		stats:    deliveryStats{counters: counters},
+		counters: counters,
+	}
+}
+
+// queuedEvent is an event waiting in an amplitudeQueue, with when it was
+// queued
+type queuedEvent struct {
+	event  map[string]interface{}
+	queued time.Time
+}
+
+// deliveryStats is how sending events to Amplitude is going, so analytics
+// that are backed up or failing show up in /stats rather than only as
+// missing events. Successes and failures are also counted as
+// server-events-delivered and server-events-failed.
+type deliveryStats struct {
+	mu       sync.Mutex
+	counters *counterSet
+	// sending is when the event being sent was queued. It's the oldest
+	// event not yet delivered, since events are sent one at a time in
+	// order.
+	sending time.Time
+	// lag is how long the last delivered event waited to be delivered
+	lag           time.Duration
+	lastStatus    int
+	lastDelivered time.Time
+}
+
+func (s *deliveryStats) start(e queuedEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sending = e.queued
+}
+
+// finish records the response to the event being sent: its status, or 0
+// if there wasn't one
+func (s *deliveryStats) finish(status int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastStatus = status
+	if err != nil || status > 204 {
+		s.counters.Incr("server-events-failed")
+	} else {
+		s.counters.Incr("server-events-delivered")
+		s.lastDelivered = time.Now()
+		s.lag = s.lastDelivered.Sub(s.sending)
+	}
+	s.sending = time.Time{}
+}
+
+type deliveryGauges struct {
+	QueueDepth     int     `json:"queue_depth"`
+	QueueCapacity  int     `json:"queue_capacity"`
+	OldestEventAge float64 `json:"oldest_event_age_seconds"`
+	LagMillis      int64   `json:"delivery_lag_ms"`
+	// LastStatus is Amplitude's last response code, or 0 if the last
+	// request failed without one
+	LastStatus    int        `json:"last_status"`
+	LastDelivered *time.Time `json:"last_delivered,omitempty"`
+}
+
+// Gauges are the queue's depth and how sending is going
+func (q *amplitudeQueue) Gauges() deliveryGauges {
+	return q.stats.gauges(q.events)
+}
+
+func (s *deliveryStats) gauges(queue chan queuedEvent) deliveryGauges {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g := deliveryGauges{
+		QueueDepth:    len(queue),
+		QueueCapacity: cap(queue),
+		LagMillis:     s.lag.Milliseconds(),
+		LastStatus:    s.lastStatus,
+	}
+	if !s.sending.IsZero() {
+		g.OldestEventAge = time.Since(s.sending).Seconds()
+	}
+	if !s.lastDelivered.IsZero() {
+		lastDelivered := s.lastDelivered
+		g.LastDelivered = &lastDelivered
+	}
+	return g
+}
+
+// EventSink is where logEvent sends events: the queue for Amplitude
+// normally, or a recordingSink in a test harness
+type EventSink interface {
+	Send(event map[string]interface{})
+}
+
+// Send never holds up a request on analytics. If the queue is full because
+// Amplitude is slow or down, the event is dropped.
+func (q *amplitudeQueue) Send(event map[string]interface{}) {
+	select {
+	case q.events <- queuedEvent{event: event, queued: time.Now()}:
+	default:
+		q.counters.Incr("server-events-dropped")
+	}
+}
+
+// recordingSink keeps every event, for checking what a request logged
+type recordingSink struct {
+	mu     sync.Mutex
+	events []map[string]interface{}
+}
+
+func (s *recordingSink) Send(event map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+}
+
+// Events returns the events of the given type, or all of them for ""
+func (s *recordingSink) Events(eventType string) []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var matching []map[string]interface{}
+	for _, event := range s.events {
+		if eventType == "" || event["event_type"] == eventType {
+			matching = append(matching, event)
+		}
+	}
+	return matching
+}
+
+// logEvent counts e and sends it to s.Events, with e's fields as its
+// properties
+func (s *Server) logEvent(deviceID string, e event) {
+	name := e.eventType()
+	s.counters.Incr(name)
+
+	event := make(map[string]interface{})
+	if data, err := json.Marshal(e); err != nil {
+		log.Printf("Error marshaling event %v: %v\n", name, err)
+	} else if err := json.Unmarshal(data, &event); err != nil {
+		log.Printf("Error reading properties of event %v: %v\n", name, err)
+	}
+	event["event_type"] = name
+
+	if deviceID == "" {
+		event["device_id"] = serverDeviceID
+		event["platform"] = "server"
+	} else {
+		event["device_id"] = deviceID
+		p := s.identities.Get(deviceID)
+		if p.Platform != "" {
+			event["platform"] = p.Platform
+		}
+		if p.AppVersion != "" {
+			event["app_version"] = p.AppVersion
+		}
+	}
+	event["server_version"] = version
+	if t := s.tenantOf(deviceID); t != defaultTenant {
+		event["tenant"] = t.Name
+	}
+
+	s.Events.Send(event)
+}
+
+// sendToAmplitude sends each event with its tenant's API key, or apiKey for
+// the default tenant
+func (s *Server) sendToAmplitude(apiKey string) {
+	if apiKey == "" && !s.tenantsHaveAmplitudeKeys() {
+		log.Print("Skipping Amplitude logging because no api_key provided.\n")
+		s.discardEvents()
+		return
+	}
+
+	client := &http.Client{}
+	url := url.URL{
+		Scheme: "https",
+		Host:   "api.amplitude.com",
+		Path:   "/httpapi",
+	}
+	query := url.Query()
+	for {
+		queued := <-s.amplitude.events
+		event := queued.event
+		jsonEvent, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Error during Amplitude event marshal: %v\n", err)
+			continue
+		}
+
+		key := apiKey
+		if name, ok := event["tenant"].(string); ok {
+			if t := s.findTenant(name); t != nil {
+				key = t.AmplitudeAPIKey
+			}
+		}
+		if key == "" {
+			continue
+		}
+		query.Set("api_key", key)
+		query.Set("event", string(jsonEvent))
+		url.RawQuery = query.Encode()
+
+		s.amplitude.stats.start(queued)
+		resp, err := client.Get(url.String())
+		if err != nil {
+			s.amplitude.stats.finish(0, err)
+			log.Printf("Error sending Amplitude request: %v\n", err)
+			continue
+		}
+		resp.Body.Close()
+		s.amplitude.stats.finish(resp.StatusCode, nil)
+		if resp.StatusCode > 204 {
+			log.Printf("Amplitude returned status %v\n", resp.StatusCode)
+		}
+	}
+}
+
+func (s *Server) tenantsHaveAmplitudeKeys() bool {
+	for _, t := range s.config().Tenants {
+		if t.AmplitudeAPIKey != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// discardEvents drains the event queue when nothing sends it anywhere
+func (s *Server) discardEvents() {
+	for range s.amplitude.events {
+	}
+}
@@ -0,0 +1,79 @@
+package potterylog
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// Storage is where images and exports are kept: S3 normally, or a local
+// directory with -fake-storage.
+type Storage interface {
+	Put(bucketName, key string, body io.ReadSeeker, contentType string) error
+	// PutFile uploads a possibly very large file, in parts if needed, and
+	// calls progress (if it isn't nil) with the bytes stored so far
+	PutFile(bucketName, key string, file *os.File, contentType string, progress func(stored int64)) error
+	Get(bucketName, key string) (io.ReadCloser, string, error)
+	// Fetch is a Get that honors a byte range and conditional headers
+	Fetch(bucketName, key string, cond FetchConditions) (*FetchedObject, error)
+	// Download stops when ctx is done
+	Download(ctx context.Context, bucketName, key string, file *os.File) error
+	Exists(bucketName, key string) bool
+	Head(bucketName, key string) (ObjectInfo, error)
+	Delete(bucketName, key string) error
+	List(bucketName, prefix string) ([]string, error)
+	// URL is the public address of an object, and Key reverses it
+	URL(bucketName, key string) string
+	Key(bucketName, url string) (string, bool)
+}
+
+// isNotFound is whether a storage error means the object doesn't exist
+func isNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	if os.IsNotExist(err) {
+		return true
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		switch aerr.Code() {
+		case "NotFound", "NoSuchKey":
+			return true
+		}
+	}
+	return false
+}
+
+// ObjectInfo is what Head knows about an object
+type ObjectInfo struct {
+	Key  string
+	Size int64
+	// ETag is the hex MD5 of the content, except for multipart uploads
+	ETag        string
+	ContentType string
+}
+
+// FetchConditions are the Range and conditional headers of a request that's
+// being passed on to storage
+type FetchConditions struct {
+	Range           string
+	IfNoneMatch     string
+	IfModifiedSince time.Time
+}
+
+// FetchedObject is what storage answered. Body is nil when Status is 304
+// Not Modified or 416 Range Not Satisfiable.
+type FetchedObject struct {
+	Status       int
+	Body         io.ReadCloser
+	ContentType  string
+	ContentRange string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+}
@@ -0,0 +1,288 @@
+package potterylog
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A studio is a pot library shared by several devices, e.g. a community
+// studio tracking pieces on its shelves. Members' roles decide what they
+// can do with the studio's pots.
+const (
+	roleOwner  = "owner"
+	roleMember = "member"
+	roleViewer = "viewer"
+)
+
+var roleRank = map[string]int{
+	roleViewer: 1,
+	roleMember: 2,
+	roleOwner:  3,
+}
+
+var errNoStudio = newAPIError("studio_not_found", "There is no studio with that id")
+var errStudioForbidden = newAPIError("studio_forbidden", "You don't have permission to do that in this studio")
+
+type studio struct {
+	ID      string            `json:"id"`
+	Name    string            `json:"name"`
+	Members map[string]string `json:"members"`
+	Created time.Time         `json:"created"`
+}
+
+const studioLibraryPrefix = "studio-"
+
+// library is the pot store name of the studio's shared pots
+func (s *studio) library() string {
+	return studioLibraryPrefix + s.ID
+}
+
+func (s *studio) allows(deviceID, role string) bool {
+	return roleRank[s.Members[deviceID]] >= roleRank[role]
+}
+
+// studioStore keeps all studios in a single JSON file
+type studioStore struct {
+	mu       sync.Mutex
+	location string
+	studios  map[string]*studio
+	clock    Clock
+}
+
+// NewStudioStore loads the studios from the given file
+func NewStudioStore(location string, clock Clock) (*studioStore, error) {
+	s := &studioStore{
+		mu:       sync.Mutex{},
+		location: location,
+		studios:  make(map[string]*studio),
+		clock:    clock,
+	}
+	data, err := ioutil.ReadFile(location)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, json.Unmarshal(data, &s.studios)
+}
+
+func (s *studioStore) save() error {
+	data, err := json.Marshal(s.studios)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.location+".tmp", data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(s.location+".tmp", s.location)
+}
+
+func (s *studioStore) Create(name, ownerID string) (*studio, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := &studio{
+		ID:      newID(),
+		Name:    name,
+		Members: map[string]string{ownerID: roleOwner},
+		Created: s.clock.Now(),
+	}
+	s.studios[st.ID] = st
+	return st, s.save()
+}
+
+// Get returns a copy of the studio, or nil
+func (s *studioStore) Get(studioID string) *studio {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.studios[studioID]
+	if !ok {
+		return nil
+	}
+	copied := *st
+	copied.Members = make(map[string]string, len(st.Members))
+	for member, role := range st.Members {
+		copied.Members[member] = role
+	}
+	return &copied
+}
+
+func (s *studioStore) ForDevice(deviceID string) []*studio {
+	s.mu.Lock()
+	ids := []string{}
+	for id, st := range s.studios {
+		if _, ok := st.Members[deviceID]; ok {
+			ids = append(ids, id)
+		}
+	}
+	s.mu.Unlock()
+
+	list := []*studio{}
+	for _, id := range ids {
+		list = append(list, s.Get(id))
+	}
+	return list
+}
+
+// SetRole adds, changes, or (with role "") removes a member
+func (s *studioStore) SetRole(studioID, memberID, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.studios[studioID]
+	if !ok {
+		return errNoStudio
+	}
+	members := make(map[string]string, len(st.Members))
+	for member, r := range st.Members {
+		members[member] = r
+	}
+	if role == "" {
+		delete(members, memberID)
+	} else {
+		members[memberID] = role
+	}
+	owners := 0
+	for _, r := range members {
+		if r == roleOwner {
+			owners++
+		}
+	}
+	if owners == 0 {
+		return newAPIError("studio_needs_owner", "A studio must have at least one owner")
+	}
+	st.Members = members
+	return s.save()
+}
+
+// potLibrary picks the library a pots request is for and checks that the
+// device may read it (GET) or change it (anything else). It handles the
+// error and returns false if not.
+func (s *Server) potLibrary(w http.ResponseWriter, req *http.Request, deviceID string) (string, bool) {
+	studioID := req.FormValue("studioId")
+	if studioID == "" {
+		return requestTenant(req).dataKey(deviceID), true
+	}
+	st := s.studios.Get(studioID)
+	if st == nil {
+		s.handleErrCode(errNoStudio, http.StatusNotFound, deviceID, w)
+		return "", false
+	}
+	needed := roleMember
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		needed = roleViewer
+	}
+	if !st.allows(deviceID, needed) {
+		s.handleErrCode(errStudioForbidden, http.StatusForbidden, deviceID, w)
+		return "", false
+	}
+	return st.library(), true
+}
+
+// Studios serves /v2/studios (GET lists the device's studios, POST with
+// `name` creates one), /v2/studios/<id>/members, where owners PUT or
+// DELETE a `member` deviceId with a `role`, and /v2/studios/<id>/webhooks
+// (see potwebhooks.go).
+func (s *Server) Studios(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	if !s.requireDevice(w, req, deviceID) {
+		return
+	}
+	parts := strings.SplitN(strings.Trim(strings.TrimPrefix(req.URL.Path, "/v2/studios"), "/"), "/", 2)
+	studioID := parts[0]
+
+	if studioID == "" {
+		switch req.Method {
+		case http.MethodGet:
+			writeJSON(w, struct {
+				Status  string    `json:"status"`
+				Studios []*studio `json:"studios"`
+			}{
+				Status:  "ok",
+				Studios: s.studios.ForDevice(deviceID),
+			})
+		case http.MethodPost:
+			name := req.FormValue("name")
+			if name == "" {
+				s.handleErrCode(errMissingField("name"), http.StatusBadRequest, deviceID, w)
+				return
+			}
+			st, err := s.studios.Create(name, deviceID)
+			if s.handleErr(err, deviceID, w) {
+				return
+			}
+			s.logEvent(deviceID, CreateStudioEvent)
+			writeStudio(w, st)
+		default:
+			s.handleErrCode(errMethodNotAllowed, http.StatusMethodNotAllowed, deviceID, w)
+		}
+		return
+	}
+
+	st := s.studios.Get(studioID)
+	if st == nil || !st.allows(deviceID, roleViewer) {
+		s.handleErrCode(errNoStudio, http.StatusNotFound, deviceID, w)
+		return
+	}
+	if len(parts) == 1 && req.Method == http.MethodGet {
+		writeStudio(w, st)
+		return
+	}
+	if len(parts) != 2 || (parts[1] != "members" && parts[1] != "webhooks") {
+		s.handleErrCode(errNotFound, http.StatusNotFound, deviceID, w)
+		return
+	}
+	if !st.allows(deviceID, roleOwner) {
+		s.handleErrCode(errStudioForbidden, http.StatusForbidden, deviceID, w)
+		return
+	}
+	if parts[1] == "webhooks" {
+		s.StudioWebhooks(w, req, deviceID, st)
+		return
+	}
+
+	memberID := req.FormValue("member")
+	role := req.FormValue("role")
+	if memberID == "" || !validID(memberID) {
+		s.handleErrCode(errMissingField("member"), http.StatusBadRequest, deviceID, w)
+		return
+	}
+	switch req.Method {
+	case http.MethodPut:
+		if _, ok := roleRank[role]; !ok {
+			s.handleErrCode(errors.New("role must be owner, member, or viewer"), http.StatusBadRequest, deviceID, w)
+			return
+		}
+	case http.MethodDelete:
+		role = ""
+	default:
+		s.handleErrCode(errMethodNotAllowed, http.StatusMethodNotAllowed, deviceID, w)
+		return
+	}
+	if s.handleErrCode(s.studios.SetRole(studioID, memberID, role), http.StatusBadRequest, deviceID, w) {
+		return
+	}
+	s.logEvent(deviceID, StudioMemberEvent{Role: role})
+	writeStudio(w, s.studios.Get(studioID))
+}
+
+func writeStudio(w http.ResponseWriter, st *studio) {
+	writeJSON(w, struct {
+		Status string  `json:"status"`
+		Studio *studio `json:"studio"`
+	}{
+		Status: "ok",
+		Studio: st,
+	})
+}
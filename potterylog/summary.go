@@ -0,0 +1,102 @@
+package potterylog
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The usage summary is a daily report of uploads, exports, and the like for
+// small deployments without a metrics stack. It goes to a webhook, by email,
+// or both.
+type usageSummaryConfig struct {
+	WebhookURL string `json:"webhook_url"`
+	smtpConfig
+}
+
+func (c usageSummaryConfig) enabled() bool {
+	return c.WebhookURL != "" || c.configured()
+}
+
+// usageSummary is the webhook payload
+type usageSummary struct {
+	Event string `json:"event"`
+	Day   string `json:"day"`
+	usageTotals
+	// Errors are counted in-process, so they only cover the time since the
+	// last summary or restart
+	Errors int64 `json:"errors"`
+}
+
+func (s *Server) errorsSinceLastSummary() int64 {
+	s.summaryErrors.mu.Lock()
+	defer s.summaryErrors.mu.Unlock()
+	total := s.counters.Snapshot()[ErrorEvent{}.eventType()]
+	since := total - s.summaryErrors.last
+	s.summaryErrors.last = total
+	return since
+}
+
+// sendUsageSummary reports on the previous UTC day
+func (s *Server) sendUsageSummary(r *jobRun) error {
+	cfg := s.config().UsageSummary
+	if !cfg.enabled() {
+		r.Logf("No webhook_url or email configured for the usage summary")
+		return nil
+	}
+	today := s.Clock.Now().UTC().Truncate(24 * time.Hour)
+	day := today.AddDate(0, 0, -1)
+	totals, err := s.ops.UsageOn(day)
+	if err != nil {
+		return err
+	}
+	summary := usageSummary{
+		Event:       "usage-summary",
+		Day:         day.Format("2006-01-02"),
+		usageTotals: totals,
+		Errors:      s.errorsSinceLastSummary(),
+	}
+
+	var failed []string
+	if cfg.WebhookURL != "" {
+		if err := postWebhook(cfg.WebhookURL, summary); err != nil {
+			failed = append(failed, "webhook: "+err.Error())
+		}
+	}
+	if cfg.configured() {
+		if err := emailUsageSummary(cfg, summary); err != nil {
+			failed = append(failed, "email: "+err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("sending the usage summary failed: %s", strings.Join(failed, "; "))
+	}
+	r.Logf("Sent the usage summary for %s", summary.Day)
+	return nil
+}
+
+func emailUsageSummary(cfg usageSummaryConfig, s usageSummary) error {
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "Uploads:       %d (%s)\n", s.Uploads, formatBytes(s.UploadBytes))
+	fmt.Fprintf(&body, "Exports:       %d (%s)\n", s.Exports, formatBytes(s.ExportBytes))
+	fmt.Fprintf(&body, "Imports:       %d\n", s.Imports)
+	fmt.Fprintf(&body, "New devices:   %d\n", s.NewDevices)
+	fmt.Fprintf(&body, "Errors:        %d\n", s.Errors)
+	fmt.Fprintf(&body, "Admin actions: %d\n", s.AdminActions)
+	fmt.Fprintf(&body, "\nStorage grew by about %s.\n", formatBytes(s.UploadBytes+s.ExportBytes))
+	return cfg.send("Pottery Log usage for "+s.Day, body.String())
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
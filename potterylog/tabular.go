@@ -0,0 +1,197 @@
+package potterylog
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A table export is the device's pots as rows, without images, for users
+// who want to look at their work in a spreadsheet. It's built from the
+// metadata the app sends, a stored version, or the latest stored version,
+// and uploaded to the import bucket next to the device's exports.
+
+var tableFormatPattern = regexp.MustCompile(`^(csv|jsonl)$`)
+
+var tableFormatField = field{Name: "format", Pattern: tableFormatPattern}
+
+// tableRow is a pot as one line of a JSON-lines table
+type tableRow struct {
+	ID         string               `json:"id"`
+	Title      string               `json:"title"`
+	Status     string               `json:"status"`
+	StatusDate string               `json:"status_date"`
+	Dates      map[string]time.Time `json:"dates"`
+	Notes      map[string]string    `json:"notes"`
+	Images     int                  `json:"images"`
+}
+
+const tableDateFormat = "2006-01-02"
+
+// requestMetadata is the app metadata a request is about: the metadata
+// it sent, the stored version it names, or else the latest stored version.
+// It handles the error and returns false if there isn't any.
+func (s *Server) requestMetadata(w http.ResponseWriter, req *http.Request, deviceID string) ([]byte, string, bool) {
+	if !s.validateForm(w, req, optional(metadataVersionField)) {
+		return nil, "", false
+	}
+	if metadata := req.FormValue("metadata"); metadata != "" {
+		return []byte(metadata), "", true
+	}
+	if versionID := req.FormValue("version"); versionID != "" {
+		metadata, err := s.metadataHistory.getPlain(requestTenant(req).dataKey(deviceID), versionID)
+		if s.handleMetadataErr(err, deviceID, w) {
+			return nil, "", false
+		}
+		return metadata, versionID, true
+	}
+	latest, metadata, err := s.metadataHistory.Latest(requestTenant(req).dataKey(deviceID))
+	if err == nil && latest.Encrypted {
+		err = errMetadataEncrypted
+	}
+	if s.handleMetadataErr(err, deviceID, w) {
+		return nil, "", false
+	}
+	return metadata, latest.ID, true
+}
+
+// potTable renders pots as CSV, with a date column for each status any pot
+// has, or as JSON lines
+func potTable(list []appPot, format string) ([]byte, error) {
+	var out bytes.Buffer
+	if format == "jsonl" {
+		enc := json.NewEncoder(&out)
+		for _, p := range list {
+			status, date := p.Status()
+			row := tableRow{
+				ID:     p.ID,
+				Title:  p.Title,
+				Status: status,
+				Dates:  p.Dates,
+				Notes:  p.Notes,
+				Images: len(p.Images),
+			}
+			if status != "" {
+				row.StatusDate = date.Format(tableDateFormat)
+			}
+			if err := enc.Encode(row); err != nil {
+				return nil, err
+			}
+		}
+		return out.Bytes(), nil
+	}
+
+	allDates := make(map[string]time.Time)
+	for _, p := range list {
+		for s := range p.Dates {
+			allDates[s] = time.Time{}
+		}
+	}
+	statuses := orderStatuses(allDates)
+	header := []string{"id", "title", "status", "status_date"}
+	for _, s := range statuses {
+		header = append(header, s+"_date")
+	}
+	header = append(header, "notes", "images")
+
+	w := csv.NewWriter(&out)
+	w.Write(header)
+	for _, p := range list {
+		status, date := p.Status()
+		row := []string{p.ID, csvCell(p.Title), status, ""}
+		if status != "" {
+			row[3] = date.Format(tableDateFormat)
+		}
+		for _, s := range statuses {
+			cell := ""
+			if d, ok := p.Dates[s]; ok {
+				cell = d.Format(tableDateFormat)
+			}
+			row = append(row, cell)
+		}
+		row = append(row, csvCell(flattenNotes(p.Notes)), strconv.Itoa(len(p.Images)))
+		w.Write(row)
+	}
+	w.Flush()
+	return out.Bytes(), w.Error()
+}
+
+// flattenNotes joins notes into one cell, like "thrown: ...; glazed: ..."
+func flattenNotes(notes map[string]string) string {
+	dates := make(map[string]time.Time, len(notes))
+	for s := range notes {
+		dates[s] = time.Time{}
+	}
+	parts := []string{}
+	for _, s := range orderStatuses(dates) {
+		parts = append(parts, s+": "+notes[s])
+	}
+	return strings.Join(parts, "; ")
+}
+
+// csvCell keeps spreadsheets from running text that looks like a formula
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// ExportTable uploads the device's pots as a CSV (the default) or JSON-lines
+// file and returns its URI
+func (s *Server) ExportTable(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField, tableFormatField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	if !s.requireDevice(w, req, deviceID) {
+		return
+	}
+	format := req.FormValue("format")
+	if format == "" {
+		format = "csv"
+	}
+	metadata, version, ok := s.requestMetadata(w, req, deviceID)
+	if !ok {
+		return
+	}
+	list, err := appPots(metadata)
+	if s.handleErrCode(err, http.StatusBadRequest, deviceID, w) {
+		return
+	}
+	table, err := potTable(list, format)
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+
+	contentType := "text/csv; charset=utf-8"
+	if format == "jsonl" {
+		contentType = "application/x-ndjson"
+	}
+	bucketName := requestTenant(req).importBucket()
+	key := deviceID + "/pottery_log_pots_" + s.Clock.Now().Format("2006_01_02_150405") + "." + format
+	if s.handleErr(s.Storage.Put(bucketName, key, bytes.NewReader(table), contentType), deviceID, w) {
+		return
+	}
+	s.logEvent(deviceID, ExportTableEvent{Format: format, Pots: len(list), Bytes: len(table)})
+	writeJSON(w, struct {
+		Status  string `json:"status"`
+		URI     string `json:"uri"`
+		Format  string `json:"format"`
+		Version string `json:"version,omitempty"`
+		Pots    int    `json:"pots"`
+		Bytes   int    `json:"bytes"`
+	}{
+		Status:  "ok",
+		URI:     s.objectUrl(bucketName, key),
+		Format:  format,
+		Version: version,
+		Pots:    len(list),
+		Bytes:   len(table),
+	})
+}
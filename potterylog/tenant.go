@@ -0,0 +1,285 @@
+package potterylog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A tenant is one app deployment served by this process, like staging and
+// prod or a white-label build, with its own buckets, Amplitude key, limits,
+// quotas, and device data (see dataKey). Studios, shares, and the ops
+// database's per-device tables other than usage are still shared. Requests
+// pick a tenant with the X-Pottery-Tenant header or by hostname. Everything
+// else is the default tenant, which uses the top-level config and flags.
+type tenant struct {
+	Name  string   `json:"name"`
+	Hosts []string `json:"hosts"`
+
+	ImageBucket     string `json:"image_bucket"`
+	ImportBucket    string `json:"import_bucket"`
+	AmplitudeAPIKey string `json:"amplitude_api_key"`
+
+	// Limits default to the top-level settings
+	MaxUploads          int `json:"max_uploads"`
+	MaxExports          int `json:"max_exports"`
+	MaxExportsPerDevice int `json:"max_exports_per_device"`
+
+	// Notifiers replace the top-level ones, if set
+	Notifiers []notifierConfig `json:"notifiers"`
+}
+
+const tenantHeader = "X-Pottery-Tenant"
+
+// tenantField names a tenant on the admin port, where requests aren't
+// routed to one
+var tenantField = field{Name: "tenant", MaxLen: 128, Pattern: validIDPattern}
+
+func errUnknownTenant(name string) *apiError {
+	return newAPIError("unknown_tenant", "Unknown tenant "+name, name)
+}
+
+var defaultTenant = &tenant{}
+
+type tenantContextKey struct{}
+
+func (t *tenant) imageBucket() string {
+	if t.ImageBucket != "" {
+		return t.ImageBucket
+	}
+	return imageBucketName
+}
+
+func (t *tenant) importBucket() string {
+	if t.ImportBucket != "" {
+		return t.ImportBucket
+	}
+	return importBucketName
+}
+
+// dataKeySeparator joins a tenant's name and a device id in a data key.
+// Device ids can't contain it.
+const dataKeySeparator = "~"
+
+// dataKey is what the device is called in the stores under -data_dir (pots,
+// metadata history, and device tokens), so that each tenant has its own.
+// The default tenant's devices keep their ids, so data from before tenants
+// stays where it was. A device can't name another tenant's key, since ids
+// can't contain the separator.
+func (t *tenant) dataKey(deviceID string) string {
+	if t.Name == "" {
+		return deviceID
+	}
+	return t.Name + dataKeySeparator + deviceID
+}
+
+// splitDataKey is the tenant and device id of a data key, or nil if the
+// tenant is no longer configured
+func (s *Server) splitDataKey(key string) (*tenant, string) {
+	name, deviceID, found := strings.Cut(key, dataKeySeparator)
+	if !found {
+		return defaultTenant, key
+	}
+	return s.findTenant(name), deviceID
+}
+
+// validateTenants checks that tenant names are unique and can be used in
+// data keys
+func validateTenants(c *config) error {
+	seen := make(map[string]bool)
+	for _, t := range c.Tenants {
+		if !validID(t.Name) {
+			return fmt.Errorf("tenants: %q isn't a valid tenant name", t.Name)
+		}
+		if seen[t.Name] {
+			return fmt.Errorf("tenants: there are two tenants named %s", t.Name)
+		}
+		seen[t.Name] = true
+	}
+	return nil
+}
+
+// The limits fall back to c's top-level ones
+
+func (t *tenant) maxUploads(c *config) int {
+	if t.MaxUploads > 0 {
+		return t.MaxUploads
+	}
+	return c.MaxUploads
+}
+
+func (t *tenant) maxExports(c *config) int {
+	if t.MaxExports > 0 {
+		return t.MaxExports
+	}
+	return c.MaxExports
+}
+
+func (t *tenant) maxExportsPerDevice(c *config) int {
+	if t.MaxExportsPerDevice > 0 {
+		return t.MaxExportsPerDevice
+	}
+	return c.MaxExportsPerDevice
+}
+
+func (s *Server) findTenant(name string) *tenant {
+	if name == "" {
+		return defaultTenant
+	}
+	tenants := s.config().Tenants
+	for i := range tenants {
+		if tenants[i].Name == name {
+			return &tenants[i]
+		}
+	}
+	return nil
+}
+
+// tenants returns the default tenant and every configured one
+func (s *Server) tenants() []*tenant {
+	all := []*tenant{defaultTenant}
+	configured := s.config().Tenants
+	for i := range configured {
+		all = append(all, &configured[i])
+	}
+	return all
+}
+
+// tenantForHost finds the tenant serving host, or the default tenant
+func (s *Server) tenantForHost(hostport string) *tenant {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	tenants := s.config().Tenants
+	for i := range tenants {
+		for _, h := range tenants[i].Hosts {
+			if h == host {
+				return &tenants[i]
+			}
+		}
+	}
+	return defaultTenant
+}
+
+// requestTenant is the tenant withTenant picked for the request
+func requestTenant(req *http.Request) *tenant {
+	if t, ok := req.Context().Value(tenantContextKey{}).(*tenant); ok {
+		return t
+	}
+	return defaultTenant
+}
+
+// tenantOf is the tenant the device was last seen using (see
+// rememberTenant). Background jobs and analytics, which don't have a
+// request, use it; handlers use requestTenant.
+func (s *Server) tenantOf(deviceID string) *tenant {
+	if s.deviceTenants == nil {
+		return defaultTenant
+	}
+	if t := s.findTenant(s.deviceTenants.Get(deviceID)); t != nil {
+		return t
+	}
+	return defaultTenant
+}
+
+// withTenant picks the request's tenant and remembers it for the device
+func (s *Server) withTenant(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		deviceID := preFormValue(req, "deviceId")
+		t := s.tenantForHost(req.Host)
+		if name := req.Header.Get(tenantHeader); name != "" {
+			t = s.findTenant(name)
+			if t == nil {
+				s.handleErrCode(errUnknownTenant(name), http.StatusBadRequest, deviceID, w)
+				return
+			}
+		}
+		req = req.WithContext(context.WithValue(req.Context(), tenantContextKey{}, t))
+		s.rememberTenant(req, deviceID)
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// rememberTenant saves the request's tenant as the device's, for tenantOf,
+// if it can be trusted: the request's host picked it, or the request has
+// the device's token. Anyone can send X-Pottery-Tenant with a deviceId, so
+// the header alone doesn't move the device's background work to another
+// tenant's buckets.
+func (s *Server) rememberTenant(req *http.Request, deviceID string) {
+	if deviceID == "" || s.deviceTenants == nil {
+		return
+	}
+	t := requestTenant(req)
+	if t == s.tenantOf(deviceID) {
+		return
+	}
+	byHost := t != defaultTenant && t == s.tenantForHost(req.Host)
+	if !byHost && !s.hasDeviceToken(req, deviceID) {
+		return
+	}
+	if err := s.deviceTenants.Set(deviceID, t.Name); err != nil {
+		log.Printf("Error saving the tenant for device %s: %v\n", deviceID, err)
+	}
+}
+
+// deviceTenantStore remembers which tenant each device belongs to. Devices
+// of the default tenant aren't stored.
+type deviceTenantStore struct {
+	mu       sync.Mutex
+	location string
+	tenants  map[string]string
+}
+
+// NewDeviceTenantStore loads the device tenants from the given file
+func NewDeviceTenantStore(location string) (*deviceTenantStore, error) {
+	s := &deviceTenantStore{
+		mu:       sync.Mutex{},
+		location: location,
+		tenants:  make(map[string]string),
+	}
+	data, err := ioutil.ReadFile(location)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, json.Unmarshal(data, &s.tenants)
+}
+
+func (s *deviceTenantStore) Get(deviceID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tenants[deviceID]
+}
+
+func (s *deviceTenantStore) Set(deviceID, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tenants[deviceID] == name {
+		return nil
+	}
+	if name == "" {
+		delete(s.tenants, deviceID)
+	} else {
+		s.tenants[deviceID] = name
+	}
+
+	data, err := json.Marshal(s.tenants)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.location+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(s.location+".tmp", s.location)
+}
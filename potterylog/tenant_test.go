@@ -0,0 +1,138 @@
+package potterylog
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// tenantCall sends a request to the harness as if to host, with the
+// device's token if there is one, and decodes the response into out
+func tenantCall(t *testing.T, h *testHarness, host, method, path, token string, body io.Reader, out interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, h.Server.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	if method == http.MethodPost && !strings.HasPrefix(path, "/v2/") {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func newTenantHarness(t *testing.T) *testHarness {
+	t.Helper()
+	h, err := newTestHarness(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Close)
+	c := *h.srv.config()
+	c.Tenants = []tenant{{Name: "staging", Hosts: []string{"staging.pottery.invalid"}, ImageBucket: "staging-images", ImportBucket: "staging-exports"}}
+	h.srv.setConfig(&c)
+	return h
+}
+
+const (
+	prodHost    = "pottery.invalid"
+	stagingHost = "staging.pottery.invalid"
+)
+
+func TestTenantsKeepSeparateDeviceData(t *testing.T) {
+	h := newTenantHarness(t)
+	form := func(values url.Values) io.Reader { return strings.NewReader(values.Encode()) }
+	device := url.Values{"deviceId": {"device1"}}
+
+	// The same device id registers separately in each tenant
+	var prod, staging struct {
+		DeviceToken string `json:"device_token"`
+	}
+	if code := tenantCall(t, h, prodHost, http.MethodPost, "/pottery-log/register-device", "", form(device), &prod); code != http.StatusOK {
+		t.Fatalf("register in the default tenant: got %d", code)
+	}
+	if code := tenantCall(t, h, stagingHost, http.MethodPost, "/pottery-log/register-device", "", form(device), &staging); code != http.StatusOK {
+		t.Fatalf("register in staging: got %d", code)
+	}
+	if code := tenantCall(t, h, stagingHost, http.MethodPost, "/pottery-log/metadata-versions", prod.DeviceToken, form(device), nil); code != http.StatusUnauthorized {
+		t.Errorf("the default tenant's token in staging: got %d, want 401", code)
+	}
+
+	// Metadata history
+	backup := url.Values{"deviceId": {"device1"}, "metadata": {`{"pots":[]}`}}
+	if code := tenantCall(t, h, stagingHost, http.MethodPost, "/pottery-log/backup-metadata", staging.DeviceToken, form(backup), nil); code != http.StatusOK {
+		t.Fatalf("backup in staging: got %d", code)
+	}
+	var versions struct {
+		Versions []metadataVersion `json:"versions"`
+	}
+	tenantCall(t, h, prodHost, http.MethodPost, "/pottery-log/metadata-versions", prod.DeviceToken, form(device), &versions)
+	if len(versions.Versions) != 0 {
+		t.Errorf("the default tenant sees %d of staging's metadata versions", len(versions.Versions))
+	}
+	tenantCall(t, h, stagingHost, http.MethodPost, "/pottery-log/metadata-versions", staging.DeviceToken, form(device), &versions)
+	if len(versions.Versions) != 1 {
+		t.Errorf("staging has %d metadata versions, want 1", len(versions.Versions))
+	}
+
+	// Pots
+	if code := tenantCall(t, h, prodHost, http.MethodPost, "/v2/pots?deviceId=device1", prod.DeviceToken, strings.NewReader(`{"title":"Vase"}`), nil); code != http.StatusOK {
+		t.Fatalf("create a pot: got %d", code)
+	}
+	var pots struct {
+		Pots []*pot `json:"pots"`
+	}
+	tenantCall(t, h, stagingHost, http.MethodGet, "/v2/pots?deviceId=device1", staging.DeviceToken, nil, &pots)
+	if len(pots.Pots) != 0 {
+		t.Errorf("staging sees %d of the default tenant's pots", len(pots.Pots))
+	}
+	tenantCall(t, h, prodHost, http.MethodGet, "/v2/pots?deviceId=device1", prod.DeviceToken, nil, &pots)
+	if len(pots.Pots) != 1 {
+		t.Errorf("the default tenant has %d pots, want 1", len(pots.Pots))
+	}
+}
+
+func TestTenantsCountUsageSeparately(t *testing.T) {
+	h := newTenantHarness(t)
+	staging := h.srv.findTenant("staging")
+
+	h.srv.ops.AddUsage(staging, "device1", "uploads", 3)
+	h.srv.ops.AddUsage(defaultTenant, "device1", "uploads", 1)
+	if n, err := h.srv.ops.Usage(staging, "device1", "uploads", h.Clock.Now()); err != nil || n != 3 {
+		t.Errorf("staging usage: got %d, %v, want 3", n, err)
+	}
+	if n, err := h.srv.ops.Usage(defaultTenant, "device1", "uploads", h.Clock.Now()); err != nil || n != 1 {
+		t.Errorf("default tenant usage: got %d, %v, want 1", n, err)
+	}
+}
+
+func TestTenantNamesMustBeValid(t *testing.T) {
+	for _, tenants := range [][]tenant{
+		{{Name: ""}},
+		{{Name: "a/b"}},
+		{{Name: "staging"}, {Name: "staging"}},
+	} {
+		if err := validateTenants(&config{Tenants: tenants}); err == nil {
+			t.Errorf("tenants %v were accepted", tenants)
+		}
+	}
+	if err := validateTenants(&config{Tenants: []tenant{{Name: "staging"}, {Name: "white-label"}}}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,301 @@
+package potterylog
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Users moving photos over from Google Photos links or other apps can have
+// the server fetch an image by URL instead of downloading and uploading it
+// themselves. The URL is the user's, so the server only connects to public
+// addresses (checked on every address dialed, redirects included), gives
+// up after a while, and refuses anything over max_bytes or that isn't an
+// image. What it fetches then goes through the upload pipeline like an
+// uploaded image.
+type uploadFromURLConfig struct {
+	// The largest image fetched (default 25MB)
+	MaxBytes int64 `json:"max_bytes"`
+	// How long a fetch may take (default 30)
+	TimeoutSeconds int `json:"timeout_seconds"`
+	// Fetch from loopback and private network addresses, which are refused
+	// by default so a link can't reach the server's own network
+	AllowPrivateAddresses bool `json:"allow_private_addresses"`
+}
+
+func (c uploadFromURLConfig) maxBytes() int64 {
+	if c.MaxBytes > 0 {
+		return c.MaxBytes
+	}
+	return 25 << 20
+}
+
+func (c uploadFromURLConfig) timeout() time.Duration {
+	if c.TimeoutSeconds > 0 {
+		return time.Duration(c.TimeoutSeconds) * time.Second
+	}
+	return 30 * time.Second
+}
+
+// maxImageURLRedirects is how many redirects a fetch follows, since share
+// links usually redirect to the photo itself
+const maxImageURLRedirects = 5
+
+var (
+	errInvalidImageURL = newAPIError("invalid_image_url", "The link must be an http or https URL")
+	errPrivateImageURL = newAPIError("private_image_url", "The link points at a private address")
+	errImageURLTimeout = newAPIError("image_url_timeout", "Downloading the image took too long")
+	errNotAnImage      = newAPIError("not_an_image", "The link isn't to an image")
+	// errImageURLUnreachable is any other failure to fetch, like a name
+	// that doesn't resolve
+	errImageURLUnreachable = newAPIError("image_url_unreachable", "The image's server couldn't be reached")
+)
+
+func errImageURLFailed(status int) *apiError {
+	return newAPIError("image_url_failed", fmt.Sprintf("The image couldn't be downloaded (status %d)", status), fmt.Sprint(status))
+}
+
+func errImageTooLarge(limit int64) *apiError {
+	return newAPIError("image_too_large",
+		fmt.Sprintf("The image is more than the server's limit of %s", formatBytes(limit)),
+		formatBytes(limit))
+}
+
+var (
+	imageURLField = field{Name: "url", Required: true, MaxLen: 2048, Pattern: uriPattern}
+	// fileName overrides the name taken from the URL
+	imageFileNameField = field{Name: "fileName", MaxLen: 255, Pattern: fileNamePattern}
+)
+
+// notFileNameChars are what's dropped from a URL's last path segment to
+// make a file name
+var notFileNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// imageURLClient fetches images for UploadFromURL
+func imageURLClient(c uploadFromURLConfig) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !c.AllowPrivateAddresses {
+		dialer.Control = refusePrivateAddresses(errPrivateImageURL)
+	}
+	return &http.Client{
+		Timeout: c.timeout(),
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: c.timeout(),
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxImageURLRedirects {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errInvalidImageURL
+			}
+			return nil
+		},
+	}
+}
+
+// fetchImageURL downloads the image at u into memory, and returns it with
+// its type as the server sent it, and the function that releases its
+// memory reservation once the caller is done with it
+func (s *Server) fetchImageURL(u *url.URL) (*bytes.Reader, string, func(), error) {
+	c := s.config().UploadFromURL
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", nil, errInvalidImageURL
+	}
+	req.Header.Set("User-Agent", "pottery-log-server/"+version)
+	req.Header.Set("Accept", "image/*")
+	resp, err := imageURLClient(c).Do(req)
+	if err != nil {
+		var netErr net.Error
+		switch {
+		case errors.Is(err, errPrivateImageURL):
+			return nil, "", nil, errPrivateImageURL
+		case errors.Is(err, errInvalidImageURL):
+			return nil, "", nil, errInvalidImageURL
+		case errors.As(err, &netErr) && netErr.Timeout():
+			return nil, "", nil, errImageURLTimeout
+		}
+		return nil, "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, "", nil, errImageURLFailed(resp.StatusCode)
+	}
+	limit := c.maxBytes()
+	if resp.ContentLength > limit {
+		return nil, "", nil, errImageTooLarge(limit)
+	}
+	reserve := limit
+	if resp.ContentLength >= 0 {
+		reserve = resp.ContentLength
+	}
+	release, err := s.memory.Reserve(reserve, memoryWait)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		release()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, "", nil, errImageURLTimeout
+		}
+		return nil, "", nil, err
+	}
+	if int64(len(data)) > limit {
+		release()
+		return nil, "", nil, errImageTooLarge(limit)
+	}
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return bytes.NewReader(data), contentType, release, nil
+}
+
+// imageURLFileName names an image fetched from u after the URL's last
+// path segment, with an extension for its type if it has none
+func imageURLFileName(u *url.URL, contentType string) string {
+	name := notFileNameChars.ReplaceAllString(path.Base(u.Path), "")
+	name = strings.TrimLeft(name, ".")
+	if len(name) > 100 {
+		name = name[len(name)-100:]
+	}
+	if name == "" {
+		name = "image"
+	}
+	if imageTypeByExtension(name) == "" {
+		name += imageExtension(contentType)
+	}
+	return name
+}
+
+// imageExtension is the usual file extension for an image type
+func imageExtension(contentType string) string {
+	switch contentType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/heic":
+		return ".heic"
+	case "image/heif":
+		return ".heif"
+	}
+	if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// UploadFromURL stores the image at url like Upload stores an uploaded one
+func (s *Server) UploadFromURL(w http.ResponseWriter, req *http.Request) {
+	if !s.validateForm(w, req, deviceIDField, imageURLField, imageFileNameField, onConflictField, imagePotIDField, imageCapturedAtField) {
+		return
+	}
+	deviceID := req.FormValue("deviceId")
+	t := requestTenant(req)
+	u, err := url.Parse(req.FormValue("url"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		s.handleErrCode(errInvalidImageURL, http.StatusBadRequest, deviceID, w)
+		return
+	}
+
+	started := s.Clock.Now()
+	body, contentType, release, err := s.fetchImageURL(u)
+	if err == errMemoryBusy {
+		s.tooBusy(w, err, deviceID, 30*time.Second)
+		return
+	}
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		s.handleErrCode(err, imageURLStatus(apiErr), deviceID, w)
+		return
+	}
+	if err != nil {
+		log.Printf("Error fetching an image from %s: %v\n", u.Host, err)
+		s.handleErrCode(errImageURLUnreachable, http.StatusBadGateway, deviceID, w)
+		return
+	}
+	defer release()
+	// Links often lead to a page about the photo rather than the photo,
+	// so anything the server doesn't say is an image is sniffed, without
+	// going by the URL's extension
+	item := &uploadItem{
+		DeviceID:       deviceID,
+		Bucket:         t.imageBucket(),
+		ContentType:    contentType,
+		Body:           body,
+		Size:           body.Size(),
+		FailOnConflict: req.FormValue("onConflict") == "error",
+	}
+	if !s.imageItemFields(w, req, item) {
+		return
+	}
+	if s.handleErr(detectContentType(s, item), deviceID, w) {
+		return
+	}
+	if !isImageType(item.ContentType) {
+		s.handleErrCode(errNotAnImage, http.StatusUnsupportedMediaType, deviceID, w)
+		return
+	}
+	item.FileName = req.FormValue("fileName")
+	if item.FileName == "" {
+		item.FileName = imageURLFileName(u, item.ContentType)
+	}
+	if _, err := body.Seek(0, io.SeekStart); s.handleErr(err, deviceID, w) {
+		return
+	}
+
+	err = s.withUploadSlot(t, func() error {
+		_, err := s.uploads.Run(s, item)
+		return err
+	})
+	if err == errUploadsBusy {
+		s.logEvent(deviceID, UploadBusyEvent)
+		s.tooBusy(w, err, deviceID, 30*time.Second)
+		return
+	}
+	if err == errFileNameTaken {
+		s.handleErrCode(err, http.StatusConflict, deviceID, w)
+		return
+	}
+	if s.handleErr(err, deviceID, w) {
+		return
+	}
+
+	writeUploadedImage(w, item)
+	s.logEvent(deviceID, UploadFromURLEvent{
+		Bytes:       body.Size(),
+		ContentType: contentType,
+		Host:        u.Hostname(),
+		Duration:    millis(s.Clock.Now().Sub(started)),
+	})
+	s.ops.AddUsage(t, deviceID, "uploads", 1)
+	s.ops.AddUsage(t, deviceID, "upload_bytes", body.Size())
+	s.warnQuota(t, deviceID)
+}
+
+// imageURLStatus is the HTTP status for an error fetching an image URL
+func imageURLStatus(err *apiError) int {
+	switch err.Code {
+	case "image_too_large":
+		return http.StatusRequestEntityTooLarge
+	case "image_url_failed":
+		return http.StatusBadGateway
+	case errImageURLTimeout.Code:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadRequest
+}
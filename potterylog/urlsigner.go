@@ -0,0 +1,250 @@
+package potterylog
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// The config's object_urls picks how clients are given the URLs of stored
+// images and exports, to suit how the deployment's buckets are accessed:
+//
+//   - "public", the default, is the bucket's own URL, for public buckets.
+//   - "presigned" is an S3 presigned URL, for private buckets.
+//   - "cdn" is the URL on a CDN in front of the bucket, from cdn_base_urls,
+//     signed with a CloudFront key pair if cdn_key_pair_id is set.
+//   - "proxy" is the URL on this server's image or export proxy.
+//
+// Presigned and CDN-signed URLs work for expires_seconds (default a day).
+// Every objectUrl goes through the signer, and objectKey reverses its URLs
+// as well as plain storage URLs. The database keeps plain storage URLs, so
+// its records don't expire, and they're signed again when they're handed
+// out.
+
+const (
+	objectURLsPublic    = "public"
+	objectURLsPresigned = "presigned"
+	objectURLsCDN       = "cdn"
+	objectURLsProxy     = "proxy"
+)
+
+const defaultObjectURLExpiry = 24 * time.Hour
+
+// S3 won't honor a presigned URL for longer than a week
+const maxPresignedExpiry = 7 * 24 * time.Hour
+
+type objectURLConfig struct {
+	Mode           string `json:"mode"`
+	ExpiresSeconds int    `json:"expires_seconds"`
+	// The CDN's base URL, like https://images.example.com, by bucket. Buckets
+	// without one get public URLs.
+	CDNBaseURLs       map[string]string `json:"cdn_base_urls"`
+	CDNKeyPairID      string            `json:"cdn_key_pair_id"`
+	CDNPrivateKeyFile string            `json:"cdn_private_key_file"`
+}
+
+func (c objectURLConfig) expiry() time.Duration {
+	if c.ExpiresSeconds > 0 {
+		return time.Duration(c.ExpiresSeconds) * time.Second
+	}
+	return defaultObjectURLExpiry
+}
+
+// urlSigner makes the URLs clients are given for stored objects
+type urlSigner interface {
+	URL(s *Server, bucketName, key string) (string, error)
+	// Key reverses URL, or returns false if url isn't one of the signer's
+	Key(s *Server, bucketName, url string) (string, bool)
+}
+
+// presigner is storage that can make temporary URLs for private objects
+type presigner interface {
+	Presign(bucketName, key string, expires time.Duration) (string, error)
+}
+
+// newURLSigner checks object_urls and makes its signer, reading the CDN's
+// private key if there is one
+func newURLSigner(c objectURLConfig) (urlSigner, error) {
+	switch c.Mode {
+	case "", objectURLsPublic:
+		return publicSigner{}, nil
+	case objectURLsPresigned:
+		if c.expiry() > maxPresignedExpiry {
+			return nil, fmt.Errorf("object_urls: expires_seconds can be at most %d for presigned URLs", int(maxPresignedExpiry.Seconds()))
+		}
+		return presignedSigner{expires: c.expiry()}, nil
+	case objectURLsCDN:
+		s := cdnSigner{baseURLs: make(map[string]string), expires: c.expiry()}
+		for bucketName, base := range c.CDNBaseURLs {
+			if u, err := url.Parse(base); err != nil || u.Scheme == "" || u.Host == "" {
+				return nil, fmt.Errorf("object_urls: cdn_base_urls for %s should be like https://images.example.com", bucketName)
+			}
+			s.baseURLs[bucketName] = strings.TrimSuffix(base, "/")
+		}
+		if c.CDNKeyPairID != "" {
+			key, err := sign.LoadPEMPrivKeyFile(c.CDNPrivateKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("object_urls: can't read cdn_private_key_file: %v", err)
+			}
+			s.signer = sign.NewURLSigner(c.CDNKeyPairID, key)
+		}
+		return s, nil
+	case objectURLsProxy:
+		return proxySigner{}, nil
+	}
+	return nil, fmt.Errorf("object_urls: mode %q must be %s, %s, %s, or %s",
+		c.Mode, objectURLsPublic, objectURLsPresigned, objectURLsCDN, objectURLsProxy)
+}
+
+func (s *Server) signer() urlSigner {
+	if signer := s.config().signer; signer != nil {
+		return signer
+	}
+	return publicSigner{}
+}
+
+// objectUrl is the URL a client is given for the object. If it can't be
+// signed, the client gets the plain storage URL.
+func (s *Server) objectUrl(bucketName, key string) string {
+	u, err := s.signer().URL(s, bucketName, key)
+	if err != nil {
+		log.Printf("Error signing the URL of %s/%s: %v\n", bucketName, key, err)
+		return s.Storage.URL(bucketName, key)
+	}
+	return u
+}
+
+// objectKey is the key of the object in bucketName at url, which is either
+// a plain storage URL or one the signer made
+func (s *Server) objectKey(bucketName, url string) (string, bool) {
+	if key, ok := s.signer().Key(s, bucketName, url); ok {
+		return key, true
+	}
+	return s.Storage.Key(bucketName, url)
+}
+
+// storedURL is the plain storage URL of the object at uri, for the
+// database, where a signed URL would expire. Anything else is left alone.
+func (s *Server) storedURL(bucketName, uri string) string {
+	if key, ok := s.objectKey(bucketName, uri); ok {
+		return s.Storage.URL(bucketName, key)
+	}
+	return uri
+}
+
+// resignURL is uri from the database as a client should be given it now
+func (s *Server) resignURL(bucketName, uri string) string {
+	if key, ok := s.objectKey(bucketName, uri); ok {
+		return s.objectUrl(bucketName, key)
+	}
+	return uri
+}
+
+// withoutQuery is url without its signature, if it has one
+func withoutQuery(url string) string {
+	if i := strings.IndexByte(url, '?'); i >= 0 {
+		return url[:i]
+	}
+	return url
+}
+
+type publicSigner struct{}
+
+func (publicSigner) URL(s *Server, bucketName, key string) (string, error) {
+	return s.Storage.URL(bucketName, key), nil
+}
+
+func (publicSigner) Key(s *Server, bucketName, url string) (string, bool) {
+	return "", false
+}
+
+type presignedSigner struct {
+	expires time.Duration
+}
+
+func (p presignedSigner) URL(s *Server, bucketName, key string) (string, error) {
+	store, ok := s.Storage.(presigner)
+	if !ok {
+		// Local storage has no private objects
+		return s.Storage.URL(bucketName, key), nil
+	}
+	return store.Presign(bucketName, key, p.expires)
+}
+
+func (presignedSigner) Key(s *Server, bucketName, urlString string) (string, bool) {
+	plain := withoutQuery(urlString)
+	if key, ok := s.Storage.Key(bucketName, plain); ok {
+		return key, true
+	}
+	// AWS presigns with the bucket's regional host
+	u, err := url.Parse(plain)
+	if err != nil || !strings.HasPrefix(u.Host, bucketName+".s3.") || !strings.HasSuffix(u.Host, ".amazonaws.com") {
+		return "", false
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	return key, key != ""
+}
+
+func (s *s3Store) Presign(bucketName, key string, expires time.Duration) (string, error) {
+	req, _ := s.svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	return req.Presign(expires)
+}
+
+type cdnSigner struct {
+	baseURLs map[string]string
+	// signer is nil if the CDN serves objects without signatures
+	signer  *sign.URLSigner
+	expires time.Duration
+}
+
+func (c cdnSigner) URL(s *Server, bucketName, key string) (string, error) {
+	base, ok := c.baseURLs[bucketName]
+	if !ok {
+		return s.Storage.URL(bucketName, key), nil
+	}
+	u := base + "/" + key
+	if c.signer == nil {
+		return u, nil
+	}
+	return c.signer.Sign(u, s.Clock.Now().Add(c.expires))
+}
+
+func (c cdnSigner) Key(s *Server, bucketName, url string) (string, bool) {
+	base, ok := c.baseURLs[bucketName]
+	plain := withoutQuery(url)
+	if !ok || !strings.HasPrefix(plain, base+"/") || plain == base+"/" {
+		return "", false
+	}
+	return strings.TrimPrefix(plain, base+"/"), true
+}
+
+// proxySigner's URLs are relative to the server unless -public_url is set
+type proxySigner struct{}
+
+func (s *Server) proxyPathFor(bucketName string) string {
+	if s.configuredBuckets()[bucketName] {
+		return imageProxyPath
+	}
+	return exportProxyPath
+}
+
+func (proxySigner) URL(s *Server, bucketName, key string) (string, error) {
+	return s.publicURL + s.proxyPathFor(bucketName) + key, nil
+}
+
+func (proxySigner) Key(s *Server, bucketName, url string) (string, bool) {
+	prefix := s.publicURL + s.proxyPathFor(bucketName)
+	if !strings.HasPrefix(url, prefix) || url == prefix {
+		return "", false
+	}
+	return strings.TrimPrefix(url, prefix), true
+}
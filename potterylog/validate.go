@@ -0,0 +1,85 @@
+package potterylog
+
+import (
+	"net/http"
+	"regexp"
+)
+
+// field describes a form field a handler accepts, so handlers can check
+// their input the same way with validateForm
+type field struct {
+	Name     string
+	Required bool
+	// MaxLen is in bytes; 0 means no limit
+	MaxLen int
+	// Pattern is the allowed format, if any
+	Pattern *regexp.Regexp
+	// Invalid is the error for values that don't match Pattern
+	Invalid *apiError
+}
+
+// Fields that several handlers share
+var (
+	deviceIDField  = field{Name: "deviceId", Required: true, MaxLen: 128, Pattern: validIDPattern, Invalid: errInvalidDeviceID}
+	uriField       = field{Name: "uri", Required: true, MaxLen: 2048, Pattern: uriPattern}
+	importURLField = field{Name: "importURL", MaxLen: 2048, Pattern: uriPattern}
+	// exportHistoryIDField is an id from /pottery-log/export-history, or "latest"
+	exportHistoryIDField = field{Name: "exportHistoryId", MaxLen: 128, Pattern: validIDPattern}
+	exportIDField        = field{Name: "exportId", MaxLen: 128, Pattern: validIDPattern}
+	// Debug logs are named after these, so they must be safe in a file name
+	logNameField      = field{Name: "name", MaxLen: 64, Pattern: fileNamePattern}
+	appOwnershipField = field{Name: "appOwnership", MaxLen: 32, Pattern: fileNamePattern}
+	// dryRunField makes a destructive request report what it would remove
+	dryRunField = field{Name: "dryRun", Pattern: boolPattern}
+)
+
+var uriPattern = regexp.MustCompile(`^[!-~]+$`) // printable ASCII, no spaces
+var fileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]*$`)
+var boolPattern = regexp.MustCompile(`^(true|false)$`)
+
+func errFieldTooLong(name string) *apiError {
+	return newAPIError("field_too_long", name+" is too long", name)
+}
+
+func errInvalidField(name string) *apiError {
+	return newAPIError("invalid_field", "Invalid "+name, name)
+}
+
+// validateForm checks the request's form values against fields. If one
+// doesn't pass, it responds with a 400 and returns false.
+func (s *Server) validateForm(w http.ResponseWriter, req *http.Request, fields ...field) bool {
+	deviceID := req.FormValue("deviceId")
+	for _, f := range fields {
+		value := req.FormValue(f.Name)
+		var err *apiError
+		switch {
+		case value == "":
+			if f.Required {
+				err = errMissingField(f.Name)
+			}
+		case f.MaxLen > 0 && len(value) > f.MaxLen:
+			err = errFieldTooLong(f.Name)
+		case f.Pattern != nil && !f.Pattern.MatchString(value):
+			err = f.Invalid
+			if err == nil {
+				err = errInvalidField(f.Name)
+			}
+		}
+		if err != nil {
+			s.handleErrCode(err, http.StatusBadRequest, deviceID, w)
+			return false
+		}
+	}
+	return true
+}
+
+// optional is f without the requirement to be present
+func optional(f field) field {
+	f.Required = false
+	return f
+}
+
+// required is f with the requirement to be present
+func required(name string) field {
+	return field{Name: name, Required: true}
+}
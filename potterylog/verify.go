@@ -0,0 +1,157 @@
+package potterylog
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const verifyReportSize = 200
+
+// verifyFinding is a stored object that failed verification
+type verifyFinding struct {
+	Bucket   string    `json:"bucket"`
+	Key      string    `json:"key"`
+	Problem  string    `json:"problem"`
+	Repaired bool      `json:"repaired"`
+	Found    time.Time `json:"found"`
+}
+
+// verifyResults are from the verifier, which re-downloads a sample of
+// stored images and compares them to their stored size and checksum.
+// Interrupted uploads can leave empty or truncated objects, and because
+// uploads skip keys that already exist the app can never fix them.
+// Repairing deletes the bad object so the app's next upload replaces it.
+type verifyResults struct {
+	mu       sync.Mutex
+	lastRun  time.Time
+	checked  int
+	findings []verifyFinding
+}
+
+// verifyObject returns a description of what's wrong, or "" if it's fine
+func (s *Server) verifyObject(bucketName, key string) string {
+	info, err := s.Storage.Head(bucketName, key)
+	if err != nil {
+		return "head failed: " + err.Error()
+	}
+	if info.Size == 0 {
+		return "empty"
+	}
+
+	body, _, err := s.Storage.Get(bucketName, key)
+	if err != nil {
+		return "download failed: " + err.Error()
+	}
+	defer body.Close()
+	hash := md5.New()
+	size, err := io.Copy(hash, body)
+	if err != nil {
+		return "download failed: " + err.Error()
+	}
+	if size != info.Size {
+		return "truncated"
+	}
+	// Multipart ETags ("<md5>-<parts>") aren't a plain checksum
+	if !strings.Contains(info.ETag, "-") && hex.EncodeToString(hash.Sum(nil)) != info.ETag {
+		return "checksum mismatch"
+	}
+	return ""
+}
+
+// runVerify checks a sample of each image bucket and returns how many
+// images it checked and how many were corrupt
+func (s *Server) runVerify(sampleSize int, repair bool) (int, int) {
+	// Tenants can share a bucket; check each bucket once
+	var findings []verifyFinding
+	checked := 0
+	seen := make(map[string]bool)
+	for _, t := range s.tenants() {
+		bucketName := t.imageBucket()
+		if seen[bucketName] {
+			continue
+		}
+		seen[bucketName] = true
+		bucketFindings, n := s.verifyBucket(bucketName, sampleSize, repair)
+		findings = append(findings, bucketFindings...)
+		checked += n
+	}
+
+	s.verifier.mu.Lock()
+	defer s.verifier.mu.Unlock()
+	s.verifier.lastRun = s.Clock.Now()
+	s.verifier.checked += checked
+	s.verifier.findings = append(s.verifier.findings, findings...)
+	if over := len(s.verifier.findings) - verifyReportSize; over > 0 {
+		s.verifier.findings = s.verifier.findings[over:]
+	}
+	s.logEvent("", VerifyEvent{Checked: checked, Corrupt: len(findings)})
+	return checked, len(findings)
+}
+
+// verifyBucket checks a sample of the bucket's images, returning what it
+// found and how many it checked
+func (s *Server) verifyBucket(bucketName string, sampleSize int, repair bool) ([]verifyFinding, int) {
+	keys, err := s.Storage.List(bucketName, "")
+	if err != nil {
+		log.Printf("Error listing objects to verify in %s: %v\n", bucketName, err)
+		return nil, 0
+	}
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	if len(keys) > sampleSize {
+		keys = keys[:sampleSize]
+	}
+
+	var findings []verifyFinding
+	for _, key := range keys {
+		problem := s.verifyObject(bucketName, key)
+		if problem == "" {
+			continue
+		}
+		finding := verifyFinding{
+			Bucket:  bucketName,
+			Key:     key,
+			Problem: problem,
+			Found:   s.Clock.Now(),
+		}
+		if repair && !strings.HasPrefix(problem, "download failed") && !strings.HasPrefix(problem, "head failed") {
+			if err := s.Storage.Delete(bucketName, key); err != nil {
+				log.Printf("Error removing corrupt object %s: %v\n", key, err)
+			} else {
+				finding.Repaired = true
+			}
+		}
+		log.Printf("Verify: %s/%s is %s (repaired: %v)\n", bucketName, key, problem, finding.Repaired)
+		s.logEvent(strings.SplitN(key, "/", 2)[0], VerifyCorruptEvent{Problem: problem, Repaired: finding.Repaired})
+		findings = append(findings, finding)
+	}
+	return findings, len(keys)
+}
+
+// VerifyReport is the admin view of recent verification results
+func (s *Server) VerifyReport(w http.ResponseWriter, req *http.Request) {
+	s.verifier.mu.Lock()
+	defer s.verifier.mu.Unlock()
+
+	findings := s.verifier.findings
+	if findings == nil {
+		findings = []verifyFinding{}
+	}
+	writeJSON(w, struct {
+		Status   string          `json:"status"`
+		LastRun  time.Time       `json:"last_run"`
+		Checked  int             `json:"checked"`
+		Findings []verifyFinding `json:"findings"`
+	}{
+		Status:   "ok",
+		LastRun:  s.verifier.lastRun,
+		Checked:  s.verifier.checked,
+		Findings: findings,
+	})
+}
@@ -0,0 +1,31 @@
+package potterylog
+
+import (
+	"net/http"
+	"runtime"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X github.com/seveneightn9ne/pottery-log-server/v2/potterylog.version=1.2.0"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+func (s *Server) Version(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, struct {
+		Status    string `json:"status"`
+		Version   string `json:"version"`
+		Commit    string `json:"commit"`
+		BuildDate string `json:"build_date"`
+		GoVersion string `json:"go_version"`
+	}{
+		Status:    "ok",
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	})
+}